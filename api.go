@@ -0,0 +1,491 @@
+// In-process path based API for applications that embed the file system.
+
+package memfs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"bazil.org/fuse"
+)
+
+// ENOTDIR is returned when a path component is not a directory.
+var ENOTDIR = fuse.Errno(syscall.ENOTDIR)
+
+//===========================================================================
+// Path Resolution
+//===========================================================================
+
+// Resolve returns the entity at the absolute path in the file system.
+func (mfs *FileSystem) Resolve(path string) (Entity, error) {
+	mfs.Lock()
+	defer mfs.Unlock()
+	return mfs.resolve(path)
+}
+
+// resolve walks the tree from the root to the entity at the path. Must be
+// called with the lock held.
+func (mfs *FileSystem) resolve(path string) (Entity, error) {
+	path = filepath.Clean("/" + path)
+
+	var ent Entity = mfs.root
+	if path != "/" {
+		for _, name := range strings.Split(path[1:], "/") {
+			dir, ok := ent.(*Dir)
+			if !ok {
+				return nil, ENOTDIR
+			}
+
+			if err := dir.populate(); err != nil {
+				return nil, err
+			}
+
+			if ent, ok = dir.child(name); !ok {
+				return nil, fuse.ENOENT
+			}
+		}
+	}
+
+	// Merge the lower entries of a resolved directory so it can be listed.
+	if dir, ok := ent.(*Dir); ok {
+		if err := dir.populate(); err != nil {
+			return nil, err
+		}
+	}
+
+	return ent, nil
+}
+
+// resolveParent returns the directory that contains the path and the base
+// name of the path. Must be called with the lock held.
+func (mfs *FileSystem) resolveParent(path string) (*Dir, string, error) {
+	path = filepath.Clean("/" + path)
+	if path == "/" {
+		return nil, "", fuse.EPERM
+	}
+
+	ent, err := mfs.resolve(filepath.Dir(path))
+	if err != nil {
+		return nil, "", err
+	}
+
+	dir, ok := ent.(*Dir)
+	if !ok {
+		return nil, "", ENOTDIR
+	}
+
+	return dir, filepath.Base(path), nil
+}
+
+// apiMutation creates a mutation of the entity made by the in-process API on
+// behalf of the user running the file system.
+func (mfs *FileSystem) apiMutation(op string, ent Entity) *Mutation {
+	m := newMutation(op, mfs.apiHeader(), ent.GetNode())
+	m.Source = SourceAPI
+	m.entity = ent
+	return m
+}
+
+// apiHeader returns the identity of the caller of the path API, which is the
+// process running the file system.
+func (mfs *FileSystem) apiHeader() fuse.Header {
+	return fuse.Header{Uid: mfs.uid, Gid: mfs.gid, Pid: uint32(os.Getpid())}
+}
+
+//===========================================================================
+// Path API
+//===========================================================================
+
+// ReadFile returns a copy of the contents of the file at the path.
+func (mfs *FileSystem) ReadFile(path string) ([]byte, error) {
+	mfs.Lock()
+	defer mfs.Unlock()
+
+	ent, err := mfs.resolve(path)
+	if err != nil {
+		return nil, err
+	}
+
+	f, ok := ent.(*File)
+	if !ok {
+		return nil, fuse.Errno(syscall.EISDIR)
+	}
+
+	// Read deduplicated and encrypted data and snapshots without faulting
+	// them back into memory.
+	if f.blocks != nil {
+		return f.assemble(), nil
+	}
+
+	if f.sealed != nil || f.IsArchive() || (f.spilled && mfs.keys != nil) {
+		r, err := f.open()
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		return ioutil.ReadAll(r)
+	}
+
+	if err := f.fault(); err != nil {
+		return nil, err
+	}
+	mfs.touch(f)
+
+	data := make([]byte, len(f.Data))
+	copy(data, f.Data)
+	return data, nil
+}
+
+// WriteFile replaces the contents of the file at the path with data,
+// creating the file with the specified mode if it does not exist.
+func (mfs *FileSystem) WriteFile(path string, data []byte, mode os.FileMode) error {
+	mfs.Lock()
+	defer mfs.Unlock()
+
+	if mfs.readonly {
+		return fuse.EPERM
+	}
+
+	dir, name, err := mfs.resolveParent(path)
+	if err != nil {
+		return err
+	}
+
+	if dir.IsArchive() || dir.reserved(name) {
+		return fuse.EPERM
+	}
+
+	if err := dir.diverge(); err != nil {
+		return err
+	}
+
+	var f *File
+	if ent, ok := dir.Children[name]; ok {
+		if f, ok = ent.(*File); !ok {
+			return fuse.Errno(syscall.EISDIR)
+		}
+
+		if err := mfs.checkRules(mfs.apiHeader(), f.Path(), f); err != nil {
+			return err
+		}
+	} else {
+		if err := mfs.checkRules(mfs.apiHeader(), filepath.Join(dir.Path(), name), nil); err != nil {
+			return err
+		}
+
+		if err := mfs.checkInodes(); err != nil {
+			return err
+		}
+
+		if err := mfs.checkQuota(mfs.uid, dir, uint64(len(data)), 1); err != nil {
+			return err
+		}
+
+		f = dir.create(name, mode, mfs.uid, mfs.gid)
+		m := mfs.apiMutation(OpCreate, f)
+		m.parent, m.name = dir, name
+		mfs.record(m)
+	}
+
+	if f.IsArchive() {
+		return fuse.EPERM
+	}
+
+	if err := mfs.checkRuleSize(f.Path(), uint64(len(data))); err != nil {
+		return err
+	}
+
+	if err := mfs.checkWrite(f, uint64(len(data))); err != nil {
+		return err
+	}
+
+	if err := mfs.checkSpace(addClamped(uint64(len(data)), -int64(f.Attrs.Size))); err != nil {
+		return err
+	}
+
+	if err := f.fault(); err != nil {
+		return err
+	}
+
+	m := mfs.apiMutation(OpWrite, f)
+	f.truncate(0)
+	f.write(0, data)
+	f.Attrs.Mtime = f.Attrs.Atime
+	f.dirty = false
+
+	m.NewSize = f.Attrs.Size
+	if err := mfs.record(m); err != nil {
+		// The data is kept as written but not flushed, as flush does.
+		f.dirty = true
+		return err
+	}
+
+	if f.retain() {
+		m = mfs.apiMutation(OpSetxattr, f)
+		m.xattr = RetainXattr
+		mfs.record(m)
+	}
+
+	f.dedup()
+	f.seal()
+	mfs.reclaim(f)
+	return nil
+}
+
+// Mkdir creates a directory with the specified mode at the path.
+func (mfs *FileSystem) Mkdir(path string, mode os.FileMode) error {
+	mfs.Lock()
+	defer mfs.Unlock()
+
+	if mfs.readonly {
+		return fuse.EPERM
+	}
+
+	dir, name, err := mfs.resolveParent(path)
+	if err != nil {
+		return err
+	}
+
+	if dir.IsArchive() || dir.reserved(name) {
+		return fuse.EPERM
+	}
+
+	if err := dir.diverge(); err != nil {
+		return err
+	}
+
+	if _, ok := dir.Children[name]; ok {
+		return fuse.EEXIST
+	}
+
+	if err := mfs.checkRules(mfs.apiHeader(), filepath.Join(dir.Path(), name), nil); err != nil {
+		return err
+	}
+
+	if err := mfs.checkInodes(); err != nil {
+		return err
+	}
+
+	if err := mfs.checkQuota(mfs.uid, dir, 0, 1); err != nil {
+		return err
+	}
+
+	c := dir.mkdir(name, mode, mfs.uid, mfs.gid)
+	m := mfs.apiMutation(OpMkdir, c)
+	m.parent, m.name = dir, name
+	mfs.record(m)
+	return nil
+}
+
+// Remove the file or empty directory at the path.
+func (mfs *FileSystem) Remove(path string) error {
+	mfs.Lock()
+	defer mfs.Unlock()
+
+	if mfs.readonly {
+		return fuse.EPERM
+	}
+
+	dir, name, err := mfs.resolveParent(path)
+	if err != nil {
+		return err
+	}
+
+	if dir.IsArchive() {
+		return fuse.EPERM
+	}
+
+	path = filepath.Join(dir.Path(), name)
+	if ent, ok := dir.Children[name]; ok {
+		if err := mfs.checkRules(mfs.apiHeader(), path, ent); err != nil {
+			return err
+		}
+	}
+
+	ent, err := dir.remove(name)
+	if err != nil {
+		return err
+	}
+
+	m := mfs.apiMutation(OpRemove, ent)
+	m.Path = path
+	m.NewSize = 0
+	m.parent, m.name = dir, name
+	mfs.record(m)
+	return nil
+}
+
+// Rename moves the entity at oldpath to newpath.
+func (mfs *FileSystem) Rename(oldpath, newpath string) error {
+	mfs.Lock()
+	defer mfs.Unlock()
+
+	if mfs.readonly {
+		return fuse.EPERM
+	}
+
+	src, oldName, err := mfs.resolveParent(oldpath)
+	if err != nil {
+		return err
+	}
+
+	dst, newName, err := mfs.resolveParent(newpath)
+	if err != nil {
+		return err
+	}
+
+	if src.IsArchive() || dst.IsArchive() || dst.reserved(newName) {
+		return fuse.EPERM
+	}
+
+	if ent, ok := src.Children[oldName]; ok {
+		if err := mfs.checkRuleMove(mfs.apiHeader(), ent, dst, newName); err != nil {
+			return err
+		}
+
+		if err := mfs.checkMove(ent, src, dst); err != nil {
+			return err
+		}
+	}
+
+	oldPath := filepath.Join(src.Path(), oldName)
+	ent, err := src.rename(oldName, dst, newName)
+	if err != nil {
+		return err
+	}
+
+	m := mfs.apiMutation(OpRename, ent)
+	m.Path = oldPath
+	m.NewPath = filepath.Join(dst.Path(), newName)
+	m.parent, m.name = src, oldName
+	m.dst, m.newName = dst, newName
+	mfs.record(m)
+	return nil
+}
+
+// Symlink creates a symbolic link at the path that points to the target.
+func (mfs *FileSystem) Symlink(target, path string) error {
+	mfs.Lock()
+	defer mfs.Unlock()
+
+	if mfs.readonly {
+		return fuse.EPERM
+	}
+
+	dir, name, err := mfs.resolveParent(path)
+	if err != nil {
+		return err
+	}
+
+	if dir.IsArchive() || dir.reserved(name) {
+		return fuse.EPERM
+	}
+
+	if err := dir.diverge(); err != nil {
+		return err
+	}
+
+	if _, ok := dir.Children[name]; ok {
+		return fuse.EEXIST
+	}
+
+	if err := mfs.checkRules(mfs.apiHeader(), filepath.Join(dir.Path(), name), nil); err != nil {
+		return err
+	}
+
+	if err := mfs.checkInodes(); err != nil {
+		return err
+	}
+
+	size := uint64(len(target))
+	if err := mfs.checkQuota(mfs.uid, dir, size, 1); err != nil {
+		return err
+	}
+
+	if err := mfs.checkSpace(size); err != nil {
+		return err
+	}
+
+	l := dir.symlink(name, target, mfs.uid, mfs.gid)
+	m := mfs.apiMutation(OpSymlink, l)
+	m.parent, m.name = dir, name
+	mfs.record(m)
+	return nil
+}
+
+// Readlink returns the target of the symbolic link at the path.
+func (mfs *FileSystem) Readlink(path string) (string, error) {
+	mfs.Lock()
+	defer mfs.Unlock()
+
+	ent, err := mfs.resolve(path)
+	if err != nil {
+		return "", err
+	}
+
+	l, ok := ent.(*Symlink)
+	if !ok {
+		return "", fuse.Errno(syscall.EINVAL)
+	}
+	return l.Target, nil
+}
+
+// Link creates newpath as a hard link to the file at oldpath.
+func (mfs *FileSystem) Link(oldpath, newpath string) error {
+	mfs.Lock()
+	defer mfs.Unlock()
+
+	if mfs.readonly {
+		return fuse.EPERM
+	}
+
+	ent, err := mfs.resolve(oldpath)
+	if err != nil {
+		return err
+	}
+
+	f, ok := ent.(*File)
+	if !ok || f.IsArchive() {
+		return fuse.EPERM
+	}
+
+	dir, name, err := mfs.resolveParent(newpath)
+	if err != nil {
+		return err
+	}
+
+	if dir.IsArchive() || dir.reserved(name) {
+		return fuse.EPERM
+	}
+
+	if _, ok := dir.Children[name]; ok {
+		return fuse.EEXIST
+	}
+
+	if err := f.checkProtected(false); err != nil {
+		return err
+	}
+
+	path := filepath.Join(dir.Path(), name)
+	if err := mfs.checkRules(mfs.apiHeader(), path, nil); err != nil {
+		return err
+	}
+
+	if err := dir.diverge(); err != nil {
+		return err
+	}
+
+	if err := f.Parent.diverge(); err != nil {
+		return err
+	}
+
+	dir.link(f, name)
+	m := mfs.apiMutation(OpLink, f)
+	m.NewPath = path
+	m.parent, m.name = dir, name
+	mfs.record(m)
+	return nil
+}
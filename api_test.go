@@ -0,0 +1,166 @@
+package memfs_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"bazil.org/fuse"
+
+	"golang.org/x/net/context"
+
+	. "github.com/bbengfort/memfs"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Path API", func() {
+
+	var err error
+	var tmpDir string
+	var config *Config
+	var fs *FileSystem
+
+	BeforeEach(func() {
+		tmpDir, err = ioutil.TempDir("", TempDirPrefix)
+		Ω(err).ShouldNot(HaveOccurred())
+
+		config = makeTestConfig()
+		fs = New(filepath.Join(tmpDir, "testmp"), config)
+	})
+
+	AfterEach(func() {
+		Ω(os.RemoveAll(tmpDir)).Should(Succeed())
+	})
+
+	It("should write and read files", func() {
+		Ω(fs.Mkdir("/data", 0755)).Should(Succeed())
+		Ω(fs.WriteFile("/data/a.txt", []byte("hello world"), 0644)).Should(Succeed())
+
+		data, err := fs.ReadFile("/data/a.txt")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(data).Should(Equal([]byte("hello world")))
+
+		ent, err := fs.Resolve("/data/a.txt")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(ent.GetNode().Attrs.Size).Should(Equal(uint64(11)))
+		Ω(ent.GetNode().Attrs.Mode).Should(Equal(os.FileMode(0644)))
+	})
+
+	It("should replace the contents of existing files", func() {
+		Ω(fs.WriteFile("/a.txt", []byte("a much longer first version"), 0644)).Should(Succeed())
+		Ω(fs.WriteFile("/a.txt", []byte("second"), 0644)).Should(Succeed())
+
+		data, err := fs.ReadFile("/a.txt")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(data).Should(Equal([]byte("second")))
+	})
+
+	It("should rename and remove entities", func() {
+		Ω(fs.Mkdir("/src", 0755)).Should(Succeed())
+		Ω(fs.Mkdir("/dst", 0755)).Should(Succeed())
+		Ω(fs.WriteFile("/src/a.txt", []byte("moving"), 0644)).Should(Succeed())
+
+		Ω(fs.Rename("/src/a.txt", "/dst/b.txt")).Should(Succeed())
+		_, err := fs.Resolve("/src/a.txt")
+		Ω(err).Should(Equal(fuse.ENOENT))
+
+		ent, err := fs.Resolve("/dst/b.txt")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(ent.Path()).Should(Equal("/dst/b.txt"))
+
+		Ω(fs.Remove("/dst/b.txt")).Should(Succeed())
+		_, err = fs.Resolve("/dst/b.txt")
+		Ω(err).Should(Equal(fuse.ENOENT))
+	})
+
+	It("should create symbolic and hard links", func() {
+		Ω(fs.Mkdir("/data", 0755)).Should(Succeed())
+		Ω(fs.WriteFile("/data/a.txt", []byte("linked"), 0644)).Should(Succeed())
+		Ω(fs.Symlink("a.txt", "/data/s.txt")).Should(Succeed())
+		Ω(fs.Link("/data/a.txt", "/b.txt")).Should(Succeed())
+		Ω(fs.Link("/data", "/c")).Should(Equal(fuse.EPERM))
+
+		target, err := fs.Readlink("/data/s.txt")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(target).Should(Equal("a.txt"))
+
+		// Hard links share the data of the file, which outlives its first name.
+		Ω(fs.WriteFile("/b.txt", []byte("changed"), 0644)).Should(Succeed())
+		Ω(fs.Rename("/data/a.txt", "/data/d.txt")).Should(Succeed())
+		Ω(fs.Remove("/data/d.txt")).Should(Succeed())
+
+		data, err := fs.ReadFile("/b.txt")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(data).Should(Equal([]byte("changed")))
+
+		ent, err := fs.Resolve("/b.txt")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(ent.Path()).Should(Equal("/b.txt"))
+		Ω(ent.GetNode().Attrs.Nlink).Should(Equal(uint32(1)))
+	})
+
+	It("should return errors for bad paths", func() {
+		Ω(fs.WriteFile("/a.txt", []byte("file"), 0644)).Should(Succeed())
+
+		_, err := fs.ReadFile("/missing.txt")
+		Ω(err).Should(Equal(fuse.ENOENT))
+
+		_, err = fs.Resolve("/a.txt/child")
+		Ω(err).Should(Equal(ENOTDIR))
+
+		Ω(fs.Mkdir("/a.txt", 0755)).Should(Equal(fuse.EEXIST))
+	})
+
+	It("should reserve the names of the hidden directories in the root", func() {
+		for _, name := range []string{"/" + ControlDir, "/" + SnapshotDir} {
+			Ω(fs.WriteFile(name, []byte("file"), 0644)).Should(Equal(fuse.EPERM))
+			Ω(fs.Mkdir(name, 0755)).Should(Equal(fuse.EPERM))
+		}
+
+		Ω(fs.WriteFile("/a.txt", []byte("file"), 0644)).Should(Succeed())
+		Ω(fs.Rename("/a.txt", "/"+SnapshotDir)).Should(Equal(fuse.EPERM))
+
+		// The names are only reserved in the root.
+		Ω(fs.Mkdir("/data", 0755)).Should(Succeed())
+		Ω(fs.Rename("/a.txt", "/data/"+SnapshotDir)).Should(Succeed())
+
+		root, err := fs.Root()
+		Ω(err).ShouldNot(HaveOccurred())
+		req := &fuse.CreateRequest{Name: SnapshotDir, Mode: 0644}
+		_, _, err = root.(*Dir).Create(context.TODO(), req, new(fuse.CreateResponse))
+		Ω(err).Should(Equal(fuse.EPERM))
+		_, err = root.(*Dir).Mkdir(context.TODO(), &fuse.MkdirRequest{Name: ControlDir, Mode: 0755})
+		Ω(err).Should(Equal(fuse.EPERM))
+	})
+
+	It("should publish events from the api", func() {
+		sub := fs.Subscribe("/", 8)
+		defer sub.Close()
+
+		Ω(fs.WriteFile("/a.txt", []byte("hello"), 0644)).Should(Succeed())
+
+		var event *Event
+		Eventually(sub.Events).Should(Receive(&event))
+		Ω(event.Op).Should(Equal(OpCreate))
+		Eventually(sub.Events).Should(Receive(&event))
+		Ω(event.Op).Should(Equal(OpWrite))
+		Ω(event.Size).Should(Equal(uint64(5)))
+	})
+
+	Context("read only file system", func() {
+
+		BeforeEach(func() {
+			config.ReadOnly = true
+			fs = New(filepath.Join(tmpDir, "testmp"), config)
+		})
+
+		It("should not allow mutations", func() {
+			Ω(fs.WriteFile("/a.txt", []byte("hello"), 0644)).Should(Equal(fuse.EPERM))
+			Ω(fs.Mkdir("/data", 0755)).Should(Equal(fuse.EPERM))
+		})
+
+	})
+
+})
@@ -0,0 +1,144 @@
+// Append-only audit trail of file system mutations.
+
+package memfs
+
+import (
+	"encoding/json"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+//===========================================================================
+// Audit Log Type and Constructor
+//===========================================================================
+
+// AuditConfig specifies where the audit trail is written and which
+// mutations are recorded to it. Empty filters record everything.
+type AuditConfig struct {
+	Path     string   `json:"path" yaml:"path"`         // Append-only file to write audit records to
+	Prefixes []string `json:"prefixes" yaml:"prefixes"` // Only record mutations beneath these paths
+	Ops      []string `json:"ops" yaml:"ops"`           // Only record these operations (e.g. write, remove)
+}
+
+// AuditLog writes one JSON record per mutation to a dedicated append-only
+// file, separate from the debug Logger, for compliance purposes.
+type AuditLog struct {
+	sync.Mutex
+	Path     string          // Path to the audit log file
+	prefixes []string        // Path prefixes to filter records by
+	ops      map[string]bool // Operations to filter records by
+	file     *os.File        // Handle to the append-only file
+	encoder  *json.Encoder   // Writes JSON records to the file
+}
+
+// OpenAuditLog opens the audit file in append-only mode, creating it with
+// owner only permissions if it does not exist.
+func OpenAuditLog(conf *AuditConfig) (*AuditLog, error) {
+	file, err := os.OpenFile(conf.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	audit := &AuditLog{
+		Path:     conf.Path,
+		prefixes: make([]string, 0, len(conf.Prefixes)),
+		ops:      make(map[string]bool, len(conf.Ops)),
+		file:     file,
+		encoder:  json.NewEncoder(file),
+	}
+
+	for _, prefix := range conf.Prefixes {
+		audit.prefixes = append(audit.prefixes, strings.TrimSuffix(prefix, "/"))
+	}
+
+	for _, op := range conf.Ops {
+		audit.ops[Regularize(op)] = true
+	}
+
+	return audit, nil
+}
+
+//===========================================================================
+// Audit Log Methods
+//===========================================================================
+
+// auditRecord is the JSON representation of a mutation in the audit log.
+type auditRecord struct {
+	Time    string `json:"time"`
+	Op      string `json:"op"`
+	Node    uint64 `json:"node"`
+	Path    string `json:"path"`
+	NewPath string `json:"newpath,omitempty"`
+	Uid     uint32 `json:"uid"`
+	Gid     uint32 `json:"gid"`
+	Pid     uint32 `json:"pid"`
+	OldSize uint64 `json:"oldsize"`
+	NewSize uint64 `json:"newsize"`
+	OldMode string `json:"oldmode"`
+	NewMode string `json:"newmode"`
+}
+
+// Match returns true if the mutation passes the path prefix and operation
+// filters of the audit log.
+func (a *AuditLog) Match(m *Mutation) bool {
+	if len(a.ops) > 0 && !a.ops[m.Op] {
+		return false
+	}
+
+	if len(a.prefixes) == 0 {
+		return true
+	}
+
+	for _, prefix := range a.prefixes {
+		if HasPathPrefix(m.Path, prefix) || (m.NewPath != "" && HasPathPrefix(m.NewPath, prefix)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Record writes the mutation to the audit log if it matches the filters.
+func (a *AuditLog) Record(m *Mutation) error {
+	if !a.Match(m) {
+		return nil
+	}
+
+	a.Lock()
+	defer a.Unlock()
+
+	if a.file == nil {
+		return os.ErrClosed
+	}
+
+	return a.encoder.Encode(&auditRecord{
+		Time:    m.Time.Format(time.RFC3339Nano),
+		Op:      m.Op,
+		Node:    m.Node,
+		Path:    m.Path,
+		NewPath: m.NewPath,
+		Uid:     m.Uid,
+		Gid:     m.Gid,
+		Pid:     m.Pid,
+		OldSize: m.OldSize,
+		NewSize: m.NewSize,
+		OldMode: m.OldMode.String(),
+		NewMode: m.NewMode.String(),
+	})
+}
+
+// Close the audit log file.
+func (a *AuditLog) Close() error {
+	a.Lock()
+	defer a.Unlock()
+
+	if a.file == nil {
+		return nil
+	}
+
+	err := a.file.Close()
+	a.file = nil
+	return err
+}
@@ -0,0 +1,156 @@
+package memfs_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"bazil.org/fuse"
+
+	"golang.org/x/net/context"
+
+	. "github.com/bbengfort/memfs"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("AuditLog", func() {
+
+	var err error
+	var tmpDir string
+	var config *Config
+	var fs *FileSystem
+	var root *Dir
+	var ctx context.Context
+
+	hdr := fuse.Header{Uid: 501, Gid: 20, Pid: 4242}
+
+	BeforeEach(func() {
+		tmpDir, err = ioutil.TempDir("", TempDirPrefix)
+		Ω(err).ShouldNot(HaveOccurred())
+
+		config = makeTestConfig()
+		config.Audit.Path = filepath.Join(tmpDir, "audit.log")
+		ctx = context.TODO()
+	})
+
+	JustBeforeEach(func() {
+		fs = New(filepath.Join(tmpDir, "testmp"), config)
+
+		node, err := fs.Root()
+		Ω(err).ShouldNot(HaveOccurred())
+		root = node.(*Dir)
+	})
+
+	AfterEach(func() {
+		Ω(fs.Shutdown()).Should(Succeed())
+		Ω(os.RemoveAll(tmpDir)).Should(Succeed())
+	})
+
+	// Reads the audit records written to the audit log.
+	records := func() []map[string]interface{} {
+		data, err := ioutil.ReadFile(config.Audit.Path)
+		Ω(err).ShouldNot(HaveOccurred())
+
+		recs := make([]map[string]interface{}, 0)
+		for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+			if line == "" {
+				continue
+			}
+			rec := make(map[string]interface{})
+			Ω(json.Unmarshal([]byte(line), &rec)).Should(Succeed())
+			recs = append(recs, rec)
+		}
+		return recs
+	}
+
+	It("should record mutations with the caller identity", func() {
+		node, _, err := root.Create(ctx, &fuse.CreateRequest{Header: hdr, Name: "a.txt", Mode: 0644}, &fuse.CreateResponse{})
+		Ω(err).ShouldNot(HaveOccurred())
+
+		file := node.(*File)
+		err = file.Write(ctx, &fuse.WriteRequest{Header: hdr, Data: []byte("hello")}, &fuse.WriteResponse{})
+		Ω(err).ShouldNot(HaveOccurred())
+
+		recs := records()
+		Ω(recs).Should(HaveLen(2))
+
+		Ω(recs[0]["op"]).Should(Equal(OpCreate))
+		Ω(recs[0]["path"]).Should(Equal("/a.txt"))
+		Ω(recs[0]["uid"]).Should(BeNumerically("==", 501))
+		Ω(recs[0]["gid"]).Should(BeNumerically("==", 20))
+		Ω(recs[0]["pid"]).Should(BeNumerically("==", 4242))
+		Ω(recs[0]["time"]).ShouldNot(BeZero())
+
+		Ω(recs[1]["op"]).Should(Equal(OpWrite))
+		Ω(recs[1]["oldsize"]).Should(BeNumerically("==", 0))
+		Ω(recs[1]["newsize"]).Should(BeNumerically("==", 5))
+	})
+
+	It("should record the old and new modes on setattr", func() {
+		node, _, err := root.Create(ctx, &fuse.CreateRequest{Header: hdr, Name: "a.txt", Mode: 0644}, &fuse.CreateResponse{})
+		Ω(err).ShouldNot(HaveOccurred())
+
+		req := &fuse.SetattrRequest{Header: hdr, Mode: 0600, Valid: fuse.SetattrMode}
+		Ω(node.(*File).Setattr(ctx, req, &fuse.SetattrResponse{})).Should(Succeed())
+
+		recs := records()
+		Ω(recs).Should(HaveLen(2))
+		Ω(recs[1]["op"]).Should(Equal(OpSetattr))
+		Ω(recs[1]["oldmode"]).Should(Equal(os.FileMode(0644).String()))
+		Ω(recs[1]["newmode"]).Should(Equal(os.FileMode(0600).String()))
+	})
+
+	It("should record both paths of a rename", func() {
+		node, err := root.Mkdir(ctx, &fuse.MkdirRequest{Header: hdr, Name: "sub", Mode: 0755})
+		Ω(err).ShouldNot(HaveOccurred())
+
+		_, _, err = root.Create(ctx, &fuse.CreateRequest{Header: hdr, Name: "a.txt", Mode: 0644}, &fuse.CreateResponse{})
+		Ω(err).ShouldNot(HaveOccurred())
+
+		req := &fuse.RenameRequest{Header: hdr, OldName: "a.txt", NewName: "b.txt"}
+		Ω(root.Rename(ctx, req, node)).Should(Succeed())
+		Ω(root.Children).ShouldNot(HaveKey("a.txt"))
+		Ω(node.(*Dir).Children).Should(HaveKey("b.txt"))
+
+		recs := records()
+		Ω(recs).Should(HaveLen(3))
+		Ω(recs[2]["op"]).Should(Equal(OpRename))
+		Ω(recs[2]["path"]).Should(Equal("/a.txt"))
+		Ω(recs[2]["newpath"]).Should(Equal("/sub/b.txt"))
+	})
+
+	Context("with filters", func() {
+
+		BeforeEach(func() {
+			config.Audit.Prefixes = []string{"/secure"}
+			config.Audit.Ops = []string{"create", "remove"}
+		})
+
+		It("should only record matching paths and operations", func() {
+			node, err := root.Mkdir(ctx, &fuse.MkdirRequest{Header: hdr, Name: "secure", Mode: 0755})
+			Ω(err).ShouldNot(HaveOccurred())
+			dir := node.(*Dir)
+
+			_, _, err = root.Create(ctx, &fuse.CreateRequest{Header: hdr, Name: "public.txt", Mode: 0644}, &fuse.CreateResponse{})
+			Ω(err).ShouldNot(HaveOccurred())
+
+			_, _, err = dir.Create(ctx, &fuse.CreateRequest{Header: hdr, Name: "key.pem", Mode: 0600}, &fuse.CreateResponse{})
+			Ω(err).ShouldNot(HaveOccurred())
+
+			Ω(dir.Remove(ctx, &fuse.RemoveRequest{Header: hdr, Name: "key.pem"})).Should(Succeed())
+
+			recs := records()
+			Ω(recs).Should(HaveLen(2))
+			Ω(recs[0]["op"]).Should(Equal(OpCreate))
+			Ω(recs[0]["path"]).Should(Equal("/secure/key.pem"))
+			Ω(recs[1]["op"]).Should(Equal(OpRemove))
+			Ω(recs[1]["path"]).Should(Equal("/secure/key.pem"))
+		})
+
+	})
+
+})
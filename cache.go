@@ -0,0 +1,79 @@
+// Kernel attribute and entry cache durations and invalidation.
+
+package memfs
+
+import (
+	"time"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+)
+
+// DefaultAttrValid is how long the kernel caches attributes by default,
+// matching the duration used by bazil.org/fuse/fs.
+const DefaultAttrValid = time.Minute
+
+//===========================================================================
+// Cache Durations
+//===========================================================================
+
+// attrValid sets how long the kernel may cache the attributes. If the
+// configured duration is zero the FUSE default is used, if it is negative
+// the attributes are not cached.
+func (mfs *FileSystem) attrValid(attr *fuse.Attr) {
+	if mfs.Config.AttrValid > 0 {
+		attr.Valid = time.Duration(mfs.Config.AttrValid)
+	} else if mfs.Config.AttrValid < 0 {
+		attr.Valid = 0
+	}
+}
+
+// entryValid sets how long the kernel may cache the directory entry and the
+// attributes of the node in a lookup response.
+func (mfs *FileSystem) entryValid(resp *fuse.LookupResponse) {
+	if mfs.Config.EntryValid > 0 {
+		resp.EntryValid = time.Duration(mfs.Config.EntryValid)
+	} else if mfs.Config.EntryValid < 0 {
+		resp.EntryValid = 0
+	}
+	mfs.attrValid(&resp.Attr)
+}
+
+//===========================================================================
+// Cache Invalidation
+//===========================================================================
+
+// invalidate notifies the kernel that the cached data, attributes and
+// directory entries affected by the mutation are stale. Notifications are
+// sent from a separate go routine since the kernel may need to issue
+// requests to the file system (and therefore acquire the lock) before the
+// notification completes. Must be called with the lock held.
+func (mfs *FileSystem) invalidate(m *Mutation) {
+	if mfs.server == nil {
+		return
+	}
+
+	go func(srv *fs.Server) {
+		if node, ok := m.entity.(fs.Node); ok {
+			invalidated(m, srv.InvalidateNodeData(node))
+		}
+
+		if m.parent != nil {
+			invalidated(m, srv.InvalidateEntry(m.parent, m.name))
+			invalidated(m, srv.InvalidateNodeData(m.parent))
+		}
+
+		if m.dst != nil {
+			invalidated(m, srv.InvalidateEntry(m.dst, m.newName))
+			invalidated(m, srv.InvalidateNodeData(m.dst))
+		}
+	}(mfs.server)
+}
+
+// invalidated logs the result of a cache invalidation. Nodes that are not
+// cached by the kernel do not need to be invalidated so that error is ignored.
+func invalidated(m *Mutation, err error) {
+	if err != nil && err != fuse.ErrNotCached {
+		logger.Subsystem("cache").Warn("could not invalidate kernel cache after %s on %q: %s", m.Op, m.Path, err)
+	}
+}
@@ -0,0 +1,105 @@
+package memfs_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"bazil.org/fuse"
+
+	"golang.org/x/net/context"
+
+	. "github.com/bbengfort/memfs"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Kernel Cache", func() {
+
+	var err error
+	var tmpDir string
+	var config *Config
+	var fs *FileSystem
+	var root *Dir
+	var ctx context.Context
+
+	BeforeEach(func() {
+		tmpDir, err = ioutil.TempDir("", TempDirPrefix)
+		Ω(err).ShouldNot(HaveOccurred())
+
+		config = makeTestConfig()
+		ctx = context.TODO()
+	})
+
+	JustBeforeEach(func() {
+		fs = New(filepath.Join(tmpDir, "testmp"), config)
+		Ω(fs.WriteFile("/a.txt", []byte("cached"), 0644)).Should(Succeed())
+
+		node, err := fs.Root()
+		Ω(err).ShouldNot(HaveOccurred())
+		root = node.(*Dir)
+	})
+
+	AfterEach(func() {
+		Ω(os.RemoveAll(tmpDir)).Should(Succeed())
+	})
+
+	Context("with configured durations", func() {
+
+		BeforeEach(func() {
+			config.AttrValid = Duration(5 * time.Second)
+			config.EntryValid = Duration(10 * time.Second)
+		})
+
+		It("should set the entry and attribute durations on lookup", func() {
+			resp := &fuse.LookupResponse{}
+			node, err := root.Lookup(ctx, &fuse.LookupRequest{Name: "a.txt"}, resp)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(node).ShouldNot(BeNil())
+			Ω(resp.EntryValid).Should(Equal(10 * time.Second))
+
+			attr := &fuse.Attr{}
+			Ω(node.Attr(ctx, attr)).Should(Succeed())
+			Ω(attr.Valid).Should(Equal(5 * time.Second))
+		})
+
+	})
+
+	Context("with caching disabled", func() {
+
+		BeforeEach(func() {
+			config.AttrValid = Duration(-1)
+			config.EntryValid = Duration(-1)
+		})
+
+		It("should not allow the kernel to cache", func() {
+			resp := &fuse.LookupResponse{EntryValid: time.Minute}
+			node, err := root.Lookup(ctx, &fuse.LookupRequest{Name: "a.txt"}, resp)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(resp.EntryValid).Should(BeZero())
+
+			attr := &fuse.Attr{Valid: time.Minute}
+			Ω(node.Attr(ctx, attr)).Should(Succeed())
+			Ω(attr.Valid).Should(BeZero())
+		})
+
+	})
+
+	It("should use the default duration on getattr", func() {
+		ent, err := fs.Resolve("/a.txt")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		resp := &fuse.GetattrResponse{}
+		Ω(ent.(*File).Getattr(ctx, &fuse.GetattrRequest{}, resp)).Should(Succeed())
+		Ω(resp.Attr.Valid).Should(Equal(DefaultAttrValid))
+		Ω(resp.Attr.Size).Should(Equal(uint64(6)))
+	})
+
+	It("should return ENOENT when looking up missing entries", func() {
+		_, err := root.Lookup(ctx, &fuse.LookupRequest{Name: "missing"}, &fuse.LookupResponse{})
+		Ω(err).Should(Equal(fuse.ENOENT))
+	})
+
+})
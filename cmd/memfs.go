@@ -1,29 +1,57 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
+	"time"
 
 	"github.com/bbengfort/memfs"
 	"github.com/urfave/cli"
 )
 
-var fs *memfs.FileSystem
+// daemon is a file system or a manager of volumes served by the process.
+type daemon interface {
+	Run() error
+	Shutdown() error
+	Reload(flags *memfs.Config) ([]string, error)
+}
+
+var fs daemon
+var flags *memfs.Config
 
 //===========================================================================
 // OS Signal Handlers
 //===========================================================================
 
 func signalHandler() {
-	// Make signal channel and register notifiers for Interrupt and Terminate
+	// Make signal channel and register notifiers for Interrupt, Terminate
+	// and Hangup
 	sigchan := make(chan os.Signal, 1)
 	signal.Notify(sigchan, os.Interrupt)
 	signal.Notify(sigchan, syscall.SIGTERM)
+	signal.Notify(sigchan, syscall.SIGHUP)
+
+	// Reload the configuration on hangup until we receive another signal
+	for sig := range sigchan {
+		if sig != syscall.SIGHUP {
+			break
+		}
 
-	// Block until we receive a signal on the channel
-	<-sigchan
+		remount, err := fs.Reload(flags)
+		if err != nil {
+			fmt.Printf("reload error: %s\n", err)
+		} else if len(remount) > 0 {
+			fmt.Printf("reloaded configuration, remount to apply: %s\n", strings.Join(remount, ", "))
+		}
+	}
 
 	// Defer the clean exit until the end of the function
 	defer os.Exit(0)
@@ -42,14 +70,14 @@ func main() {
 	app := cli.NewApp()
 	app.Name = "memfs"
 	app.Usage = "In memory file system with anti-entropy replication"
-	app.ArgsUsage = "mount point"
+	app.ArgsUsage = "mount point (omitted if volumes are configured)"
 	app.Version = memfs.PackageVersion()
 	app.Author = "Benjamin Bengfort"
 	app.Email = "bengfort@cs.umd.edu"
 	app.Flags = []cli.Flag{
 		cli.StringFlag{
 			Name:  "config, c",
-			Usage: "specify a path to the configuration `FILE`",
+			Usage: "specify a path to the JSON or YAML configuration `FILE`",
 		},
 		cli.StringFlag{
 			Name:  "name, N",
@@ -67,8 +95,104 @@ func main() {
 			Name:  "readonly, R",
 			Usage: "set the fs to read only mode, false by default",
 		},
+		cli.StringFlag{
+			Name:  "overlay, O",
+			Usage: "overlay the fs on a read only lower `DIR`",
+		},
+		cli.StringFlag{
+			Name:  "preload, P",
+			Usage: "seed the fs from a directory or tar archive at `PATH`",
+		},
+		cli.StringFlag{
+			Name:  "inodes, I",
+			Usage: "save and restore the inode numbers of the fs in `FILE`",
+		},
+		cli.BoolFlag{
+			Name:  "secure, S",
+			Usage: "overwrite file data before it is freed, false by default",
+		},
+		cli.BoolFlag{
+			Name:  "mlock",
+			Usage: "lock memory so file data is never swapped, false by default",
+		},
 	}
 
+	// Commands served by the control api of a manager must name the volume
+	volume := cli.StringFlag{
+		Name:   "volume, V",
+		Usage:  "specify the `NAME` of the volume if volumes are configured",
+		EnvVar: memfs.EnvPrefix + "_VOLUME",
+	}
+
+	// The export, snapshot and reap commands require the address of the
+	// control api
+	control := cli.StringFlag{
+		Name:   "control, a",
+		Usage:  "specify the `ADDR` of the control api",
+		EnvVar: memfs.EnvPrefix + "_CONTROL",
+	}
+
+	app.Commands = []cli.Command{
+		{
+			Name:   "export",
+			Usage:  "write a tar archive of a running fs from its control api",
+			Action: export,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "output, o",
+					Usage: "write the archive to `FILE` instead of stdout",
+				},
+				cli.StringFlag{
+					Name:  "compression, z",
+					Usage: "compress the archive with `FORMAT` (gzip)",
+				},
+				control,
+				volume,
+			},
+		},
+	}
+
+	app.Commands = append(app.Commands, cli.Command{
+		Name:  "snapshot",
+		Usage: "manage the snapshots of a running fs from its control api",
+		Subcommands: []cli.Command{
+			{
+				Name:      "create",
+				Usage:     "freeze the fs into a read only snapshot",
+				ArgsUsage: "name",
+				Action:    snapshot(http.MethodPost),
+				Flags:     []cli.Flag{control, volume},
+			},
+			{
+				Name:   "list",
+				Usage:  "list the snapshots of the fs",
+				Action: snapshot(http.MethodGet),
+				Flags:  []cli.Flag{control, volume},
+			},
+			{
+				Name:      "delete",
+				Usage:     "delete a snapshot and release its data",
+				ArgsUsage: "name",
+				Action:    snapshot(http.MethodDelete),
+				Flags:     []cli.Flag{control, volume},
+			},
+		},
+	})
+
+	app.Commands = append(app.Commands, cli.Command{
+		Name:   "reap",
+		Usage:  "remove the expired files and directories of a running fs",
+		Action: reap,
+		Flags: []cli.Flag{
+			control,
+			volume,
+			cli.BoolFlag{
+				Name:  "dry-run, n",
+				Usage: "list the expired entries without removing them",
+			},
+		},
+	})
+
 	app.Action = runfs
 	app.Run(os.Args)
 
@@ -80,40 +204,47 @@ func runfs(c *cli.Context) error {
 	var mountPath string
 	var config *memfs.Config
 
-	// Validate the arguments
-	if c.NArg() != 1 {
-		return cli.NewExitError("please supply the path to the mount point", 1)
+	// Create the configuration from the defaults, the passed in file, the
+	// environment and the command line options (in order of precedence).
+	flags = &memfs.Config{
+		Name:       c.String("name"),
+		CacheSize:  c.Uint64("cache"),
+		Level:      c.String("level"),
+		ReadOnly:   c.Bool("readonly"),
+		Overlay:    c.String("overlay"),
+		Preload:    c.String("preload"),
+		InodeState: c.String("inodes"),
+		Secure:     c.Bool("secure"),
+		Mlock:      c.Bool("mlock"),
 	}
 
-	// Get the mount path from the arguments
-	mountPath = c.Args()[0]
-
-	// Create the configuration from the passed in file or with defaults
-	cpath := c.String("config")
-	if config, err = makeConfig(cpath); err != nil {
+	if config, err = memfs.LoadConfig(c.String("config"), flags); err != nil {
 		return cli.NewExitError(err.Error(), 1)
 	}
 
-	// Update the configuration with command line options
-	if c.String("name") != "" {
-		config.Name = c.String("name")
-	}
+	// Serve the configured volumes, which are mounted at their own mount
+	// points, or create the file system on the mount point argument
+	if len(config.Volumes) > 0 {
+		if c.NArg() != 0 {
+			return cli.NewExitError("mount points are specified by the configured volumes", 1)
+		}
 
-	if c.Uint64("cache") != 0 {
-		config.CacheSize = c.Uint64("cache")
-	}
+		if fs, err = memfs.NewManager(config); err != nil {
+			return cli.NewExitError(err.Error(), 1)
+		}
+	} else {
+		// Validate the arguments
+		if c.NArg() != 1 {
+			return cli.NewExitError("please supply the path to the mount point", 1)
+		}
 
-	if c.String("level") != "" {
-		config.Level = c.String("level")
-	}
+		// Get the mount path from the arguments
+		mountPath = c.Args()[0]
 
-	if c.Bool("readonly") {
-		config.ReadOnly = c.Bool("readonly")
+		// Create the new file system
+		fs = memfs.New(mountPath, config)
 	}
 
-	// Create the new file system
-	fs = memfs.New(mountPath, config)
-
 	// Handle interrupts
 	go signalHandler()
 
@@ -125,30 +256,156 @@ func runfs(c *cli.Context) error {
 	return nil
 }
 
-// Helper function to make the configuration.
-func makeConfig(cpath string) (*memfs.Config, error) {
-	// Construct configuration from command line options or JSON file.
-	config := new(memfs.Config)
+// endpoint returns the url of the path on the control api at the address,
+// beneath the named volume if the control api is served by a manager.
+func endpoint(addr, volume, path string) string {
+	if volume != "" {
+		path = "/volumes/" + url.PathEscape(volume) + path
+	}
+	return fmt.Sprintf("http://%s%s", addr, path)
+}
+
+func export(c *cli.Context) error {
+
+	// Validate the arguments
+	if c.String("control") == "" {
+		return cli.NewExitError("please specify the address of the control api", 1)
+	}
+
+	query := url.Values{}
+	query.Set("compression", c.String("compression"))
+	resp, err := http.Get(endpoint(c.String("control"), c.String("volume"), "/export?"+query.Encode()))
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	defer resp.Body.Close()
 
-	// Load the configuration if a path was passed in.
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return cli.NewExitError(strings.TrimSpace(string(msg)), 1)
+	}
 
-	if cpath != "" {
-		if err := config.Load(cpath); err != nil {
-			return nil, err
+	// Write the archive to stdout unless an output file is specified
+	path := c.String("output")
+	if path == "" {
+		if _, err := io.Copy(os.Stdout, resp.Body); err != nil {
+			return cli.NewExitError(fmt.Sprintf("export failed: %s", err), 1)
 		}
+		return nil
+	}
+
+	out, err := os.Create(path)
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+
+	// The server aborts the stream if the export fails once it has started,
+	// so a failed copy leaves a truncated archive that is removed.
+	if _, err = io.Copy(out, resp.Body); err == nil {
+		err = out.Close()
 	} else {
-		name, err := os.Hostname()
+		out.Close()
+	}
+
+	if err != nil {
+		os.Remove(path)
+		return cli.NewExitError(fmt.Sprintf("export failed: %s", err), 1)
+	}
+	return nil
+}
+
+func snapshot(method string) func(c *cli.Context) error {
+	return func(c *cli.Context) error {
+
+		// Validate the arguments
+		if c.String("control") == "" {
+			return cli.NewExitError("please specify the address of the control api", 1)
+		}
+
+		query := url.Values{}
+		if method != http.MethodGet {
+			if c.NArg() != 1 {
+				return cli.NewExitError("please supply the name of the snapshot", 1)
+			}
+			query.Set("name", c.Args()[0])
+		}
+
+		req, err := http.NewRequest(method, endpoint(c.String("control"), c.String("volume"), "/snapshots?"+query.Encode()), nil)
+		if err != nil {
+			return cli.NewExitError(err.Error(), 1)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
 		if err != nil {
-			name = "terp"
+			return cli.NewExitError(err.Error(), 1)
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode >= 300 {
+			msg, _ := ioutil.ReadAll(resp.Body)
+			return cli.NewExitError(strings.TrimSpace(string(msg)), 1)
+		}
+
+		if method != http.MethodGet {
+			return nil
+		}
+
+		// Print the snapshots with their creation times
+		var snapshots []*memfs.Snapshot
+		if err := json.NewDecoder(resp.Body).Decode(&snapshots); err != nil {
+			return cli.NewExitError(err.Error(), 1)
 		}
 
-		// Add reasonable defaults to the configuration
-		config.Name = name
-		config.CacheSize = uint64(4295000000)
-		config.Level = "info"
-		config.ReadOnly = false
-		config.Replicas = make([]*memfs.Replica, 0, 0)
+		for _, snap := range snapshots {
+			fmt.Printf("%s\t%s\n", snap.Name, snap.Created.Format(time.RFC3339))
+		}
+		return nil
 	}
+}
 
-	return config, nil
+func reap(c *cli.Context) error {
+
+	// Validate the arguments
+	if c.String("control") == "" {
+		return cli.NewExitError("please specify the address of the control api", 1)
+	}
+
+	// A GET reports the expired entries without removing them
+	method := http.MethodPost
+	if c.Bool("dry-run") {
+		method = http.MethodGet
+	}
+
+	req, err := http.NewRequest(method, endpoint(c.String("control"), c.String("volume"), "/reap"), nil)
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return cli.NewExitError(strings.TrimSpace(string(msg)), 1)
+	}
+
+	// Print the expired entries followed by a summary
+	report := new(memfs.ReapReport)
+	if err := json.NewDecoder(resp.Body).Decode(report); err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+
+	for _, path := range report.Paths {
+		fmt.Println(path)
+	}
+
+	verb := "removed"
+	if report.DryRun {
+		verb = "would remove"
+	}
+	fmt.Printf("%s %d files and %d directories (%d bytes)\n", verb, report.Files, report.Dirs, report.Bytes)
+	return nil
 }
@@ -0,0 +1,243 @@
+// Transparent compression of cold file data in memory.
+
+package memfs
+
+import (
+	"bytes"
+	"compress/flate"
+	"io"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"bazil.org/fuse"
+)
+
+// CompressXattr is the extended attribute that opts a file out of compression
+// when it is set to "0", "false", "off" or "no".
+const CompressXattr = "user.memfs.compress"
+
+// Minimum interval between sweeps for cold files.
+const minCompressSweep = time.Second
+
+//===========================================================================
+// Compression Configuration
+//===========================================================================
+
+// CompressConfig enables the compression of the data of files that have not
+// been accessed for an interval. Compressed data is decompressed when the file
+// is next read or written.
+type CompressConfig struct {
+	After Duration `json:"after" yaml:"after"` // Compress data not accessed for this long (0 disables)
+	Level int      `json:"level" yaml:"level"` // Flate compression level (0 for the default)
+}
+
+// level returns the flate compression level of the configuration.
+func (conf *CompressConfig) level() int {
+	if conf.Level == 0 {
+		return flate.DefaultCompression
+	}
+	return conf.Level
+}
+
+//===========================================================================
+// File Compression
+//===========================================================================
+
+// deflate compresses the data at the level, returning nil if the data does
+// not compress. It does not require the lock.
+func deflate(data []byte, level int) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	zw, err := flate.NewWriter(buf, level)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := zw.Write(data); err != nil {
+		return nil, err
+	}
+
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+
+	// Data that does not compress is left as it is.
+	if buf.Len() >= len(data) {
+		return nil, nil
+	}
+	return append([]byte(nil), buf.Bytes()...), nil
+}
+
+// pack replaces the resident data of the file with the compressed data and
+// releases the uncompressed data from memory. Must be called with the lock
+// held.
+func (f *File) pack(packed []byte) {
+	f.packed = packed
+	f.fs.zbytes += uint64(len(f.Data))
+	f.fs.zsize += uint64(len(f.packed))
+	f.scrub(f.Data)
+	f.Data = nil
+}
+
+// unpack decompresses the data of a compressed file back into memory. Must be
+// called with the lock held.
+func (f *File) unpack() error {
+	data, err := ioutil.ReadAll(f.packedReader())
+	if err != nil {
+		logger.Error("could not decompress data of file %d: %s", f.ID, err)
+		return fuse.EIO
+	}
+
+	f.Data = data
+	f.dropPacked()
+	return nil
+}
+
+// dropPacked releases the compressed data of the file. Must be called with
+// the lock held.
+func (f *File) dropPacked() {
+	if f.packed == nil {
+		return
+	}
+
+	f.fs.zbytes = addClamped(f.fs.zbytes, -int64(f.Attrs.Size))
+	f.fs.zsize = addClamped(f.fs.zsize, -int64(len(f.packed)))
+
+	// Compressed data shared with snapshots is left to them.
+	if f.held == nil || f.held.refs == 0 {
+		f.scrub(f.packed)
+	}
+	f.disown(uint64(len(f.packed)))
+	f.packed = nil
+}
+
+// packedReader returns a reader of the decompressed data of the file. Must
+// be called with the lock held.
+func (f *File) packedReader() io.Reader {
+	return flate.NewReader(bytes.NewReader(f.packed))
+}
+
+// readPacked decompresses len(buf) bytes of the data of the file from the
+// offset into buf without releasing the compressed data. Must be called with
+// the lock held.
+func (f *File) readPacked(buf []byte, off int64) error {
+	r := f.packedReader()
+	_, err := io.CopyN(ioutil.Discard, r, off)
+	if err == nil {
+		_, err = io.ReadFull(r, buf)
+	}
+
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		logger.Error("could not decompress data of file %d: %s", f.ID, err)
+		return fuse.EIO
+	}
+	return nil
+}
+
+// compressible returns true if the file holds resident data that has not
+// been accessed since the cutoff and neither it nor the rules of its path
+// opted out of compression. Must be called with the lock held.
+func (f *File) compressible(cutoff time.Time) bool {
+	if f.dirty || f.IsArchive() || f.cow != nil || len(f.Data) == 0 || !f.Attrs.Atime.Before(cutoff) {
+		return false
+	}
+
+	value, _ := f.getxattr(CompressXattr)
+	switch strings.ToLower(string(value)) {
+	case "0", "false", "off", "no":
+		return false
+	}
+	return len(f.fs.Config.Rules) == 0 || f.fs.zone(f.Path()).compress
+}
+
+//===========================================================================
+// Cold Data Sweeps
+//===========================================================================
+
+// CompressCold compresses the data of every file that has not been accessed
+// for the configured interval, returning the number of files compressed. It
+// is called periodically in the background if compression is enabled. The
+// lock is only held to find the cold files and to swap in their compressed
+// data; the data is pinned while it is compressed so that files modified in
+// the meantime are copied first and left uncompressed.
+func (mfs *FileSystem) CompressCold() int {
+	mfs.Lock()
+	after := time.Duration(mfs.Config.Compress.After)
+	if after <= 0 {
+		mfs.Unlock()
+		return 0
+	}
+
+	files := make([]*coldFile, 0)
+	level := mfs.Config.Compress.level()
+	cutoff := time.Now().Add(-after)
+	mfs.Inodes.Each(func(ent Entity) {
+		if f, ok := ent.(*File); ok && f.compressible(cutoff) {
+			cow, data := f.pin()
+			files = append(files, &coldFile{File: f, cow: cow, data: data})
+		}
+	})
+	mfs.Unlock()
+
+	for _, c := range files {
+		var err error
+		if c.deflated, err = deflate(c.data, level); err != nil {
+			logger.Error("could not compress data of file %d: %s", c.ID, err)
+		}
+	}
+
+	mfs.Lock()
+	defer mfs.Unlock()
+
+	n := 0
+	for _, c := range files {
+		c.unpin(c.cow, c.data)
+		if c.deflated == nil || !c.unchanged(c.data) || !c.compressible(cutoff) {
+			continue
+		}
+
+		c.pack(c.deflated)
+		n++
+	}
+
+	if n > 0 {
+		logger.Debug("compressed %d cold files, saving %d bytes", n, mfs.zbytes-mfs.zsize)
+	}
+	return n
+}
+
+// coldFile is a file whose pinned data is compressed without the lock held.
+type coldFile struct {
+	*File
+	cow      *shared // Pins the data of the file while it is compressed
+	data     []byte  // Data of the file when it was found to be cold
+	deflated []byte  // Compressed data (nil if it does not compress)
+}
+
+// unchanged returns true if the file still holds the data, i.e. it was not
+// modified, faulted or released since the data was pinned. Must be called
+// with the lock held.
+func (f *File) unchanged(data []byte) bool {
+	return len(f.Data) == len(data) && len(data) > 0 && &f.Data[0] == &data[0]
+}
+
+// sweep compresses cold files at half the configured interval until the file
+// system is shut down.
+func (mfs *FileSystem) sweep(after time.Duration, stop <-chan struct{}) {
+	interval := after / 2
+	if interval < minCompressSweep {
+		interval = minCompressSweep
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			mfs.CompressCold()
+		case <-stop:
+			return
+		}
+	}
+}
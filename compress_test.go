@@ -0,0 +1,133 @@
+package memfs_test
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"bazil.org/fuse"
+
+	"golang.org/x/net/context"
+
+	. "github.com/bbengfort/memfs"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Compress", func() {
+
+	var err error
+	var tmpDir string
+	var config *Config
+	var fs *FileSystem
+	var ctx context.Context
+	var data []byte
+
+	// cold writes a file and ages its access time past the interval.
+	cold := func(path string) *File {
+		Ω(fs.WriteFile(path, data, 0644)).Should(Succeed())
+		ent, err := fs.Resolve(path)
+		Ω(err).ShouldNot(HaveOccurred())
+
+		f := ent.(*File)
+		f.Attrs.Atime = time.Now().Add(-2 * time.Hour)
+		return f
+	}
+
+	BeforeEach(func() {
+		tmpDir, err = ioutil.TempDir("", TempDirPrefix)
+		Ω(err).ShouldNot(HaveOccurred())
+
+		config = makeTestConfig()
+		config.Compress.After = Duration(time.Hour)
+		ctx = context.TODO()
+		data = bytes.Repeat([]byte("INFO request handled in 3ms\n"), 1024)
+	})
+
+	JustBeforeEach(func() {
+		fs = New(filepath.Join(tmpDir, "testmp"), config)
+	})
+
+	AfterEach(func() {
+		Ω(fs.Shutdown()).Should(Succeed())
+		Ω(os.RemoveAll(tmpDir)).Should(Succeed())
+	})
+
+	It("should compress files that have not been accessed", func() {
+		f := cold("/cold.log")
+		Ω(fs.WriteFile("/hot.log", data, 0644)).Should(Succeed())
+
+		resp := new(fuse.StatfsResponse)
+		Ω(fs.Statfs(ctx, new(fuse.StatfsRequest), resp)).Should(Succeed())
+		free := resp.Bfree
+
+		Ω(fs.CompressCold()).Should(Equal(1))
+		Ω(f.Data).Should(BeEmpty())
+
+		Ω(fs.Statfs(ctx, new(fuse.StatfsRequest), resp)).Should(Succeed())
+		Ω(resp.Bfree).Should(BeNumerically(">", free+uint64(len(data))/1024))
+
+		contents, err := fs.ReadFile("/cold.log")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(contents).Should(Equal(data))
+	})
+
+	It("should decompress on read and write", func() {
+		f := cold("/cold.log")
+		Ω(fs.CompressCold()).Should(Equal(1))
+
+		req := &fuse.ReadRequest{Offset: 28, Size: 27}
+		resp := new(fuse.ReadResponse)
+		Ω(f.Read(ctx, req, resp)).Should(Succeed())
+		Ω(resp.Data).Should(Equal([]byte("INFO request handled in 3ms")))
+
+		f.Attrs.Atime = time.Now().Add(-2 * time.Hour)
+		Ω(fs.CompressCold()).Should(Equal(1))
+
+		write := &fuse.WriteRequest{Offset: 0, Data: []byte("WARN")}
+		Ω(f.Write(ctx, write, new(fuse.WriteResponse))).Should(Succeed())
+		Ω(f.Data[:8]).Should(Equal([]byte("WARN req")))
+	})
+
+	It("should not lose writes made while the data is compressed", func() {
+		files := make([]*File, 0, 32)
+		for i := 0; i < cap(files); i++ {
+			files = append(files, cold(fmt.Sprintf("/cold-%d.log", i)))
+		}
+
+		done := make(chan int)
+		go func() {
+			done <- fs.CompressCold()
+		}()
+
+		write := &fuse.WriteRequest{Offset: 0, Data: []byte("WARN")}
+		for _, f := range files {
+			Ω(f.Write(ctx, write, new(fuse.WriteResponse))).Should(Succeed())
+		}
+		Ω(<-done).Should(BeNumerically("<=", len(files)))
+
+		expected := append([]byte("WARN"), data[4:]...)
+		for _, f := range files {
+			contents, err := fs.ReadFile(f.Path())
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(contents).Should(Equal(expected))
+		}
+	})
+
+	It("should not compress files that opt out", func() {
+		f := cold("/cold.log")
+		f.XAttrs[CompressXattr] = []byte("off")
+		Ω(fs.CompressCold()).Should(BeZero())
+		Ω(f.Data).Should(Equal(data))
+	})
+
+	It("should validate the compression level", func() {
+		config.Compress.Level = 12
+		Ω(config.Validate()).ShouldNot(Succeed())
+	})
+
+})
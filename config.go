@@ -1,10 +1,28 @@
-// Implements the reading and writing to and from a JSON config file.
+// Implements the reading and writing to and from a JSON or YAML config file.
 
 package memfs
 
 import (
+	"compress/flate"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Configuration defaults and limits.
+const (
+	DefaultCacheSize = uint64(4295000000) // Default maximum amount of memory used
+	MinCacheSize     = uint64(1048576)    // Smallest cache size that can be configured
+	EnvPrefix        = "MEMFS"            // Prefix of environment variable overrides
 )
 
 //===========================================================================
@@ -13,36 +31,121 @@ import (
 
 // Replica implements the definition for a remote replica connections.
 type Replica struct {
-	PID  uint   `json:"pid"`  // Precedence ID for the replica
-	Name string `json:"name"` // Name of the replica
-	Host string `json:"host"` // IP address or hostname of the replica
-	Port int    `json:"port"` // Port the replica is listening on
+	PID  uint   `json:"pid" yaml:"pid"`   // Precedence ID for the replica
+	Name string `json:"name" yaml:"name"` // Name of the replica
+	Host string `json:"host" yaml:"host"` // IP address or hostname of the replica
+	Port int    `json:"port" yaml:"port"` // Port the replica is listening on
 }
 
 // Config implements the local configuration directives.
 type Config struct {
-	Name      string     `json:"name"`      // Identifier for replica lists
-	CacheSize uint64     `json:"cachesize"` // Maximum amount of memory used
-	Level     string     `json:"level"`     // Minimum level to log at (debug, info, warn, error, critical)
-	ReadOnly  bool       `json:"readonly"`  // Whether or not the FS is read only
-	Replicas  []*Replica `json:"replicas"`  // List of remote replicas in system
-	Path      string     `json:"-"`         // Path the config was loaded from
+	Name       string         `json:"name" yaml:"name"`             // Identifier for replica lists
+	CacheSize  uint64         `json:"cachesize" yaml:"cachesize"`   // Maximum amount of memory used
+	MaxInodes  uint64         `json:"maxinodes" yaml:"maxinodes"`   // Maximum number of files and directories (0 derives from capacity)
+	Level      string         `json:"level" yaml:"level"`           // Minimum level to log at (debug, info, warn, error, critical)
+	ReadOnly   bool           `json:"readonly" yaml:"readonly"`     // Whether or not the FS is read only
+	Replicas   []*Replica     `json:"replicas" yaml:"replicas"`     // List of remote replicas in system
+	Logging    LogConfig      `json:"logging" yaml:"logging"`       // Log sink, format and subsystem levels
+	Audit      AuditConfig    `json:"audit" yaml:"audit"`           // Audit trail of mutations and its filters
+	Watch      WatchConfig    `json:"watch" yaml:"watch"`           // Bounds of the change notification buffers
+	Control    string         `json:"control" yaml:"control"`       // Address to serve the HTTP control API on
+	AttrValid  Duration       `json:"attrvalid" yaml:"attrvalid"`   // How long the kernel caches attributes (0 default, <0 never)
+	EntryValid Duration       `json:"entryvalid" yaml:"entryvalid"` // How long the kernel caches entries (0 default, <0 never)
+	Quotas     QuotaConfig    `json:"quotas" yaml:"quotas"`         // Byte and inode limits per user and directory
+	Spill      SpillConfig    `json:"spill" yaml:"spill"`           // Backing directory for cold file data
+	Mirror     MirrorConfig   `json:"mirror" yaml:"mirror"`         // Backing directory to load and propagate mutations to
+	Overlay    string         `json:"overlay" yaml:"overlay"`       // Read-only lower directory beneath the in-memory tree
+	Preload    string         `json:"preload" yaml:"preload"`       // Directory or tar archive to load into the tree at mount
+	InodeState string         `json:"inodestate" yaml:"inodestate"` // File the inode numbers of the tree are saved to and restored from
+	Dedup      DedupConfig    `json:"dedup" yaml:"dedup"`           // Content-addressed block store for file data
+	Compress   CompressConfig `json:"compress" yaml:"compress"`     // Compression of cold file data in memory
+	Encryption EncryptConfig  `json:"encryption" yaml:"encryption"` // Key that file data and extended attributes are encrypted with
+	Secure     bool           `json:"secure" yaml:"secure"`         // Overwrite file data in memory and on disk before it is freed
+	Mlock      bool           `json:"mlock" yaml:"mlock"`           // Lock memory so that file data is never swapped to disk
+	XAttr      XattrConfig    `json:"xattr" yaml:"xattr"`           // Size limits of extended attributes
+	TTL        TTLConfig      `json:"ttl" yaml:"ttl"`               // Expiration of entries that have not been modified
+	Rules      []*Rule        `json:"rules" yaml:"rules"`           // Policies of the subtrees that match path globs
+	Volumes    []*Volume      `json:"volumes" yaml:"volumes"`       // Named file systems served by one process
+	Budget     uint64         `json:"budget" yaml:"budget"`         // Memory shared by all volumes (0 for unlimited)
+	Path       string         `json:"-" yaml:"-"`                   // Path the config was loaded from
+}
+
+//===========================================================================
+// Config Constructors
+//===========================================================================
+
+// DefaultConfig returns a configuration with reasonable defaults, named
+// after the hostname of the machine.
+func DefaultConfig() *Config {
+	name, err := os.Hostname()
+	if err != nil {
+		name = "terp"
+	}
+
+	return &Config{
+		Name:      name,
+		CacheSize: DefaultCacheSize,
+		Level:     "info",
+		ReadOnly:  false,
+		Replicas:  make([]*Replica, 0, 0),
+	}
+}
+
+// LoadConfig creates a configuration by layering, in increasing order of
+// precedence, the defaults, the file at path (if not empty), the MEMFS_*
+// environment variables and the non-zero fields of flags (if not nil). The
+// resulting configuration is validated before it is returned.
+func LoadConfig(path string, flags *Config) (*Config, error) {
+	conf := DefaultConfig()
+
+	if path != "" {
+		if err := conf.Load(path); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := conf.Environ(); err != nil {
+		return nil, err
+	}
+
+	if flags != nil {
+		conf.Update(flags)
+	}
+
+	if err := conf.Validate(); err != nil {
+		return nil, err
+	}
+
+	return conf, nil
 }
 
 //===========================================================================
 // Config Methods
 //===========================================================================
 
-// Load a configuration from a path on disk by deserializing the JSON data.
+// isYAML returns true if the path has a YAML file extension.
+func isYAML(path string) bool {
+	ext := Regularize(filepath.Ext(path))
+	return ext == ".yaml" || ext == ".yml"
+}
+
+// Load a configuration from a path on disk by deserializing the JSON or YAML
+// data (determined by the file extension) over the current values.
 func (conf *Config) Load(path string) error {
 	data, err := ioutil.ReadFile(path)
 	if err != nil {
 		return err
 	}
 
-	// Unmarshal the JSON data
-	if err := json.Unmarshal(data, &conf); err != nil {
-		return err
+	// Unmarshal the YAML or JSON data
+	if isYAML(path) {
+		err = yaml.Unmarshal(data, conf)
+	} else {
+		err = json.Unmarshal(data, &conf)
+	}
+
+	if err != nil {
+		return fmt.Errorf("could not parse %s: %s", path, err)
 	}
 
 	// Save the loaded path
@@ -50,15 +153,24 @@ func (conf *Config) Load(path string) error {
 	return nil
 }
 
-// Dump a configuration to JSON to the path on disk. If dump is an empty
-// string then will dump the config to the path it was loaded from.
+// Dump a configuration as JSON or YAML (determined by the file extension)
+// to the path on disk. If dump is an empty string then will dump the config
+// to the path it was loaded from.
 func (conf *Config) Dump(path string) error {
+	var err error
+	var data []byte
+
 	if path == "" {
 		path = conf.Path
 	}
 
-	// Marshal the JSON configuration data
-	data, err := json.Marshal(conf)
+	// Marshal the YAML or JSON configuration data
+	if isYAML(path) {
+		data, err = yaml.Marshal(conf)
+	} else {
+		data, err = json.Marshal(conf)
+	}
+
 	if err != nil {
 		return err
 	}
@@ -66,3 +178,411 @@ func (conf *Config) Dump(path string) error {
 	// Write the data to disk
 	return ioutil.WriteFile(path, data, 0644)
 }
+
+// Environ overrides the configuration with MEMFS_* environment variables.
+// The variable names are composed from the configuration keys, with nested
+// sections separated by underscores, e.g. MEMFS_CACHESIZE, MEMFS_READONLY or
+// MEMFS_LOGGING_PATH. Lists are comma separated and maps are comma separated
+// key=value pairs. Lists of replicas cannot be set from the environment.
+func (conf *Config) Environ() error {
+	return environ(EnvPrefix, reflect.ValueOf(conf).Elem())
+}
+
+// Update the configuration with the non-zero values of other, for example
+// from command line flags. Lists and maps replace the current values.
+func (conf *Config) Update(other *Config) {
+	update(reflect.ValueOf(conf).Elem(), reflect.ValueOf(other).Elem())
+}
+
+// Validate the configuration, returning an error that describes every
+// problem that was found.
+func (conf *Config) Validate() error {
+	problems := make([]string, 0)
+	invalid := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	if conf.Level != "" {
+		if _, err := ParseLevel(conf.Level); err != nil {
+			invalid("level: %s", err)
+		}
+	}
+
+	if conf.CacheSize < MinCacheSize {
+		invalid("cachesize: %d bytes is less than the minimum of %d bytes", conf.CacheSize, MinCacheSize)
+	}
+
+	if format := Regularize(conf.Logging.Format); format != "" && format != "text" && format != "json" {
+		invalid("logging.format: %q is not text or json", conf.Logging.Format)
+	}
+
+	for name, level := range conf.Logging.Levels {
+		if _, err := ParseLevel(level); err != nil {
+			invalid("logging.levels.%s: %s", name, err)
+		}
+	}
+
+	validateStorage("", conf, invalid)
+
+	switch conf.Dedup.Chunking {
+	case "", ChunkFixed, ChunkContent:
+	default:
+		invalid("dedup.chunking: %q is not fixed or content", conf.Dedup.Chunking)
+	}
+
+	if conf.Dedup.BlockSize < 0 {
+		invalid("dedup.blocksize: %d is negative", conf.Dedup.BlockSize)
+	}
+
+	if conf.Compress.Level < flate.HuffmanOnly || conf.Compress.Level > flate.BestCompression {
+		invalid("compress.level: %d is not between %d and %d", conf.Compress.Level, flate.HuffmanOnly, flate.BestCompression)
+	}
+
+	if conf.XAttr.MaxValue > XattrSizeMax {
+		invalid("xattr.maxvalue: %d bytes exceeds the limit of %d bytes", conf.XAttr.MaxValue, XattrSizeMax)
+	}
+
+	if conf.Encryption.Key != "" {
+		if _, err := parseKey(conf.Encryption.Key); err != nil {
+			invalid("encryption.key: %s", err)
+		}
+	}
+
+	for i, key := range conf.Encryption.OldKeys {
+		if _, err := parseKey(key); err != nil {
+			invalid("encryption.oldkeys[%d]: %s", i, err)
+		}
+	}
+
+	if conf.Encryption.Enabled() && conf.Dedup.Enabled {
+		invalid("encryption: cannot be combined with deduplication")
+	}
+
+	for path := range conf.Quotas.Directories {
+		if !filepath.IsAbs(path) || filepath.Clean(path) != path {
+			invalid("quotas.directories: %q is not a clean absolute path", path)
+		}
+	}
+
+	if conf.TTL.Interval < 0 {
+		invalid("ttl.interval: %s is negative", conf.TTL.Interval)
+	}
+
+	for path, ttl := range conf.TTL.Directories {
+		if !filepath.IsAbs(path) || filepath.Clean(path) != path {
+			invalid("ttl.directories: %q is not a clean absolute path", path)
+		}
+
+		if ttl < 0 {
+			invalid("ttl.directories: %s of %q is negative", ttl, path)
+		}
+	}
+
+	for i, rule := range conf.Rules {
+		if rule == nil {
+			invalid("rules[%d]: rule is empty", i)
+			continue
+		}
+
+		if !strings.HasPrefix(rule.Path, "/") {
+			invalid("rules[%d]: %q is not an absolute path", i, rule.Path)
+		} else if _, err := filepath.Match(rule.Path, "/"); err != nil {
+			invalid("rules[%d]: %q is not a valid glob: %s", i, rule.Path, err)
+		}
+
+		if rule.TTL < 0 {
+			invalid("rules[%d]: ttl %s is negative", i, rule.TTL)
+		}
+
+		if rule.Retention < 0 {
+			invalid("rules[%d]: retention %s is negative", i, rule.Retention)
+		}
+	}
+
+	validateReplicas("replicas", conf.Replicas, invalid)
+
+	if conf.Budget > 0 && conf.Budget < MinCacheSize {
+		invalid("budget: %d bytes is less than the minimum of %d bytes", conf.Budget, MinCacheSize)
+	}
+
+	// Files and directories cannot be shared by the volumes.
+	if len(conf.Volumes) > 0 {
+		if !reflect.DeepEqual(conf.Audit, AuditConfig{}) {
+			invalid("audit: must be specified by each volume")
+		}
+
+		if conf.Spill != (SpillConfig{}) {
+			invalid("spill: must be specified by each volume")
+		}
+
+		if conf.Mirror != (MirrorConfig{}) {
+			invalid("mirror: must be specified by each volume")
+		}
+
+		if conf.Overlay != "" {
+			invalid("overlay: must be specified by each volume")
+		}
+
+		if conf.Preload != "" {
+			invalid("preload: must be specified by each volume")
+		}
+
+		if conf.InodeState != "" {
+			invalid("inodestate: must be specified by each volume")
+		}
+	}
+
+	names := make(map[string]bool, len(conf.Volumes))
+	mounts := make(map[string]bool, len(conf.Volumes))
+	paths := make(map[string]bool, len(conf.Volumes))
+	for i, vol := range conf.Volumes {
+		if vol == nil {
+			invalid("volumes[%d]: volume is empty", i)
+			continue
+		}
+
+		if vol.Name == "" || vol.Name == "." || vol.Name == ".." || strings.Contains(vol.Name, "/") {
+			invalid("volumes[%d]: %q is not a valid name", i, vol.Name)
+		} else if names[vol.Name] {
+			invalid("volumes[%d]: name %q is not unique", i, vol.Name)
+		}
+		names[vol.Name] = true
+
+		if vol.Mount == "" {
+			invalid("volumes[%d]: mount point is empty", i)
+		} else if mount := filepath.Clean(vol.Mount); mounts[mount] {
+			invalid("volumes[%d]: mount point %q is not unique", i, vol.Mount)
+		} else {
+			mounts[mount] = true
+		}
+
+		if vol.CacheSize > 0 && vol.CacheSize < MinCacheSize {
+			invalid("volumes[%d]: cachesize %d bytes is less than the minimum of %d bytes", i, vol.CacheSize, MinCacheSize)
+		}
+
+		validateReplicas(fmt.Sprintf("volumes[%d].replicas", i), vol.Replicas, invalid)
+		validateStorage(fmt.Sprintf("volumes[%d].", i), conf.volume(vol), invalid)
+
+		for _, path := range []string{vol.Audit.Path, vol.Spill.Path, vol.Mirror.Path, vol.InodeState} {
+			if path == "" {
+				continue
+			}
+
+			if path = filepath.Clean(path); paths[path] {
+				invalid("volumes[%d]: path %q is not unique", i, path)
+			}
+			paths[path] = true
+		}
+	}
+
+	if len(problems) > 0 {
+		return errors.New("invalid configuration: " + strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// validateStorage reports the audit trail, spill, mirror and overlay
+// settings of the configuration that are invalid, under the key prefix.
+func validateStorage(prefix string, conf *Config, invalid func(string, ...interface{})) {
+	for _, op := range conf.Audit.Ops {
+		if !ListContains(Regularize(op), MutationOps) {
+			invalid("%saudit.ops: %q is not one of %s", prefix, op, strings.Join(MutationOps, ", "))
+		}
+	}
+
+	if conf.Spill.Capacity > 0 && conf.Spill.Capacity < conf.CacheSize {
+		invalid("%sspill.capacity: %d bytes is less than the cache size of %d bytes", prefix, conf.Spill.Capacity, conf.CacheSize)
+	}
+
+	if conf.Overlay != "" && conf.Mirror.Path != "" {
+		invalid("%soverlay: cannot be combined with a mirror directory", prefix)
+	}
+
+	// The backing files of an encrypted file system are sealed streams, so
+	// the mirror must be explicitly configured to hold them.
+	if conf.Mirror.Path != "" && conf.Encryption.Enabled() && !conf.Mirror.Sealed {
+		invalid("%smirror.sealed: must be set to mirror an encrypted file system, whose files are mirrored as sealed streams rather than plaintext", prefix)
+	}
+
+	if conf.Mirror.Sealed && !conf.Encryption.Enabled() {
+		invalid("%smirror.sealed: requires encryption", prefix)
+	}
+}
+
+// validateReplicas reports replicas under the key that are empty or whose
+// precedence IDs or addresses are not unique.
+func validateReplicas(key string, replicas []*Replica, invalid func(string, ...interface{})) {
+	pids := make(map[uint]bool, len(replicas))
+	addrs := make(map[string]bool, len(replicas))
+	for i, replica := range replicas {
+		if replica == nil {
+			invalid("%s[%d]: replica is empty", key, i)
+			continue
+		}
+
+		if pids[replica.PID] {
+			invalid("%s[%d]: pid %d is not unique", key, i, replica.PID)
+		}
+		pids[replica.PID] = true
+
+		if replica.Port <= 0 || replica.Port > 65535 {
+			invalid("%s[%d]: port %d is not between 1 and 65535", key, i, replica.Port)
+		}
+
+		addr := replica.Addr()
+		if addrs[addr] {
+			invalid("%s[%d]: address %s is not unique", key, i, addr)
+		}
+		addrs[addr] = true
+	}
+}
+
+// Addr returns the host:port network address of the replica.
+func (r *Replica) Addr() string {
+	return net.JoinHostPort(r.Host, strconv.Itoa(r.Port))
+}
+
+//===========================================================================
+// Config Reflection Helpers
+//===========================================================================
+
+// setter is implemented by configuration types that parse themselves from
+// strings, such as Duration.
+type setter interface {
+	Set(string) error
+}
+
+// configKey returns the yaml key of the struct field or "" if it is ignored.
+func configKey(field reflect.StructField) string {
+	key := strings.Split(field.Tag.Get("yaml"), ",")[0]
+	if key == "-" || field.PkgPath != "" {
+		return ""
+	}
+
+	if key == "" {
+		key = strings.ToLower(field.Name)
+	}
+	return key
+}
+
+// environ recursively sets the fields of the struct value from environment
+// variables named by the prefix and the configuration keys.
+func environ(prefix string, val reflect.Value) error {
+	for i := 0; i < val.NumField(); i++ {
+		key := configKey(val.Type().Field(i))
+		if key == "" {
+			continue
+		}
+
+		name := prefix + "_" + strings.ToUpper(key)
+		field := val.Field(i)
+
+		if field.Kind() == reflect.Struct {
+			if err := environ(name, field); err != nil {
+				return err
+			}
+			continue
+		}
+
+		env, ok := os.LookupEnv(name)
+		if !ok {
+			continue
+		}
+
+		if err := setField(field, env); err != nil {
+			return fmt.Errorf("could not parse $%s: %s", name, err)
+		}
+	}
+
+	return nil
+}
+
+// setField parses the string into the configuration field.
+func setField(field reflect.Value, s string) error {
+	if field.CanAddr() {
+		if set, ok := field.Addr().Interface().(setter); ok {
+			return set.Set(s)
+		}
+	}
+
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(s)
+	case reflect.Bool:
+		val, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		field.SetBool(val)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		val, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return err
+		}
+		field.SetInt(val)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		val, err := strconv.ParseUint(s, 10, 64)
+		if err != nil {
+			return err
+		}
+		field.SetUint(val)
+	case reflect.Slice:
+		if field.Type().Elem().Kind() != reflect.String {
+			return fmt.Errorf("cannot set %s from the environment", field.Type())
+		}
+		items := reflect.MakeSlice(field.Type(), 0, 0)
+		for _, item := range strings.Split(s, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = reflect.Append(items, reflect.ValueOf(item).Convert(field.Type().Elem()))
+			}
+		}
+		field.Set(items)
+	case reflect.Map:
+		if field.Type().Key().Kind() != reflect.String || field.Type().Elem().Kind() != reflect.String {
+			return fmt.Errorf("cannot set %s from the environment", field.Type())
+		}
+		items := reflect.MakeMap(field.Type())
+		for _, item := range strings.Split(s, ",") {
+			parts := strings.SplitN(item, "=", 2)
+			if len(parts) != 2 {
+				return fmt.Errorf("%q is not a key=value pair", item)
+			}
+			items.SetMapIndex(reflect.ValueOf(strings.TrimSpace(parts[0])), reflect.ValueOf(strings.TrimSpace(parts[1])))
+		}
+		field.Set(items)
+	default:
+		return fmt.Errorf("cannot set %s from the environment", field.Type())
+	}
+
+	return nil
+}
+
+// update recursively sets the fields of dst to the non-zero fields of src.
+func update(dst, src reflect.Value) {
+	for i := 0; i < src.NumField(); i++ {
+		if configKey(src.Type().Field(i)) == "" {
+			continue
+		}
+
+		field := src.Field(i)
+		if field.Kind() == reflect.Struct {
+			update(dst.Field(i), field)
+			continue
+		}
+
+		if !isZero(field) {
+			dst.Field(i).Set(field)
+		}
+	}
+}
+
+// isZero returns true if the value is the zero value of its type or is an
+// empty list or map.
+func isZero(val reflect.Value) bool {
+	switch val.Kind() {
+	case reflect.Slice, reflect.Map:
+		return val.Len() == 0
+	default:
+		return reflect.DeepEqual(val.Interface(), reflect.Zero(val.Type()).Interface())
+	}
+}
@@ -2,7 +2,9 @@ package memfs_test
 
 import (
 	"io/ioutil"
+	"os"
 	"path/filepath"
+	"time"
 
 	. "github.com/bbengfort/memfs"
 
@@ -59,4 +61,138 @@ var _ = Describe("Config", func() {
 		Ω(bravo.Path).Should(Equal(path))
 	})
 
+	It("should be able to dump and load a YAML config", func() {
+		alpha := makeTestConfig()
+		alpha.Logging.Levels = map[string]string{"fuse": "debug"}
+		alpha.AttrValid = Duration(5 * time.Second)
+		path := filepath.Join(tmpDir, "test-config.yml")
+
+		err = alpha.Dump(path)
+		Ω(err).ShouldNot(HaveOccurred())
+
+		data, err := ioutil.ReadFile(path)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(string(data)).Should(ContainSubstring("attrvalid: 5s"))
+
+		bravo := new(Config)
+		err = bravo.Load(path)
+		Ω(err).ShouldNot(HaveOccurred())
+
+		Ω(bravo.Name).Should(Equal(alpha.Name))
+		Ω(bravo.CacheSize).Should(Equal(alpha.CacheSize))
+		Ω(bravo.Logging.Levels).Should(Equal(alpha.Logging.Levels))
+		Ω(bravo.AttrValid).Should(Equal(alpha.AttrValid))
+		Ω(bravo.Path).Should(Equal(path))
+	})
+
+	Describe("layering", func() {
+
+		var path string
+
+		BeforeEach(func() {
+			path = filepath.Join(tmpDir, "memfs.yaml")
+			data := []byte("name: filehost\ncachesize: 8000000\nlevel: warn\nlogging:\n  format: json\n")
+			Ω(ioutil.WriteFile(path, data, 0644)).Should(Succeed())
+		})
+
+		AfterEach(func() {
+			os.Unsetenv("MEMFS_CACHESIZE")
+			os.Unsetenv("MEMFS_LEVEL")
+			os.Unsetenv("MEMFS_LOGGING_LEVELS")
+			os.Unsetenv("MEMFS_AUDIT_OPS")
+			Ω(os.RemoveAll(tmpDir)).Should(Succeed())
+		})
+
+		It("should apply defaults when no file is specified", func() {
+			conf, err := LoadConfig("", nil)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(conf.Name).ShouldNot(BeZero())
+			Ω(conf.CacheSize).Should(Equal(DefaultCacheSize))
+			Ω(conf.Level).Should(Equal("info"))
+		})
+
+		It("should layer the file over the defaults", func() {
+			conf, err := LoadConfig(path, nil)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(conf.Name).Should(Equal("filehost"))
+			Ω(conf.CacheSize).Should(Equal(uint64(8000000)))
+			Ω(conf.Logging.Format).Should(Equal("json"))
+			Ω(conf.Path).Should(Equal(path))
+		})
+
+		It("should layer the environment over the file", func() {
+			os.Setenv("MEMFS_CACHESIZE", "16000000")
+			os.Setenv("MEMFS_LOGGING_LEVELS", "fuse=debug, http=error")
+			os.Setenv("MEMFS_AUDIT_OPS", "write,remove")
+
+			conf, err := LoadConfig(path, nil)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(conf.Name).Should(Equal("filehost"))
+			Ω(conf.CacheSize).Should(Equal(uint64(16000000)))
+			Ω(conf.Logging.Levels).Should(Equal(map[string]string{"fuse": "debug", "http": "error"}))
+			Ω(conf.Audit.Ops).Should(Equal([]string{"write", "remove"}))
+		})
+
+		It("should layer the flags over the environment", func() {
+			os.Setenv("MEMFS_LEVEL", "error")
+
+			conf, err := LoadConfig(path, &Config{Level: "debug", ReadOnly: true})
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(conf.Level).Should(Equal("debug"))
+			Ω(conf.ReadOnly).Should(BeTrue())
+			Ω(conf.Name).Should(Equal("filehost"))
+		})
+
+		It("should report unparseable environment variables", func() {
+			os.Setenv("MEMFS_CACHESIZE", "lots")
+			_, err := LoadConfig(path, nil)
+			Ω(err).Should(MatchError(ContainSubstring("$MEMFS_CACHESIZE")))
+		})
+
+	})
+
+	Describe("validation", func() {
+
+		It("should accept the default configuration", func() {
+			Ω(DefaultConfig().Validate()).Should(Succeed())
+		})
+
+		It("should describe every invalid value", func() {
+			conf := DefaultConfig()
+			conf.Level = "loud"
+			conf.CacheSize = 1024
+			conf.Logging.Format = "xml"
+			conf.Logging.Levels = map[string]string{"fuse": "chatty"}
+			conf.Audit.Ops = []string{"chmod"}
+
+			err := conf.Validate()
+			Ω(err).Should(HaveOccurred())
+			Ω(err.Error()).Should(ContainSubstring("level:"))
+			Ω(err.Error()).Should(ContainSubstring("cachesize:"))
+			Ω(err.Error()).Should(ContainSubstring("logging.format:"))
+			Ω(err.Error()).Should(ContainSubstring("logging.levels.fuse:"))
+			Ω(err.Error()).Should(ContainSubstring("audit.ops:"))
+		})
+
+		It("should only seal the mirror of an encrypted file system", func() {
+			conf := DefaultConfig()
+			conf.Mirror.Path = "/var/lib/memfs"
+			conf.Mirror.Sealed = true
+			Ω(conf.Validate()).Should(MatchError(ContainSubstring("mirror.sealed: requires encryption")))
+		})
+
+		It("should reject duplicate replicas", func() {
+			conf := DefaultConfig()
+			conf.Replicas = []*Replica{
+				{PID: 1, Name: "alpha", Host: "localhost", Port: 3264},
+				{PID: 1, Name: "bravo", Host: "localhost", Port: 3264},
+			}
+
+			err := conf.Validate()
+			Ω(err).Should(MatchError(ContainSubstring("pid 1 is not unique")))
+			Ω(err).Should(MatchError(ContainSubstring("address localhost:3264 is not unique")))
+		})
+
+	})
+
 })
@@ -0,0 +1,573 @@
+// Authenticated encryption of file data and extended attributes at rest.
+
+package memfs
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"bazil.org/fuse"
+)
+
+// Sealed data is split into chunks of plaintext that are encrypted
+// separately, each prefixed with the ID of its key and a random nonce and
+// followed by the authentication tag. A sealed stream is prefixed with a
+// magic string and the random ID that its chunks are sealed for.
+const (
+	sealChunk    = 64 * 1024
+	keyIDSize    = 4
+	nonceSize    = 12
+	sealOverhead = keyIDSize + nonceSize + 16
+	sealMagic    = "MEMFSEAL"
+)
+
+//===========================================================================
+// Keyring Type and Constructor
+//===========================================================================
+
+// EncryptConfig supplies the 256-bit AES key that file data, extended
+// attributes and spilled data are encrypted with, either directly or from a
+// key file, as 64 hex characters. Previous keys can be listed so that data
+// sealed with them can be read and rotated to the current key. Snapshots
+// share the sealed data and the audit log only records metadata. A mirror
+// directory receives the data as sealed streams and the extended attributes
+// sealed as they are in memory, so it can only be loaded with the keys that
+// it was written with.
+type EncryptConfig struct {
+	Key     string   `json:"key" yaml:"key"`         // Hex encoded key (or set $MEMFS_ENCRYPTION_KEY)
+	KeyFile string   `json:"keyfile" yaml:"keyfile"` // File containing the hex encoded key
+	OldKeys []string `json:"oldkeys" yaml:"oldkeys"` // Hex encoded keys that data may still be sealed with
+}
+
+// Enabled returns true if a key or key file is configured.
+func (conf *EncryptConfig) Enabled() bool {
+	return conf.Key != "" || conf.KeyFile != ""
+}
+
+// Keyring seals data with the current key and opens data sealed with the
+// current key or any of the previous keys.
+type Keyring struct {
+	current uint32                 // ID of the key that data is sealed with
+	keys    map[uint32]cipher.AEAD // Current and previous keys by ID
+}
+
+// NewKeyring creates a keyring from the configured keys, reading the key
+// file if a key is not supplied directly.
+func NewKeyring(conf *EncryptConfig) (*Keyring, error) {
+	key := conf.Key
+	if key == "" && conf.KeyFile != "" {
+		data, err := ioutil.ReadFile(conf.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		key = strings.TrimSpace(string(data))
+
+		if info, err := os.Stat(conf.KeyFile); err == nil && info.Mode().Perm()&0077 != 0 {
+			logger.Warn("key file %s is accessible by other users", conf.KeyFile)
+		}
+	}
+
+	k := &Keyring{keys: make(map[uint32]cipher.AEAD)}
+	for _, old := range conf.OldKeys {
+		if _, err := k.add(old); err != nil {
+			return nil, err
+		}
+	}
+
+	var err error
+	if k.current, err = k.add(key); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// add the hex encoded key to the keyring, returning its ID.
+func (k *Keyring) add(key string) (uint32, error) {
+	raw, err := parseKey(key)
+	if err != nil {
+		return 0, err
+	}
+
+	block, err := aes.NewCipher(raw)
+	if err != nil {
+		return 0, err
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return 0, err
+	}
+
+	sum := sha256.Sum256(raw)
+	id := binary.BigEndian.Uint32(sum[:keyIDSize])
+	k.keys[id] = aead
+	return id, nil
+}
+
+// parseKey decodes a hex encoded 256-bit key.
+func parseKey(key string) ([]byte, error) {
+	raw, err := hex.DecodeString(key)
+	if err != nil || len(raw) != 32 {
+		return nil, errors.New("key must be 64 hex characters")
+	}
+	return raw, nil
+}
+
+//===========================================================================
+// Keyring Methods
+//===========================================================================
+
+// Seal encrypts and authenticates the plaintext and the additional data with
+// the current key. The additional data is not included in the output and
+// must be supplied again to open it.
+func (k *Keyring) Seal(plain, ad []byte) []byte {
+	out := make([]byte, keyIDSize+nonceSize, keyIDSize+nonceSize+len(plain)+16)
+	binary.BigEndian.PutUint32(out, k.current)
+	if _, err := io.ReadFull(rand.Reader, out[keyIDSize:]); err != nil {
+		panic(fmt.Sprintf("could not read random nonce: %s", err))
+	}
+	return k.keys[k.current].Seal(out, out[keyIDSize:], plain, ad)
+}
+
+// Open authenticates and decrypts data sealed with any key in the keyring
+// and the same additional data.
+func (k *Keyring) Open(data, ad []byte) ([]byte, error) {
+	if len(data) < sealOverhead {
+		return nil, errors.New("sealed data is truncated")
+	}
+
+	aead, ok := k.keys[binary.BigEndian.Uint32(data)]
+	if !ok {
+		return nil, errors.New("data is sealed with an unknown key")
+	}
+
+	nonce := data[keyIDSize : keyIDSize+nonceSize]
+	return aead.Open(nil, nonce, data[keyIDSize+nonceSize:], ad)
+}
+
+// Current returns true if the data was sealed with the current key.
+func (k *Keyring) Current(data []byte) bool {
+	return len(data) >= keyIDSize && binary.BigEndian.Uint32(data) == k.current
+}
+
+// merge adds the keys of the previous keyring so that data sealed with them
+// can still be opened.
+func (k *Keyring) merge(prev *Keyring) {
+	for id, aead := range prev.keys {
+		if _, ok := k.keys[id]; !ok {
+			k.keys[id] = aead
+		}
+	}
+}
+
+// sealChunks seals the data in chunks of sealChunk bytes for the ID. Empty
+// data is sealed as a single empty chunk, so that there is always a final
+// chunk.
+func (k *Keyring) sealChunks(id sealID, data []byte) [][]byte {
+	chunks := make([][]byte, 0, len(data)/sealChunk+1)
+	for off := 0; off == 0 || off < len(data); off += sealChunk {
+		end := off + sealChunk
+		if end > len(data) {
+			end = len(data)
+		}
+		chunks = append(chunks, k.Seal(data[off:end], id.chunk(len(chunks), end == len(data))))
+	}
+	return chunks
+}
+
+// openChunks decrypts the concatenated chunks sealed for the ID.
+func (k *Keyring) openChunks(id sealID, data []byte) ([]byte, error) {
+	if len(data) == 0 {
+		return nil, errors.New("sealed data is truncated")
+	}
+
+	plain := make([]byte, 0, len(data))
+	for off, i := 0, 0; off < len(data); off, i = off+sealChunk+sealOverhead, i+1 {
+		end := off + sealChunk + sealOverhead
+		if end > len(data) {
+			end = len(data)
+		}
+
+		chunk, err := k.Open(data[off:end], id.chunk(i, end == len(data)))
+		if err != nil {
+			wipe(plain)
+			return nil, err
+		}
+		plain = append(plain, chunk...)
+		wipe(chunk)
+	}
+	return plain, nil
+}
+
+//===========================================================================
+// Additional Data
+//===========================================================================
+
+// sealID identifies the data that a chunk is sealed for. The ID is bound to
+// each chunk along with the index of the chunk and whether it is the final
+// chunk, so that chunks cannot be moved between files, reordered or dropped.
+type sealID [16]byte
+
+// nodeSealID returns the ID that the data of the node is sealed for, from
+// its inode number and generation.
+func nodeSealID(n *Node) sealID {
+	var id sealID
+	binary.BigEndian.PutUint64(id[:8], n.ID)
+	binary.BigEndian.PutUint64(id[8:], n.Gen)
+	return id
+}
+
+// chunk returns the additional data of the chunk at the index.
+func (id sealID) chunk(index int, final bool) []byte {
+	ad := make([]byte, len(id)+9)
+	copy(ad, id[:])
+	binary.BigEndian.PutUint64(ad[len(id):], uint64(index))
+	if final {
+		ad[len(ad)-1] = 1
+	}
+	return ad
+}
+
+// xattr returns the additional data of the value of the named extended
+// attribute, so that values cannot be moved between nodes or attributes.
+// Snapshots share values with nodes that have other inode numbers, so nodes
+// keep the ID that their values are sealed for.
+func (id sealID) xattr(name string) []byte {
+	ad := make([]byte, 0, len(id)+len("xattr:")+len(name))
+	ad = append(ad, id[:]...)
+	return append(ad, "xattr:"+name...)
+}
+
+//===========================================================================
+// File Sealing
+//===========================================================================
+
+// sealed holds the encrypted chunks of a file, which are shared with the
+// snapshots taken while the file was sealed.
+type sealed struct {
+	shared          // Snapshots sharing the chunks
+	id     sealID   // ID of the file the chunks are sealed for
+	chunks [][]byte // Sealed chunks of the data
+}
+
+// newSealed seals the data for the node.
+func newSealed(keys *Keyring, n *Node, data []byte) *sealed {
+	id := nodeSealID(n)
+	return &sealed{id: id, chunks: keys.sealChunks(id, data)}
+}
+
+// open decrypts the chunk at the index.
+func (s *sealed) open(keys *Keyring, i int) ([]byte, error) {
+	return keys.Open(s.chunks[i], s.id.chunk(i, i == len(s.chunks)-1))
+}
+
+// seal encrypts the data of a flushed file and wipes the plaintext from
+// memory. The data is decrypted chunk by chunk when it is read and is only
+// held in plaintext again while the file is being modified. Must be called
+// with the lock held.
+func (f *File) seal() {
+	if f.fs.keys == nil || f.IsArchive() || f.sealed != nil || f.cow != nil || len(f.Data) == 0 {
+		return
+	}
+
+	f.sealed = newSealed(f.fs.keys, &f.Node, f.Data)
+	f.sealed.live = true
+	wipe(f.Data)
+	f.Data = nil
+}
+
+// unseal decrypts the data of a sealed file back into memory so that it can
+// be modified. Must be called with the lock held.
+func (f *File) unseal() error {
+	buf := bytes.NewBuffer(make([]byte, 0, f.Attrs.Size))
+	if err := f.openSealed(buf); err != nil {
+		return err
+	}
+
+	f.Data = buf.Bytes()
+	f.dropSealed()
+	return nil
+}
+
+// dropSealed releases the sealed chunks of the file, which are then held
+// only by snapshots if any share them. Must be called with the lock held.
+func (f *File) dropSealed() {
+	if f.sealed == nil {
+		return
+	}
+
+	if f.sealed.refs > 0 {
+		f.fs.snapbytes += f.Attrs.Size
+	}
+
+	f.sealed.live = false
+	f.sealed = nil
+}
+
+// openSealed decrypts the data of a sealed file into w. Must be called with
+// the lock held.
+func (f *File) openSealed(w io.Writer) error {
+	for i := range f.sealed.chunks {
+		plain, err := f.sealed.open(f.fs.keys, i)
+		if err != nil {
+			logger.Error("could not decrypt data of file %d: %s", f.ID, err)
+			return fuse.EIO
+		}
+
+		_, err = w.Write(plain)
+		wipe(plain)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readSealed decrypts len(buf) bytes of a sealed file from the offset,
+// decrypting only the chunks that are read. Must be called with the lock
+// held.
+func (f *File) readSealed(buf []byte, off int64) error {
+	n := 0
+	for i := int(off / sealChunk); i < len(f.sealed.chunks) && n < len(buf); i++ {
+		plain, err := f.sealed.open(f.fs.keys, i)
+		if err != nil {
+			logger.Error("could not decrypt data of file %d: %s", f.ID, err)
+			return fuse.EIO
+		}
+
+		start := 0
+		if n == 0 {
+			start = int(off % sealChunk)
+		}
+
+		if start < len(plain) {
+			n += copy(buf[n:], plain[start:])
+		}
+		wipe(plain)
+	}
+	return nil
+}
+
+//===========================================================================
+// Key Rotation
+//===========================================================================
+
+// RotateKey re-encrypts the sealed data, extended attributes and spilled data
+// of the file system with the key of the configuration, keeping the previous
+// keys so that data that cannot be rotated can still be read. It returns the
+// number of nodes that were rotated.
+func (mfs *FileSystem) RotateKey(conf *EncryptConfig) (int, error) {
+	keys, err := NewKeyring(conf)
+	if err != nil {
+		return 0, err
+	}
+
+	mfs.Lock()
+	defer mfs.Unlock()
+	return mfs.rotate(keys)
+}
+
+// rotate replaces the keyring and re-seals all data that is not sealed with
+// its current key. Must be called with the lock held.
+func (mfs *FileSystem) rotate(keys *Keyring) (int, error) {
+	if mfs.keys == nil {
+		return 0, errors.New("encryption is not enabled")
+	}
+
+	keys.merge(mfs.keys)
+	mfs.keys = keys
+	if mfs.spill != nil {
+		mfs.spill.keys = keys
+	}
+
+	n := 0
+	var rerr error
+	mfs.Inodes.Each(func(ent Entity) {
+		rotated, err := mfs.rotateNode(ent)
+		if err != nil && rerr == nil {
+			rerr = err
+		}
+		if rotated {
+			n++
+		}
+	})
+
+	if rerr != nil {
+		return n, rerr
+	}
+
+	logger.Info("rotated the encryption key of %d nodes", n)
+	return n, nil
+}
+
+// rotateNode re-seals the extended attributes and data of the entity that
+// are not sealed with the current key. Chunks shared with snapshots are
+// replaced in place, so the snapshots are rotated as well. Must be called
+// with the lock held.
+func (mfs *FileSystem) rotateNode(ent Entity) (bool, error) {
+	rotated := false
+	node := ent.GetNode()
+	for name, value := range node.XAttrs {
+		if mfs.keys.Current(value) {
+			continue
+		}
+
+		plain, err := mfs.keys.Open(value, node.xattrID.xattr(name))
+		if err != nil {
+			return rotated, err
+		}
+		node.XAttrs[name] = mfs.keys.Seal(plain, node.xattrID.xattr(name))
+		rotated = true
+	}
+
+	f, ok := ent.(*File)
+	if !ok {
+		return rotated, nil
+	}
+
+	if f.sealed != nil {
+		for i, chunk := range f.sealed.chunks {
+			if mfs.keys.Current(chunk) {
+				continue
+			}
+
+			plain, err := f.sealed.open(mfs.keys, i)
+			if err != nil {
+				return rotated, err
+			}
+			f.sealed.chunks[i] = mfs.keys.Seal(plain, f.sealed.id.chunk(i, i == len(f.sealed.chunks)-1))
+			wipe(plain)
+			rotated = true
+		}
+	}
+
+	if f.spilled && f.lower == "" {
+		data, err := mfs.spill.Get(&f.Node, f.spillID)
+		if err != nil {
+			return rotated, err
+		}
+
+		err = mfs.spill.Put(&f.Node, f.spillID, data)
+		wipe(data)
+		if err != nil {
+			return rotated, err
+		}
+		rotated = true
+	}
+
+	return rotated, nil
+}
+
+//===========================================================================
+// Encrypted Extended Attributes
+//===========================================================================
+
+// getxattr returns the decrypted value of the extended attribute. Must be
+// called with the lock held.
+func (n *Node) getxattr(name string) ([]byte, bool) {
+	value, ok := n.XAttrs[name]
+	if !ok || n.fs.keys == nil {
+		return value, ok
+	}
+
+	plain, err := n.fs.keys.Open(value, n.xattrID.xattr(name))
+	if err != nil {
+		logger.Error("could not decrypt xattr %s of node %d: %s", name, n.ID, err)
+		return nil, false
+	}
+	return plain, true
+}
+
+// diskXattr returns the sealed value of the extended attribute as it is
+// written to disk: the ID that it is sealed for followed by the value, since
+// the node has another ID when it is loaded again. Must be called with the
+// lock held.
+func (n *Node) diskXattr(name string) []byte {
+	value := make([]byte, 0, len(n.xattrID)+len(n.XAttrs[name]))
+	value = append(value, n.xattrID[:]...)
+	return append(value, n.XAttrs[name]...)
+}
+
+// openDiskXattr decrypts the value of an extended attribute written to disk
+// by diskXattr.
+func (k *Keyring) openDiskXattr(name string, data []byte) ([]byte, error) {
+	var id sealID
+	if len(data) < len(id) {
+		return nil, errors.New("value is not a sealed extended attribute")
+	}
+
+	copy(id[:], data)
+	return k.Open(data[len(id):], id.xattr(name))
+}
+
+//===========================================================================
+// Sealed Streams
+//===========================================================================
+
+// sealStream writes the plaintext read from r to w as a sealed stream: the
+// magic string and a random ID followed by the chunks of the plaintext
+// sealed for the ID. A new ID is generated each time a stream is written.
+func (k *Keyring) sealStream(w io.Writer, r io.Reader) error {
+	var id sealID
+	if _, err := io.ReadFull(rand.Reader, id[:]); err != nil {
+		return err
+	}
+
+	if _, err := w.Write(append([]byte(sealMagic), id[:]...)); err != nil {
+		return err
+	}
+
+	// Read ahead by a chunk to know which chunk is the final one.
+	buf, next := make([]byte, sealChunk), make([]byte, sealChunk)
+	defer func() {
+		wipe(buf)
+		wipe(next)
+	}()
+
+	n, err := readChunk(r, buf)
+	for i := 0; err == nil; i++ {
+		m := 0
+		if n == sealChunk {
+			if m, err = readChunk(r, next); err != nil {
+				break
+			}
+		}
+
+		if _, err = w.Write(k.Seal(buf[:n], id.chunk(i, m == 0))); err != nil || m == 0 {
+			break
+		}
+		buf, next, n = next, buf, m
+	}
+	return err
+}
+
+// openStream decrypts a sealed stream written by sealStream.
+func (k *Keyring) openStream(data []byte) ([]byte, error) {
+	if len(data) < len(sealMagic)+len(sealID{}) || string(data[:len(sealMagic)]) != sealMagic {
+		return nil, errors.New("data is not a sealed stream")
+	}
+
+	var id sealID
+	copy(id[:], data[len(sealMagic):])
+	return k.openChunks(id, data[len(sealMagic)+len(id):])
+}
+
+// readChunk reads until buf is full or r is exhausted.
+func readChunk(r io.Reader, buf []byte) (int, error) {
+	n, err := io.ReadFull(r, buf)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = nil
+	}
+	return n, err
+}
@@ -0,0 +1,367 @@
+package memfs_test
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"bazil.org/fuse"
+
+	"golang.org/x/net/context"
+
+	. "github.com/bbengfort/memfs"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Encryption", func() {
+
+	const (
+		key    = "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f"
+		newKey = "f0e0d0c0b0a090807060504030201000f0e0d0c0b0a090807060504030201000"
+	)
+
+	var err error
+	var tmpDir string
+	var config *Config
+	var fs *FileSystem
+	var ctx context.Context
+	var data []byte
+
+	resolve := func(path string) *File {
+		ent, err := fs.Resolve(path)
+		Ω(err).ShouldNot(HaveOccurred())
+		return ent.(*File)
+	}
+
+	BeforeEach(func() {
+		tmpDir, err = ioutil.TempDir("", TempDirPrefix)
+		Ω(err).ShouldNot(HaveOccurred())
+
+		config = makeTestConfig()
+		config.Encryption.Key = key
+		ctx = context.TODO()
+
+		// Span several sealed chunks.
+		data = bytes.Repeat([]byte("attack at dawn\n"), 10000)
+	})
+
+	JustBeforeEach(func() {
+		fs = New(filepath.Join(tmpDir, "testmp"), config)
+	})
+
+	AfterEach(func() {
+		Ω(fs.Shutdown()).Should(Succeed())
+		Ω(os.RemoveAll(tmpDir)).Should(Succeed())
+	})
+
+	It("should not hold flushed data in plaintext", func() {
+		Ω(fs.WriteFile("/secret.txt", data, 0600)).Should(Succeed())
+		f := resolve("/secret.txt")
+		Ω(f.Data).Should(BeEmpty())
+
+		contents, err := fs.ReadFile("/secret.txt")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(contents).Should(Equal(data))
+
+		// Read across the boundary of the first chunk.
+		req := &fuse.ReadRequest{Offset: 65530, Size: 20}
+		resp := new(fuse.ReadResponse)
+		Ω(f.Read(ctx, req, resp)).Should(Succeed())
+		Ω(resp.Data).Should(Equal(data[65530:65550]))
+	})
+
+	It("should not wipe the data of a read response when the file is sealed", func() {
+		Ω(fs.WriteFile("/secret.txt", nil, 0600)).Should(Succeed())
+		f := resolve("/secret.txt")
+		Ω(f.Write(ctx, &fuse.WriteRequest{Data: data}, new(fuse.WriteResponse))).Should(Succeed())
+
+		resp := new(fuse.ReadResponse)
+		Ω(f.Read(ctx, &fuse.ReadRequest{Offset: 0, Size: 20}, resp)).Should(Succeed())
+		Ω(f.Flush(ctx, new(fuse.FlushRequest))).Should(Succeed())
+		Ω(f.Data).Should(BeEmpty())
+		Ω(resp.Data).Should(Equal(data[:20]))
+	})
+
+	It("should decrypt data to modify it", func() {
+		Ω(fs.WriteFile("/secret.txt", data, 0600)).Should(Succeed())
+		f := resolve("/secret.txt")
+
+		write := &fuse.WriteRequest{Offset: 0, Data: []byte("defend")}
+		Ω(f.Write(ctx, write, new(fuse.WriteResponse))).Should(Succeed())
+		Ω(f.Data[:14]).Should(Equal([]byte("defend at dawn")))
+
+		// Truncated data is zeroed before it is released.
+		tail := f.Data[15:30]
+		req := &fuse.SetattrRequest{Size: 15, Valid: fuse.SetattrSize}
+		Ω(f.Setattr(ctx, req, &fuse.SetattrResponse{})).Should(Succeed())
+		Ω(tail).Should(Equal(make([]byte, 15)))
+
+		Ω(f.Flush(ctx, new(fuse.FlushRequest))).Should(Succeed())
+		Ω(f.Data).Should(BeEmpty())
+
+		contents, err := fs.ReadFile("/secret.txt")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(contents).Should(Equal([]byte("defend at dawn\n")))
+	})
+
+	It("should encrypt extended attributes", func() {
+		Ω(fs.WriteFile("/secret.txt", data, 0600)).Should(Succeed())
+		f := resolve("/secret.txt")
+
+		set := &fuse.SetxattrRequest{Name: "user.owner", Xattr: []byte("alice")}
+		Ω(f.Setxattr(ctx, set)).Should(Succeed())
+		Ω(f.XAttrs["user.owner"]).ShouldNot(ContainSubstring("alice"))
+
+		resp := new(fuse.GetxattrResponse)
+		Ω(f.Getxattr(ctx, &fuse.GetxattrRequest{Name: "user.owner"}, resp)).Should(Succeed())
+		Ω(resp.Xattr).Should(Equal([]byte("alice")))
+	})
+
+	It("should bind extended attributes to their node", func() {
+		Ω(fs.WriteFile("/a.txt", data, 0600)).Should(Succeed())
+		Ω(fs.WriteFile("/b.txt", data, 0600)).Should(Succeed())
+		a, b := resolve("/a.txt"), resolve("/b.txt")
+		Ω(a.Setxattr(ctx, &fuse.SetxattrRequest{Name: "user.owner", Xattr: []byte("alice")})).Should(Succeed())
+		Ω(b.Setxattr(ctx, &fuse.SetxattrRequest{Name: "user.owner", Xattr: []byte("bob")})).Should(Succeed())
+
+		// Snapshots share the values sealed for the live node.
+		Ω(fs.CreateSnapshot("nightly")).Should(Succeed())
+		resp := new(fuse.GetxattrResponse)
+		Ω(resolve("/.snapshots/nightly/a.txt").Getxattr(ctx, &fuse.GetxattrRequest{Name: "user.owner"}, resp)).Should(Succeed())
+		Ω(resp.Xattr).Should(Equal([]byte("alice")))
+
+		a.XAttrs["user.owner"] = b.XAttrs["user.owner"]
+		Ω(a.Getxattr(ctx, &fuse.GetxattrRequest{Name: "user.owner"}, new(fuse.GetxattrResponse))).ShouldNot(Succeed())
+	})
+
+	It("should share sealed data with snapshots", func() {
+		Ω(fs.WriteFile("/secret.txt", data, 0600)).Should(Succeed())
+		Ω(fs.CreateSnapshot("nightly")).Should(Succeed())
+		Ω(fs.WriteFile("/secret.txt", []byte("retreat"), 0600)).Should(Succeed())
+
+		snap := resolve("/.snapshots/nightly/secret.txt")
+		Ω(snap.Data).Should(BeEmpty())
+
+		contents, err := fs.ReadFile("/.snapshots/nightly/secret.txt")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(contents).Should(Equal(data))
+
+		contents, err = fs.ReadFile("/secret.txt")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(contents).Should(Equal([]byte("retreat")))
+	})
+
+	Context("with a spill directory", func() {
+
+		var spillDir string
+
+		BeforeEach(func() {
+			spillDir = filepath.Join(tmpDir, "spill")
+			config.CacheSize = 100
+			config.MaxInodes = 100
+			config.Spill = SpillConfig{Path: spillDir}
+		})
+
+		It("should write spilled data in sealed chunks", func() {
+			Ω(fs.WriteFile("/a.txt", []byte(strings.Repeat("attack at dawn\n", 5)), 0600)).Should(Succeed())
+			Ω(fs.WriteFile("/b.txt", data, 0600)).Should(Succeed())
+
+			names, err := filepath.Glob(filepath.Join(spillDir, "*.spill"))
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(names).ShouldNot(BeEmpty())
+
+			for _, name := range names {
+				raw, err := ioutil.ReadFile(name)
+				Ω(err).ShouldNot(HaveOccurred())
+				Ω(raw).ShouldNot(ContainSubstring("attack"))
+			}
+
+			contents, err := fs.ReadFile("/b.txt")
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(contents).Should(Equal(data))
+
+			req := &fuse.ReadRequest{Offset: 65530, Size: 20}
+			resp := new(fuse.ReadResponse)
+			Ω(resolve("/b.txt").Read(ctx, req, resp)).Should(Succeed())
+			Ω(resp.Data).Should(Equal(data[65530:65550]))
+		})
+
+		It("should not open chunks that are reordered, dropped or moved", func() {
+			Ω(fs.WriteFile("/b.txt", data, 0600)).Should(Succeed())
+			Ω(fs.WriteFile("/c.txt", data, 0600)).Should(Succeed())
+
+			spillPath := func(f *File) string {
+				return filepath.Join(spillDir, fmt.Sprintf("%d-%d.spill", f.ID, f.Gen))
+			}
+
+			Ω(fs.WriteFile("/d.txt", []byte("attack at dawn\n"), 0600)).Should(Succeed())
+
+			b, c := resolve("/b.txt"), resolve("/c.txt")
+			Ω(spillPath(c)).Should(BeAnExistingFile())
+			raw, err := ioutil.ReadFile(spillPath(b))
+			Ω(err).ShouldNot(HaveOccurred())
+
+			// Each chunk of plaintext is sealed with 32 bytes of overhead.
+			size := 64*1024 + 32
+			Ω(len(raw)).Should(BeNumerically(">", 2*size))
+
+			swapped := append(append(append([]byte(nil), raw[size:2*size]...), raw[:size]...), raw[2*size:]...)
+			Ω(ioutil.WriteFile(spillPath(b), swapped, 0600)).Should(Succeed())
+			_, err = fs.ReadFile("/b.txt")
+			Ω(err).Should(HaveOccurred())
+
+			// Only complete chunks are kept so that the final chunk is dropped.
+			Ω(ioutil.WriteFile(spillPath(b), raw[:2*size], 0600)).Should(Succeed())
+			_, err = fs.ReadFile("/b.txt")
+			Ω(err).Should(HaveOccurred())
+
+			req := &fuse.ReadRequest{Offset: int64(2*64*1024 - 10), Size: 10}
+			Ω(b.Read(ctx, req, new(fuse.ReadResponse))).Should(MatchError(fuse.EIO))
+
+			Ω(ioutil.WriteFile(spillPath(c), raw, 0600)).Should(Succeed())
+			_, err = fs.ReadFile("/c.txt")
+			Ω(err).Should(HaveOccurred())
+		})
+
+		It("should share spilled data with snapshots", func() {
+			Ω(fs.WriteFile("/b.txt", data, 0600)).Should(Succeed())
+			Ω(fs.WriteFile("/a.txt", []byte("attack at dawn\n"), 0600)).Should(Succeed())
+			Ω(fs.CreateSnapshot("nightly")).Should(Succeed())
+			Ω(fs.WriteFile("/b.txt", []byte("retreat"), 0600)).Should(Succeed())
+
+			contents, err := fs.ReadFile("/.snapshots/nightly/b.txt")
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(contents).Should(Equal(data))
+
+			req := &fuse.ReadRequest{Offset: 65530, Size: 20}
+			resp := new(fuse.ReadResponse)
+			Ω(resolve("/.snapshots/nightly/b.txt").Read(ctx, req, resp)).Should(Succeed())
+			Ω(resp.Data).Should(Equal(data[65530:65550]))
+		})
+
+	})
+
+	Context("with a mirror directory", func() {
+
+		var backing string
+
+		BeforeEach(func() {
+			backing = filepath.Join(tmpDir, "backing")
+			Ω(os.MkdirAll(backing, 0755)).Should(Succeed())
+			config.Mirror.Path = backing
+			config.Mirror.Sealed = true
+		})
+
+		It("should only mirror to a sealed mirror", func() {
+			Ω(config.Validate()).ShouldNot(MatchError(ContainSubstring("mirror.sealed:")))
+
+			config.Mirror.Sealed = false
+			Ω(config.Validate()).Should(MatchError(ContainSubstring("mirror.sealed:")))
+
+			Ω(fs.Shutdown()).Should(Succeed())
+			fs = New(filepath.Join(tmpDir, "testmp"), config)
+			Ω(fs.WriteFile("/secret.txt", data, 0600)).Should(Succeed())
+			Ω(filepath.Join(backing, "secret.txt")).ShouldNot(BeAnExistingFile())
+		})
+
+		It("should write sealed copies that can be loaded again", func() {
+			Ω(fs.WriteFile("/secret.txt", data, 0600)).Should(Succeed())
+			Ω(fs.WriteFile("/empty.txt", nil, 0600)).Should(Succeed())
+			Ω(fs.WriteFile("/short.txt", []byte("attack at dawn\n"), 0600)).Should(Succeed())
+
+			f := resolve("/short.txt")
+			req := &fuse.SetattrRequest{Size: 6, Valid: fuse.SetattrSize}
+			Ω(f.Setattr(ctx, req, &fuse.SetattrResponse{})).Should(Succeed())
+			Ω(f.Setxattr(ctx, &fuse.SetxattrRequest{Name: "user.owner", Xattr: []byte("alice")})).Should(Succeed())
+
+			for _, name := range []string{"secret.txt", "empty.txt", "short.txt"} {
+				raw, err := ioutil.ReadFile(filepath.Join(backing, name))
+				Ω(err).ShouldNot(HaveOccurred())
+				Ω(raw).ShouldNot(ContainSubstring("attack"))
+				Ω(raw).ShouldNot(BeEmpty())
+			}
+
+			Ω(fs.Shutdown()).Should(Succeed())
+			fs = New(filepath.Join(tmpDir, "testmp"), config)
+
+			contents, err := fs.ReadFile("/secret.txt")
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(contents).Should(Equal(data))
+
+			contents, err = fs.ReadFile("/empty.txt")
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(contents).Should(BeEmpty())
+
+			contents, err = fs.ReadFile("/short.txt")
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(contents).Should(Equal([]byte("attack")))
+
+			resp := new(fuse.GetxattrResponse)
+			Ω(resolve("/short.txt").Getxattr(ctx, &fuse.GetxattrRequest{Name: "user.owner"}, resp)).Should(Succeed())
+			Ω(resp.Xattr).Should(Equal([]byte("alice")))
+		})
+
+		It("should not load a mirror written with another key", func() {
+			Ω(fs.WriteFile("/secret.txt", data, 0600)).Should(Succeed())
+			Ω(fs.Shutdown()).Should(Succeed())
+
+			config.Encryption.Key = newKey
+			fs = New(filepath.Join(tmpDir, "testmp"), config)
+			_, err := fs.Resolve("/secret.txt")
+			Ω(err).Should(HaveOccurred())
+		})
+
+	})
+
+	It("should rotate the key on reload", func() {
+		Ω(fs.WriteFile("/secret.txt", data, 0600)).Should(Succeed())
+		f := resolve("/secret.txt")
+		Ω(f.Setxattr(ctx, &fuse.SetxattrRequest{Name: "user.owner", Xattr: []byte("alice")})).Should(Succeed())
+		sealed := f.XAttrs["user.owner"]
+
+		next := *fs.Config
+		next.Level = ""
+		next.Encryption = EncryptConfig{Key: newKey}
+		remount, err := fs.Apply(&next)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(remount).Should(BeEmpty())
+		Ω(f.XAttrs["user.owner"]).ShouldNot(Equal(sealed))
+
+		contents, err := fs.ReadFile("/secret.txt")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(contents).Should(Equal(data))
+
+		// Rotating back re-seals the data with the previous key.
+		n, err := fs.RotateKey(&EncryptConfig{Key: key})
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(n).Should(Equal(1))
+	})
+
+	It("should not enable encryption while mounted", func() {
+		next := *fs.Config
+		next.Level = ""
+		next.Encryption = EncryptConfig{}
+		remount, err := fs.Apply(&next)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(remount).Should(ContainElement("encryption"))
+	})
+
+	It("should validate the keys", func() {
+		config.Encryption.Key = "not a key"
+		Ω(config.Validate()).Should(MatchError(ContainSubstring("encryption.key")))
+
+		config.Encryption.Key = key
+		config.Encryption.OldKeys = []string{key[:10]}
+		Ω(config.Validate()).Should(MatchError(ContainSubstring("encryption.oldkeys[0]")))
+
+		config.Encryption.OldKeys = nil
+		config.Dedup.Enabled = true
+		Ω(config.Validate()).Should(MatchError(ContainSubstring("deduplication")))
+	})
+
+})
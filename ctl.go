@@ -0,0 +1,295 @@
+// Virtual control files under a hidden directory of the mount point.
+
+package memfs
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"golang.org/x/net/context"
+)
+
+// ControlDir is the hidden directory of the root that the control files
+// appear in. The contents of the files are generated when they are read, so
+// scripts can inspect and manage the file system without the HTTP API. The
+// name is reserved, so no entry of the root can be created with it.
+const ControlDir = ".memfs"
+
+// The control files, the value that secrets in the configuration are
+// replaced with and the timeout used to check if replicas are reachable.
+const (
+	ctlStats    = "stats"
+	ctlConfig   = "config"
+	ctlReplicas = "replicas"
+	ctlLogLevel = "loglevel"
+	ctlSnapshot = "snapshot"
+
+	redacted       = "REDACTED"
+	replicaTimeout = 500 * time.Millisecond
+)
+
+//===========================================================================
+// Control Directory
+//===========================================================================
+
+// ctlDir is the read-only directory holding the control files.
+type ctlDir struct {
+	fs    *FileSystem         // The file system the files control
+	attrs fuse.Attr           // Attributes of the directory
+	files map[string]*ctlFile // Control files by name
+}
+
+// ctlFile is a synthetic file whose contents are generated by read when it
+// is opened and that applies the data written to it with write, if set.
+type ctlFile struct {
+	fs    *FileSystem            // The file system the file controls
+	attrs fuse.Attr              // Attributes of the file
+	read  func() ([]byte, error) // Generates the contents of the file
+	write func([]byte) error     // Applies data written to the file (nil if read-only)
+}
+
+// ctl returns the control directory, creating it on first access. Must be
+// called with the lock held.
+func (mfs *FileSystem) ctl() *ctlDir {
+	if mfs.ctlDir != nil {
+		return mfs.ctlDir
+	}
+
+	d := &ctlDir{fs: mfs, files: make(map[string]*ctlFile)}
+	d.attrs = mfs.ctlAttrs(os.ModeDir | 0555)
+
+	d.add(ctlStats, 0444, mfs.ctlReadStats, nil)
+	d.add(ctlConfig, 0444, mfs.ctlReadConfig, nil)
+	d.add(ctlReplicas, 0444, mfs.ctlReadReplicas, nil)
+	d.add(ctlLogLevel, 0644, mfs.ctlReadLogLevel, mfs.ctlWriteLogLevel)
+	d.add(ctlSnapshot, 0644, mfs.ctlReadSnapshots, mfs.ctlWriteSnapshot)
+
+	mfs.ctlDir = d
+	return d
+}
+
+// add a control file with the mode and read and write functions.
+func (d *ctlDir) add(name string, mode os.FileMode, read func() ([]byte, error), write func([]byte) error) {
+	d.files[name] = &ctlFile{fs: d.fs, attrs: d.fs.ctlAttrs(mode), read: read, write: write}
+}
+
+// ctlAttrs returns the attributes of a control node with a new inode number.
+// Must be called with the lock held.
+func (mfs *FileSystem) ctlAttrs(mode os.FileMode) fuse.Attr {
+	now := time.Now()
+	ino, _ := mfs.Inodes.Allocate()
+	return fuse.Attr{
+		Inode: ino, Mode: mode, Nlink: 1, Uid: mfs.uid, Gid: mfs.gid,
+		Atime: now, Mtime: now, Ctime: now, Crtime: now,
+	}
+}
+
+// Attr implements fs.Node.
+func (d *ctlDir) Attr(ctx context.Context, attr *fuse.Attr) error {
+	*attr = d.attrs
+	return nil
+}
+
+// Lookup returns the named control file.
+func (d *ctlDir) Lookup(ctx context.Context, name string) (fs.Node, error) {
+	if f, ok := d.files[name]; ok {
+		return f, nil
+	}
+	return nil, fuse.ENOENT
+}
+
+// ReadDirAll lists the control files.
+func (d *ctlDir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
+	dirents := make([]fuse.Dirent, 0, len(d.files))
+	for name, f := range d.files {
+		dirents = append(dirents, fuse.Dirent{Inode: f.attrs.Inode, Type: fuse.DT_File, Name: name})
+	}
+
+	sort.Slice(dirents, func(i, j int) bool {
+		return dirents[i].Name < dirents[j].Name
+	})
+	return dirents, nil
+}
+
+//===========================================================================
+// Control Files
+//===========================================================================
+
+// Attr implements fs.Node. The size of a control file is reported as zero
+// since its contents are only generated when it is read.
+func (f *ctlFile) Attr(ctx context.Context, attr *fuse.Attr) error {
+	*attr = f.attrs
+	return nil
+}
+
+// Open the control file in direct IO mode so that the kernel reads the
+// generated contents regardless of the reported size.
+func (f *ctlFile) Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.OpenResponse) (fs.Handle, error) {
+	if !req.Flags.IsReadOnly() && f.write == nil {
+		return nil, fuse.EPERM
+	}
+
+	resp.Flags |= fuse.OpenDirectIO
+	return f, nil
+}
+
+// ReadAll generates the contents of the control file, once per open.
+func (f *ctlFile) ReadAll(ctx context.Context) ([]byte, error) {
+	return f.read()
+}
+
+// Write applies the data to the file system. Only the user that mounted the
+// file system or root may write to control files.
+func (f *ctlFile) Write(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error {
+	if f.write == nil || (req.Header.Uid != 0 && req.Header.Uid != f.fs.uid) {
+		return fuse.EPERM
+	}
+
+	if err := f.write(req.Data); err != nil {
+		return err
+	}
+
+	resp.Size = len(req.Data)
+	return nil
+}
+
+// Setattr accepts the truncation of writable control files when they are
+// opened for writing by a shell redirect, but otherwise changes nothing.
+func (f *ctlFile) Setattr(ctx context.Context, req *fuse.SetattrRequest, resp *fuse.SetattrResponse) error {
+	if f.write == nil {
+		return fuse.EPERM
+	}
+
+	resp.Attr = f.attrs
+	return nil
+}
+
+//===========================================================================
+// Control File Contents
+//===========================================================================
+
+// ctlReadStats lists the usage of the file system, one "key value" per line.
+func (mfs *FileSystem) ctlReadStats() ([]byte, error) {
+	mfs.Lock()
+	defer mfs.Unlock()
+
+	buf := new(bytes.Buffer)
+	fmt.Fprintf(buf, "files %d\n", mfs.nfiles)
+	fmt.Fprintf(buf, "dirs %d\n", mfs.ndirs)
+	fmt.Fprintf(buf, "bytes %d\n", mfs.nbytes)
+	fmt.Fprintf(buf, "used %d\n", mfs.used())
+	fmt.Fprintf(buf, "capacity %d\n", mfs.capacity())
+	fmt.Fprintf(buf, "inodes %d\n", mfs.Inodes.Len())
+	fmt.Fprintf(buf, "maxinodes %d\n", mfs.maxInodes())
+	return buf.Bytes(), nil
+}
+
+// ctlReadConfig returns the current configuration as JSON, with the
+// encryption keys redacted.
+func (mfs *FileSystem) ctlReadConfig() ([]byte, error) {
+	mfs.Lock()
+	conf := *mfs.Config
+	mfs.Unlock()
+
+	if conf.Encryption.Key != "" {
+		conf.Encryption.Key = redacted
+	}
+
+	if len(conf.Encryption.OldKeys) > 0 {
+		conf.Encryption.OldKeys = []string{redacted}
+	}
+
+	data, err := json.MarshalIndent(&conf, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(data, '\n'), nil
+}
+
+// replicaStatus describes a replica and whether it is reachable.
+type replicaStatus struct {
+	Replica
+	Addr   string `json:"addr"`
+	Status string `json:"status"`
+}
+
+// ctlReadReplicas returns the replicas as JSON, with a status of up if a
+// connection to the replica could be opened or down otherwise.
+func (mfs *FileSystem) ctlReadReplicas() ([]byte, error) {
+	mfs.Lock()
+	replicas := make([]*replicaStatus, 0, len(mfs.Config.Replicas))
+	for _, replica := range mfs.Config.Replicas {
+		replicas = append(replicas, &replicaStatus{Replica: *replica, Addr: replica.Addr()})
+	}
+	mfs.Unlock()
+
+	// Check the replicas concurrently without holding the lock.
+	var wg sync.WaitGroup
+	for _, replica := range replicas {
+		wg.Add(1)
+		go func(r *replicaStatus) {
+			defer wg.Done()
+			r.Status = "down"
+			if conn, err := net.DialTimeout("tcp", r.Addr, replicaTimeout); err == nil {
+				conn.Close()
+				r.Status = "up"
+			}
+		}(replica)
+	}
+	wg.Wait()
+
+	data, err := json.MarshalIndent(replicas, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(data, '\n'), nil
+}
+
+// ctlReadLogLevel returns the minimum level that is logged.
+func (mfs *FileSystem) ctlReadLogLevel() ([]byte, error) {
+	return []byte(strings.ToLower(logger.level().String()) + "\n"), nil
+}
+
+// ctlWriteLogLevel changes the minimum level that is logged, applying it to
+// the configuration as a reload would.
+func (mfs *FileSystem) ctlWriteLogLevel(data []byte) error {
+	level := strings.TrimSpace(string(data))
+	if _, err := ParseLevel(level); err != nil {
+		return fuse.Errno(syscall.EINVAL)
+	}
+
+	mfs.Lock()
+	conf := *mfs.Config
+	mfs.Unlock()
+
+	conf.Level = level
+	if _, err := mfs.Apply(&conf); err != nil {
+		logger.Error("could not change log level: %s", err)
+		return fuse.EIO
+	}
+	return nil
+}
+
+// ctlReadSnapshots lists the names of the snapshots, one per line.
+func (mfs *FileSystem) ctlReadSnapshots() ([]byte, error) {
+	buf := new(bytes.Buffer)
+	for _, snapshot := range mfs.Snapshots() {
+		fmt.Fprintln(buf, snapshot.Name)
+	}
+	return buf.Bytes(), nil
+}
+
+// ctlWriteSnapshot creates a snapshot with the name written to the file.
+func (mfs *FileSystem) ctlWriteSnapshot(data []byte) error {
+	return mfs.CreateSnapshot(strings.TrimSpace(string(data)))
+}
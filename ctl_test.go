@@ -0,0 +1,156 @@
+package memfs_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+
+	"bazil.org/fuse"
+	fusefs "bazil.org/fuse/fs"
+
+	"golang.org/x/net/context"
+
+	. "github.com/bbengfort/memfs"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Control Files", func() {
+
+	var err error
+	var tmpDir string
+	var config *Config
+	var fs *FileSystem
+	var ctl fusefs.Node
+	var ctx context.Context
+
+	// lookup returns the named control file.
+	lookup := func(name string) fusefs.Node {
+		node, err := ctl.(fusefs.NodeStringLookuper).Lookup(ctx, name)
+		Ω(err).ShouldNot(HaveOccurred())
+		return node
+	}
+
+	// read returns the generated contents of the named control file.
+	read := func(name string) string {
+		data, err := lookup(name).(fusefs.HandleReadAller).ReadAll(ctx)
+		Ω(err).ShouldNot(HaveOccurred())
+		return string(data)
+	}
+
+	// write writes the data to the named control file as the user.
+	write := func(name, data string, uid uint32) error {
+		req := &fuse.WriteRequest{Header: fuse.Header{Uid: uid}, Data: []byte(data)}
+		return lookup(name).(fusefs.HandleWriter).Write(ctx, req, new(fuse.WriteResponse))
+	}
+
+	BeforeEach(func() {
+		tmpDir, err = ioutil.TempDir("", TempDirPrefix)
+		Ω(err).ShouldNot(HaveOccurred())
+
+		config = makeTestConfig()
+		config.Level = "info"
+		config.Encryption.Key = "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f"
+		ctx = context.TODO()
+	})
+
+	JustBeforeEach(func() {
+		fs = New(filepath.Join(tmpDir, "testmp"), config)
+		Ω(fs.WriteFile("/a.txt", []byte("hello"), 0644)).Should(Succeed())
+
+		node, err := fs.Root()
+		Ω(err).ShouldNot(HaveOccurred())
+
+		ctl, err = node.(*Dir).Lookup(ctx, &fuse.LookupRequest{Name: ControlDir}, &fuse.LookupResponse{})
+		Ω(err).ShouldNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		Ω(fs.Shutdown()).Should(Succeed())
+		Ω(os.RemoveAll(tmpDir)).Should(Succeed())
+	})
+
+	It("should list the control files", func() {
+		dirents, err := ctl.(fusefs.HandleReadDirAller).ReadDirAll(ctx)
+		Ω(err).ShouldNot(HaveOccurred())
+
+		names := make([]string, 0, len(dirents))
+		for _, dirent := range dirents {
+			names = append(names, dirent.Name)
+		}
+		Ω(names).Should(Equal([]string{"config", "loglevel", "replicas", "snapshot", "stats"}))
+
+		// The control directory is hidden from the root listing.
+		node, _ := fs.Root()
+		dirents, err = node.(*Dir).ReadDirAll(ctx)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(dirents).Should(HaveLen(1))
+	})
+
+	It("should report the usage of the file system", func() {
+		stats := read("stats")
+		Ω(stats).Should(ContainSubstring("files 1\n"))
+		Ω(stats).Should(ContainSubstring("dirs 0\n"))
+		Ω(stats).Should(ContainSubstring("bytes 5\n"))
+		Ω(stats).Should(ContainSubstring("capacity " + strconv.FormatUint(config.CacheSize, 10) + "\n"))
+	})
+
+	It("should report the configuration without secrets", func() {
+		conf := new(Config)
+		Ω(json.Unmarshal([]byte(read("config")), conf)).Should(Succeed())
+		Ω(conf.Name).Should(Equal("testhost"))
+		Ω(conf.Encryption.Key).Should(Equal("REDACTED"))
+	})
+
+	It("should report whether replicas are reachable", func() {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		Ω(err).ShouldNot(HaveOccurred())
+		defer ln.Close()
+		port := ln.Addr().(*net.TCPAddr).Port
+
+		next := *fs.Config
+		next.Replicas = []*Replica{
+			{PID: 1, Name: "up", Host: "127.0.0.1", Port: port},
+			{PID: 2, Name: "down", Host: "127.0.0.1", Port: 1},
+		}
+		_, err = fs.Apply(&next)
+		Ω(err).ShouldNot(HaveOccurred())
+
+		var replicas []map[string]interface{}
+		Ω(json.Unmarshal([]byte(read("replicas")), &replicas)).Should(Succeed())
+		Ω(replicas).Should(HaveLen(2))
+		Ω(replicas[0]["status"]).Should(Equal("up"))
+		Ω(replicas[1]["status"]).Should(Equal("down"))
+	})
+
+	It("should change the log level", func() {
+		Ω(read("loglevel")).Should(Equal("info\n"))
+		Ω(write("loglevel", "debug\n", 0)).Should(Succeed())
+		Ω(fs.Config.Level).Should(Equal("debug"))
+		Ω(read("loglevel")).Should(Equal("debug\n"))
+
+		Ω(write("loglevel", "loud\n", 0)).Should(MatchError(fuse.Errno(syscall.EINVAL)))
+		Ω(write("loglevel", "info\n", 4242)).Should(MatchError(fuse.EPERM))
+		Ω(write("loglevel", "info\n", 0)).Should(Succeed())
+	})
+
+	It("should create snapshots", func() {
+		Ω(write("snapshot", "nightly\n", 0)).Should(Succeed())
+		Ω(fs.Snapshots()).Should(HaveLen(1))
+		Ω(read("snapshot")).Should(Equal("nightly\n"))
+	})
+
+	It("should not write to read-only control files", func() {
+		Ω(write("stats", "files 0", 0)).Should(MatchError(fuse.EPERM))
+
+		req := &fuse.OpenRequest{Flags: fuse.OpenWriteOnly}
+		_, err := lookup("config").(fusefs.NodeOpener).Open(ctx, req, new(fuse.OpenResponse))
+		Ω(err).Should(MatchError(fuse.EPERM))
+	})
+
+})
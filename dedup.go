@@ -0,0 +1,280 @@
+// Content-addressed deduplication of file data in reference counted blocks.
+
+package memfs
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"io"
+	"net/http"
+)
+
+// Chunking strategies and the default block size of the block store.
+const (
+	ChunkFixed            = "fixed"
+	ChunkContent          = "content"
+	DefaultDedupBlockSize = 64 * 1024
+)
+
+// gear is the table of random values of the rolling hash used to find
+// content-defined chunk boundaries.
+var gear [256]uint64
+
+func init() {
+	// Fill the table deterministically (splitmix64) so that chunk boundaries
+	// are stable across runs.
+	seed := uint64(0x9e3779b97f4a7c15)
+	for i := range gear {
+		seed += 0x9e3779b97f4a7c15
+		z := seed
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		gear[i] = z ^ (z >> 31)
+	}
+}
+
+//===========================================================================
+// Block Store Type and Constructor
+//===========================================================================
+
+// DedupConfig enables the block store, which splits the data of flushed
+// files into blocks that are stored once no matter how many files contain
+// them.
+type DedupConfig struct {
+	Enabled   bool   `json:"enabled" yaml:"enabled"`     // Store the data of flushed files as deduplicated blocks
+	Chunking  string `json:"chunking" yaml:"chunking"`   // Split data into fixed or content-defined chunks
+	BlockSize int    `json:"blocksize" yaml:"blocksize"` // Size (or average size if content-defined) of blocks
+}
+
+// DedupStats reports the savings of the block store.
+type DedupStats struct {
+	Blocks   int    `json:"blocks"`   // Number of unique blocks stored
+	Logical  uint64 `json:"logical"`  // Bytes of file data referencing blocks
+	Physical uint64 `json:"physical"` // Bytes of unique blocks
+	Savings  uint64 `json:"savings"`  // Bytes saved by deduplication
+}
+
+// BlockStore holds reference counted blocks of file data keyed by their
+// SHA-256 hash. It is protected by the lock of the file system.
+type BlockStore struct {
+	blocks   map[[sha256.Size]byte]*block // Stored blocks by hash
+	content  bool                         // If chunks are content-defined
+	size     int                          // Size of fixed chunks
+	min, max int                          // Bounds of content-defined chunks
+	mask     uint64                       // Rolling hash mask of a chunk boundary
+	logical  uint64                       // Bytes referenced by files
+	physical uint64                       // Bytes stored
+}
+
+// block is an immutable chunk of data shared by one or more files.
+type block struct {
+	sum  [sha256.Size]byte // Hash of the data
+	data []byte            // Contents of the block
+	refs int               // Number of references from files
+}
+
+// NewBlockStore creates an empty block store with the configured chunking.
+func NewBlockStore(conf *DedupConfig) *BlockStore {
+	s := &BlockStore{
+		blocks:  make(map[[sha256.Size]byte]*block),
+		content: conf.Chunking == ChunkContent,
+		size:    conf.BlockSize,
+	}
+
+	if s.size <= 0 {
+		s.size = DefaultDedupBlockSize
+	}
+
+	// Boundaries are found with probability 1/2^bits past the minimum size,
+	// so the average chunk is close to the block size.
+	bits := uint(0)
+	for 1<<(bits+1) <= s.size {
+		bits++
+	}
+
+	s.min, s.max = s.size/4, s.size*4
+	s.mask = 1<<bits - 1
+	return s
+}
+
+//===========================================================================
+// Block Store Methods
+//===========================================================================
+
+// Put splits the data into chunks, storing the chunks that are not already
+// stored and referencing the ones that are.
+func (s *BlockStore) Put(data []byte) []*block {
+	blocks := make([]*block, 0, len(data)/s.size+1)
+	for len(data) > 0 {
+		n := s.cut(data)
+		chunk := data[:n]
+		data = data[n:]
+
+		sum := sha256.Sum256(chunk)
+		b, ok := s.blocks[sum]
+		if !ok {
+			b = &block{sum: sum, data: append([]byte(nil), chunk...)}
+			s.blocks[sum] = b
+			s.physical += uint64(n)
+		}
+
+		b.refs++
+		s.logical += uint64(n)
+		blocks = append(blocks, b)
+	}
+	return blocks
+}
+
+// Retain adds a reference to each of the blocks, returning a copy of the list.
+func (s *BlockStore) Retain(blocks []*block) []*block {
+	for _, b := range blocks {
+		b.refs++
+		s.logical += uint64(len(b.data))
+	}
+	return append([]*block(nil), blocks...)
+}
+
+// Release removes a reference to each of the blocks, deleting the blocks
+// that are no longer referenced.
+func (s *BlockStore) Release(blocks []*block) {
+	for _, b := range blocks {
+		b.refs--
+		s.logical -= uint64(len(b.data))
+		if b.refs == 0 {
+			delete(s.blocks, b.sum)
+			s.physical -= uint64(len(b.data))
+		}
+	}
+}
+
+// Savings returns the number of bytes saved by storing blocks once.
+func (s *BlockStore) Savings() uint64 {
+	return s.logical - s.physical
+}
+
+// cut returns the length of the next chunk of the data.
+func (s *BlockStore) cut(data []byte) int {
+	if !s.content {
+		if len(data) < s.size {
+			return len(data)
+		}
+		return s.size
+	}
+
+	if len(data) <= s.min {
+		return len(data)
+	}
+
+	limit := len(data)
+	if limit > s.max {
+		limit = s.max
+	}
+
+	var hash uint64
+	for i := s.min; i < limit; i++ {
+		hash = (hash << 1) + gear[data[i]]
+		if hash&s.mask == 0 {
+			return i + 1
+		}
+	}
+	return limit
+}
+
+//===========================================================================
+// File Deduplication
+//===========================================================================
+
+// dedup moves the data of a flushed file into the block store. The data is
+// read from the blocks until the file is next modified, when it is faulted
+// back into memory. Must be called with the lock held.
+func (f *File) dedup() {
+	if f.fs.blocks == nil || f.IsArchive() || f.spilled || f.blocks != nil || len(f.Data) == 0 {
+		return
+	}
+
+	f.blocks = f.fs.blocks.Put(f.Data)
+	f.scrubData()
+	f.unshare(false)
+	f.Data = nil
+}
+
+// inflate copies the data of a deduplicated file back into memory and
+// releases its blocks. Must be called with the lock held.
+func (f *File) inflate() {
+	f.Data = f.assemble()
+	f.release()
+}
+
+// release removes the references of the file to its blocks. Must be called
+// with the lock held.
+func (f *File) release() {
+	if f.blocks == nil {
+		return
+	}
+
+	f.fs.blocks.Release(f.blocks)
+	f.blocks = nil
+}
+
+// assemble returns a copy of the data of a deduplicated file. Must be called
+// with the lock held.
+func (f *File) assemble() []byte {
+	data := make([]byte, f.Attrs.Size)
+	f.readBlocks(data, 0)
+	return data
+}
+
+// readBlocks reads len(buf) bytes of a deduplicated file from the offset,
+// returning the number of bytes read. Must be called with the lock held.
+func (f *File) readBlocks(buf []byte, off int64) int {
+	n := 0
+	for _, b := range f.blocks {
+		size := int64(len(b.data))
+		if off >= size {
+			off -= size
+			continue
+		}
+
+		n += copy(buf[n:], b.data[off:])
+		off = 0
+		if n == len(buf) {
+			break
+		}
+	}
+	return n
+}
+
+// blockReader returns a reader of the data of a deduplicated file. Must be
+// called with the lock held.
+func (f *File) blockReader() io.Reader {
+	readers := make([]io.Reader, 0, len(f.blocks))
+	for _, b := range f.blocks {
+		readers = append(readers, bytes.NewReader(b.data))
+	}
+	return io.MultiReader(readers...)
+}
+
+// DedupStats returns the savings of the block store, or nil if deduplication
+// is not enabled.
+func (mfs *FileSystem) DedupStats() *DedupStats {
+	mfs.Lock()
+	defer mfs.Unlock()
+
+	if mfs.blocks == nil {
+		return nil
+	}
+
+	return &DedupStats{
+		Blocks:   len(mfs.blocks.blocks),
+		Logical:  mfs.blocks.logical,
+		Physical: mfs.blocks.physical,
+		Savings:  mfs.blocks.Savings(),
+	}
+}
+
+// serveDedup writes the savings of the block store as JSON.
+func (mfs *FileSystem) serveDedup(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(mfs.DedupStats())
+}
@@ -0,0 +1,128 @@
+package memfs_test
+
+import (
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+
+	"bazil.org/fuse"
+
+	"golang.org/x/net/context"
+
+	. "github.com/bbengfort/memfs"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Dedup", func() {
+
+	var err error
+	var tmpDir string
+	var config *Config
+	var fs *FileSystem
+	var ctx context.Context
+	var data []byte
+
+	BeforeEach(func() {
+		tmpDir, err = ioutil.TempDir("", TempDirPrefix)
+		Ω(err).ShouldNot(HaveOccurred())
+
+		config = makeTestConfig()
+		config.Dedup = DedupConfig{Enabled: true, BlockSize: 1024}
+		ctx = context.TODO()
+
+		data = make([]byte, 16*1024)
+		rand.New(rand.NewSource(42)).Read(data)
+	})
+
+	JustBeforeEach(func() {
+		fs = New(filepath.Join(tmpDir, "testmp"), config)
+	})
+
+	AfterEach(func() {
+		Ω(os.RemoveAll(tmpDir)).Should(Succeed())
+	})
+
+	It("should store identical files once", func() {
+		Ω(fs.WriteFile("/a.bin", data, 0644)).Should(Succeed())
+		Ω(fs.WriteFile("/b.bin", data, 0644)).Should(Succeed())
+
+		stats := fs.DedupStats()
+		Ω(stats.Blocks).Should(Equal(16))
+		Ω(stats.Logical).Should(Equal(uint64(2 * len(data))))
+		Ω(stats.Savings).Should(Equal(uint64(len(data))))
+
+		resp := new(fuse.StatfsResponse)
+		Ω(fs.Statfs(ctx, new(fuse.StatfsRequest), resp)).Should(Succeed())
+		Ω(resp.Blocks - resp.Bfree).Should(BeNumerically("<", 2*len(data)/512))
+
+		Ω(fs.Remove("/a.bin")).Should(Succeed())
+		Ω(fs.Remove("/b.bin")).Should(Succeed())
+		Ω(fs.DedupStats().Blocks).Should(BeZero())
+	})
+
+	It("should read deduplicated files without copying them into memory", func() {
+		Ω(fs.WriteFile("/a.bin", data, 0644)).Should(Succeed())
+		ent, err := fs.Resolve("/a.bin")
+		Ω(err).ShouldNot(HaveOccurred())
+		f := ent.(*File)
+
+		req := &fuse.ReadRequest{Offset: 1000, Size: 100}
+		resp := new(fuse.ReadResponse)
+		Ω(f.Read(ctx, req, resp)).Should(Succeed())
+		Ω(resp.Data).Should(Equal(data[1000:1100]))
+		Ω(f.Data).Should(BeEmpty())
+	})
+
+	It("should copy shared blocks before they are modified", func() {
+		Ω(fs.WriteFile("/a.bin", data, 0644)).Should(Succeed())
+		Ω(fs.WriteFile("/b.bin", data, 0644)).Should(Succeed())
+
+		ent, err := fs.Resolve("/b.bin")
+		Ω(err).ShouldNot(HaveOccurred())
+		f := ent.(*File)
+
+		req := &fuse.WriteRequest{Offset: 0, Data: []byte("modified")}
+		Ω(f.Write(ctx, req, new(fuse.WriteResponse))).Should(Succeed())
+		Ω(fs.DedupStats().Savings).Should(BeZero())
+
+		a, err := fs.ReadFile("/a.bin")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(a).Should(Equal(data))
+
+		Ω(f.Flush(ctx, new(fuse.FlushRequest))).Should(Succeed())
+		Ω(fs.DedupStats().Blocks).Should(Equal(17))
+		Ω(fs.DedupStats().Savings).Should(Equal(uint64(len(data) - 1024)))
+
+		b, err := fs.ReadFile("/b.bin")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(b[:8]).Should(Equal([]byte("modified")))
+		Ω(b[8:]).Should(Equal(data[8:]))
+	})
+
+	Context("with content-defined chunking", func() {
+
+		BeforeEach(func() {
+			config.Dedup.Chunking = ChunkContent
+		})
+
+		It("should share blocks of shifted data", func() {
+			Ω(fs.WriteFile("/a.bin", data, 0644)).Should(Succeed())
+			Ω(fs.WriteFile("/b.bin", append([]byte("shifted"), data...), 0644)).Should(Succeed())
+			Ω(fs.DedupStats().Savings).Should(BeNumerically(">", len(data)/2))
+
+			b, err := fs.ReadFile("/b.bin")
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(b[7:]).Should(Equal(data))
+		})
+
+	})
+
+	It("should validate the chunking", func() {
+		config.Dedup.Chunking = "rabin"
+		Ω(config.Validate()).ShouldNot(Succeed())
+	})
+
+})
@@ -4,6 +4,8 @@ package memfs
 
 import (
 	"os"
+	"path/filepath"
+	"syscall"
 	"time"
 
 	"bazil.org/fuse"
@@ -11,6 +13,10 @@ import (
 	"golang.org/x/net/context"
 )
 
+// ENOTEMPTY is returned when a directory that has entries is removed or
+// replaced.
+var ENOTEMPTY = fuse.Errno(syscall.ENOTEMPTY)
+
 //===========================================================================
 // Dir Type and Constructor
 //===========================================================================
@@ -19,7 +25,13 @@ import (
 // entities in the file system. Most importantly it references its children.
 type Dir struct {
 	Node
-	Children map[string]Entity // Contents of the directory
+	Children  map[string]Entity // Contents of the directory
+	usage     Usage             // Bytes and inodes beneath the directory
+	origin    string            // Lower directory entries are merged from (overlay mode)
+	merged    bool              // If the entries of the lower directory have been merged
+	whiteouts map[string]bool   // Names removed from the lower directory
+	source    *Dir              // Live directory a snapshot has yet to copy the entries of
+	views     []*Dir            // Snapshot directories that have yet to copy the entries
 }
 
 // Init the directory with the required properties for the directory.
@@ -30,6 +42,9 @@ func (d *Dir) Init(name string, mode os.FileMode, parent *Dir, memfs *FileSystem
 
 	// Make the children mapping
 	d.Children = make(map[string]Entity)
+
+	// Register the directory by its inode
+	memfs.Inodes.Register(d)
 }
 
 //===========================================================================
@@ -41,6 +56,190 @@ func (d *Dir) GetNode() *Node {
 	return &d.Node
 }
 
+// reserved returns true if the name is reserved for the hidden control or
+// snapshots directory of the root, so no entry can be created with it.
+func (d *Dir) reserved(name string) bool {
+	return d == d.fs.root && reservedName(name)
+}
+
+// reservedName returns true if the name is that of a hidden directory of the
+// root.
+func reservedName(name string) bool {
+	return name == ControlDir || name == SnapshotDir
+}
+
+// create a file in the directory owned by the specified user and group and
+// update the file system state. Must be called with the lock held.
+func (d *Dir) create(name string, mode os.FileMode, uid, gid uint32) *File {
+	// Update the directory Atime
+	d.Attrs.Atime = time.Now()
+
+	// Create the file
+	f := new(File)
+	f.Init(name, mode, d, d.fs)
+	f.Attrs.Uid = uid
+	f.Attrs.Gid = gid
+
+	// Add the file to the directory
+	d.Children[f.Name] = f
+
+	// Update the directory Mtime
+	d.Attrs.Mtime = time.Now()
+
+	// Update the file system state
+	d.fs.nfiles++
+	d.fs.charge(&f.Node, 0, 1)
+	return f
+}
+
+// mkdir creates a subdirectory owned by the specified user and group and
+// updates the file system state. Must be called with the lock held.
+func (d *Dir) mkdir(name string, mode os.FileMode, uid, gid uint32) *Dir {
+	// Update the directory Atime
+	d.Attrs.Atime = time.Now()
+
+	// Create the child directory
+	c := new(Dir)
+	c.Init(name, mode, d, d.fs)
+	c.Attrs.Uid = uid
+	c.Attrs.Gid = gid
+
+	// Add the directory to the directory
+	d.Children[c.Name] = c
+
+	// Update the directory Mtime
+	d.Attrs.Mtime = time.Now()
+
+	// Update the file system state
+	d.fs.ndirs++
+	d.fs.charge(&c.Node, 0, 1)
+	return c
+}
+
+// remove the named entry from the directory and update the file system
+// state. The Parent of the removed entry is left intact so that its former
+// path can still be reported. Must be called with the lock held.
+func (d *Dir) remove(name string) (Entity, error) {
+	if err := d.diverge(); err != nil {
+		return nil, err
+	}
+
+	// Update the directory Atime
+	d.Attrs.Atime = time.Now()
+
+	// Get the node from the directory by name.
+	ent, ok := d.Children[name]
+	if !ok {
+		logger.Debug("(error) could not find node to remove named %q in %q", name, d.Path())
+		return nil, fuse.EEXIST
+	}
+
+	// Do not remove a directory that contains files.
+	if err := checkEmpty(ent); err != nil {
+		logger.Debug("(error) will not remove non-empty directory %q in %q", name, d.Path())
+		return nil, err
+	}
+
+	// Delete the entry from the directory Children
+	delete(d.Children, name)
+	d.whiteout(name)
+
+	// Update the directory Mtime
+	d.Attrs.Mtime = time.Now()
+
+	// Update the file system state once the last name of the entry is removed
+	if f, ok := ent.(*File); !ok || f.unlinkName(d, name) {
+		d.fs.unlink(ent)
+	}
+	return ent, nil
+}
+
+// rename moves the named entry from the directory to the dst directory with
+// the new name. Must be called with the lock held.
+func (d *Dir) rename(oldName string, dst *Dir, newName string) (Entity, error) {
+	if err := d.diverge(); err != nil {
+		return nil, err
+	}
+
+	if err := dst.diverge(); err != nil {
+		return nil, err
+	}
+
+	// Update the directory Atimes
+	d.Attrs.Atime = time.Now()
+	dst.Attrs.Atime = time.Now()
+
+	// Get the child entity from the directory
+	ent, ok := d.Children[oldName]
+	if !ok {
+		logger.Debug("(error) could not find %q in %q to move", oldName, d.Path())
+		return nil, fuse.EEXIST
+	}
+
+	// Renaming a hard link of a file to another of its names does nothing.
+	prev, exists := dst.Children[newName]
+	if exists && prev == ent {
+		return ent, nil
+	}
+
+	// Replace the entry at the destination if it exists.
+	if exists {
+		if err := checkEmpty(prev); err != nil {
+			logger.Debug("(error) will not replace non-empty directory %q in %q", newName, dst.Path())
+			return nil, err
+		}
+
+		if f, ok := prev.(*File); !ok || f.unlinkName(dst, newName) {
+			d.fs.unlink(prev)
+		}
+	}
+
+	delete(d.Children, oldName) // Delete the entity from the old directory
+	d.whiteout(oldName)
+	d.Attrs.Mtime = time.Now()
+
+	// Get the node from the entity and update attrs. The usage of a file is
+	// charged to its Parent, so moving one of its hard links moves nothing.
+	node := ent.GetNode()
+	if f, ok := ent.(*File); !ok || !f.renameLink(d, oldName, dst, newName) {
+		// Move the usage of the entity to the new directory
+		if d != dst {
+			u := subtreeUsage(ent)
+			chargeTree(d, -int64(u.Bytes), -int64(u.Inodes))
+			chargeTree(dst, int64(u.Bytes), int64(u.Inodes))
+		}
+
+		node.Name = newName
+		node.Parent = dst
+	}
+	node.Attrs.Mtime = time.Now()
+
+	dst.Children[newName] = ent // Add the entity to the new directory
+	dst.Attrs.Mtime = time.Now()
+
+	return ent, nil
+}
+
+// checkEmpty returns ENOTEMPTY if the entity is a directory that has entries,
+// merging the entries of its lower directory first so that a directory that
+// has never been accessed is not mistaken for an empty one. Must be called
+// with the lock held.
+func checkEmpty(ent Entity) error {
+	d, ok := ent.(*Dir)
+	if !ok {
+		return nil
+	}
+
+	if err := d.populate(); err != nil {
+		return err
+	}
+
+	if len(d.Children) > 0 {
+		return ENOTEMPTY
+	}
+	return nil
+}
+
 //===========================================================================
 // Dir fuse.Node* Interface
 //===========================================================================
@@ -51,35 +250,52 @@ func (d *Dir) GetNode() *Node {
 //
 // https://godoc.org/bazil.org/fuse/fs#NodeCreater
 func (d *Dir) Create(ctx context.Context, req *fuse.CreateRequest, resp *fuse.CreateResponse) (fs.Node, fs.Handle, error) {
+	start := time.Now()
+	d.fs.Lock()
+	defer d.fs.Unlock()
+
 	if d.IsArchive() || d.fs.readonly {
 		return nil, nil, fuse.EPERM
 	}
 
-	d.fs.Lock()
-	defer d.fs.Unlock()
+	if err := d.populate(); err != nil {
+		return nil, nil, err
+	}
 
-	// Update the directory Atime
-	d.Attrs.Atime = time.Now()
+	if d.reserved(req.Name) {
+		logger.Debug("(error) cannot create reserved name %q in %q", req.Name, d.Path())
+		return nil, nil, fuse.EPERM
+	}
 
-	// Create the file
-	f := new(File)
-	f.Init(req.Name, req.Mode, d, d.fs)
+	if err := d.diverge(); err != nil {
+		return nil, nil, err
+	}
 
-	// Set the file's UID and GID to that of the caller
-	f.Attrs.Uid = req.Header.Uid
-	f.Attrs.Gid = req.Header.Gid
+	if err := d.fs.checkInodes(); err != nil {
+		return nil, nil, err
+	}
 
-	// Add the file to the directory
-	d.Children[f.Name] = f
+	if err := d.fs.checkRules(req.Header, filepath.Join(d.Path(), req.Name), nil); err != nil {
+		return nil, nil, err
+	}
 
-	// Update the directory Mtime
-	d.Attrs.Mtime = time.Now()
+	if err := d.fs.checkQuota(req.Header.Uid, d, 0, 1); err != nil {
+		return nil, nil, err
+	}
 
-	// Update the file system state
-	d.fs.nfiles++
+	// Create the file with the UID and GID of the caller
+	f := d.create(req.Name, req.Mode, req.Header.Uid, req.Header.Gid)
+	d.fs.record(newMutation(OpCreate, req.Header, &f.Node))
+
+	// Set the cache duration of the new entry
+	d.fs.entryValid(&resp.LookupResponse)
 
 	// Log the file creation and return the file, which is both node and handle.
-	logger.Info("create %q in %q, mode %v", f.Name, d.Path(), req.Mode)
+	if fuseLog.Enabled(LevelInfo) {
+		fuseLog.Event(LevelInfo, &LogFields{
+			Op: "create", Node: f.ID, Path: f.Path(), UID: req.Header.Uid, Latency: time.Since(start),
+		}, "create %q in %q, mode %v", f.Name, d.Path(), req.Mode)
+	}
 	return f, f, nil
 }
 
@@ -87,49 +303,118 @@ func (d *Dir) Create(ctx context.Context, req *fuse.CreateRequest, resp *fuse.Cr
 // existing Node. Receiver must be a directory.
 //
 // A LinkRequest is a request to create a hard link and contains the old node
-// ID and the NewName (a string), the old node is supplied to the server.
+// ID and the NewName (a string), the old node is supplied to the server. Only
+// files can be hard linked; the data and inode of the file are charged to the
+// directory of its first name.
 //
 // https://godoc.org/bazil.org/fuse/fs#NodeLinker
-// TODO: Implement
-// func (d *Dir) Link(ctx context.Context, req *fuse.LinkRequest, old Node) (fs.Node, error) {
-// 	return nil, nil
-// }
+func (d *Dir) Link(ctx context.Context, req *fuse.LinkRequest, old fs.Node) (fs.Node, error) {
+	start := time.Now()
+	d.fs.Lock()
+	defer d.fs.Unlock()
+
+	if d.IsArchive() || d.fs.readonly {
+		return nil, fuse.EPERM
+	}
+
+	f, ok := old.(*File)
+	if !ok || f.IsArchive() {
+		logger.Debug("(error) can only hard link files, not %q", old)
+		return nil, fuse.EPERM
+	}
+
+	if err := d.populate(); err != nil {
+		return nil, err
+	}
+
+	if d.reserved(req.NewName) {
+		logger.Debug("(error) cannot link reserved name %q in %q", req.NewName, d.Path())
+		return nil, fuse.EPERM
+	}
+
+	if _, ok := d.Children[req.NewName]; ok {
+		return nil, fuse.EEXIST
+	}
+
+	if err := f.checkProtected(false); err != nil {
+		return nil, err
+	}
+
+	path := filepath.Join(d.Path(), req.NewName)
+	if err := d.fs.checkRules(req.Header, path, nil); err != nil {
+		return nil, err
+	}
+
+	if err := d.diverge(); err != nil {
+		return nil, err
+	}
+
+	if err := f.Parent.diverge(); err != nil {
+		return nil, err
+	}
+
+	d.link(f, req.NewName)
+	m := newMutation(OpLink, req.Header, &f.Node)
+	m.NewPath = path
+	d.fs.record(m)
+
+	if fuseLog.Enabled(LevelInfo) {
+		fuseLog.Event(LevelInfo, &LogFields{
+			Op: "link", Node: f.ID, Path: path, UID: req.Header.Uid, Latency: time.Since(start),
+		}, "link %q in %q to %q", req.NewName, d.Path(), f.Path())
+	}
+	return f, nil
+}
 
 // Mkdir creates (but not opens) a directory in the given directory.
 //
 // https://godoc.org/bazil.org/fuse/fs#NodeMkdirer
 func (d *Dir) Mkdir(ctx context.Context, req *fuse.MkdirRequest) (fs.Node, error) {
+	start := time.Now()
+	d.fs.Lock()
+	defer d.fs.Unlock()
+
 	if d.IsArchive() || d.fs.readonly {
 		return nil, fuse.EPERM
 	}
 
-	d.fs.Lock()
-	defer d.fs.Unlock()
+	// TODO: Allow for the creation of archive directories
 
-	// Update the directory Atime
-	d.Attrs.Atime = time.Now()
+	if err := d.populate(); err != nil {
+		return nil, err
+	}
 
-	// TODO: Allow for the creation of archive directories
+	if d.reserved(req.Name) {
+		logger.Debug("(error) cannot create reserved name %q in %q", req.Name, d.Path())
+		return nil, fuse.EPERM
+	}
 
-	// Create the child directory
-	c := new(Dir)
-	c.Init(req.Name, req.Mode, d, d.fs)
+	if err := d.diverge(); err != nil {
+		return nil, err
+	}
 
-	// Set the directory's UID and GID to that of the caller
-	c.Attrs.Uid = req.Header.Uid
-	c.Attrs.Gid = req.Header.Gid
+	if err := d.fs.checkInodes(); err != nil {
+		return nil, err
+	}
 
-	// Add the directory to the directory
-	d.Children[c.Name] = c
+	if err := d.fs.checkRules(req.Header, filepath.Join(d.Path(), req.Name), nil); err != nil {
+		return nil, err
+	}
 
-	// Update the directory Mtime
-	d.Attrs.Mtime = time.Now()
+	if err := d.fs.checkQuota(req.Header.Uid, d, 0, 1); err != nil {
+		return nil, err
+	}
 
-	// Update the file system state
-	d.fs.ndirs++
+	// Create the child directory with the UID and GID of the caller
+	c := d.mkdir(req.Name, req.Mode, req.Header.Uid, req.Header.Gid)
+	d.fs.record(newMutation(OpMkdir, req.Header, &c.Node))
 
 	// Log the directory creation and return the dir node
-	logger.Info("mkdir %q in %q, mode %v", c.Name, d.Path(), req.Mode)
+	if fuseLog.Enabled(LevelInfo) {
+		fuseLog.Event(LevelInfo, &LogFields{
+			Op: "mkdir", Node: c.ID, Path: c.Path(), UID: req.Header.Uid, Latency: time.Since(start),
+		}, "mkdir %q in %q, mode %v", c.Name, d.Path(), req.Mode)
+	}
 	return c, nil
 }
 
@@ -147,46 +432,43 @@ func (d *Dir) Mkdir(ctx context.Context, req *fuse.MkdirRequest) (fs.Node, error
 //
 // https://godoc.org/bazil.org/fuse/fs#NodeRemover
 func (d *Dir) Remove(ctx context.Context, req *fuse.RemoveRequest) error {
-	if d.IsArchive() || d.fs.readonly {
-		return fuse.EPERM
-	}
-
+	start := time.Now()
 	d.fs.Lock()
 	defer d.fs.Unlock()
 
-	// Update the directory Atime
-	d.Attrs.Atime = time.Now()
-
-	var ent Entity
-	var ok bool
-
-	// Get the node from the directory by name.
-	if ent, ok = d.Children[req.Name]; !ok {
-		logger.Debug("(error) could not find node to remove named %q in %q", req.Name, d.Path())
-		return fuse.EEXIST
+	if d.IsArchive() || d.fs.readonly {
+		return fuse.EPERM
 	}
 
-	// Do not remove a directory that contains files.
-	if ent.IsDir() && len(ent.(*Dir).Children) > 0 {
-		logger.Debug("(error) will not remove non-empty directory %q in %q", req.Name, d.Path())
-		return fuse.EIO
+	if err := d.populate(); err != nil {
+		return err
 	}
 
-	// Delete the entry from the directory Children
-	delete(d.Children, req.Name)
-
-	// Update the directory Mtime
-	d.Attrs.Mtime = time.Now()
+	path := filepath.Join(d.Path(), req.Name)
+	if ent, ok := d.Children[req.Name]; ok {
+		if err := d.fs.checkRules(req.Header, path, ent); err != nil {
+			return err
+		}
+	}
 
-	// Update the file system state
-	if ent.IsDir() {
-		d.fs.ndirs--
-	} else {
-		d.fs.nfiles--
+	ent, err := d.remove(req.Name)
+	if err != nil {
+		return err
 	}
 
+	// The path of a file is that of another name if a hard link was removed.
+	node := ent.GetNode()
+	m := newMutation(OpRemove, req.Header, node)
+	m.Path = path
+	m.NewSize = 0
+	d.fs.record(m)
+
 	// Log the directory removal and return no error
-	logger.Info("removed %q from %q", req.Name, d.Path())
+	if fuseLog.Enabled(LevelInfo) {
+		fuseLog.Event(LevelInfo, &LogFields{
+			Op: "remove", Node: node.ID, Path: path, Size: node.Attrs.Size, UID: req.Header.Uid, Latency: time.Since(start),
+		}, "removed %q from %q", req.Name, d.Path())
+	}
 	return nil
 }
 
@@ -195,48 +477,61 @@ func (d *Dir) Remove(ctx context.Context, req *fuse.RemoveRequest) error {
 //
 // https://godoc.org/bazil.org/fuse/fs#NodeRenamer
 func (d *Dir) Rename(ctx context.Context, req *fuse.RenameRequest, newDir fs.Node) error {
-	if d.IsArchive() || d.fs.readonly {
-		return fuse.EPERM
-	}
-
+	start := time.Now()
 	d.fs.Lock()
 	defer d.fs.Unlock()
 
-	// Update the directory Atime
-	d.Attrs.Atime = time.Now()
-
-	var dst *Dir
-	var ok bool
-	var ent Entity
-	var node *Node
+	if d.IsArchive() || d.fs.readonly {
+		return fuse.EPERM
+	}
 
 	// Convert newDir to an actual Dir object
-	if dst, ok = newDir.(*Dir); !ok {
+	dst, ok := newDir.(*Dir)
+	if !ok {
 		logger.Debug("(error) could not convert %q to a directory", newDir)
 		return fuse.EEXIST
 	}
 
-	// Update the dst directory Atime
-	dst.Attrs.Atime = time.Now()
+	if err := d.populate(); err != nil {
+		return err
+	}
 
-	// Get the child entity from the directory
-	if ent, ok = d.Children[req.OldName]; !ok {
-		logger.Debug("(error) could not find %q in %q to move", req.OldName, d.Path())
-		return fuse.EEXIST
+	if err := dst.populate(); err != nil {
+		return err
 	}
 
-	// Get the node from the entity and update attrs.
-	node = ent.GetNode()
-	node.Name = req.NewName
-	node.Attrs.Mtime = time.Now()
+	if dst.reserved(req.NewName) {
+		logger.Debug("(error) cannot rename %q to reserved name %q", req.OldName, req.NewName)
+		return fuse.EPERM
+	}
 
-	dst.Children[req.NewName] = ent // Add the entity to the new directory
-	dst.Attrs.Mtime = time.Now()
+	if ent, ok := d.Children[req.OldName]; ok {
+		if err := d.fs.checkRuleMove(req.Header, ent, dst, req.NewName); err != nil {
+			return err
+		}
 
-	delete(dst.Children, req.OldName) // Delete the entity from the old directory
-	d.Attrs.Mtime = time.Now()
+		if err := d.fs.checkMove(ent, d, dst); err != nil {
+			return err
+		}
+	}
+
+	src := filepath.Join(d.Path(), req.OldName)
+	ent, err := d.rename(req.OldName, dst, req.NewName)
+	if err != nil {
+		return err
+	}
+
+	node := ent.GetNode()
+	m := newMutation(OpRename, req.Header, node)
+	m.Path = src
+	m.NewPath = filepath.Join(dst.Path(), req.NewName)
+	d.fs.record(m)
 
-	logger.Info("moved %q from %q to %q", req.OldName, d.Path(), ent.Path())
+	if fuseLog.Enabled(LevelInfo) {
+		fuseLog.Event(LevelInfo, &LogFields{
+			Op: "rename", Node: node.ID, Path: m.NewPath, Size: node.Attrs.Size, UID: req.Header.Uid, Latency: time.Since(start),
+		}, "moved %q from %q to %q", req.OldName, d.Path(), m.NewPath)
+	}
 	return nil
 }
 
@@ -247,10 +542,12 @@ func (d *Dir) Rename(ctx context.Context, req *fuse.RenameRequest, newDir fs.Nod
 //
 // Lookup need not to handle the names "." and "..".
 //
-// https://godoc.org/bazil.org/fuse/fs#NodeStringLookuper
-// NOTE: implemented NodeStringLookuper rather than NodeRequestLookuper
 // https://godoc.org/bazil.org/fuse/fs#NodeRequestLookuper
-func (d *Dir) Lookup(ctx context.Context, name string) (fs.Node, error) {
+// NOTE: implemented NodeRequestLookuper rather than NodeStringLookuper so
+// that the entry cache duration can be set on the response.
+// https://godoc.org/bazil.org/fuse/fs#NodeStringLookuper
+func (d *Dir) Lookup(ctx context.Context, req *fuse.LookupRequest, resp *fuse.LookupResponse) (fs.Node, error) {
+	name := req.Name
 
 	d.fs.Lock()
 	defer d.fs.Unlock()
@@ -258,11 +555,25 @@ func (d *Dir) Lookup(ctx context.Context, name string) (fs.Node, error) {
 	// Update the directory Atime
 	d.Attrs.Atime = time.Now()
 
-	if ent, ok := d.Children[name]; ok {
+	// Set the cache duration of the entry
+	d.fs.entryValid(resp)
+
+	if err := d.populate(); err != nil {
+		return nil, err
+	}
+
+	if d == d.fs.root && name == ControlDir {
+		return d.fs.ctl(), nil
+	}
+
+	if ent, ok := d.child(name); ok {
 		logger.Debug("lookup %s in %s", name, d.Path())
 
-		if ent.IsDir() {
-			return ent.(*Dir), nil
+		switch e := ent.(type) {
+		case *Dir:
+			return e, nil
+		case *Symlink:
+			return e, nil
 		}
 
 		return ent.(*File), nil
@@ -272,14 +583,64 @@ func (d *Dir) Lookup(ctx context.Context, name string) (fs.Node, error) {
 	return nil, fuse.ENOENT
 }
 
-// Symlink creates a new symbolic link in the receiver, which must be a directory.
-// TODO is the above true about directories?
+// Symlink creates a new symbolic link in the receiver, which must be a
+// directory. The target of the link is charged as its data.
 //
 // https://godoc.org/bazil.org/fuse/fs#NodeSymlinker
-// TODO: Implement
-// func (d *Dir) Symlink(ctx context.Context, req *fuse.SymlinkRequest) (Node, error) {
-//     return nil, fuse.EEXIST
-// }
+func (d *Dir) Symlink(ctx context.Context, req *fuse.SymlinkRequest) (fs.Node, error) {
+	start := time.Now()
+	d.fs.Lock()
+	defer d.fs.Unlock()
+
+	if d.IsArchive() || d.fs.readonly {
+		return nil, fuse.EPERM
+	}
+
+	if err := d.populate(); err != nil {
+		return nil, err
+	}
+
+	if d.reserved(req.NewName) {
+		logger.Debug("(error) cannot create reserved name %q in %q", req.NewName, d.Path())
+		return nil, fuse.EPERM
+	}
+
+	if _, ok := d.Children[req.NewName]; ok {
+		return nil, fuse.EEXIST
+	}
+
+	if err := d.diverge(); err != nil {
+		return nil, err
+	}
+
+	if err := d.fs.checkInodes(); err != nil {
+		return nil, err
+	}
+
+	size := uint64(len(req.Target))
+	if err := d.fs.checkRules(req.Header, filepath.Join(d.Path(), req.NewName), nil); err != nil {
+		return nil, err
+	}
+
+	if err := d.fs.checkQuota(req.Header.Uid, d, size, 1); err != nil {
+		return nil, err
+	}
+
+	if err := d.fs.checkSpace(size); err != nil {
+		return nil, err
+	}
+
+	// Create the link with the UID and GID of the caller
+	l := d.symlink(req.NewName, req.Target, req.Header.Uid, req.Header.Gid)
+	d.fs.record(newMutation(OpSymlink, req.Header, &l.Node))
+
+	if fuseLog.Enabled(LevelInfo) {
+		fuseLog.Event(LevelInfo, &LogFields{
+			Op: "symlink", Node: l.ID, Path: l.Path(), UID: req.Header.Uid, Latency: time.Since(start),
+		}, "symlink %q in %q to %q", l.Name, d.Path(), req.Target)
+	}
+	return l, nil
+}
 
 //===========================================================================
 // Dir fuse.Handle* Interface
@@ -290,21 +651,25 @@ func (d *Dir) Lookup(ctx context.Context, name string) (fs.Node, error) {
 //
 // https://godoc.org/bazil.org/fuse/fs#HandleReadDirAller
 func (d *Dir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
-	contents := make([]fuse.Dirent, 0, len(d.Children))
-
 	d.fs.Lock()
 	defer d.fs.Unlock()
 
 	// Set the access time
 	d.Attrs.Atime = time.Now()
 
-	// Create the Dirent response
-	for _, entity := range d.Children {
+	if err := d.populate(); err != nil {
+		return nil, err
+	}
+
+	// Create the Dirent response, named by the entries of the directory since
+	// the name of a hard linked file is only one of its names.
+	contents := make([]fuse.Dirent, 0, len(d.Children))
+	for name, entity := range d.Children {
 		node := entity.GetNode()
 		dirent := fuse.Dirent{
 			Inode: node.Attrs.Inode,
 			Type:  node.FuseType(),
-			Name:  node.Name,
+			Name:  name,
 		}
 
 		contents = append(contents, dirent)
@@ -0,0 +1,308 @@
+// Export of the file system tree as a tar stream.
+
+package memfs
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Compression formats of exported tar streams.
+const (
+	CompressNone = ""
+	CompressGzip = "gzip"
+)
+
+// Mode bits of the special permissions in tar headers.
+const (
+	tarSetuid = 04000
+	tarSetgid = 02000
+	tarSticky = 01000
+)
+
+//===========================================================================
+// Tar Export
+//===========================================================================
+
+// Export writes the contents of the file system to w as a tar stream,
+// compressed with the specified format. The tree is frozen as a snapshot
+// would be, so the stream is a consistent point-in-time copy of the tree,
+// but the lock is only held to read each directory and to open each file, so
+// mutations proceed while the stream is written. Entries are released as
+// soon as they are written. Modes, owners, times and extended attributes (as
+// PAX records) are preserved. Symbolic links are written as symlink entries
+// and every name of a hard linked file but the first as a link entry.
+func (mfs *FileSystem) Export(w io.Writer, compression string) error {
+	var zw io.WriteCloser
+	switch compression {
+	case CompressNone:
+	case CompressGzip:
+		zw = gzip.NewWriter(w)
+		w = zw
+	default:
+		return fmt.Errorf("unsupported compression %q", compression)
+	}
+
+	mfs.Lock()
+	ent, err := mfs.freeze(mfs.root, nil)
+	mfs.Unlock()
+
+	if ent != nil {
+		defer func() {
+			mfs.Lock()
+			mfs.thaw(ent)
+			mfs.Unlock()
+		}()
+	}
+
+	if err != nil {
+		return err
+	}
+
+	tw := tar.NewWriter(w)
+	nfiles, ndirs := 0, 0
+	links := make(map[*File]string)
+	err = mfs.exportDir(tw, ent.(*Dir), links, func(ent Entity) {
+		if ent.IsDir() {
+			ndirs++
+		} else {
+			nfiles++
+		}
+	})
+
+	if err != nil {
+		return err
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+
+	if zw != nil {
+		if err := zw.Close(); err != nil {
+			return err
+		}
+	}
+
+	logger.Info("exported %d files and %d directories", nfiles, ndirs)
+	return nil
+}
+
+// exportDir writes the entries of the frozen directory to the tar stream in
+// name order, recursing into subdirectories and calling fn for each entity
+// that is written. Each entry is released once it has been written. The
+// links map holds the name written for each hard linked file.
+func (mfs *FileSystem) exportDir(tw *tar.Writer, dir *Dir, links map[*File]string, fn func(Entity)) error {
+	mfs.Lock()
+	if err := dir.populate(); err != nil {
+		mfs.Unlock()
+		return err
+	}
+
+	names := make([]string, 0, len(dir.Children))
+	for name := range dir.Children {
+		names = append(names, name)
+	}
+	mfs.Unlock()
+	sort.Strings(names)
+
+	for _, name := range names {
+		ent := dir.Children[name]
+		if err := mfs.exportEntry(tw, ent, links); err != nil {
+			return err
+		}
+		fn(ent)
+
+		if child, ok := ent.(*Dir); ok {
+			if err := mfs.exportDir(tw, child, links, fn); err != nil {
+				return err
+			}
+		}
+
+		mfs.Lock()
+		delete(dir.Children, name)
+		mfs.thaw(ent)
+		mfs.Unlock()
+	}
+
+	return nil
+}
+
+// exportEntry writes the header and the data of the frozen entity to the tar
+// stream. Since the data of a frozen file is never modified, it is only
+// opened with the lock held and is read without it.
+func (mfs *FileSystem) exportEntry(tw *tar.Writer, ent Entity, links map[*File]string) error {
+	mfs.Lock()
+	hdr, data, err := mfs.exportHeader(ent, links)
+	mfs.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	if data == nil {
+		return tw.WriteHeader(hdr)
+	}
+	defer data.Close()
+
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+
+	_, err = io.CopyN(tw, data, hdr.Size)
+	return err
+}
+
+// exportHeader returns the tar header of the entity and, if it is a file that
+// has not been written under another name, a reader of its data. Must be
+// called with the lock held.
+func (mfs *FileSystem) exportHeader(ent Entity, links map[*File]string) (*tar.Header, io.ReadCloser, error) {
+	node := ent.GetNode()
+	hdr := &tar.Header{
+		Name:       strings.TrimPrefix(ent.Path(), "/"),
+		Mode:       tarMode(node.Attrs.Mode),
+		Uid:        int(node.Attrs.Uid),
+		Gid:        int(node.Attrs.Gid),
+		ModTime:    node.Attrs.Mtime,
+		AccessTime: node.Attrs.Atime,
+		Format:     tar.FormatPAX,
+	}
+
+	if len(node.XAttrs) > 0 {
+		hdr.PAXRecords = make(map[string]string, len(node.XAttrs))
+		for name := range node.XAttrs {
+			value, _ := node.getxattr(name)
+			hdr.PAXRecords[paxXattrPrefix+name] = string(value)
+		}
+	}
+
+	var f *File
+	switch e := ent.(type) {
+	case *Symlink:
+		hdr.Typeflag = tar.TypeSymlink
+		hdr.Linkname = e.Target
+		return hdr, nil, nil
+	case *File:
+		f = e
+	default:
+		hdr.Typeflag = tar.TypeDir
+		hdr.Name += "/"
+		return hdr, nil, nil
+	}
+
+	if f.origin != nil {
+		if name, ok := links[f.origin]; ok {
+			hdr.Typeflag = tar.TypeLink
+			hdr.Linkname = name
+			return hdr, nil, nil
+		}
+		links[f.origin] = hdr.Name
+	}
+
+	hdr.Typeflag = tar.TypeReg
+	hdr.Size = int64(f.Attrs.Size)
+	data, err := f.open()
+	if err != nil {
+		return nil, nil, err
+	}
+	return hdr, data, nil
+}
+
+// tarMode returns the permissions of the mode as the mode of a tar header,
+// including the setuid, setgid and sticky bits.
+func tarMode(mode os.FileMode) int64 {
+	bits := int64(mode.Perm())
+	if mode&os.ModeSetuid != 0 {
+		bits |= tarSetuid
+	}
+
+	if mode&os.ModeSetgid != 0 {
+		bits |= tarSetgid
+	}
+
+	if mode&os.ModeSticky != 0 {
+		bits |= tarSticky
+	}
+	return bits
+}
+
+// open returns a reader of the data of the file, reading it from disk if it
+// has been spilled or not yet copied up from the lower directory, or from its
+// blocks, compressed data or sealed chunks if it has been deduplicated,
+// compressed or encrypted, rather than faulting it into memory.
+// Must be called with the lock held.
+func (f *File) open() (io.ReadCloser, error) {
+	switch {
+	case f.lower != "":
+		return os.Open(f.lower)
+	case f.spilled && f.fs.spill.keys != nil:
+		data, err := f.fs.spill.Get(&f.Node, f.spillID)
+		if err != nil {
+			return nil, err
+		}
+		return ioutil.NopCloser(bytes.NewReader(data)), nil
+	case f.spilled:
+		return os.Open(f.fs.spill.path(&f.Node))
+	case f.blocks != nil:
+		return ioutil.NopCloser(f.blockReader()), nil
+	case f.packed != nil:
+		return ioutil.NopCloser(f.packedReader()), nil
+	case f.sealed != nil:
+		buf := bytes.NewBuffer(make([]byte, 0, f.Attrs.Size))
+		if err := f.openSealed(buf); err != nil {
+			return nil, err
+		}
+		return ioutil.NopCloser(buf), nil
+	default:
+		return ioutil.NopCloser(bytes.NewReader(f.Data)), nil
+	}
+}
+
+// serveExport writes a tar stream of the file system, compressed with the
+// format in the compression query parameter. The stream holds the plaintext
+// of every file whether or not encryption is enabled, so like the rest of the
+// control API it is only served to clients on the loopback interface.
+func (mfs *FileSystem) serveExport(w http.ResponseWriter, r *http.Request) {
+	compression := r.URL.Query().Get("compression")
+	switch compression {
+	case CompressNone:
+		w.Header().Set("Content-Type", "application/x-tar")
+	case CompressGzip:
+		w.Header().Set("Content-Type", "application/gzip")
+	default:
+		http.Error(w, fmt.Sprintf("unsupported compression %q", compression), http.StatusBadRequest)
+		return
+	}
+
+	// Once the stream has started the status can no longer be changed, so
+	// the connection is aborted to keep the client from taking a truncated
+	// stream for a complete one.
+	sw := &startedWriter{Writer: w}
+	if err := mfs.Export(sw, compression); err != nil {
+		logger.Subsystem("http").Error("could not export file system: %s", err)
+		if !sw.started {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// startedWriter records whether anything has been written to the writer.
+type startedWriter struct {
+	io.Writer
+	started bool
+}
+
+func (w *startedWriter) Write(p []byte) (int, error) {
+	w.started = true
+	return w.Writer.Write(p)
+}
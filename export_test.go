@@ -0,0 +1,271 @@
+package memfs_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+
+	. "github.com/bbengfort/memfs"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Export", func() {
+
+	var err error
+	var tmpDir string
+	var config *Config
+	var fs *FileSystem
+
+	BeforeEach(func() {
+		tmpDir, err = ioutil.TempDir("", TempDirPrefix)
+		Ω(err).ShouldNot(HaveOccurred())
+		config = makeTestConfig()
+	})
+
+	JustBeforeEach(func() {
+		fs = New(filepath.Join(tmpDir, "testmp"), config)
+		Ω(fs.Mkdir("/docs", 0750)).Should(Succeed())
+		Ω(fs.WriteFile("/docs/a.txt", []byte("exported"), 0640)).Should(Succeed())
+		Ω(fs.WriteFile("/b.txt", []byte("root"), 0644)).Should(Succeed())
+
+		ent, err := fs.Resolve("/docs/a.txt")
+		Ω(err).ShouldNot(HaveOccurred())
+		ent.GetNode().XAttrs["user.tag"] = []byte("exported")
+	})
+
+	AfterEach(func() {
+		Ω(os.RemoveAll(tmpDir)).Should(Succeed())
+	})
+
+	It("should write the tree as a tar stream", func() {
+		buf := new(bytes.Buffer)
+		Ω(fs.Export(buf, CompressNone)).Should(Succeed())
+
+		names := make([]string, 0)
+		archive := tar.NewReader(buf)
+		for {
+			hdr, err := archive.Next()
+			if err == io.EOF {
+				break
+			}
+			Ω(err).ShouldNot(HaveOccurred())
+			names = append(names, hdr.Name)
+
+			if hdr.Name == "docs/a.txt" {
+				Ω(hdr.Mode).Should(Equal(int64(0640)))
+				Ω(hdr.PAXRecords).Should(HaveKeyWithValue("SCHILY.xattr.user.tag", "exported"))
+
+				data, err := ioutil.ReadAll(archive)
+				Ω(err).ShouldNot(HaveOccurred())
+				Ω(data).Should(Equal([]byte("exported")))
+			}
+		}
+
+		Ω(names).Should(Equal([]string{"b.txt", "docs/", "docs/a.txt"}))
+	})
+
+	It("should round trip through a compressed archive", func() {
+		path := filepath.Join(tmpDir, "export.tar.gz")
+		fobj, err := os.Create(path)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(fs.Export(fobj, CompressGzip)).Should(Succeed())
+		Ω(fobj.Close()).Should(Succeed())
+
+		clone := New(filepath.Join(tmpDir, "clone"), makeTestConfig())
+		Ω(clone.Preload(path)).Should(Succeed())
+
+		data, err := clone.ReadFile("/docs/a.txt")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(data).Should(Equal([]byte("exported")))
+
+		ent, err := clone.Resolve("/docs/a.txt")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(ent.GetNode().XAttrs["user.tag"]).Should(Equal([]byte("exported")))
+	})
+
+	It("should preserve the setuid, setgid and sticky bits", func() {
+		ent, err := fs.Resolve("/docs/a.txt")
+		Ω(err).ShouldNot(HaveOccurred())
+		ent.GetNode().Attrs.Mode |= os.ModeSetuid | os.ModeSetgid
+
+		ent, err = fs.Resolve("/docs")
+		Ω(err).ShouldNot(HaveOccurred())
+		ent.GetNode().Attrs.Mode |= os.ModeSticky
+
+		path := filepath.Join(tmpDir, "export.tar")
+		fobj, err := os.Create(path)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(fs.Export(fobj, CompressNone)).Should(Succeed())
+		Ω(fobj.Close()).Should(Succeed())
+
+		fobj, err = os.Open(path)
+		Ω(err).ShouldNot(HaveOccurred())
+		defer fobj.Close()
+
+		modes := make(map[string]int64)
+		archive := tar.NewReader(fobj)
+		for {
+			hdr, err := archive.Next()
+			if err == io.EOF {
+				break
+			}
+			Ω(err).ShouldNot(HaveOccurred())
+			modes[hdr.Name] = hdr.Mode
+		}
+
+		Ω(modes).Should(HaveKeyWithValue("docs/", int64(01750)))
+		Ω(modes).Should(HaveKeyWithValue("docs/a.txt", int64(06640)))
+
+		clone := New(filepath.Join(tmpDir, "clone"), makeTestConfig())
+		Ω(clone.Preload(path)).Should(Succeed())
+
+		ent, err = clone.Resolve("/docs/a.txt")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(ent.GetNode().Attrs.Mode).Should(Equal(os.ModeSetuid | os.ModeSetgid | 0640))
+	})
+
+	It("should write symbolic and hard links as link entries", func() {
+		Ω(fs.Symlink("docs/a.txt", "/s.txt")).Should(Succeed())
+		Ω(fs.Link("/docs/a.txt", "/c.txt")).Should(Succeed())
+
+		buf := new(bytes.Buffer)
+		Ω(fs.Export(buf, CompressNone)).Should(Succeed())
+
+		headers := make(map[string]*tar.Header)
+		archive := tar.NewReader(buf)
+		for {
+			hdr, err := archive.Next()
+			if err == io.EOF {
+				break
+			}
+			Ω(err).ShouldNot(HaveOccurred())
+			headers[hdr.Name] = hdr
+		}
+
+		Ω(headers["s.txt"].Typeflag).Should(Equal(byte(tar.TypeSymlink)))
+		Ω(headers["s.txt"].Linkname).Should(Equal("docs/a.txt"))
+		Ω(headers["c.txt"].Typeflag).Should(Equal(byte(tar.TypeReg)))
+		Ω(headers["docs/a.txt"].Typeflag).Should(Equal(byte(tar.TypeLink)))
+		Ω(headers["docs/a.txt"].Linkname).Should(Equal("c.txt"))
+	})
+
+	It("should reject unsupported compression", func() {
+		Ω(fs.Export(ioutil.Discard, "xz")).ShouldNot(Succeed())
+
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/export?compression=xz", nil)
+		req.RemoteAddr = "127.0.0.1:4157"
+		fs.Handler().ServeHTTP(w, req)
+		Ω(w.Code).Should(Equal(400))
+	})
+
+	Context("with an inode limit", func() {
+
+		BeforeEach(func() {
+			config.MaxInodes = 4
+		})
+
+		It("should export a tree that uses every inode", func() {
+			Ω(fs.WriteFile("/c.txt", nil, 0644)).Should(MatchError(ENOSPC))
+			Ω(fs.Export(ioutil.Discard, CompressNone)).Should(Succeed())
+			Ω(fs.Inodes.Len()).Should(Equal(4))
+		})
+
+	})
+
+	Context("with an overlay", func() {
+
+		var lower string
+
+		BeforeEach(func() {
+			lower = filepath.Join(tmpDir, "lower")
+			Ω(os.MkdirAll(lower, 0755)).Should(Succeed())
+			Ω(ioutil.WriteFile(filepath.Join(lower, "z.txt"), []byte("lower"), 0644)).Should(Succeed())
+			config.Overlay = lower
+		})
+
+		It("should abort the stream if the export fails once it has started", func() {
+			// The lower file is read when it is written, after the rest of the tree.
+			_, err := fs.Resolve("/z.txt")
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(os.Remove(filepath.Join(lower, "z.txt"))).Should(Succeed())
+
+			srv := httptest.NewServer(fs.Handler())
+			defer srv.Close()
+
+			// The response may not have been sent when the stream is aborted.
+			resp, err := http.Get(srv.URL + "/export")
+			if err == nil {
+				defer resp.Body.Close()
+				_, err = ioutil.ReadAll(resp.Body)
+			}
+			Ω(err).Should(HaveOccurred())
+		})
+
+	})
+
+	It("should only export to clients on the loopback interface", func() {
+		w := httptest.NewRecorder()
+		fs.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/export", nil))
+		Ω(w.Code).Should(Equal(403))
+		Ω(w.Body.String()).ShouldNot(ContainSubstring("exported"))
+
+		w = httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/export", nil)
+		req.RemoteAddr = "[::1]:4157"
+		fs.Handler().ServeHTTP(w, req)
+		Ω(w.Code).Should(Equal(200))
+	})
+
+	It("should not block mutations while the stream is written", func() {
+		inodes := fs.Inodes.Len()
+		buf := new(bytes.Buffer)
+		w := &mutatingWriter{Writer: buf, mutate: func() {
+			Ω(fs.WriteFile("/docs/a.txt", []byte("modified"), 0640)).Should(Succeed())
+			Ω(fs.WriteFile("/c.txt", []byte("created"), 0644)).Should(Succeed())
+		}}
+		Ω(fs.Export(w, CompressNone)).Should(Succeed())
+		Ω(w.mutated).Should(BeTrue())
+		Ω(fs.Inodes.Len()).Should(Equal(inodes + 1))
+
+		files := make(map[string]string)
+		archive := tar.NewReader(buf)
+		for {
+			hdr, err := archive.Next()
+			if err == io.EOF {
+				break
+			}
+			Ω(err).ShouldNot(HaveOccurred())
+
+			data, err := ioutil.ReadAll(archive)
+			Ω(err).ShouldNot(HaveOccurred())
+			files[hdr.Name] = string(data)
+		}
+
+		Ω(files).Should(HaveKeyWithValue("docs/a.txt", "exported"))
+		Ω(files).ShouldNot(HaveKey("c.txt"))
+	})
+
+})
+
+// mutatingWriter calls mutate the first time it is written to.
+type mutatingWriter struct {
+	io.Writer
+	mutate  func()
+	mutated bool
+}
+
+func (w *mutatingWriter) Write(p []byte) (int, error) {
+	if !w.mutated {
+		w.mutated = true
+		w.mutate()
+	}
+	return w.Writer.Write(p)
+}
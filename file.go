@@ -3,6 +3,8 @@
 package memfs
 
 import (
+	"container/list"
+	"io"
 	"os"
 	"time"
 
@@ -19,8 +21,19 @@ import (
 // not chunked or broken up until transport.
 type File struct {
 	Node
-	Data  []byte // Actual data contained by the File
-	dirty bool   // If data has been written but not flushed
+	Data    []byte        // Actual data contained by the File
+	dirty   bool          // If data has been written but not flushed
+	spilled bool          // If data has been evicted to the spill directory
+	lower   string        // Path of the data in the lower directory until copied up
+	cow     *shared       // Snapshots and write backs sharing the data, which is copied before writes
+	blocks  []*block      // Deduplicated blocks holding the data since it was flushed
+	packed  []byte        // Compressed data of a file that has not been accessed
+	held    *shared       // Snapshots sharing the spilled or compressed data
+	sealed  *sealed       // Encrypted chunks of the data since it was flushed
+	spillID sealID        // ID the spilled data is sealed for if encryption is enabled
+	links   []link        // Hard links of the file other than its Parent and Name
+	origin  *File         // Live file a frozen file was copied from, which identifies hard links
+	lru     *list.Element // Position of the file in the resident files of the spill store
 }
 
 // Init the file and create the data array
@@ -30,6 +43,9 @@ func (f *File) Init(name string, mode os.FileMode, parent *Dir, memfs *FileSyste
 
 	// Make the data array
 	f.Data = make([]byte, 0, 0)
+
+	// Register the file by its inode
+	memfs.Inodes.Register(f)
 }
 
 //===========================================================================
@@ -41,6 +57,84 @@ func (f *File) GetNode() *Node {
 	return &f.Node
 }
 
+// write data into the file at the given offset, growing the file if needed,
+// and return the number of bytes written. Must be called with the lock held.
+func (f *File) write(off uint64, data []byte) uint64 {
+	f.unshare(true)
+
+	olen := uint64(len(f.Data)) // original data length
+	wlen := uint64(len(data))   // data write length
+	lim := off + wlen           // The final length of the data
+
+	// Ensure the original size is the same as the set size (debugging)
+	if olen != f.Attrs.Size {
+		msg := "bad size match: %d vs %d"
+		logger.Error(msg, olen, f.Attrs.Size)
+	}
+
+	// If the amount of data being written is greater than the amount of data
+	// currently being stored, allocate a new array with sufficient size and
+	// copy the original data to that buffer.
+	if lim > olen {
+		buf := make([]byte, lim)
+
+		var to uint64
+		if off < olen {
+			to = off
+		} else {
+			to = olen
+		}
+
+		copy(buf[0:to], f.Data[0:to])
+		f.scrub(f.Data)
+		f.Data = buf
+
+		// Update the size attributes of the file
+		f.Attrs.Size = lim
+		f.Attrs.Blocks = Blocks(f.Attrs.Size)
+
+		// Update the file system state
+		f.fs.nbytes += lim - olen
+		f.fs.charge(&f.Node, int64(lim-olen), 0)
+	}
+
+	// Copy the data from the request into our data buffer
+	copy(f.Data[off:lim], data)
+
+	// Mark the file as dirty
+	f.dirty = true
+	return wlen
+}
+
+// truncate the file to the specified size, extending it with zeros if the
+// size is larger than the current data. Must be called with the lock held.
+func (f *File) truncate(size uint64) {
+	f.unshare(true)
+
+	olen := uint64(len(f.Data))
+
+	if size > olen {
+		buf := make([]byte, size)
+		copy(buf, f.Data)
+		f.scrub(f.Data)
+		f.Data = buf
+		f.fs.nbytes += size - olen
+	} else {
+		f.scrub(f.Data[size:])
+		f.Data = f.Data[:size]
+		if f.fs.nbytes > olen-size {
+			f.fs.nbytes -= olen - size
+		} else {
+			f.fs.nbytes = 0
+		}
+	}
+
+	f.fs.charge(&f.Node, int64(size)-int64(olen), 0)
+
+	f.Attrs.Size = size
+	f.Attrs.Blocks = Blocks(f.Attrs.Size)
+}
+
 //===========================================================================
 // File fuse.Node* Interface
 //===========================================================================
@@ -56,24 +150,52 @@ func (f *File) GetNode() *Node {
 //
 // https://godoc.org/bazil.org/fuse/fs#NodeSetattrer
 func (f *File) Setattr(ctx context.Context, req *fuse.SetattrRequest, resp *fuse.SetattrResponse) error {
+	f.fs.Lock()
+	defer f.fs.Unlock()
+
 	if f.IsArchive() || f.fs.readonly {
 		return fuse.EPERM
 	}
 
-	// If size is set, this represents a truncation for a file (for a dir?)
+	if err := f.fs.checkRuleSetattr(f, req); err != nil {
+		return err
+	}
+
+	if err := f.fs.checkSetattr(&f.Node, req); err != nil {
+		return err
+	}
+
+	if err := f.Parent.diverge(); err != nil {
+		return err
+	}
+
 	if req.Valid.Size() {
-		f.fs.Lock() // Only lock if we're going to change the size.
+		if req.Size > f.Attrs.Size {
+			if err := f.fs.checkSpace(req.Size - f.Attrs.Size); err != nil {
+				return err
+			}
+		}
 
-		f.Attrs.Size = req.Size
-		f.Attrs.Blocks = Blocks(f.Attrs.Size)
-		f.Data = f.Data[:req.Size] // If size > len(f.Data) then panic!
-		logger.Debug("truncate size from %d to %d on file %d", f.Attrs.Size, req.Size, f.ID)
+		if err := f.fault(); err != nil {
+			return err
+		}
+	}
 
-		f.fs.Unlock() // Must unlock before Node.Setattr is called!
+	m := newMutation(OpSetattr, req.Header, &f.Node)
+
+	// If size is set, this represents a truncation for a file (for a dir?)
+	if req.Valid.Size() {
+		logger.Debug("truncate size from %d to %d on file %d", f.Attrs.Size, req.Size, f.ID)
+		f.truncate(req.Size)
 	}
 
-	// Now use the embedded Node's Setattr method.
-	return f.Node.Setattr(ctx, req, resp)
+	// Now use the embedded Node's setattr method.
+	f.Node.setattr(req, resp)
+
+	m.NewSize = f.Attrs.Size
+	m.NewMode = f.Attrs.Mode
+	f.fs.record(m)
+	return nil
 }
 
 // Fsync must be defined or edting with vim or emacs fails.
@@ -85,7 +207,7 @@ func (f *File) Fsync(ctx context.Context, req *fuse.FsyncRequest) error {
 	defer f.fs.Unlock()
 
 	logger.Debug("fsync on file %d", f.ID)
-	return nil
+	return f.flush(req.Header)
 }
 
 //===========================================================================
@@ -100,23 +222,59 @@ func (f *File) Fsync(ctx context.Context, req *fuse.FsyncRequest) error {
 //
 // https://godoc.org/bazil.org/fuse/fs#HandleFlusher
 func (f *File) Flush(ctx context.Context, req *fuse.FlushRequest) error {
-	logger.Info("flush file %d (dirty: %t, contains %d bytes with size %d)", f.ID, f.dirty, len(f.Data), f.Attrs.Size)
+	f.fs.Lock()
+	defer f.fs.Unlock()
+
+	if fuseLog.Enabled(LevelInfo) {
+		fuseLog.Event(LevelInfo, &LogFields{
+			Op: "flush", Node: f.ID, Path: f.Path(), Size: f.Attrs.Size, UID: req.Header.Uid,
+		}, "flush file %d (dirty: %t, contains %d bytes with size %d)", f.ID, f.dirty, len(f.Data), f.Attrs.Size)
+	}
+
+	// Closing a file that was only read, e.g. in a snapshot, flushes nothing.
+	if !f.dirty {
+		return nil
+	}
 
 	if f.IsArchive() || f.fs.readonly {
 		return fuse.EPERM
 	}
 
-	f.fs.Lock()
-	defer f.fs.Unlock()
+	return f.flush(req.Header)
+}
 
+// flush marks written data as durable, updating the file times and recording
+// the flush so that it can be propagated, e.g. to a mirror. It does nothing
+// if the file is not dirty. If the mirror cannot apply the flush, the file
+// remains dirty so that it is propagated by the next flush. Must be called
+// with the lock held.
+func (f *File) flush(hdr fuse.Header) error {
 	if !f.dirty {
 		return nil
 	}
 
+	if err := f.Parent.diverge(); err != nil {
+		return err
+	}
+
 	f.Attrs.Atime = time.Now()
 	f.Attrs.Mtime = f.Attrs.Atime
 	f.dirty = false
 
+	if err := f.fs.record(newMutation(OpFlush, hdr, &f.Node)); err != nil {
+		f.dirty = true
+		return err
+	}
+
+	// Files in an immutable zone are retained once flushed with data.
+	if f.retain() {
+		m := newMutation(OpSetxattr, hdr, &f.Node)
+		m.xattr = RetainXattr
+		f.fs.record(m)
+	}
+
+	f.dedup()
+	f.seal()
 	return nil
 }
 
@@ -153,6 +311,7 @@ func (f *File) Flush(ctx context.Context, req *fuse.FlushRequest) error {
 //
 // https://godoc.org/bazil.org/fuse/fs#HandleReader
 func (f *File) Read(ctx context.Context, req *fuse.ReadRequest, resp *fuse.ReadResponse) error {
+	start := time.Now()
 	f.fs.Lock()
 	defer f.fs.Unlock()
 
@@ -161,14 +320,63 @@ func (f *File) Read(ctx context.Context, req *fuse.ReadRequest, resp *fuse.ReadR
 	if to > f.Attrs.Size {
 		to = f.Attrs.Size
 	}
+	if to < uint64(req.Offset) {
+		to = uint64(req.Offset)
+	}
 
 	// Set the access time on the file.
 	f.Attrs.Atime = time.Now()
+	f.fs.touch(f)
+
+	// Read files in the lower directory, files that are too large to be
+	// resident, encrypted files and snapshots, which share the data of the
+	// live file, directly from disk or their blocks, sealed chunks or
+	// compressed data, otherwise fault the data back into memory.
+	if f.lower != "" {
+		resp.Data = make([]byte, to-uint64(req.Offset))
+		if _, err := f.readLower(resp.Data, req.Offset); err != nil && err != io.EOF {
+			logger.Error("could not read %q: %s", f.lower, err)
+			return fuse.EIO
+		}
+	} else if f.blocks != nil {
+		resp.Data = make([]byte, to-uint64(req.Offset))
+		f.readBlocks(resp.Data, req.Offset)
+	} else if f.sealed != nil {
+		resp.Data = make([]byte, to-uint64(req.Offset))
+		if err := f.readSealed(resp.Data, req.Offset); err != nil {
+			return err
+		}
+	} else if f.packed != nil && f.IsArchive() {
+		resp.Data = make([]byte, to-uint64(req.Offset))
+		if err := f.readPacked(resp.Data, req.Offset); err != nil {
+			return err
+		}
+	} else if f.spilled && (f.Attrs.Size > f.fs.Config.CacheSize || f.fs.keys != nil || f.IsArchive()) {
+		resp.Data = make([]byte, to-uint64(req.Offset))
+		if _, err := f.fs.spill.ReadAt(&f.Node, f.spillID, resp.Data, req.Offset); err != nil && err != io.EOF {
+			logger.Error("could not read spilled data of file %d: %s", f.ID, err)
+			return fuse.EIO
+		}
+	} else {
+		if err := f.fault(); err != nil {
+			return err
+		}
 
-	// Set the data on the response object.
-	resp.Data = f.Data[req.Offset:to]
+		// Set the data on the response object. The response is sent after
+		// the lock is released, so encrypted and secure file systems return
+		// a copy of the data, which is wiped in place when the file is
+		// sealed, compressed, deduplicated, reallocated or truncated.
+		resp.Data = f.Data[req.Offset:to]
+		if f.fs.secure() {
+			resp.Data = append([]byte(nil), resp.Data...)
+		}
+	}
 
-	logger.Debug("read %d bytes from offset %d in file %d", req.Size, req.Offset, f.ID)
+	if fuseLog.Enabled(LevelDebug) {
+		fuseLog.Event(LevelDebug, &LogFields{
+			Op: "read", Node: f.ID, Path: f.Path(), Size: uint64(len(resp.Data)), UID: req.Header.Uid, Latency: time.Since(start),
+		}, "read %d bytes from offset %d in file %d", req.Size, req.Offset, f.ID)
+	}
 	return nil
 }
 
@@ -194,57 +402,59 @@ func (f *File) Read(ctx context.Context, req *fuse.ReadRequest, resp *fuse.ReadR
 //
 // https://godoc.org/bazil.org/fuse/fs#HandleWriter
 func (f *File) Write(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error {
+	start := time.Now()
+	f.fs.Lock()
+	defer f.fs.Unlock()
+
 	if f.IsArchive() || f.fs.readonly {
 		return fuse.EPERM
 	}
 
-	f.fs.Lock()
-	defer f.fs.Unlock()
-
-	olen := uint64(len(f.Data))   // original data length
-	wlen := uint64(len(req.Data)) // data write length
-	off := uint64(req.Offset)     // offset of the write
-	lim := off + wlen             // The final length of the data
+	off := uint64(req.Offset) // offset of the write
+	if err := f.checkProtected(off >= f.Attrs.Size); err != nil {
+		return err
+	}
 
-	// Ensure the original size is the same as the set size (debugging)
-	if olen != f.Attrs.Size {
-		msg := "bad size match: %d vs %d"
-		logger.Error(msg, olen, f.Attrs.Size)
+	if err := f.fs.checkRules(req.Header, f.Path(), nil); err != nil {
+		return err
 	}
 
-	// If the amount of data being written is greater than the amount of data
-	// currently being stored, allocate a new array with sufficient size and
-	// copy the original data to that buffer.
-	if lim > olen {
-		buf := make([]byte, lim)
+	if err := f.fs.checkRuleSize(f.Path(), off+uint64(len(req.Data))); err != nil {
+		return err
+	}
 
-		var to uint64
-		if off < olen {
-			to = off
-		} else {
-			to = olen
-		}
+	if err := f.fs.checkWrite(f, off+uint64(len(req.Data))); err != nil {
+		return err
+	}
 
-		copy(buf[0:to], f.Data[0:to])
-		f.Data = buf
+	if err := f.Parent.diverge(); err != nil {
+		return err
+	}
 
-		// Update the size attributes of the file
-		f.Attrs.Size = lim
-		f.Attrs.Blocks = Blocks(f.Attrs.Size)
+	if lim := off + uint64(len(req.Data)); lim > f.Attrs.Size {
+		if err := f.fs.checkSpace(lim - f.Attrs.Size); err != nil {
+			return err
+		}
+	}
 
-		// Update the file system state
-		f.fs.nbytes += lim - olen
+	if err := f.fault(); err != nil {
+		return err
 	}
 
-	// Copy the data from the request into our data buffer
-	copy(f.Data[off:lim], req.Data[:])
+	m := newMutation(OpWrite, req.Header, &f.Node)
+	wlen := f.write(off, req.Data) // data write length
 
 	// Set the attributes on the response
 	resp.Size = int(wlen)
 
-	// Mark the file as dirty
-	f.dirty = true
+	m.NewSize = f.Attrs.Size
+	f.fs.record(m)
+	f.fs.reclaim(f)
 
-	logger.Debug("wrote %d bytes offset by %d to file %d", wlen, off, f.ID)
+	if fuseLog.Enabled(LevelDebug) {
+		fuseLog.Event(LevelDebug, &LogFields{
+			Op: "write", Node: f.ID, Path: f.Path(), Size: wlen, UID: req.Header.Uid, Latency: time.Since(start),
+		}, "wrote %d bytes offset by %d to file %d", wlen, off, f.ID)
+	}
 	return nil
 }
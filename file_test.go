@@ -98,6 +98,26 @@ var _ = Describe("Files", func() {
 			Ω(file.Data).Should(Equal(data[:1056]))
 		})
 
+		It("should extend data with zeros on setattr size", func() {
+			file := new(File)
+			file.Init("test.txt", 0644, root, fs)
+			data := []byte(randString(1056))
+			file.Data = data
+			file.Attrs.Size = 1056
+
+			ctx := context.TODO()
+			req := &fuse.SetattrRequest{Size: 4107, Valid: fuse.SetattrSize}
+			resp := &fuse.SetattrResponse{Attr: file.Attrs}
+
+			err := file.Setattr(ctx, req, resp)
+			Ω(err).ShouldNot(HaveOccurred())
+
+			Ω(file.Attrs.Size).Should(Equal(uint64(4107)))
+			Ω(file.Attrs.Blocks).Should(Equal(uint64(9)))
+			Ω(file.Data[:1056]).Should(Equal(data))
+			Ω(file.Data[1056:]).Should(Equal(make([]byte, 4107-1056)))
+		})
+
 		It("should return part of the data on read", func() {
 			file := new(File)
 			file.Init("test.txt", 0644, root, fs)
@@ -273,6 +293,24 @@ var _ = Describe("Files", func() {
 			Ω(file.Attrs.Size).Should(Equal(uint64(1852)))
 		})
 
+		It("should not allow Flush of written data once read only", func() {
+			file := new(File)
+			file.Init("test.txt", 0644, root, fs)
+
+			ctx := context.TODO()
+			req := &fuse.WriteRequest{Offset: 0, Data: []byte("unflushed")}
+			Ω(file.Write(ctx, req, new(fuse.WriteResponse))).Should(Succeed())
+
+			next := *config
+			next.Level = "info"
+			next.ReadOnly = true
+			_, err := fs.Apply(&next)
+			Ω(err).ShouldNot(HaveOccurred())
+
+			err = file.Flush(ctx, &fuse.FlushRequest{})
+			Ω(err).Should(Equal(fuse.EPERM))
+		})
+
 		It("should be able to update portions of data", func() {
 			file := new(File)
 			file.Init("test.txt", 0644, root, fs)
@@ -327,15 +365,13 @@ var _ = Describe("Files", func() {
 			Ω(err).Should(Equal(fuse.EPERM))
 		})
 
-		It("should not alow Flush", func() {
+		It("should allow Flush of a file that was not written", func() {
 			file := new(File)
 			file.Init("test.txt", 0644, root, fs)
 
 			ctx := context.TODO()
 			req := &fuse.FlushRequest{}
-			err := file.Flush(ctx, req)
-			Ω(err).Should(HaveOccurred())
-			Ω(err).Should(Equal(fuse.EPERM))
+			Ω(file.Flush(ctx, req)).Should(Succeed())
 		})
 
 		It("should not allow Write", func() {
@@ -0,0 +1,311 @@
+// Allocation and lookup of inode numbers.
+
+package memfs
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+//===========================================================================
+// Inode Table Type and Constructor
+//===========================================================================
+
+// InodeState is the serializable state of an InodeTable, which allows inode
+// numbers to be allocated consistently across restarts of the file system.
+type InodeState struct {
+	Next        uint64            `json:"next"`        // Next never allocated inode number
+	Free        []uint64          `json:"free"`        // Released inode numbers awaiting reuse
+	Generations map[uint64]uint64 `json:"generations"` // Generation of reused inode numbers
+	Paths       map[string]uint64 `json:"paths"`       // Inode numbers of the entries of the tree by path
+}
+
+// InodeTable allocates inode numbers to nodes and maps them back to the
+// entities for O(1) lookup by ID. Inode numbers of removed nodes are reused,
+// but every reuse increments the generation of the number so that the pair
+// (inode, generation) never refers to two different nodes, which allows file
+// handles (e.g. of an NFS re-export) to detect stale references.
+//
+// The state of the table, including the inode numbers of the entries of the
+// tree by path, can be saved and restored so that entries that are loaded
+// again (from a mirror, a preload or an overlay lower directory) keep their
+// inode numbers and generations across restarts. The nodes of snapshots are
+// not saved, since snapshots do not outlive the file system.
+type InodeTable struct {
+	sync.Mutex
+	next   uint64            // Next never allocated inode number
+	free   []uint64          // Released inode numbers awaiting reuse
+	gens   map[uint64]uint64 // Generation of reused inode numbers
+	nodes  map[uint64]Entity // Entities by inode number
+	claims map[string]uint64 // Restored inode numbers of paths that have yet to be loaded
+}
+
+// NewInodeTable creates an inode table that allocates inodes from 1.
+func NewInodeTable() *InodeTable {
+	return &InodeTable{
+		next:   1,
+		free:   make([]uint64, 0),
+		gens:   make(map[uint64]uint64),
+		nodes:  make(map[uint64]Entity),
+		claims: make(map[string]uint64),
+	}
+}
+
+//===========================================================================
+// Inode Table Methods
+//===========================================================================
+
+// Allocate returns an unused inode number and its generation, preferring
+// the least recently released inode number over a never allocated one.
+func (t *InodeTable) Allocate() (uint64, uint64) {
+	t.Lock()
+	defer t.Unlock()
+
+	if len(t.free) > 0 {
+		ino := t.free[0]
+		t.free = t.free[1:]
+		t.gens[ino]++
+		return ino, t.gens[ino]
+	}
+
+	ino := t.next
+	t.next++
+	return ino, 0
+}
+
+// Register associates the entity with its inode number.
+func (t *InodeTable) Register(ent Entity) {
+	t.Lock()
+	defer t.Unlock()
+	t.nodes[ent.GetNode().ID] = ent
+}
+
+// Release the inode number for reuse once its entity has been removed.
+func (t *InodeTable) Release(ino uint64) {
+	t.Lock()
+	defer t.Unlock()
+
+	if _, ok := t.nodes[ino]; !ok {
+		return
+	}
+
+	delete(t.nodes, ino)
+	t.free = append(t.free, ino)
+}
+
+// Get returns the entity with the specified inode number.
+func (t *InodeTable) Get(ino uint64) (Entity, bool) {
+	t.Lock()
+	defer t.Unlock()
+	ent, ok := t.nodes[ino]
+	return ent, ok
+}
+
+// Each calls the function with every registered entity. The function must
+// not call other methods of the table.
+func (t *InodeTable) Each(fn func(Entity)) {
+	t.Lock()
+	defer t.Unlock()
+
+	for _, ent := range t.nodes {
+		fn(ent)
+	}
+}
+
+// Len returns the number of inodes in use.
+func (t *InodeTable) Len() int {
+	t.Lock()
+	defer t.Unlock()
+	return len(t.nodes)
+}
+
+// Generation returns the current generation of the inode number.
+func (t *InodeTable) Generation(ino uint64) uint64 {
+	t.Lock()
+	defer t.Unlock()
+	return t.gens[ino]
+}
+
+// Claim returns the restored inode number and generation of the path so that
+// an entry that is loaded again keeps them. A path can only be claimed once
+// and only if its inode number is not in use.
+func (t *InodeTable) Claim(path string) (uint64, uint64, bool) {
+	t.Lock()
+	defer t.Unlock()
+
+	ino, ok := t.claims[path]
+	if !ok {
+		return 0, 0, false
+	}
+
+	delete(t.claims, path)
+	if _, ok := t.nodes[ino]; ok {
+		return 0, 0, false
+	}
+	return ino, t.gens[ino], true
+}
+
+// Settle releases the restored inode numbers of paths that have not been
+// loaded again, e.g. because they were removed while the file system was not
+// running, so that they are reused with a new generation.
+func (t *InodeTable) Settle() {
+	t.Lock()
+	defer t.Unlock()
+
+	released := make([]uint64, 0, len(t.claims))
+	for _, ino := range t.claims {
+		if _, ok := t.nodes[ino]; !ok {
+			released = append(released, ino)
+		}
+	}
+
+	sort.Slice(released, func(i, j int) bool { return released[i] < released[j] })
+	t.free = append(t.free, released...)
+	t.claims = make(map[string]uint64)
+}
+
+// State returns a copy of the allocation state of the table, including the
+// inode numbers of the entries of the live tree and of the restored paths
+// that have yet to be loaded. Must be called with the file system lock held,
+// since the paths of the entries are resolved through their parents.
+func (t *InodeTable) State() *InodeState {
+	t.Lock()
+	defer t.Unlock()
+
+	state := &InodeState{
+		Next:        t.next,
+		Free:        make([]uint64, len(t.free)),
+		Generations: make(map[uint64]uint64, len(t.gens)),
+		Paths:       make(map[string]uint64, len(t.nodes)+len(t.claims)),
+	}
+
+	copy(state.Free, t.free)
+	for ino, gen := range t.gens {
+		state.Generations[ino] = gen
+	}
+
+	for path, ino := range t.claims {
+		state.Paths[path] = ino
+	}
+
+	for ino, ent := range t.nodes {
+		if !ent.IsArchive() {
+			state.Paths[ent.Path()] = ino
+		}
+	}
+
+	return state
+}
+
+// Restore the allocation state of the table, e.g. when the file system is
+// mounted again. The inode numbers of the paths of the state are claimed by
+// the entries that are loaded at those paths. Inode numbers that are
+// registered to entities are neither claimed nor reused, so that they are
+// not allocated twice.
+func (t *InodeTable) Restore(state *InodeState) error {
+	if state.Next == 0 {
+		return errors.New("inode state must allocate inodes from at least 1")
+	}
+
+	t.Lock()
+	defer t.Unlock()
+
+	t.next = state.Next
+	t.gens = make(map[uint64]uint64, len(state.Generations))
+	for ino, gen := range state.Generations {
+		t.gens[ino] = gen
+	}
+
+	// Ensure inodes registered before the restore are never reallocated.
+	for ino := range t.nodes {
+		if ino >= t.next {
+			t.next = ino + 1
+		}
+	}
+
+	t.claims = make(map[string]uint64, len(state.Paths))
+	claimed := make(map[uint64]bool, len(state.Paths))
+	for path, ino := range state.Paths {
+		if _, ok := t.nodes[ino]; ok || ino == 0 || claimed[ino] {
+			continue
+		}
+
+		if ino >= t.next {
+			t.next = ino + 1
+		}
+
+		t.claims[path] = ino
+		claimed[ino] = true
+	}
+
+	t.free = make([]uint64, 0, len(state.Free))
+	for _, ino := range state.Free {
+		if _, ok := t.nodes[ino]; !ok && ino < t.next && !claimed[ino] {
+			t.free = append(t.free, ino)
+			claimed[ino] = true
+		}
+	}
+
+	return nil
+}
+
+// Dump the allocation state of the table as JSON to the path on disk,
+// replacing the previous state atomically. Must be called with the file
+// system lock held.
+func (t *InodeTable) Dump(path string) error {
+	data, err := json.Marshal(t.State())
+	if err != nil {
+		return err
+	}
+
+	tmp := filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+".memfs-tmp")
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// Load the allocation state of the table from JSON at the path on disk.
+func (t *InodeTable) Load(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	state := new(InodeState)
+	if err := json.Unmarshal(data, state); err != nil {
+		return err
+	}
+
+	return t.Restore(state)
+}
+
+//===========================================================================
+// File System Inode State
+//===========================================================================
+
+// allocate returns the inode number and generation of a new node in the
+// parent directory. Entries that are being loaded take the inode numbers that
+// were restored for their paths, if any.
+func (mfs *FileSystem) allocate(parent *Dir, name string) (uint64, uint64) {
+	if mfs.loading && parent != nil {
+		if ino, gen, ok := mfs.Inodes.Claim(filepath.Join(parent.Path(), name)); ok {
+			return ino, gen
+		}
+	}
+	return mfs.Inodes.Allocate()
+}
+
+// saveInodes writes the state of the inode table to the configured file, if
+// any. Must be called with the lock held.
+func (mfs *FileSystem) saveInodes() error {
+	if mfs.Config.InodeState == "" {
+		return nil
+	}
+	return mfs.Inodes.Dump(mfs.Config.InodeState)
+}
@@ -0,0 +1,169 @@
+package memfs_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/bbengfort/memfs"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("InodeTable", func() {
+
+	var err error
+	var tmpDir string
+
+	BeforeEach(func() {
+		tmpDir, err = ioutil.TempDir("", TempDirPrefix)
+		Ω(err).ShouldNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		Ω(os.RemoveAll(tmpDir)).Should(Succeed())
+	})
+
+	It("should allocate monotonically increasing inodes", func() {
+		table := NewInodeTable()
+		for i := uint64(1); i <= 10; i++ {
+			ino, gen := table.Allocate()
+			Ω(ino).Should(Equal(i))
+			Ω(gen).Should(BeZero())
+		}
+	})
+
+	It("should reuse released inodes with a new generation", func() {
+		fs := New(filepath.Join(tmpDir, "testmp"), makeTestConfig())
+		Ω(fs.WriteFile("/a.txt", []byte("a"), 0644)).Should(Succeed())
+		Ω(fs.WriteFile("/b.txt", []byte("b"), 0644)).Should(Succeed())
+
+		ent, err := fs.Resolve("/a.txt")
+		Ω(err).ShouldNot(HaveOccurred())
+		ino := ent.GetNode().ID
+		Ω(ent.GetNode().Gen).Should(BeZero())
+
+		Ω(fs.Remove("/a.txt")).Should(Succeed())
+		_, ok := fs.Inodes.Get(ino)
+		Ω(ok).Should(BeFalse())
+
+		Ω(fs.WriteFile("/c.txt", []byte("c"), 0644)).Should(Succeed())
+		ent, err = fs.Resolve("/c.txt")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(ent.GetNode().ID).Should(Equal(ino))
+		Ω(ent.GetNode().Gen).Should(Equal(uint64(1)))
+		Ω(ent.GetNode().Attrs.Inode).Should(Equal(ino))
+	})
+
+	It("should look up entities by inode", func() {
+		fs := New(filepath.Join(tmpDir, "testmp"), makeTestConfig())
+		Ω(fs.Mkdir("/data", 0755)).Should(Succeed())
+		Ω(fs.WriteFile("/data/a.txt", []byte("a"), 0644)).Should(Succeed())
+
+		ent, err := fs.Resolve("/data/a.txt")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		found, ok := fs.Inodes.Get(ent.GetNode().ID)
+		Ω(ok).Should(BeTrue())
+		Ω(found).Should(Equal(ent))
+		Ω(fs.Inodes.Len()).Should(Equal(3))
+	})
+
+	It("should dump and load the allocation state", func() {
+		fs := New(filepath.Join(tmpDir, "testmp"), makeTestConfig())
+		for _, name := range []string{"/a", "/b", "/c"} {
+			Ω(fs.WriteFile(name, nil, 0644)).Should(Succeed())
+		}
+		Ω(fs.Remove("/b")).Should(Succeed())
+
+		path := filepath.Join(tmpDir, "inodes.json")
+		Ω(fs.Inodes.Dump(path)).Should(Succeed())
+
+		table := NewInodeTable()
+		Ω(table.Load(path)).Should(Succeed())
+
+		state := table.State()
+		Ω(state.Next).Should(Equal(uint64(5)))
+		Ω(state.Free).Should(Equal([]uint64{3}))
+		Ω(state.Paths).Should(Equal(map[string]uint64{"/": 1, "/a": 2, "/c": 4}))
+
+		ino, gen, ok := table.Claim("/c")
+		Ω(ok).Should(BeTrue())
+		Ω(ino).Should(Equal(uint64(4)))
+		Ω(gen).Should(BeZero())
+
+		_, _, ok = table.Claim("/c")
+		Ω(ok).Should(BeFalse())
+
+		ino, gen = table.Allocate()
+		Ω(ino).Should(Equal(uint64(3)))
+		Ω(gen).Should(Equal(uint64(1)))
+
+		ino, gen = table.Allocate()
+		Ω(ino).Should(Equal(uint64(5)))
+		Ω(gen).Should(BeZero())
+	})
+
+	It("should not restore an invalid state", func() {
+		table := NewInodeTable()
+		Ω(table.Restore(&InodeState{})).ShouldNot(Succeed())
+	})
+
+	It("should reuse the inodes of paths that are not loaded again once settled", func() {
+		table := NewInodeTable()
+		Ω(table.Restore(&InodeState{Next: 4, Paths: map[string]uint64{"/a": 2, "/b": 3}})).Should(Succeed())
+
+		_, _, ok := table.Claim("/b")
+		Ω(ok).Should(BeTrue())
+		table.Settle()
+
+		_, _, ok = table.Claim("/a")
+		Ω(ok).Should(BeFalse())
+
+		ino, gen := table.Allocate()
+		Ω(ino).Should(Equal(uint64(2)))
+		Ω(gen).Should(Equal(uint64(1)))
+	})
+
+	It("should keep the inodes and generations of a mirror across restarts", func() {
+		config := makeTestConfig()
+		config.Mirror.Path = filepath.Join(tmpDir, "backing")
+		config.InodeState = filepath.Join(tmpDir, "inodes.json")
+		Ω(os.Mkdir(config.Mirror.Path, 0755)).Should(Succeed())
+
+		fs := New(filepath.Join(tmpDir, "testmp"), config)
+		Ω(fs.Mkdir("/docs", 0755)).Should(Succeed())
+		for _, name := range []string{"/docs/a.txt", "/docs/b.txt"} {
+			Ω(fs.WriteFile(name, []byte(name), 0644)).Should(Succeed())
+		}
+		Ω(fs.Remove("/docs/a.txt")).Should(Succeed())
+		Ω(fs.WriteFile("/c.txt", []byte("c"), 0644)).Should(Succeed())
+
+		inodes := make(map[string][2]uint64)
+		for _, name := range []string{"/docs", "/docs/b.txt", "/c.txt"} {
+			ent, err := fs.Resolve(name)
+			Ω(err).ShouldNot(HaveOccurred())
+			inodes[name] = [2]uint64{ent.GetNode().ID, ent.GetNode().Gen}
+		}
+		Ω(inodes["/c.txt"][1]).Should(Equal(uint64(1)))
+		Ω(fs.Shutdown()).Should(Succeed())
+
+		fs = New(filepath.Join(tmpDir, "testmp"), config)
+		defer fs.Shutdown()
+
+		for name, ino := range inodes {
+			ent, err := fs.Resolve(name)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(ent.GetNode().ID).Should(Equal(ino[0]), name)
+			Ω(ent.GetNode().Attrs.Inode).Should(Equal(ino[0]), name)
+			Ω(ent.GetNode().Gen).Should(Equal(ino[1]), name)
+		}
+
+		Ω(fs.WriteFile("/d.txt", nil, 0644)).Should(Succeed())
+		ent, err := fs.Resolve("/d.txt")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(ent.GetNode().ID).Should(Equal(uint64(5)))
+	})
+
+})
@@ -0,0 +1,173 @@
+// Implements Node methods for symbolic links and the names of hard links.
+
+package memfs
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+
+	"bazil.org/fuse"
+	"golang.org/x/net/context"
+)
+
+//===========================================================================
+// Symlink Type and Constructor
+//===========================================================================
+
+// Symlink implements Node interfaces for symbolic links. The path that the
+// link points to is its data, so its length is the size of the link.
+type Symlink struct {
+	Node
+	Target string // Path the symbolic link points to
+}
+
+// Init the symbolic link with the path that it points to.
+func (l *Symlink) Init(name, target string, parent *Dir, memfs *FileSystem) {
+	// Symbolic links are always fully permissive, init the node.
+	l.Node.Init(name, os.ModeSymlink|0777, parent, memfs)
+
+	// Set the target and the size of the link
+	l.Target = target
+	l.Attrs.Size = uint64(len(target))
+	l.Attrs.Blocks = Blocks(l.Attrs.Size)
+
+	// Register the link by its inode
+	memfs.Inodes.Register(l)
+}
+
+//===========================================================================
+// Symlink Methods
+//===========================================================================
+
+// GetNode returns a pointer to the embedded Node object
+func (l *Symlink) GetNode() *Node {
+	return &l.Node
+}
+
+// Readlink returns the path that the symbolic link points to.
+//
+// https://godoc.org/bazil.org/fuse/fs#NodeReadlinker
+func (l *Symlink) Readlink(ctx context.Context, req *fuse.ReadlinkRequest) (string, error) {
+	l.fs.Lock()
+	defer l.fs.Unlock()
+
+	// Set the access time on the link.
+	l.Attrs.Atime = time.Now()
+
+	logger.Debug("readlink %d points to %q", l.ID, l.Target)
+	return l.Target, nil
+}
+
+//===========================================================================
+// Hard Links
+//===========================================================================
+
+// link is a name of a file in a directory other than the Parent and Name of
+// the file, i.e. one of its hard links.
+type link struct {
+	dir  *Dir   // Directory that holds the name
+	name string // Name of the file in the directory
+}
+
+// symlink creates a symbolic link to the target in the directory owned by the
+// specified user and group and updates the file system state. Must be called
+// with the lock held.
+func (d *Dir) symlink(name, target string, uid, gid uint32) *Symlink {
+	// Update the directory Atime
+	d.Attrs.Atime = time.Now()
+
+	// Create the link
+	l := new(Symlink)
+	l.Init(name, target, d, d.fs)
+	l.Attrs.Uid = uid
+	l.Attrs.Gid = gid
+
+	// Add the link to the directory
+	d.Children[l.Name] = l
+
+	// Update the directory Mtime
+	d.Attrs.Mtime = time.Now()
+
+	// Update the file system state
+	d.fs.nfiles++
+	d.fs.nbytes += l.Attrs.Size
+	d.fs.charge(&l.Node, int64(l.Attrs.Size), 1)
+	return l
+}
+
+// link adds the file to the directory under the name as a hard link. The
+// data and inode of the file are charged to the directory of its Parent
+// only. Must be called with the lock held.
+func (d *Dir) link(f *File, name string) {
+	now := time.Now()
+
+	d.Children[name] = f
+	d.Attrs.Atime = now
+	d.Attrs.Mtime = now
+
+	f.links = append(f.links, link{dir: d, name: name})
+	f.Attrs.Nlink++
+	f.Attrs.Ctime = now
+}
+
+// unlinkName removes the name of the file in the directory, which has been
+// deleted from the directory, returning true if it was the last name of the
+// file, which must then be released. If the name was the Parent and Name of
+// the file, one of its hard links takes its place and the usage of the file
+// moves to the directory of that link. Must be called with the lock held.
+func (f *File) unlinkName(d *Dir, name string) bool {
+	if len(f.links) == 0 {
+		return true
+	}
+
+	f.Attrs.Nlink--
+	f.Attrs.Ctime = time.Now()
+
+	if f.Parent == d && f.Name == name {
+		next := f.links[0]
+		f.links = f.links[1:]
+
+		u := nodeUsage(&f.Node)
+		chargeTree(f.Parent, -int64(u.Bytes), -int64(u.Inodes))
+		f.Parent, f.Name = next.dir, next.name
+		chargeTree(f.Parent, int64(u.Bytes), int64(u.Inodes))
+		return false
+	}
+
+	for i, l := range f.links {
+		if l.dir == d && l.name == name {
+			f.links = append(f.links[:i], f.links[i+1:]...)
+			break
+		}
+	}
+	return false
+}
+
+// renameLink moves the hard link of the file with the old name in the src
+// directory to the new name in the dst directory, returning false if the old
+// name is the Parent and Name of the file rather than one of its hard links.
+// Must be called with the lock held.
+func (f *File) renameLink(src *Dir, oldName string, dst *Dir, newName string) bool {
+	for i, l := range f.links {
+		if l.dir == src && l.name == oldName {
+			f.links[i] = link{dir: dst, name: newName}
+			return true
+		}
+	}
+	return false
+}
+
+// linkPaths returns the paths of the hard links of the file other than the
+// path of the file itself. Must be called with the lock held.
+func (f *File) linkPaths() []string {
+	if len(f.links) == 0 {
+		return nil
+	}
+
+	paths := make([]string, 0, len(f.links))
+	for _, l := range f.links {
+		paths = append(paths, filepath.Join(l.dir.Path(), l.name))
+	}
+	return paths
+}
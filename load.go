@@ -0,0 +1,661 @@
+// Loading of existing directory trees and tar archives into the file system.
+
+package memfs
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Prefix of the PAX records that hold extended attributes in tar archives.
+const paxXattrPrefix = "SCHILY.xattr."
+
+// Mode bits that are loaded from disk or a tar archive: the permissions and
+// the setuid, setgid and sticky bits.
+const loadModes = os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky
+
+//===========================================================================
+// Preloading
+//===========================================================================
+
+// Preload seeds the file system from a directory or a tar archive (which may
+// be gzip compressed). The contents are checked before anything is loaded,
+// returning an error if they would exceed the capacity or the inode limit of
+// the file system. Symbolic links and hard links are preserved. The file
+// system has no special files, so rather than changing the shape of the tree
+// the preload fails if the contents hold any of them.
+func (mfs *FileSystem) Preload(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	var nbytes, ninodes uint64
+	if info.IsDir() {
+		nbytes, ninodes, err = scanDir(path)
+	} else {
+		nbytes, ninodes, err = scanTar(path)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	mfs.Lock()
+	used, capacity := mfs.used(), mfs.capacity()
+	inodes, limit := mfs.liveInodes(), mfs.maxInodes()
+	mfs.Unlock()
+
+	if used+nbytes > capacity {
+		return fmt.Errorf("cannot preload %s: %d bytes would exceed the capacity of %d bytes", path, nbytes, capacity)
+	}
+
+	if inodes+ninodes > limit {
+		return fmt.Errorf("cannot preload %s: %d files and directories would exceed the limit of %d inodes", path, ninodes, limit)
+	}
+
+	if info.IsDir() {
+		return mfs.LoadDir(path)
+	}
+	return mfs.LoadTar(path)
+}
+
+// scanDir returns the number of bytes and inodes that loading the directory
+// tree rooted at path would add to the file system. Hard links of a file are
+// only counted once.
+func scanDir(path string) (nbytes uint64, ninodes uint64, err error) {
+	links := make(map[fileID]bool)
+	err = filepath.Walk(path, func(src string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if src == path {
+			return nil
+		}
+
+		if rel, err := filepath.Rel(path, src); err == nil && reservedPath(rel) {
+			return fmt.Errorf("cannot preload %s: %q is reserved for a hidden directory of the root", path, src)
+		}
+
+		switch {
+		case info.IsDir():
+			ninodes++
+		case info.Mode().IsRegular():
+			if id, ok := hardLink(info); ok {
+				if links[id] {
+					return nil
+				}
+				links[id] = true
+			}
+			ninodes++
+			nbytes += uint64(info.Size())
+		case info.Mode()&os.ModeSymlink != 0:
+			// The size of a symbolic link is the length of its target.
+			ninodes++
+			nbytes += uint64(info.Size())
+		default:
+			return fmt.Errorf("cannot preload %s: %q is a %s, which is not supported", path, src, fileType(info.Mode()))
+		}
+		return nil
+	})
+
+	return nbytes, ninodes, err
+}
+
+// scanTar returns the number of bytes and inodes that loading the tar archive
+// at path would add to the file system, including missing parent directories.
+func scanTar(path string) (nbytes uint64, ninodes uint64, err error) {
+	archive, closer, err := openTar(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer closer.Close()
+
+	dirs := map[string]bool{"/": true}
+	for {
+		hdr, err := archive.Next()
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return 0, 0, err
+		}
+
+		name := tarPath(hdr.Name)
+		if reservedPath(name) {
+			return 0, 0, fmt.Errorf("cannot preload %s: %q is reserved for a hidden directory of the root", path, hdr.Name)
+		}
+
+		for parent := filepath.Dir(name); !dirs[parent]; parent = filepath.Dir(parent) {
+			dirs[parent] = true
+			ninodes++
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if !dirs[name] {
+				dirs[name] = true
+				ninodes++
+			}
+		case tar.TypeReg:
+			ninodes++
+			nbytes += uint64(hdr.Size)
+		case tar.TypeSymlink:
+			ninodes++
+			nbytes += uint64(len(hdr.Linkname))
+		case tar.TypeLink:
+			// A hard link is another name of a file that is already counted.
+		default:
+			return 0, 0, fmt.Errorf("cannot preload %s: %q is a %s, which is not supported", path, hdr.Name, fileType(hdr.FileInfo().Mode()))
+		}
+	}
+
+	return nbytes, ninodes, nil
+}
+
+//===========================================================================
+// Directory Loading
+//===========================================================================
+
+// LoadDir copies the directory tree rooted at path on disk into the root of
+// the file system, preserving the modes, owners, modification times and
+// extended attributes of its files and directories. Existing directories are
+// merged and existing files are replaced. Symbolic links are loaded as they
+// are, without following them, and the names of a file that has hard links
+// are loaded as links of a single file. Special files are skipped. The load
+// fails if the tree holds an entry with a name that is
+// reserved for a hidden directory of the root (.memfs or .snapshots). Loading
+// is not recorded as a mutation. Loaded entries take the inode numbers that
+// were restored for their paths.
+func (mfs *FileSystem) LoadDir(path string) error {
+	return mfs.loadDir(path, nil)
+}
+
+// loadMirror loads the backing directory of the mirror, opening the sealed
+// streams and extended attribute values that it was written with if
+// encryption is enabled.
+func (mfs *FileSystem) loadMirror(path string) error {
+	return mfs.loadDir(path, mfs.keys)
+}
+
+// loadDir implements LoadDir, opening the contents of files and the values
+// of extended attributes with the keys if they are not nil.
+func (mfs *FileSystem) loadDir(path string, keys *Keyring) error {
+	mfs.Lock()
+	defer mfs.Unlock()
+
+	mfs.loading = true
+	defer func() { mfs.loading = false }()
+
+	nfiles, ndirs := 0, 0
+	times := make(map[*Dir]time.Time)
+	links := make(map[fileID]string)
+	err := filepath.Walk(path, func(src string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(path, src)
+		if err != nil || rel == "." {
+			return err
+		}
+
+		if reservedPath(rel) {
+			return fmt.Errorf("cannot load %q: the name is reserved for a hidden directory of the root", src)
+		}
+
+		var ent Entity
+		name := "/" + filepath.ToSlash(rel)
+		switch {
+		case info.IsDir():
+			ent, err = mfs.loadEntry(name, info, nil)
+			ndirs++
+		case info.Mode()&os.ModeSymlink != 0:
+			// The extended attributes of a link cannot be read without
+			// following it, so only its target is loaded.
+			target, rerr := os.Readlink(src)
+			if rerr != nil {
+				return rerr
+			}
+
+			if _, err = mfs.loadSymlink(name, info, target); err != nil {
+				return err
+			}
+			nfiles++
+			return nil
+		case info.Mode().IsRegular():
+			// Further names of a file that has been loaded are links to it.
+			id, linked := hardLink(info)
+			if first, ok := links[id]; linked && ok {
+				return mfs.loadLink(name, first)
+			}
+
+			if linked {
+				links[id] = name
+			}
+
+			data, rerr := ioutil.ReadFile(src)
+			if rerr != nil {
+				return rerr
+			}
+
+			if keys != nil {
+				if data, rerr = keys.openStream(data); rerr != nil {
+					return fmt.Errorf("could not load %q: %s", src, rerr)
+				}
+			}
+			ent, err = mfs.loadEntry(name, info, data)
+			nfiles++
+		default:
+			logger.Warn("skipping %q when loading %q: %s is not supported", rel, path, info.Mode().Type())
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		if d, ok := ent.(*Dir); ok {
+			times[d] = info.ModTime()
+		}
+
+		xattrs, err := diskXattrs(src)
+		if err != nil {
+			logger.Warn("could not load extended attributes of %q: %s", src, err)
+		}
+
+		node := ent.GetNode()
+		for name, value := range xattrs {
+			if keys != nil {
+				if value, err = keys.openDiskXattr(name, value); err != nil {
+					return fmt.Errorf("could not load extended attribute %s of %q: %s", name, src, err)
+				}
+			}
+			node.setxattr(name, value)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	loadTimes(times)
+	logger.Info("loaded %d files and %d directories from %s", nfiles, ndirs, path)
+	return nil
+}
+
+// loadEntry creates or replaces the directory (if data is nil and the info
+// is a directory) or file at the path with the attributes of the info. Must
+// be called with the lock held.
+func (mfs *FileSystem) loadEntry(path string, info os.FileInfo, data []byte) (Entity, error) {
+	dir, name, err := mfs.resolveParent(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := dir.diverge(); err != nil {
+		return nil, err
+	}
+
+	// Symbolic links and files with hard links are replaced rather than
+	// modified, so that the other names of a file keep their contents.
+	uid, gid := mfs.owner(info)
+	ent, exists := dir.Children[name]
+	replace := exists && ent.IsDir() != info.IsDir()
+	switch e := ent.(type) {
+	case *Symlink:
+		replace = true
+	case *File:
+		replace = len(e.links) > 0
+	}
+
+	if replace {
+		if _, err = dir.remove(name); err != nil {
+			return nil, err
+		}
+		exists = false
+	}
+
+	if !exists {
+		if err := mfs.checkInodes(); err != nil {
+			return nil, err
+		}
+
+		if info.IsDir() {
+			ent = dir.mkdir(name, info.Mode().Perm(), uid, gid)
+		} else {
+			ent = dir.create(name, info.Mode().Perm(), uid, gid)
+		}
+	}
+
+	if f, ok := ent.(*File); ok {
+		if err := mfs.checkSpace(addClamped(uint64(len(data)), -int64(f.Attrs.Size))); err != nil {
+			return nil, err
+		}
+
+		if err := f.fault(); err != nil {
+			return nil, err
+		}
+
+		f.truncate(0)
+		f.write(0, data)
+		f.dirty = false
+		f.dedup()
+		f.seal()
+		mfs.reclaim(f)
+	}
+
+	node := ent.GetNode()
+	node.Attrs.Mode = (node.Attrs.Mode & os.ModeType) | info.Mode()&loadModes
+	node.Attrs.Mtime = info.ModTime()
+	node.Attrs.Atime = info.ModTime()
+	return ent, nil
+}
+
+// loadSymlink creates or replaces the entry at the path with a symbolic link
+// to the target with the attributes of the info. Must be called with the
+// lock held.
+func (mfs *FileSystem) loadSymlink(path string, info os.FileInfo, target string) (Entity, error) {
+	dir, name, err := mfs.resolveParent(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := dir.diverge(); err != nil {
+		return nil, err
+	}
+
+	if _, ok := dir.Children[name]; ok {
+		if _, err = dir.remove(name); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := mfs.checkInodes(); err != nil {
+		return nil, err
+	}
+
+	if err := mfs.checkSpace(uint64(len(target))); err != nil {
+		return nil, err
+	}
+
+	uid, gid := mfs.owner(info)
+	l := dir.symlink(name, target, uid, gid)
+	l.Attrs.Mtime = info.ModTime()
+	l.Attrs.Atime = info.ModTime()
+	return l, nil
+}
+
+// loadLink creates or replaces the entry at the path with a hard link to the
+// previously loaded file at the target path. Must be called with the lock
+// held.
+func (mfs *FileSystem) loadLink(path, target string) error {
+	ent, err := mfs.resolve(target)
+	if err != nil {
+		return fmt.Errorf("could not load hard link %q to %q: %s", path, target, err)
+	}
+
+	f, ok := ent.(*File)
+	if !ok {
+		return fmt.Errorf("could not load hard link %q: %q is not a file", path, target)
+	}
+
+	dir, name, err := mfs.resolveParent(path)
+	if err != nil {
+		return err
+	}
+
+	if err := dir.diverge(); err != nil {
+		return err
+	}
+
+	if err := f.Parent.diverge(); err != nil {
+		return err
+	}
+
+	if prev, ok := dir.Children[name]; ok {
+		if prev == ent {
+			return nil
+		}
+
+		if _, err = dir.remove(name); err != nil {
+			return err
+		}
+	}
+
+	dir.link(f, name)
+	return nil
+}
+
+//===========================================================================
+// Tar Archive Loading
+//===========================================================================
+
+// LoadTar copies the contents of the tar archive at path (which may be gzip
+// compressed) into the root of the file system, preserving the modes, owners,
+// modification times and extended attributes of its entries. Missing parent
+// directories are created, symbolic links are loaded as they are, hard links
+// are loaded as links of the file they refer to, which must precede them in
+// the archive, and special files are skipped. As with LoadDir,
+// the load fails if an entry has a name that is reserved for a hidden
+// directory of the root. Loading is not recorded as a mutation.
+func (mfs *FileSystem) LoadTar(path string) error {
+	archive, closer, err := openTar(path)
+	if err != nil {
+		return err
+	}
+	defer closer.Close()
+
+	mfs.Lock()
+	defer mfs.Unlock()
+
+	mfs.loading = true
+	defer func() { mfs.loading = false }()
+
+	nfiles, ndirs := 0, 0
+	times := make(map[*Dir]time.Time)
+	for {
+		hdr, err := archive.Next()
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return err
+		}
+
+		name := tarPath(hdr.Name)
+		if name == "/" {
+			continue
+		}
+
+		if reservedPath(name) {
+			return fmt.Errorf("cannot load %q: the name is reserved for a hidden directory of the root", hdr.Name)
+		}
+
+		var data []byte
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			ndirs++
+		case tar.TypeReg:
+			if data, err = ioutil.ReadAll(archive); err != nil {
+				return err
+			}
+			nfiles++
+		case tar.TypeSymlink, tar.TypeLink:
+			nfiles++
+		default:
+			logger.Warn("skipping %q when loading %q: tar type %q is not supported", hdr.Name, path, hdr.Typeflag)
+			continue
+		}
+
+		if err := mfs.loadParents(name); err != nil {
+			return err
+		}
+
+		// The attributes of a hard link are those of the file it refers to.
+		if hdr.Typeflag == tar.TypeLink {
+			if err := mfs.loadLink(name, tarPath(hdr.Linkname)); err != nil {
+				return err
+			}
+			continue
+		}
+
+		var ent Entity
+		if hdr.Typeflag == tar.TypeSymlink {
+			ent, err = mfs.loadSymlink(name, hdr.FileInfo(), hdr.Linkname)
+		} else {
+			ent, err = mfs.loadEntry(name, hdr.FileInfo(), data)
+		}
+
+		if err != nil {
+			return err
+		}
+
+		if d, ok := ent.(*Dir); ok {
+			times[d] = hdr.ModTime
+		}
+
+		node := ent.GetNode()
+		for key, value := range hdr.PAXRecords {
+			if strings.HasPrefix(key, paxXattrPrefix) {
+				node.setxattr(strings.TrimPrefix(key, paxXattrPrefix), []byte(value))
+			}
+		}
+	}
+
+	loadTimes(times)
+	logger.Info("loaded %d files and %d directories from %s", nfiles, ndirs, path)
+	return nil
+}
+
+// openTar opens the tar archive at path, decompressing it if it begins with
+// the gzip magic number. The returned closer closes the underlying file.
+func openTar(path string) (*tar.Reader, io.Closer, error) {
+	fobj, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	buf := bufio.NewReader(fobj)
+	magic, err := buf.Peek(2)
+	if err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		zr, err := gzip.NewReader(buf)
+		if err != nil {
+			fobj.Close()
+			return nil, nil, err
+		}
+		return tar.NewReader(zr), fobj, nil
+	}
+
+	return tar.NewReader(buf), fobj, nil
+}
+
+// tarPath returns the absolute path in the file system of a tar entry name.
+func tarPath(name string) string {
+	return filepath.Clean("/" + filepath.FromSlash(name))
+}
+
+// loadTimes sets the access and modification times of the loaded directories
+// once all of their children are loaded, since adding an entry to a directory
+// updates its times. Must be called with the lock held.
+func loadTimes(times map[*Dir]time.Time) {
+	for d, mtime := range times {
+		d.Attrs.Mtime = mtime
+		d.Attrs.Atime = mtime
+	}
+}
+
+// loadParents creates any missing directories above the path, owned by the
+// user running the file system. Must be called with the lock held.
+func (mfs *FileSystem) loadParents(path string) error {
+	dir := mfs.root
+	names := strings.Split(filepath.Dir(path), "/")[1:]
+	for _, name := range names {
+		if name == "" {
+			continue
+		}
+
+		ent, ok := dir.Children[name]
+		if !ok {
+			if err := dir.diverge(); err != nil {
+				return err
+			}
+
+			if err := mfs.checkInodes(); err != nil {
+				return err
+			}
+			ent = dir.mkdir(name, 0755, mfs.uid, mfs.gid)
+		}
+
+		if dir, ok = ent.(*Dir); !ok {
+			return ENOTDIR
+		}
+	}
+	return nil
+}
+
+//===========================================================================
+// Helpers
+//===========================================================================
+
+// reservedPath returns true if the path (relative to the root) is or is
+// beneath a name that is reserved for a hidden directory of the root.
+func reservedPath(path string) bool {
+	name := strings.SplitN(strings.TrimPrefix(filepath.ToSlash(path), "/"), "/", 2)[0]
+	return reservedName(name)
+}
+
+// fileID identifies a file on disk by its device and inode numbers.
+type fileID struct {
+	dev uint64
+	ino uint64
+}
+
+// hardLink returns the identity of the file on disk if it has more than one
+// name, i.e. if it has hard links.
+func hardLink(info os.FileInfo) (fileID, bool) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok || stat.Nlink < 2 {
+		return fileID{}, false
+	}
+	return fileID{dev: uint64(stat.Dev), ino: uint64(stat.Ino)}, true
+}
+
+// fileType describes the type of a file that cannot be loaded.
+func fileType(mode os.FileMode) string {
+	switch {
+	case mode&os.ModeDevice != 0:
+		return "device"
+	case mode&os.ModeNamedPipe != 0:
+		return "named pipe"
+	case mode&os.ModeSocket != 0:
+		return "socket"
+	}
+	return "special file"
+}
+
+// owner returns the user and group that own the file on disk or in a tar
+// archive, or the owner of the file system if they cannot be determined.
+func (mfs *FileSystem) owner(info os.FileInfo) (uint32, uint32) {
+	switch stat := info.Sys().(type) {
+	case *syscall.Stat_t:
+		return stat.Uid, stat.Gid
+	case *tar.Header:
+		return uint32(stat.Uid), uint32(stat.Gid)
+	}
+	return mfs.uid, mfs.gid
+}
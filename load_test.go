@@ -0,0 +1,224 @@
+package memfs_test
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/context"
+
+	. "github.com/bbengfort/memfs"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Load", func() {
+
+	var err error
+	var tmpDir string
+	var config *Config
+	var fs *FileSystem
+	var mtime time.Time
+
+	writeTar := func(path string, links bool) {
+		fobj, err := os.Create(path)
+		Ω(err).ShouldNot(HaveOccurred())
+		defer fobj.Close()
+
+		zw := gzip.NewWriter(fobj)
+		defer zw.Close()
+
+		tw := tar.NewWriter(zw)
+		defer tw.Close()
+
+		data := []byte("fixture")
+		headers := []*tar.Header{
+			{Typeflag: tar.TypeDir, Name: "docs/", Mode: 0750, ModTime: mtime},
+			{
+				Typeflag: tar.TypeReg, Name: "docs/a.txt", Mode: 0640, Size: int64(len(data)),
+				Uid: 1234, Gid: 5678, ModTime: mtime,
+				PAXRecords: map[string]string{"SCHILY.xattr.user.tag": "preloaded"},
+			},
+			{Typeflag: tar.TypeReg, Name: "nested/dir/d.txt", Mode: 0644, Size: int64(len(data)), ModTime: mtime},
+		}
+
+		if links {
+			headers = append(headers,
+				&tar.Header{Typeflag: tar.TypeLink, Name: "docs/b.txt", Linkname: "docs/a.txt", Mode: 0640, ModTime: mtime},
+				&tar.Header{Typeflag: tar.TypeSymlink, Name: "docs/c.txt", Linkname: "a.txt", ModTime: mtime},
+			)
+		}
+
+		for _, hdr := range headers {
+			Ω(tw.WriteHeader(hdr)).Should(Succeed())
+			if hdr.Typeflag == tar.TypeReg {
+				_, err := tw.Write(data)
+				Ω(err).ShouldNot(HaveOccurred())
+			}
+		}
+	}
+
+	BeforeEach(func() {
+		tmpDir, err = ioutil.TempDir("", TempDirPrefix)
+		Ω(err).ShouldNot(HaveOccurred())
+
+		mtime = time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC)
+		writeTar(filepath.Join(tmpDir, "fixtures.tar.gz"), false)
+		config = makeTestConfig()
+	})
+
+	JustBeforeEach(func() {
+		fs = New(filepath.Join(tmpDir, "testmp"), config)
+	})
+
+	AfterEach(func() {
+		Ω(os.RemoveAll(tmpDir)).Should(Succeed())
+	})
+
+	It("should preload a compressed tar archive", func() {
+		Ω(fs.Preload(filepath.Join(tmpDir, "fixtures.tar.gz"))).Should(Succeed())
+
+		ent, err := fs.Resolve("/docs")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(ent.GetNode().Attrs.Mode).Should(Equal(os.ModeDir | 0750))
+		Ω(ent.GetNode().Attrs.Mtime.Equal(mtime)).Should(BeTrue())
+
+		ent, err = fs.Resolve("/docs/a.txt")
+		Ω(err).ShouldNot(HaveOccurred())
+		node := ent.GetNode()
+		Ω(node.Attrs.Mode).Should(Equal(os.FileMode(0640)))
+		Ω(node.Attrs.Uid).Should(Equal(uint32(1234)))
+		Ω(node.Attrs.Gid).Should(Equal(uint32(5678)))
+		Ω(node.Attrs.Mtime.Equal(mtime)).Should(BeTrue())
+		Ω(node.XAttrs["user.tag"]).Should(Equal([]byte("preloaded")))
+
+		data, err := fs.ReadFile("/nested/dir/d.txt")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(data).Should(Equal([]byte("fixture")))
+	})
+
+	It("should preserve the links of a tar archive", func() {
+		path := filepath.Join(tmpDir, "links.tar.gz")
+		writeTar(path, true)
+		Ω(fs.Preload(path)).Should(Succeed())
+
+		a, err := fs.Resolve("/docs/a.txt")
+		Ω(err).ShouldNot(HaveOccurred())
+		b, err := fs.Resolve("/docs/b.txt")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(b).Should(BeIdenticalTo(a))
+		Ω(a.GetNode().Attrs.Nlink).Should(Equal(uint32(2)))
+
+		target, err := fs.Readlink("/docs/c.txt")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(target).Should(Equal("a.txt"))
+
+		Ω(fs.Remove("/docs/a.txt")).Should(Succeed())
+		data, err := fs.ReadFile("/docs/b.txt")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(data).Should(Equal([]byte("fixture")))
+		Ω(b.GetNode().Path()).Should(Equal("/docs/b.txt"))
+		Ω(b.GetNode().Attrs.Nlink).Should(Equal(uint32(1)))
+	})
+
+	It("should preload a directory", func() {
+		src := filepath.Join(tmpDir, "src")
+		Ω(os.MkdirAll(filepath.Join(src, "docs"), 0755)).Should(Succeed())
+		Ω(ioutil.WriteFile(filepath.Join(src, "docs", "a.txt"), []byte("fixture"), 0600)).Should(Succeed())
+
+		Ω(os.Chtimes(filepath.Join(src, "docs"), mtime, mtime)).Should(Succeed())
+
+		Ω(fs.Preload(src)).Should(Succeed())
+
+		data, err := fs.ReadFile("/docs/a.txt")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(data).Should(Equal([]byte("fixture")))
+
+		ent, err := fs.Resolve("/docs")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(ent.GetNode().Attrs.Mtime.Equal(mtime)).Should(BeTrue())
+	})
+
+	It("should preserve the links of a directory", func() {
+		src := filepath.Join(tmpDir, "src")
+		Ω(os.MkdirAll(filepath.Join(src, "docs"), 0755)).Should(Succeed())
+		Ω(os.MkdirAll(filepath.Join(src, "other"), 0755)).Should(Succeed())
+		Ω(ioutil.WriteFile(filepath.Join(src, "docs", "a.txt"), []byte("fixture"), 0600)).Should(Succeed())
+		Ω(os.Symlink("a.txt", filepath.Join(src, "docs", "c.txt"))).Should(Succeed())
+		Ω(os.Link(filepath.Join(src, "docs", "a.txt"), filepath.Join(src, "other", "b.txt"))).Should(Succeed())
+		Ω(fs.Preload(src)).Should(Succeed())
+
+		a, err := fs.Resolve("/docs/a.txt")
+		Ω(err).ShouldNot(HaveOccurred())
+		b, err := fs.Resolve("/other/b.txt")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(b).Should(BeIdenticalTo(a))
+		Ω(a.GetNode().Attrs.Nlink).Should(Equal(uint32(2)))
+
+		c, err := fs.Resolve("/docs/c.txt")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(c.GetNode().Attrs.Mode & os.ModeSymlink).ShouldNot(BeZero())
+		Ω(c.(*Symlink).Target).Should(Equal("a.txt"))
+	})
+
+	It("should list each name of a hard linked file", func() {
+		src := filepath.Join(tmpDir, "src")
+		Ω(os.MkdirAll(filepath.Join(src, "docs"), 0755)).Should(Succeed())
+		Ω(os.MkdirAll(filepath.Join(src, "other"), 0755)).Should(Succeed())
+		Ω(ioutil.WriteFile(filepath.Join(src, "docs", "a.txt"), []byte("fixture"), 0600)).Should(Succeed())
+		Ω(os.Link(filepath.Join(src, "docs", "a.txt"), filepath.Join(src, "other", "b.txt"))).Should(Succeed())
+		Ω(fs.Preload(src)).Should(Succeed())
+
+		for dir, name := range map[string]string{"/docs": "a.txt", "/other": "b.txt"} {
+			ent, err := fs.Resolve(dir)
+			Ω(err).ShouldNot(HaveOccurred())
+
+			dirents, err := ent.(*Dir).ReadDirAll(context.TODO())
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(dirents).Should(HaveLen(1))
+			Ω(dirents[0].Name).Should(Equal(name), dir)
+		}
+	})
+
+	It("should refuse to preload a directory with special files", func() {
+		src := filepath.Join(tmpDir, "src")
+		Ω(os.MkdirAll(filepath.Join(src, "docs"), 0755)).Should(Succeed())
+		Ω(syscall.Mkfifo(filepath.Join(src, "docs", "pipe"), 0600)).Should(Succeed())
+		Ω(fs.Preload(src)).Should(MatchError(ContainSubstring("named pipe")))
+
+		_, err := fs.Resolve("/docs")
+		Ω(err).Should(HaveOccurred())
+	})
+
+	It("should refuse to load the names of the hidden directories", func() {
+		src := filepath.Join(tmpDir, "src")
+		Ω(os.MkdirAll(filepath.Join(src, SnapshotDir), 0755)).Should(Succeed())
+		Ω(ioutil.WriteFile(filepath.Join(src, SnapshotDir, "a.txt"), []byte("fixture"), 0600)).Should(Succeed())
+		Ω(fs.Preload(src)).Should(MatchError(ContainSubstring("reserved")))
+		Ω(fs.LoadDir(src)).Should(MatchError(ContainSubstring("reserved")))
+
+		_, err := fs.Resolve("/" + SnapshotDir + "/a.txt")
+		Ω(err).Should(HaveOccurred())
+	})
+
+	Context("with limited capacity", func() {
+
+		BeforeEach(func() {
+			config.MaxInodes = 5
+		})
+
+		It("should fail without loading anything", func() {
+			Ω(fs.Preload(filepath.Join(tmpDir, "fixtures.tar.gz"))).ShouldNot(Succeed())
+
+			_, err := fs.Resolve("/docs")
+			Ω(err).Should(HaveOccurred())
+		})
+
+	})
+
+})
@@ -3,12 +3,15 @@
 package memfs
 
 import (
+	"encoding/json"
 	"fmt"
 	"io"
 	"log"
+	"log/syslog"
 	"net/http"
 	"os"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -40,56 +43,168 @@ func (level LogLevel) String() string {
 
 // LevelFromString parses a string and returns the LogLevel
 func LevelFromString(level string) LogLevel {
+	if lvl, err := ParseLevel(level); err == nil {
+		return lvl
+	}
+	return LevelInfo
+}
+
+// ParseLevel parses a string and returns the LogLevel or an error if the
+// string is not the name of a log level.
+func ParseLevel(level string) (LogLevel, error) {
 	// Perform string cleanup for matching
 	level = strings.ToUpper(level)
 	level = strings.Trim(level, " ")
 
 	switch level {
 	case "DEBUG":
-		return LevelDebug
+		return LevelDebug, nil
 	case "INFO":
-		return LevelInfo
+		return LevelInfo, nil
 	case "WARN":
-		return LevelWarn
+		return LevelWarn, nil
 	case "WARNING":
-		return LevelWarn
+		return LevelWarn, nil
 	case "ERROR":
-		return LevelError
+		return LevelError, nil
 	case "FATAL":
-		return LevelFatal
+		return LevelFatal, nil
 	default:
-		return LevelInfo
+		return LevelInfo, fmt.Errorf("%q is not a log level (debug, info, warn, error, fatal)", level)
 	}
 }
 
+//===========================================================================
+// Log Format Type
+//===========================================================================
+
+// LogFormat specifies how log records are serialized to the output.
+type LogFormat int
+
+// Serialization formats of log records.
+const (
+	FormatText LogFormat = iota
+	FormatJSON
+)
+
+// String representation of the log format.
+func (format LogFormat) String() string {
+	if format == FormatJSON {
+		return "json"
+	}
+	return "text"
+}
+
+// FormatFromString parses a string and returns the LogFormat
+func FormatFromString(format string) LogFormat {
+	if Regularize(format) == "json" {
+		return FormatJSON
+	}
+	return FormatText
+}
+
+//===========================================================================
+// Structured Log Records
+//===========================================================================
+
+// LogFields are the structured fields attached to a log record describing a
+// file system operation. They are emitted as JSON object keys in FormatJSON.
+type LogFields struct {
+	Op      string        `json:"op,omitempty"`      // Name of the operation
+	Node    uint64        `json:"node,omitempty"`    // ID of the node operated on
+	Path    string        `json:"path,omitempty"`    // Full path to the node
+	Size    uint64        `json:"size"`              // Size of the node or data
+	UID     uint32        `json:"uid"`               // User id of the caller
+	Latency time.Duration `json:"latency,omitempty"` // Operation duration in nanoseconds
+}
+
+// logRecord is the JSON representation of a single log message.
+type logRecord struct {
+	Level     string `json:"level"`
+	Time      string `json:"time"`
+	Subsystem string `json:"subsystem,omitempty"`
+	Message   string `json:"msg"`
+	*LogFields
+}
+
 //===========================================================================
 // Logger wrapper for log.Logger and logging initialization methods
 //===========================================================================
 
+// LogConfig specifies the sink, format and per-subsystem levels of a Logger.
+type LogConfig struct {
+	Path     string            `json:"path" yaml:"path"`         // Path to a log file, stdout if empty
+	Format   string            `json:"format" yaml:"format"`     // Format of log records (text or json)
+	Syslog   string            `json:"syslog" yaml:"syslog"`     // Tag to log to the local syslog daemon with
+	MaxSize  uint64            `json:"maxsize" yaml:"maxsize"`   // Rotate the log file after this many bytes
+	MaxAge   Duration          `json:"maxage" yaml:"maxage"`     // Rotate the log file after this duration
+	Compress bool              `json:"compress" yaml:"compress"` // Gzip rotated log files
+	Levels   map[string]string `json:"levels" yaml:"levels"`     // Minimum level overrides by subsystem
+}
+
 // Logger wraps the log.Logger to write to a file on demand and to specify a
 // miminum severity that is allowed for writing.
 type Logger struct {
-	Level  LogLevel       // The minimum severity to log to
-	logger *log.Logger    // The wrapped logger for concurrent logging
-	output io.WriteCloser // Handle to the open log file or writer object
+	*logSink         // Levels, format and writer shared with subsystem loggers
+	subsystem string // Name of the subsystem the logger writes for
+}
+
+// logSink holds the configuration and the writer of a logger. It is shared by
+// a logger and its subsystem loggers and guarded by a lock, so the logger can
+// be reconfigured while other goroutines are logging.
+type logSink struct {
+	mu     sync.RWMutex        // Guards the sink while it is replaced
+	Level  LogLevel            // The minimum severity to log to
+	Format LogFormat           // The serialization format of log records
+	Levels map[string]LogLevel // Minimum severity overrides by subsystem
+	logger *log.Logger         // The wrapped logger for concurrent logging
+	output io.WriteCloser      // Handle to the open log file or writer object
+	syslog *syslog.Writer      // Handle to the syslog daemon if it is the sink
 }
 
 // InitLogger creates a Logger object by passing a configuration that contains
 // the minimum log level and an optional path to write the log out to.
 func InitLogger(path string, level string) (*Logger, error) {
-	newLogger := new(Logger)
+	return NewLogger(&LogConfig{Path: path}, level)
+}
+
+// NewLogger creates a Logger from a log configuration and a minimum level,
+// opening a syslog connection, a rotating log file or stdout as the sink.
+func NewLogger(conf *LogConfig, level string) (*Logger, error) {
+	var err error
+
+	newLogger := &Logger{logSink: new(logSink)}
 	newLogger.Level = LevelFromString(level)
+	newLogger.Format = FormatFromString(conf.Format)
+	newLogger.Levels = make(map[string]LogLevel, len(conf.Levels))
+
+	for name, lvl := range conf.Levels {
+		newLogger.Levels[Regularize(name)] = LevelFromString(lvl)
+	}
 
-	// If a path is specified create a handle to the writer.
-	if path != "" {
+	switch {
+	case conf.Syslog != "":
+		// Syslog applies its own priority and timestamp to every message.
+		if newLogger.syslog, err = syslog.New(syslog.LOG_INFO|syslog.LOG_DAEMON, conf.Syslog); err != nil {
+			return nil, err
+		}
+		newLogger.output = newLogger.syslog
 
-		var err error
-		newLogger.output, err = os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	case conf.MaxSize > 0 || conf.MaxAge > 0:
+		// Rotate the log file if limits are specified.
+		newLogger.output, err = OpenRotatingWriter(conf.Path, conf.MaxSize, time.Duration(conf.MaxAge), conf.Compress)
 		if err != nil {
 			return nil, err
 		}
 
-	} else {
+	case conf.Path != "":
+		// If a path is specified create a handle to the writer.
+		newLogger.output, err = os.OpenFile(conf.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, err
+		}
+
+	default:
 		newLogger.output = os.Stdout
 	}
 
@@ -98,8 +213,17 @@ func InitLogger(path string, level string) (*Logger, error) {
 	return newLogger, nil
 }
 
+// Subsystem returns a logger that shares the sink of the receiver but whose
+// minimum severity can be overridden by name in Levels.
+func (logger *Logger) Subsystem(name string) *Logger {
+	return &Logger{logSink: logger.logSink, subsystem: Regularize(name)}
+}
+
 // Close the logger and any open file handles.
 func (logger *Logger) Close() error {
+	logger.mu.RLock()
+	defer logger.mu.RUnlock()
+
 	if err := logger.output.Close(); err != nil {
 		return err
 	}
@@ -108,15 +232,68 @@ func (logger *Logger) Close() error {
 
 // GetHandler returns the io.Writer object that is on the logger.
 func (logger *Logger) GetHandler() io.Writer {
+	logger.mu.RLock()
+	defer logger.mu.RUnlock()
 	return logger.output
 }
 
 // SetHandler sets a new io.WriteCloser object onto the logger
 func (logger *Logger) SetHandler(writer io.WriteCloser) {
+	logger.mu.Lock()
+	defer logger.mu.Unlock()
+
 	logger.output = writer
+	logger.syslog = nil
 	logger.logger.SetOutput(writer)
 }
 
+// Replace the levels, format and sink of the logger (and of its subsystem
+// loggers) with those of next, closing the previous sink unless it is stdout.
+// Messages being written concurrently finish before the sink is closed; next
+// must not be used afterward.
+func (logger *Logger) Replace(next *Logger) error {
+	next.mu.RLock()
+	defer next.mu.RUnlock()
+
+	logger.mu.Lock()
+	prev := logger.output
+	logger.Level = next.Level
+	logger.Format = next.Format
+	logger.Levels = next.Levels
+	logger.logger = next.logger
+	logger.output = next.output
+	logger.syslog = next.syslog
+	logger.mu.Unlock()
+
+	if prev != os.Stdout && prev != next.output {
+		return prev.Close()
+	}
+	return nil
+}
+
+// Enabled returns true if a message at the given level would be logged.
+func (logger *Logger) Enabled(level LogLevel) bool {
+	logger.mu.RLock()
+	defer logger.mu.RUnlock()
+	return logger.enabled(level)
+}
+
+// level returns the minimum severity of the logger.
+func (logger *Logger) level() LogLevel {
+	logger.mu.RLock()
+	defer logger.mu.RUnlock()
+	return logger.Level
+}
+
+// enabled returns true if a message at the given level would be logged. Must
+// be called with the read lock held.
+func (logger *Logger) enabled(level LogLevel) bool {
+	if min, ok := logger.Levels[logger.subsystem]; ok && logger.subsystem != "" {
+		return level >= min
+	}
+	return level >= logger.Level
+}
+
 //===========================================================================
 // Logging handlers
 //===========================================================================
@@ -125,21 +302,80 @@ func (logger *Logger) SetHandler(writer io.WriteCloser) {
 // format function, and a layout string can be passed with arguments.
 // The current logging format is "%(level)s [%(jsontime)s]: %(message)s"
 func (logger *Logger) Log(layout string, level LogLevel, args ...interface{}) {
+	logger.Event(level, nil, layout, args...)
+}
+
+// Event logs a message at the appropriate severity along with the structured
+// fields of the operation that produced it. In FormatJSON the record is
+// written as a single JSON object per line, otherwise the fields are omitted
+// and the message is written in the text format described by Log.
+func (logger *Logger) Event(level LogLevel, fields *LogFields, layout string, args ...interface{}) {
+	logger.mu.RLock()
+	defer logger.mu.RUnlock()
 
 	// Only log if the log level matches the log request
-	if level >= logger.Level {
-		msg := fmt.Sprintf(layout, args...)
-		msg = fmt.Sprintf("%-7s [%s]: %s", level, time.Now().Format(JSONDateTime), msg)
+	if !logger.enabled(level) {
+		return
+	}
+
+	msg := fmt.Sprintf(layout, args...)
 
-		// If level is fatal then log fatal.
-		if level == LevelFatal {
-			logger.logger.Fatalln(msg)
-		} else {
-			logger.logger.Println(msg)
+	// Syslog timestamps messages and assigns priority itself.
+	if logger.syslog != nil {
+		if logger.Format == FormatJSON {
+			msg = logger.marshal(level, fields, msg)
 		}
+		logger.writeSyslog(level, msg)
+		return
+	}
+
+	if logger.Format == FormatJSON {
+		msg = logger.marshal(level, fields, msg)
+	} else {
+		msg = fmt.Sprintf("%-7s [%s]: %s", level, time.Now().Format(JSONDateTime), msg)
+	}
+
+	// If level is fatal then log fatal.
+	if level == LevelFatal {
+		logger.logger.Fatalln(msg)
+	} else {
+		logger.logger.Println(msg)
+	}
+}
+
+// Serializes a log record as a JSON object.
+func (logger *Logger) marshal(level LogLevel, fields *LogFields, msg string) string {
+	record := &logRecord{
+		Level:     level.String(),
+		Time:      time.Now().Format(JSONDateTime),
+		Subsystem: logger.subsystem,
+		Message:   msg,
+		LogFields: fields,
+	}
 
+	data, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Sprintf(`{"level":"ERROR","msg":%q}`, err.Error())
 	}
 
+	return string(data)
+}
+
+// Writes the message to syslog with the priority matching the level.
+func (logger *Logger) writeSyslog(level LogLevel, msg string) {
+	switch level {
+	case LevelDebug:
+		logger.syslog.Debug(msg)
+	case LevelInfo:
+		logger.syslog.Info(msg)
+	case LevelWarn:
+		logger.syslog.Warning(msg)
+	case LevelError:
+		logger.syslog.Err(msg)
+	case LevelFatal:
+		logger.syslog.Crit(msg)
+		os.Exit(1)
+	}
 }
 
 // Debug message helper function
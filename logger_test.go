@@ -2,6 +2,7 @@ package memfs_test
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -179,6 +180,107 @@ var _ = Describe("Logger", func() {
 			It("should log fatal messages and exit", func() {
 				Skip("not sure how to check if fatal occurs")
 			})
+
+			It("should replace the sink of the logger and its subsystems", func() {
+				sub := logger.Subsystem("fuse")
+				next, err := InitLogger(filepath.Join(testDir, "next.log"), "DEBUG")
+				Ω(err).ShouldNot(HaveOccurred())
+
+				done := make(chan struct{})
+				go func() {
+					defer close(done)
+					for i := 0; i < 100; i++ {
+						sub.Info("concurrent message %d", i)
+					}
+				}()
+
+				Ω(logger.Replace(next)).Should(Succeed())
+				<-done
+
+				sub.Debug("after the replacement")
+				Ω(logger.Level).Should(Equal(LevelDebug))
+
+				data, err := ioutil.ReadFile(filepath.Join(testDir, "next.log"))
+				Ω(err).ShouldNot(HaveOccurred())
+				Ω(string(data)).Should(ContainSubstring("after the replacement"))
+
+				data, err = ioutil.ReadFile(path)
+				Ω(err).ShouldNot(HaveOccurred())
+				Ω(string(data)).ShouldNot(ContainSubstring("after the replacement"))
+			})
+		})
+
+		Context("structured json records", func() {
+
+			var path string
+
+			BeforeEach(func() {
+				testDir, err = ioutil.TempDir("", TempDirPrefix)
+				Ω(err).Should(BeNil(), fmt.Sprintf("%s", err))
+
+				path = filepath.Join(testDir, "testing.log")
+				conf := &LogConfig{
+					Path:   path,
+					Format: "json",
+					Levels: map[string]string{"fuse": "warn", "http": "debug"},
+				}
+
+				logger, err = NewLogger(conf, "INFO")
+				Ω(err).Should(BeNil(), fmt.Sprintf("%s", err))
+				Ω(logger.Format).Should(Equal(FormatJSON))
+			})
+
+			AfterEach(func() {
+				err = os.RemoveAll(testDir)
+				Ω(err).Should(BeNil(), fmt.Sprintf("%s", err))
+			})
+
+			It("should write one json object per line with fields", func() {
+				fields := &LogFields{Op: "write", Node: 42, Path: "/a.txt", Size: 128, UID: 501}
+				logger.Event(LevelInfo, fields, "wrote %d bytes", 128)
+
+				data, err := ioutil.ReadFile(path)
+				Ω(err).Should(BeNil(), fmt.Sprintf("%s", err))
+
+				record := make(map[string]interface{})
+				Ω(json.Unmarshal(data, &record)).Should(Succeed())
+				Ω(record["level"]).Should(Equal("INFO"))
+				Ω(record["msg"]).Should(Equal("wrote 128 bytes"))
+				Ω(record["op"]).Should(Equal("write"))
+				Ω(record["node"]).Should(BeNumerically("==", 42))
+				Ω(record["path"]).Should(Equal("/a.txt"))
+				Ω(record["size"]).Should(BeNumerically("==", 128))
+				Ω(record["uid"]).Should(BeNumerically("==", 501))
+			})
+
+			It("should omit fields from plain messages", func() {
+				logger.Info("plain message")
+
+				data, err := ioutil.ReadFile(path)
+				Ω(err).Should(BeNil(), fmt.Sprintf("%s", err))
+
+				record := make(map[string]interface{})
+				Ω(json.Unmarshal(data, &record)).Should(Succeed())
+				Ω(record).ShouldNot(HaveKey("op"))
+				Ω(record).ShouldNot(HaveKey("uid"))
+			})
+
+			It("should apply subsystem level overrides", func() {
+				logger.Subsystem("fuse").Info("suppressed")
+				logger.Subsystem("http").Debug("allowed")
+				logger.Subsystem("audit").Debug("suppressed")
+
+				data, err := ioutil.ReadFile(path)
+				Ω(err).Should(BeNil(), fmt.Sprintf("%s", err))
+
+				lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+				Ω(lines).Should(HaveLen(1))
+
+				record := make(map[string]interface{})
+				Ω(json.Unmarshal([]byte(lines[0]), &record)).Should(Succeed())
+				Ω(record["subsystem"]).Should(Equal("http"))
+				Ω(record["msg"]).Should(Equal("allowed"))
+			})
 		})
 
 	})
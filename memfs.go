@@ -4,15 +4,17 @@ package memfs
 
 import (
 	"fmt"
+	"net/http"
 	"os"
 	"strings"
 	"sync"
+	"syscall"
+	"time"
 
 	"golang.org/x/net/context"
 
 	"bazil.org/fuse"
 	"bazil.org/fuse/fs"
-	"github.com/bbengfort/sequence"
 )
 
 const (
@@ -24,12 +26,27 @@ const (
 	minBlockSize = uint64(512)
 )
 
+// Estimated memory overhead of file system metadata, used to report space
+// that is not available for file data and the default inode limit.
+const (
+	NodeOverhead     = uint64(256)  // Bytes of memory used by each node
+	DefaultInodeSize = uint64(4096) // Capacity per inode if MaxInodes is not set
+)
+
 var (
-	logger *Logger
+	logger  *Logger
+	fuseLog *Logger // Logs the events of the fuse operations
 )
 
+// ENOSPC is returned when the file system has run out of inodes.
+var ENOSPC = fuse.Errno(syscall.ENOSPC)
+
 func init() {
 	logger, _ = InitLogger("", "DEBUG")
+
+	// The subsystem logger shares the sink of the logger, which is replaced in
+	// place when the logger is reconfigured.
+	fuseLog = logger.Subsystem("fuse")
 }
 
 //===========================================================================
@@ -39,16 +56,23 @@ func init() {
 // New MemFS file system created from a mount path and a configuration. This
 // is the entry point for creating and launching all in-memory file systems.
 func New(mount string, config *Config) *FileSystem {
-	// Set the Log Level
-	if config.Level != "" {
-		logger, _ = InitLogger("", strings.ToUpper(config.Level))
+	// Set the Log Level and configure the log sink
+	if err := reconfigureLogger(&config.Logging, strings.ToUpper(config.Level)); err != nil {
+		logger.Error("could not configure logging: %s", err)
 	}
 
+	return newFileSystem(mount, config)
+}
+
+// newFileSystem creates the file system as New does without configuring the
+// process-wide logger, which the Manager configures once for all volumes.
+func newFileSystem(mount string, config *Config) *FileSystem {
 	// Create the file system
 	fs := new(FileSystem)
 	fs.MountPoint = mount
 	fs.Config = config
-	fs.Sequence, _ = sequence.New()
+	fs.Inodes = NewInodeTable()
+	fs.usage = make(map[uint32]*Usage)
 
 	// Set the UID and GID of the file system
 	fs.uid = uint32(os.Geteuid())
@@ -57,9 +81,86 @@ func New(mount string, config *Config) *FileSystem {
 	// Set other system flags from the configuration
 	fs.readonly = fs.Config.ReadOnly
 
+	// Open the audit trail if one is configured
+	if config.Audit.Path != "" {
+		var err error
+		if fs.audit, err = OpenAuditLog(&config.Audit); err != nil {
+			logger.Error("could not open audit log: %s", err)
+		}
+	}
+
+	// Keep file data out of swap if configured and permitted
+	if config.Mlock {
+		if err := lockMemory(); err != nil {
+			logger.Warn("could not lock memory, file data may be swapped to disk: %s", err)
+		}
+	}
+
+	// Create the keyring if encryption is enabled, refusing writes rather
+	// than storing data in plaintext if the key cannot be loaded.
+	if config.Encryption.Enabled() {
+		var err error
+		if fs.keys, err = NewKeyring(&config.Encryption); err != nil {
+			logger.Error("could not load encryption key, mounting readonly: %s", err)
+			fs.readonly = true
+		}
+	}
+
+	// Open the spill directory if one is configured
+	if config.Spill.Path != "" {
+		var err error
+		if fs.spill, err = OpenSpillStore(&config.Spill); err != nil {
+			logger.Error("could not open spill directory: %s", err)
+		} else {
+			fs.spill.keys = fs.keys
+		}
+	}
+
+	// Create the block store if deduplication is enabled
+	if config.Dedup.Enabled {
+		fs.blocks = NewBlockStore(&config.Dedup)
+	}
+
+	// Compress cold data in the background if enabled
+	if config.Compress.After > 0 {
+		fs.stopSweep = make(chan struct{})
+		go fs.sweep(time.Duration(config.Compress.After), fs.stopSweep)
+	}
+
+	// Remove expired entries in the background if enabled
+	if config.TTL.Interval > 0 {
+		fs.stopReap = make(chan struct{})
+		go fs.reaper(time.Duration(config.TTL.Interval), fs.stopReap)
+	}
+
+	// Create the change notification feed
+	fs.watch = NewWatcher(&config.Watch)
+
 	// Create the root directory
 	fs.root = new(Dir)
 	fs.root.Init("/", 0755, nil, fs)
+	fs.charge(&fs.root.Node, 0, 1)
+
+	// Restore the inode numbers of the entries that are loaded again
+	if config.InodeState != "" {
+		if err := fs.Inodes.Load(config.InodeState); err != nil && !os.IsNotExist(err) {
+			logger.Error("could not restore inode state: %s", err)
+		}
+	}
+
+	// Merge the lower directory into the tree on access if configured
+	fs.root.origin = config.Overlay
+
+	// Load the backing directory and mirror mutations to it if configured
+	if config.Mirror.Path != "" {
+		if fs.keys != nil && !config.Mirror.Sealed {
+			logger.Error("not mirroring to %s: the mirror of an encrypted file system must be sealed", config.Mirror.Path)
+		} else if err := fs.loadMirror(config.Mirror.Path); err != nil {
+			logger.Error("could not load mirror directory: %s", err)
+		} else if fs.mirror, err = NewMirror(&config.Mirror); err != nil {
+			logger.Error("could not open mirror directory: %s", err)
+		}
+	}
 
 	// Return the file system
 	return fs
@@ -72,24 +173,69 @@ func New(mount string, config *Config) *FileSystem {
 // FileSystem implements the fuse.FS* interfaces as well as providing a
 // lockable interaction structure to ensure concurrent accesses succeed.
 type FileSystem struct {
-	sync.Mutex                    // FileSystem can be locked and unlocked
-	MountPoint string             // Path to the mount location on disk
-	Config     *Config            // Configuration of the FileSystem
-	Conn       *fuse.Conn         // Hook to the FUSE connection object
-	Sequence   *sequence.Sequence // Monotonically increasing counter for inodes
-	root       *Dir               // The root of the file system
-	uid        uint32             // The user id of the process running the file system
-	gid        uint32             // The group id of the process running the file system
-	nfiles     uint64             // The number of files in the file system
-	ndirs      uint64             // The number of directories in the file system
-	nbytes     uint64             // The amount of data in the file system
-	readonly   bool               // If the file system is readonly or not
+	sync.Mutex                   // FileSystem can be locked and unlocked
+	MountPoint string            // Path to the mount location on disk
+	Config     *Config           // Configuration of the FileSystem
+	Conn       *fuse.Conn        // Hook to the FUSE connection object
+	server     *fs.Server        // The FUSE server, used to invalidate kernel caches
+	Inodes     *InodeTable       // Allocates inode numbers and looks up nodes by them
+	root       *Dir              // The root of the file system
+	uid        uint32            // The user id of the process running the file system
+	gid        uint32            // The group id of the process running the file system
+	nfiles     uint64            // The number of files in the file system
+	ndirs      uint64            // The number of directories in the file system
+	nbytes     uint64            // The amount of data in the file system
+	xbytes     uint64            // The amount of extended attribute data
+	sbytes     uint64            // The amount of data evicted to the spill store
+	snapbytes  uint64            // The amount of data held only by snapshots
+	snapshots  *Dir              // Hidden directory of read-only snapshots
+	views      int               // The number of snapshot directories yet to be copied
+	frozen     uint64            // The number of inodes held by snapshot and export copies
+	blocks     *BlockStore       // Deduplicated blocks of file data (nil if disabled)
+	zbytes     uint64            // The amount of data that has been compressed
+	zsize      uint64            // The size of the compressed data
+	stopSweep  chan struct{}     // Stops the background compression of cold data
+	stopReap   chan struct{}     // Stops the background removal of expired entries
+	reaping    sync.Mutex        // Serializes runs of the reaper, which release the lock between directories
+	keys       *Keyring          // Encrypts file data and extended attributes (nil if disabled)
+	usage      map[uint32]*Usage // Bytes and inodes owned by each user
+	loading    bool              // If entries are being loaded and take their restored inode numbers
+	readonly   bool              // If the file system is readonly or not
+	mountedRO  bool              // If the file system was mounted readonly
+	audit      *AuditLog         // Append-only record of mutations (optional)
+	watch      *Watcher          // Change notification feed for subscribers
+	spill      *SpillStore       // Backing store for evicted file data (optional)
+	mirror     *Mirror           // Backing directory mutations are propagated to (optional)
+	control    *http.Server      // HTTP control API server (optional)
+	ctlDir     *ctlDir           // Hidden directory of virtual control files
+	budget     *Budget           // Memory shared with the other volumes of a manager (optional)
 }
 
 // Run the FileSystem, mounting the MountPoint and connecting to FUSE
 func (mfs *FileSystem) Run() error {
 	var err error
 
+	// Seed the tree before mounting so that a failure leaves nothing mounted.
+	if mfs.Config.Preload != "" {
+		if err = mfs.Preload(mfs.Config.Preload); err != nil {
+			return err
+		}
+	}
+
+	// Reuse the inode numbers of entries that were not loaded again, except
+	// for the lower directory, whose entries are loaded as they are accessed,
+	// and save the inode numbers of the loaded tree.
+	mfs.Lock()
+	if mfs.Config.Overlay == "" {
+		mfs.Inodes.Settle()
+	}
+	err = mfs.saveInodes()
+	mfs.Unlock()
+
+	if err != nil {
+		logger.Error("could not save inode state: %s", err)
+	}
+
 	// Unmount the FS in case it was mounted with errors.
 	fuse.Unmount(mfs.MountPoint)
 
@@ -101,9 +247,12 @@ func (mfs *FileSystem) Run() error {
 	}
 
 	// If we're in readonly mode - pass to the mount options
+	mfs.Lock()
 	if mfs.readonly {
 		opts = append(opts, fuse.ReadOnly())
+		mfs.mountedRO = true
 	}
+	mfs.Unlock()
 
 	// Mount the FS with the specified options
 	if mfs.Conn, err = fuse.Mount(mfs.MountPoint, opts...); err != nil {
@@ -114,8 +263,19 @@ func (mfs *FileSystem) Run() error {
 	defer mfs.Conn.Close()
 	logger.Info("mounted memfs:// on %s", mfs.MountPoint)
 
+	// Serve the control API if an address is configured
+	if mfs.Config.Control != "" {
+		mfs.serveControl()
+	}
+
+	// Create the server so that kernel caches can be invalidated
+	server := fs.New(mfs.Conn, nil)
+	mfs.Lock()
+	mfs.server = server
+	mfs.Unlock()
+
 	// Serve the file system
-	if err = fs.Serve(mfs.Conn, mfs); err != nil {
+	if err = server.Serve(mfs); err != nil {
 		return err
 	}
 
@@ -134,6 +294,40 @@ func (mfs *FileSystem) Run() error {
 func (mfs *FileSystem) Shutdown() error {
 	logger.Info("shutting the file system down gracefully")
 
+	if mfs.audit != nil {
+		if err := mfs.audit.Close(); err != nil {
+			logger.Error("could not close audit log: %s", err)
+		}
+	}
+
+	if mfs.stopSweep != nil {
+		close(mfs.stopSweep)
+		mfs.stopSweep = nil
+	}
+
+	if mfs.stopReap != nil {
+		close(mfs.stopReap)
+		mfs.stopReap = nil
+	}
+
+	if mfs.mirror != nil {
+		if err := mfs.mirror.Close(); err != nil {
+			logger.Error("could not close mirror: %s", err)
+		}
+	}
+
+	if mfs.control != nil {
+		if err := mfs.control.Close(); err != nil {
+			logger.Error("could not close control api: %s", err)
+		}
+	}
+
+	mfs.Lock()
+	if err := mfs.saveInodes(); err != nil {
+		logger.Error("could not save inode state: %s", err)
+	}
+	mfs.Unlock()
+
 	if mfs.Conn == nil {
 		return nil
 	}
@@ -145,6 +339,96 @@ func (mfs *FileSystem) Shutdown() error {
 	return nil
 }
 
+// Subscribe to change notifications for the subtree rooted at prefix,
+// optionally filtered to the given operations. Events are delivered on a
+// channel with the specified buffer size (or the configured default if not
+// positive). The subscription must be closed when no longer needed.
+func (mfs *FileSystem) Subscribe(prefix string, buffer int, ops ...string) *Subscription {
+	return mfs.watch.Subscribe(prefix, buffer, ops...)
+}
+
+// unlink updates the file system state when an entity is detached from the
+// tree, releasing its inode for reuse. Must be called with the lock held.
+func (mfs *FileSystem) unlink(ent Entity) {
+	if ent.IsDir() {
+		mfs.ndirs--
+	} else {
+		mfs.nfiles--
+	}
+
+	node := ent.GetNode()
+	u := nodeUsage(node)
+	mfs.charge(node, -int64(u.Bytes), -int64(u.Inodes))
+	mfs.nbytes = addClamped(mfs.nbytes, -int64(u.Bytes))
+
+	if f, ok := ent.(*File); ok {
+		f.scrubData()
+		f.unshare(false)
+		f.scrubBlocks()
+		f.release()
+		f.dropPacked()
+		f.dropSealed()
+		f.discard()
+		mfs.forget(f)
+	}
+
+	for name, value := range node.XAttrs {
+		mfs.xbytes -= uint64(len(name) + len(value))
+	}
+	mfs.Inodes.Release(node.ID)
+}
+
+// maxInodes returns the configured inode limit or, if it is not set, the
+// number of inodes that the capacity allows.
+func (mfs *FileSystem) maxInodes() uint64 {
+	if mfs.Config.MaxInodes > 0 {
+		return mfs.Config.MaxInodes
+	}
+	return mfs.capacity() / DefaultInodeSize
+}
+
+// liveInodes returns the number of inodes of the live tree, excluding those
+// of snapshots and of the copies frozen for exports. Must be called with the
+// lock held.
+func (mfs *FileSystem) liveInodes() uint64 {
+	return addClamped(uint64(mfs.Inodes.Len()), -int64(mfs.frozen))
+}
+
+// checkInodes returns ENOSPC if no more inodes can be allocated. Every node
+// of the live tree (directories as well as files) counts toward the limit,
+// while the nodes of snapshots are only charged as metadata. Must be called
+// with the lock held.
+func (mfs *FileSystem) checkInodes() error {
+	if mfs.liveInodes() >= mfs.maxInodes() {
+		logger.Debug("(error) no inodes are available, limit is %d", mfs.maxInodes())
+		return ENOSPC
+	}
+	return nil
+}
+
+// used returns the bytes of data in the file system, including data that is
+// held only by snapshots and excluding the savings of deduplication and
+// compression. Must be called with the lock held.
+func (mfs *FileSystem) used() uint64 {
+	return mfs.nbytes + mfs.snapbytes - mfs.savings()
+}
+
+// savings returns the bytes saved by deduplication and compression. Must be
+// called with the lock held.
+func (mfs *FileSystem) savings() uint64 {
+	saved := addClamped(mfs.zbytes, -int64(mfs.zsize))
+	if mfs.blocks != nil {
+		saved += mfs.blocks.Savings()
+	}
+	return saved
+}
+
+// metadataSize returns the estimated memory used by nodes and extended
+// attributes. Must be called with the lock held.
+func (mfs *FileSystem) metadataSize() uint64 {
+	return uint64(mfs.Inodes.Len())*NodeOverhead + mfs.xbytes
+}
+
 //===========================================================================
 // Implement fuse.FS* Methods
 //===========================================================================
@@ -189,21 +473,52 @@ func (mfs *FileSystem) GenerateInode(parentInode uint64, name string) uint64 {
 func (mfs *FileSystem) Statfs(ctx context.Context, req *fuse.StatfsRequest, resp *fuse.StatfsResponse) error {
 	logger.Debug("statfs called on file system")
 
+	mfs.Lock()
+	defer mfs.Unlock()
+
 	// Compute the total number of available blocks
-	resp.Blocks = mfs.Config.CacheSize / minBlockSize
+	resp.Blocks = mfs.capacity() / minBlockSize
+
+	// Report the share of the memory budget if it is more constrained
+	if share := mfs.budget.share(mfs); share/minBlockSize < resp.Blocks {
+		resp.Blocks = share / minBlockSize
+	}
+
+	// Compute the number of blocks used by data and metadata
+	numblocks := Blocks(mfs.used() + mfs.metadataSize())
+
+	// Report the total number of inodes in the file system (and those free)
+	resp.Files = mfs.maxInodes()
+	if inodes := mfs.liveInodes(); inodes < resp.Files {
+		resp.Ffree = resp.Files - inodes
+	}
 
-	// Compute the number of used blocks
-	numblocks := Blocks(mfs.nbytes)
+	// Report the quota of the caller if it is more constrained
+	if q, ok := mfs.Config.Quotas.Users[req.Header.Uid]; ok {
+		u := mfs.userUsage(req.Header.Uid)
+		if q.Bytes > 0 && q.Bytes/minBlockSize < resp.Blocks {
+			resp.Blocks = q.Bytes / minBlockSize
+			numblocks = Blocks(u.Bytes)
+		}
+
+		if q.Inodes > 0 && q.Inodes < resp.Files {
+			resp.Files = q.Inodes
+			resp.Ffree = 0
+			if u.Inodes < q.Inodes {
+				resp.Ffree = q.Inodes - u.Inodes
+			}
+		}
+	}
+
+	if numblocks > resp.Blocks {
+		numblocks = resp.Blocks
+	}
 
 	// Report the number of free and available blocks for the block size
 	resp.Bfree = resp.Blocks - numblocks
 	resp.Bavail = resp.Blocks - numblocks
 	resp.Bsize = uint32(minBlockSize)
 
-	// Report the total number of files in the file system (and those free)
-	resp.Files = mfs.nfiles
-	resp.Ffree = 0
-
 	// Report the maximum length of a name and the minimum fragment size
 	resp.Namelen = 2048
 	resp.Frsize = uint32(minBlockSize)
@@ -2,6 +2,8 @@ package memfs_test
 
 import (
 	"math/rand"
+	"net/http"
+	"net/http/httptest"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
@@ -31,3 +33,10 @@ func randString(n int) string {
 	}
 	return string(b)
 }
+
+// Create a request of the control api from the loopback interface
+func localRequest(method, target string) *http.Request {
+	req := httptest.NewRequest(method, target, nil)
+	req.RemoteAddr = "127.0.0.1:4157"
+	return req
+}
@@ -1,6 +1,14 @@
 package memfs_test
 
 import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"bazil.org/fuse"
+
+	"golang.org/x/net/context"
+
 	. "github.com/bbengfort/memfs"
 
 	. "github.com/onsi/ginkgo"
@@ -15,4 +23,59 @@ var _ = Describe("MemFS Package", func() {
 		Ω(PackageVersion()).Should(Equal(ExpectedVersion))
 	})
 
+	Describe("capacity", func() {
+
+		var err error
+		var tmpDir string
+		var config *Config
+		var fs *FileSystem
+
+		BeforeEach(func() {
+			tmpDir, err = ioutil.TempDir("", TempDirPrefix)
+			Ω(err).ShouldNot(HaveOccurred())
+
+			config = makeTestConfig()
+			config.MaxInodes = 3
+			fs = New(filepath.Join(tmpDir, "testmp"), config)
+		})
+
+		AfterEach(func() {
+			Ω(os.RemoveAll(tmpDir)).Should(Succeed())
+		})
+
+		It("should limit the number of inodes", func() {
+			Ω(fs.Mkdir("/a", 0755)).Should(Succeed())
+			Ω(fs.WriteFile("/a/b.txt", nil, 0644)).Should(Succeed())
+			Ω(fs.Mkdir("/c", 0755)).Should(MatchError(ENOSPC))
+			Ω(fs.WriteFile("/c.txt", nil, 0644)).Should(MatchError(ENOSPC))
+
+			Ω(fs.Remove("/a/b.txt")).Should(Succeed())
+			Ω(fs.WriteFile("/c.txt", nil, 0644)).Should(Succeed())
+		})
+
+		It("should report free inodes and blocks used by metadata", func() {
+			resp := new(fuse.StatfsResponse)
+			Ω(fs.Statfs(context.TODO(), new(fuse.StatfsRequest), resp)).Should(Succeed())
+			Ω(resp.Files).Should(Equal(uint64(3)))
+			Ω(resp.Ffree).Should(Equal(uint64(2)))
+			Ω(resp.Blocks - resp.Bfree).Should(Equal(Blocks(NodeOverhead)))
+
+			Ω(fs.WriteFile("/a.txt", make([]byte, 1024), 0644)).Should(Succeed())
+
+			resp = new(fuse.StatfsResponse)
+			Ω(fs.Statfs(context.TODO(), new(fuse.StatfsRequest), resp)).Should(Succeed())
+			Ω(resp.Ffree).Should(Equal(uint64(1)))
+			Ω(resp.Blocks - resp.Bfree).Should(Equal(Blocks(1024 + 2*NodeOverhead)))
+		})
+
+		It("should derive the inode limit from the cache size", func() {
+			config.MaxInodes = 0
+
+			resp := new(fuse.StatfsResponse)
+			Ω(fs.Statfs(context.TODO(), new(fuse.StatfsRequest), resp)).Should(Succeed())
+			Ω(resp.Files).Should(Equal(config.CacheSize / DefaultInodeSize))
+		})
+
+	})
+
 })
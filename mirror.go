@@ -0,0 +1,467 @@
+// Propagation of mutations to a backing directory on disk.
+
+package memfs
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"bazil.org/fuse"
+)
+
+// Defaults of the write back queue.
+const (
+	DefaultMirrorQueue   = 1024
+	DefaultMirrorRetries = 5
+	DefaultMirrorBackoff = 100 * time.Millisecond
+)
+
+//===========================================================================
+// Mirror Type and Constructor
+//===========================================================================
+
+// MirrorConfig specifies a backing directory that is loaded into the file
+// system when it is created and to which mutations are propagated, either
+// synchronously (write-through) or from a background queue (write-back).
+type MirrorConfig struct {
+	Path    string   `json:"path" yaml:"path"`       // Backing directory to load and mirror mutations to
+	Async   bool     `json:"async" yaml:"async"`     // Write back from a background queue instead of writing through
+	Queue   int      `json:"queue" yaml:"queue"`     // Maximum number of pending write backs
+	Retries int      `json:"retries" yaml:"retries"` // Attempts to apply a write back before it is dropped
+	Backoff Duration `json:"backoff" yaml:"backoff"` // Delay before the first retry, doubled on each attempt
+	Sealed  bool     `json:"sealed" yaml:"sealed"`   // Mirror an encrypted file system as sealed streams
+}
+
+// Mirror applies mutations to the backing directory. Written data is only
+// propagated once it has been flushed (or fsynced), so the backing directory
+// always contains complete versions of files. Mirroring plaintext would write
+// the secrets that encryption protects to disk, so if encryption is enabled
+// the mirror must be configured as sealed: files are written as sealed
+// streams and extended attribute values as they are sealed in memory, so
+// truncating a file rewrites it. A sealed backing directory is therefore not
+// a tree of plain files, and can only be loaded by memfs with the same keys.
+type Mirror struct {
+	Path    string         // The backing directory
+	retries int            // Attempts to apply a write back
+	backoff time.Duration  // Delay before the first retry
+	queue   chan *mirrorOp // Pending write backs (nil if writing through)
+	done    sync.WaitGroup // Completes when the queue has been drained
+	mu      sync.Mutex     // Protects closed
+	closed  bool           // If the mirror no longer accepts operations
+}
+
+// NewMirror creates a mirror of the backing directory, starting the write
+// back worker if the mirror is asynchronous.
+func NewMirror(conf *MirrorConfig) (*Mirror, error) {
+	info, err := os.Stat(conf.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	if !info.IsDir() {
+		return nil, errors.New("mirror path is not a directory")
+	}
+
+	m := &Mirror{
+		Path:    conf.Path,
+		retries: conf.Retries,
+		backoff: time.Duration(conf.Backoff),
+	}
+
+	if m.retries <= 0 {
+		m.retries = DefaultMirrorRetries
+	}
+
+	if m.backoff <= 0 {
+		m.backoff = DefaultMirrorBackoff
+	}
+
+	if conf.Async {
+		size := conf.Queue
+		if size <= 0 {
+			size = DefaultMirrorQueue
+		}
+
+		m.queue = make(chan *mirrorOp, size)
+		m.done.Add(1)
+		go m.writeBack()
+	}
+
+	return m, nil
+}
+
+//===========================================================================
+// Mirror Operations
+//===========================================================================
+
+// mirrorOp is a snapshot of a mutation and of the state of the node that is
+// required to apply it to the backing directory.
+type mirrorOp struct {
+	op      string      // Name of the mutating operation
+	path    string      // Path relative to the mount point
+	newPath string      // Destination path of a rename or the new name of a link
+	isDir   bool        // If the node is a directory
+	isLink  bool        // If the node is a symbolic link
+	target  string      // Path a symbolic link points to
+	links   []string    // Paths of the other hard links of a file
+	mode    os.FileMode // Permissions of the node
+	size    uint64      // Size of the node
+	mtime   time.Time   // Modification time of the node
+	atime   time.Time   // Access time of the node
+	data    io.Reader   // Contents of a written file
+	release func()      // Releases the contents once applied (optional)
+	xattr   string      // Name of the extended attribute
+	value   []byte      // Value of the extended attribute (nil if removed)
+	keys    *Keyring    // Seals the contents (nil if encryption is disabled)
+}
+
+// Apply the operation to the backing directory, or queue it if the mirror
+// writes back, returning ENOSPC without queueing it if the queue is full.
+func (m *Mirror) Apply(op *mirrorOp) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.closed {
+		return errors.New("mirror is closed")
+	}
+
+	if m.queue == nil {
+		return m.apply(op)
+	}
+
+	select {
+	case m.queue <- op:
+		return nil
+	default:
+		return ENOSPC
+	}
+}
+
+// async returns true if the mirror writes back from a background queue.
+func (m *Mirror) async() bool {
+	return m.queue != nil
+}
+
+// Close the mirror, waiting until all queued write backs have been applied.
+func (m *Mirror) Close() error {
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		return nil
+	}
+
+	m.closed = true
+	if m.queue != nil {
+		close(m.queue)
+	}
+	m.mu.Unlock()
+
+	m.done.Wait()
+	return nil
+}
+
+// writeBack applies queued operations, retrying failed operations with
+// exponential backoff and dropping them once the retries are exhausted.
+func (m *Mirror) writeBack() {
+	defer m.done.Done()
+
+	for op := range m.queue {
+		delay := m.backoff
+		for attempt := 1; ; attempt++ {
+			err := m.apply(op)
+			if err == nil {
+				break
+			}
+
+			if attempt >= m.retries {
+				logger.Subsystem("mirror").Error("dropping %s of %q after %d attempts: %s", op.op, op.path, attempt, err)
+				break
+			}
+
+			logger.Subsystem("mirror").Warn("retrying %s of %q in %s: %s", op.op, op.path, delay, err)
+			time.Sleep(delay)
+			delay *= 2
+		}
+
+		if op.release != nil {
+			op.release()
+		}
+	}
+}
+
+// apply the operation to the backing directory.
+func (m *Mirror) apply(op *mirrorOp) error {
+	path := filepath.Join(m.Path, op.path)
+
+	switch op.op {
+	case OpCreate:
+		if op.keys != nil {
+			return writeMirrored(path, op)
+		}
+		return ioutil.WriteFile(path, nil, op.mode)
+
+	case OpMkdir:
+		if err := os.Mkdir(path, op.mode); err != nil && !os.IsExist(err) {
+			return err
+		}
+		return nil
+
+	case OpSymlink:
+		if err := os.Symlink(op.target, path); err != nil && !os.IsExist(err) {
+			return err
+		}
+		return nil
+
+	case OpLink:
+		if err := os.Link(path, filepath.Join(m.Path, op.newPath)); err != nil && !os.IsExist(err) {
+			return err
+		}
+		return nil
+
+	case OpWrite, OpFlush:
+		if err := writeMirrored(path, op); err != nil {
+			return err
+		}
+		return m.relink(path, op)
+
+	case OpRename:
+		return os.Rename(path, filepath.Join(m.Path, op.newPath))
+
+	case OpRemove:
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+
+	case OpSetattr:
+		// The attributes of a symbolic link cannot be set without following it.
+		if op.isLink {
+			return nil
+		}
+
+		// A sealed stream cannot be truncated, so it is rewritten.
+		if op.data != nil {
+			if err := writeMirrored(path, op); err != nil {
+				return err
+			}
+
+			if err := m.relink(path, op); err != nil {
+				return err
+			}
+		} else if err := os.Chmod(path, op.mode); err != nil {
+			return err
+		}
+
+		if !op.isDir && op.keys == nil {
+			if err := os.Truncate(path, int64(op.size)); err != nil {
+				return err
+			}
+		}
+		return os.Chtimes(path, op.atime, op.mtime)
+
+	case OpSetxattr:
+		if op.isLink {
+			return nil
+		}
+		return setDiskXattr(path, op.xattr, op.value)
+
+	case OpRemovexattr:
+		if op.isLink {
+			return nil
+		}
+		return removeDiskXattr(path, op.xattr)
+	}
+
+	return nil
+}
+
+// relink replaces the other hard links of a file that has been rewritten at
+// the path with links to the new backing file.
+func (m *Mirror) relink(path string, op *mirrorOp) error {
+	for _, link := range op.links {
+		link = filepath.Join(m.Path, link)
+		if err := os.Remove(link); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+
+		if err := os.Link(path, link); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeMirrored writes the contents of the operation to a temporary file,
+// sealing them if encryption is enabled, and renames it to the path so that
+// the backing file is never left partially written. A retried operation
+// writes its contents again from the start.
+func writeMirrored(path string, op *mirrorOp) error {
+	data := op.data
+	if data == nil {
+		data = bytes.NewReader(nil)
+	}
+
+	if seeker, ok := data.(io.Seeker); ok {
+		if _, err := seeker.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+	}
+
+	tmp := filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+".memfs-tmp")
+	fobj, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, op.mode)
+	if err != nil {
+		return err
+	}
+
+	if op.keys != nil {
+		err = op.keys.sealStream(fobj, data)
+	} else {
+		_, err = io.Copy(fobj, data)
+	}
+
+	if err != nil {
+		fobj.Close()
+		return err
+	}
+
+	if err := fobj.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Chmod(tmp, op.mode); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+//===========================================================================
+// File System Mirroring
+//===========================================================================
+
+// mirrorMutation snapshots the mutation and the state of the mutated node and
+// applies it to the mirror, returning an error if a write through failed or
+// the write back queue is full. Must be called with the lock held.
+func (mfs *FileSystem) mirrorMutation(m *Mutation) (err error) {
+	op := &mirrorOp{
+		op:      m.Op,
+		path:    m.Path,
+		newPath: m.NewPath,
+		mode:    m.NewMode.Perm(),
+		size:    m.NewSize,
+		xattr:   m.xattr,
+		keys:    mfs.keys,
+	}
+
+	// The node of a removed entity is no longer in the inode table.
+	if m.Op != OpRemove {
+		ent, ok := mfs.Inodes.Get(m.Node)
+		if !ok {
+			return nil
+		}
+
+		node := ent.GetNode()
+		op.isDir = node.IsDir()
+		op.mtime = node.Attrs.Mtime
+		op.atime = node.Attrs.Atime
+
+		switch e := ent.(type) {
+		case *Symlink:
+			op.isLink = true
+			op.target = e.Target
+		case *File:
+			op.links = e.linkPaths()
+		}
+
+		switch m.Op {
+		case OpWrite, OpFlush, OpSetattr:
+			f, ok := ent.(*File)
+
+			// Attributes are set on sealed streams by rewriting them, unless
+			// the data will be written when the file is flushed.
+			if m.Op == OpSetattr && (!ok || f.dirty || mfs.keys == nil) {
+				break
+			}
+
+			// Writes are only propagated once they are flushed.
+			if !ok || f.dirty {
+				return nil
+			}
+
+			var done func()
+			if done, err = mfs.mirrorData(f, op); err != nil {
+				logger.Subsystem("mirror").Error("could not read data of %q to mirror: %s", op.path, err)
+				return fuse.EIO
+			}
+
+			// The data is released by the write back worker once it is queued.
+			defer func() {
+				if err != nil || !mfs.mirror.async() {
+					done()
+				}
+			}()
+
+		case OpSetxattr:
+			if mfs.keys != nil {
+				op.value = node.diskXattr(m.xattr)
+				break
+			}
+
+			value, _ := node.getxattr(m.xattr)
+			op.value = append([]byte(nil), value...)
+		}
+	}
+
+	if err = mfs.mirror.Apply(op); err != nil {
+		logger.Subsystem("mirror").Error("could not mirror %s of %q: %s", op.op, op.path, err)
+		if err != ENOSPC {
+			err = fuse.EIO
+		}
+	}
+	return err
+}
+
+// mirrorData sets the data of the file as the contents of the operation
+// without faulting it into memory. A write through streams the data while the
+// lock is held. A write back shares resident data with the file until it has
+// been applied, as a snapshot does, and otherwise reads a copy of the data.
+// The returned function releases the data if the operation is not queued.
+// Must be called with the lock held.
+func (mfs *FileSystem) mirrorData(f *File, op *mirrorOp) (func(), error) {
+	// Encrypted data is copied so that the live file can still be sealed.
+	resident := !f.spilled && f.blocks == nil && f.packed == nil && f.sealed == nil
+	if mfs.mirror.async() && resident && mfs.keys == nil {
+		cow, data := f.pin()
+		op.data = bytes.NewReader(data)
+		op.release = func() {
+			mfs.Lock()
+			f.unpin(cow, data)
+			mfs.Unlock()
+		}
+		return func() { f.unpin(cow, data) }, nil
+	}
+
+	r, err := f.open()
+	if err != nil {
+		return nil, err
+	}
+
+	if !mfs.mirror.async() {
+		op.data = r
+		return func() { r.Close() }, nil
+	}
+	defer r.Close()
+
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	op.data = bytes.NewReader(data)
+	return func() {}, nil
+}
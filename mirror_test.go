@@ -0,0 +1,193 @@
+package memfs_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"bazil.org/fuse"
+
+	"golang.org/x/net/context"
+
+	. "github.com/bbengfort/memfs"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Mirror", func() {
+
+	var err error
+	var tmpDir string
+	var backing string
+	var config *Config
+	var fs *FileSystem
+	var ctx context.Context
+
+	readBacking := func(path string) string {
+		data, err := ioutil.ReadFile(filepath.Join(backing, path))
+		Ω(err).ShouldNot(HaveOccurred())
+		return string(data)
+	}
+
+	BeforeEach(func() {
+		tmpDir, err = ioutil.TempDir("", TempDirPrefix)
+		Ω(err).ShouldNot(HaveOccurred())
+
+		backing = filepath.Join(tmpDir, "backing")
+		Ω(os.MkdirAll(filepath.Join(backing, "docs"), 0755)).Should(Succeed())
+		Ω(ioutil.WriteFile(filepath.Join(backing, "docs", "a.txt"), []byte("existing"), 0640)).Should(Succeed())
+
+		config = makeTestConfig()
+		config.Mirror.Path = backing
+		ctx = context.TODO()
+	})
+
+	JustBeforeEach(func() {
+		fs = New(filepath.Join(tmpDir, "testmp"), config)
+	})
+
+	AfterEach(func() {
+		Ω(fs.Shutdown()).Should(Succeed())
+		Ω(os.RemoveAll(tmpDir)).Should(Succeed())
+	})
+
+	It("should load the backing directory", func() {
+		data, err := fs.ReadFile("/docs/a.txt")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(data).Should(Equal([]byte("existing")))
+
+		ent, err := fs.Resolve("/docs/a.txt")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(ent.GetNode().Attrs.Mode).Should(Equal(os.FileMode(0640)))
+	})
+
+	It("should write mutations through to the backing directory", func() {
+		Ω(fs.Mkdir("/new", 0755)).Should(Succeed())
+		Ω(fs.WriteFile("/new/b.txt", []byte("created"), 0644)).Should(Succeed())
+		Ω(readBacking("new/b.txt")).Should(Equal("created"))
+
+		Ω(fs.Rename("/docs/a.txt", "/new/c.txt")).Should(Succeed())
+		Ω(readBacking("new/c.txt")).Should(Equal("existing"))
+		Ω(filepath.Join(backing, "docs", "a.txt")).ShouldNot(BeAnExistingFile())
+
+		Ω(fs.Remove("/new/b.txt")).Should(Succeed())
+		Ω(filepath.Join(backing, "new", "b.txt")).ShouldNot(BeAnExistingFile())
+	})
+
+	It("should mirror symbolic and hard links", func() {
+		Ω(fs.Symlink("a.txt", "/docs/s.txt")).Should(Succeed())
+		Ω(fs.Link("/docs/a.txt", "/b.txt")).Should(Succeed())
+
+		target, err := os.Readlink(filepath.Join(backing, "docs", "s.txt"))
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(target).Should(Equal("a.txt"))
+
+		// Rewriting the backing file keeps its other names linked to it.
+		Ω(fs.WriteFile("/docs/a.txt", []byte("relinked"), 0640)).Should(Succeed())
+		Ω(readBacking("b.txt")).Should(Equal("relinked"))
+
+		a, err := os.Stat(filepath.Join(backing, "docs", "a.txt"))
+		Ω(err).ShouldNot(HaveOccurred())
+		b, err := os.Stat(filepath.Join(backing, "b.txt"))
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(os.SameFile(a, b)).Should(BeTrue())
+	})
+
+	It("should propagate written data when it is flushed", func() {
+		ent, err := fs.Resolve("/docs/a.txt")
+		Ω(err).ShouldNot(HaveOccurred())
+		f := ent.(*File)
+
+		req := &fuse.WriteRequest{Offset: 0, Data: []byte("modified")}
+		Ω(f.Write(ctx, req, new(fuse.WriteResponse))).Should(Succeed())
+		Ω(readBacking("docs/a.txt")).Should(Equal("existing"))
+
+		Ω(f.Flush(ctx, new(fuse.FlushRequest))).Should(Succeed())
+		Ω(readBacking("docs/a.txt")).Should(Equal("modified"))
+
+		setattr := &fuse.SetattrRequest{Valid: fuse.SetattrMode, Mode: 0600}
+		Ω(f.Setattr(ctx, setattr, new(fuse.SetattrResponse))).Should(Succeed())
+
+		info, err := os.Stat(filepath.Join(backing, "docs", "a.txt"))
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(info.Mode().Perm()).Should(Equal(os.FileMode(0600)))
+	})
+
+	It("should return the errors of writing through from flush", func() {
+		ent, err := fs.Resolve("/docs/a.txt")
+		Ω(err).ShouldNot(HaveOccurred())
+		f := ent.(*File)
+
+		req := &fuse.WriteRequest{Offset: 0, Data: []byte("modified")}
+		Ω(f.Write(ctx, req, new(fuse.WriteResponse))).Should(Succeed())
+		Ω(os.RemoveAll(filepath.Join(backing, "docs"))).Should(Succeed())
+		Ω(f.Fsync(ctx, new(fuse.FsyncRequest))).Should(MatchError(fuse.EIO))
+
+		// The file remains dirty so that the next flush propagates it.
+		Ω(os.Mkdir(filepath.Join(backing, "docs"), 0755)).Should(Succeed())
+		Ω(f.Flush(ctx, new(fuse.FlushRequest))).Should(Succeed())
+		Ω(readBacking("docs/a.txt")).Should(Equal("modified"))
+	})
+
+	Context("writing back", func() {
+
+		BeforeEach(func() {
+			config.Mirror.Async = true
+			config.Mirror.Queue = 16
+		})
+
+		It("should drain the queue on shutdown", func() {
+			for _, name := range []string{"/1.txt", "/2.txt", "/3.txt"} {
+				Ω(fs.WriteFile(name, []byte(name), 0644)).Should(Succeed())
+			}
+
+			Ω(fs.Shutdown()).Should(Succeed())
+			Ω(readBacking("1.txt")).Should(Equal("/1.txt"))
+			Ω(readBacking("3.txt")).Should(Equal("/3.txt"))
+		})
+
+		It("should refuse writes when the queue is full", func() {
+			Ω(fs.Shutdown()).Should(Succeed())
+
+			config.Mirror.Queue = 1
+			config.Mirror.Retries = 2
+			config.Mirror.Backoff = Duration(100 * time.Millisecond)
+			fs = New(filepath.Join(tmpDir, "testmp"), config)
+
+			// Write backs into the missing directory are retried until dropped.
+			Ω(os.RemoveAll(filepath.Join(backing, "docs"))).Should(Succeed())
+
+			var errs []error
+			for _, name := range []string{"/docs/1.txt", "/docs/2.txt", "/docs/3.txt"} {
+				if err := fs.WriteFile(name, []byte(name), 0644); err != nil {
+					errs = append(errs, err)
+				}
+			}
+
+			Ω(errs).ShouldNot(BeEmpty())
+			Ω(errs[0]).Should(MatchError(ENOSPC))
+		})
+
+		It("should write back the data as it was flushed", func() {
+			config.Mirror.Backoff = Duration(100 * time.Millisecond)
+			Ω(fs.Shutdown()).Should(Succeed())
+			fs = New(filepath.Join(tmpDir, "testmp"), config)
+
+			// The write back waits until the directory exists again.
+			Ω(os.RemoveAll(filepath.Join(backing, "docs"))).Should(Succeed())
+			Ω(fs.WriteFile("/docs/b.txt", []byte("original"), 0644)).Should(Succeed())
+
+			ent, err := fs.Resolve("/docs/b.txt")
+			Ω(err).ShouldNot(HaveOccurred())
+			req := &fuse.WriteRequest{Offset: 0, Data: []byte("ORIGINAL")}
+			Ω(ent.(*File).Write(ctx, req, new(fuse.WriteResponse))).Should(Succeed())
+
+			Ω(os.Mkdir(filepath.Join(backing, "docs"), 0755)).Should(Succeed())
+			Ω(fs.Shutdown()).Should(Succeed())
+			Ω(readBacking("docs/b.txt")).Should(Equal("original"))
+		})
+	})
+
+})
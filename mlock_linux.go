@@ -0,0 +1,38 @@
+//go:build linux
+// +build linux
+
+// Locking of the pages of the process in memory so that file data is never
+// written to swap.
+
+package memfs
+
+import (
+	"errors"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// Value of a limit that is unlimited. The resource number of the limit on
+// locked memory, rlimitMemlock, differs by architecture and is defined in
+// mlock_linux_mipsx.go and mlock_linux_other.go.
+const rlimInfinity = ^uint64(0)
+
+// lockMemory locks the current and future pages of the process in memory.
+// The pages are only locked if the limit on locked memory is unlimited or the
+// process is privileged, since locking future mappings against a limit would
+// cause the runtime to fail to allocate memory once it is reached.
+func lockMemory() error {
+	if os.Geteuid() != 0 {
+		var limit unix.Rlimit
+		if err := unix.Getrlimit(rlimitMemlock, &limit); err != nil {
+			return err
+		}
+
+		if limit.Cur != rlimInfinity {
+			return errors.New("the limit on locked memory is not unlimited")
+		}
+	}
+
+	return unix.Mlockall(unix.MCL_CURRENT | unix.MCL_FUTURE)
+}
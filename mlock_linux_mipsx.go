@@ -0,0 +1,11 @@
+//go:build linux && (mips || mipsle || mips64 || mips64le)
+// +build linux
+// +build mips mipsle mips64 mips64le
+
+// Resource limits of MIPS, which numbers them differently from the generic
+// numbering of the other architectures.
+
+package memfs
+
+// Resource number of the limit on locked memory.
+const rlimitMemlock = 9
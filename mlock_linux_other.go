@@ -0,0 +1,9 @@
+//go:build linux && !mips && !mipsle && !mips64 && !mips64le
+// +build linux,!mips,!mipsle,!mips64,!mips64le
+
+// Resource limits of the architectures that use the generic numbering.
+
+package memfs
+
+// Resource number of the limit on locked memory.
+const rlimitMemlock = 8
@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+// Locking the pages of the process in memory is not supported on this
+// platform.
+
+package memfs
+
+import "errors"
+
+// lockMemory returns an error since memory locking is not supported.
+func lockMemory() error {
+	return errors.New("memory locking is not supported on this platform")
+}
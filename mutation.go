@@ -0,0 +1,117 @@
+// Records of mutating operations and their dispatch to subscribers.
+
+package memfs
+
+import (
+	"os"
+	"time"
+
+	"bazil.org/fuse"
+)
+
+// Names of the operations that mutate the file system.
+const (
+	OpCreate      = "create"
+	OpMkdir       = "mkdir"
+	OpSymlink     = "symlink"
+	OpLink        = "link"
+	OpWrite       = "write"
+	OpFlush       = "flush"
+	OpRename      = "rename"
+	OpRemove      = "remove"
+	OpSetattr     = "setattr"
+	OpSetxattr    = "setxattr"
+	OpRemovexattr = "removexattr"
+)
+
+// MutationOps lists the names of all the mutating operations.
+var MutationOps = []string{
+	OpCreate, OpMkdir, OpSymlink, OpLink, OpWrite, OpFlush, OpRename, OpRemove, OpSetattr, OpSetxattr, OpRemovexattr,
+}
+
+// Sources of mutations; only mutations made through FUSE are known to the
+// kernel, all others require its caches to be invalidated.
+const (
+	SourceFUSE   = "fuse"   // A request from the kernel
+	SourceAPI    = "api"    // The in-process path API
+	SourceReaper = "reaper" // The removal of expired entries
+)
+
+//===========================================================================
+// Mutation Type and Constructor
+//===========================================================================
+
+// Mutation describes a single change to a node in the file system along with
+// the identity of the caller that made it.
+type Mutation struct {
+	Op      string      // Name of the mutating operation
+	Node    uint64      // ID of the node that was mutated
+	Path    string      // Resolved path of the node (the source path of a rename)
+	NewPath string      // Destination path of a rename or the new name of a link
+	Uid     uint32      // User id of the caller
+	Gid     uint32      // Group id of the caller
+	Pid     uint32      // Process id of the caller
+	OldSize uint64      // Size of the node before the mutation
+	NewSize uint64      // Size of the node after the mutation
+	OldMode os.FileMode // Mode of the node before the mutation
+	NewMode os.FileMode // Mode of the node after the mutation
+	Time    time.Time   // When the mutation occurred
+	Source  string      // Origin of the mutation, e.g. SourceFUSE
+	entity  Entity      // The mutated entity, if known
+	parent  *Dir        // Directory the entry was added to or removed from
+	name    string      // Name of the entry in parent
+	dst     *Dir        // Destination directory of a rename
+	newName string      // Name of the entry in dst
+	xattr   string      // Name of the extended attribute set or removed
+}
+
+// newMutation creates a mutation for the node using the caller identity in
+// the request header and the current attributes of the node as both the old
+// and new sizes and modes, which the caller should update as necessary.
+func newMutation(op string, hdr fuse.Header, n *Node) *Mutation {
+	return &Mutation{
+		Op:      op,
+		Node:    n.ID,
+		Path:    n.Path(),
+		Uid:     hdr.Uid,
+		Gid:     hdr.Gid,
+		Pid:     hdr.Pid,
+		OldSize: n.Attrs.Size,
+		NewSize: n.Attrs.Size,
+		OldMode: n.Attrs.Mode,
+		NewMode: n.Attrs.Mode,
+		Time:    time.Now(),
+		Source:  SourceFUSE,
+	}
+}
+
+//===========================================================================
+// Mutation Dispatch
+//===========================================================================
+
+// record dispatches a mutation to the audit log, to watch subscribers and to
+// the mirror, and invalidates the kernel caches if the mutation was not made
+// by the kernel. It is called after the mutation has been applied while the lock
+// is still held. The mutation cannot be undone, so the error of a mirror that
+// could not apply it is only returned for callers that report durability,
+// such as flush.
+func (mfs *FileSystem) record(m *Mutation) error {
+	mfs.watch.Publish(m)
+	mfs.updateBudget()
+
+	if m.Source != SourceFUSE {
+		mfs.invalidate(m)
+	}
+
+	var err error
+	if mfs.mirror != nil && mfs.mirrored(m) {
+		err = mfs.mirrorMutation(m)
+	}
+
+	if mfs.audit != nil {
+		if err := mfs.audit.Record(m); err != nil {
+			logger.Subsystem("audit").Error("could not record %s on %q: %s", m.Op, m.Path, err)
+		}
+	}
+	return err
+}
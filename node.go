@@ -5,6 +5,8 @@ package memfs
 import (
 	"os"
 	"path/filepath"
+	"sort"
+	"syscall"
 	"time"
 
 	"golang.org/x/net/context"
@@ -35,18 +37,22 @@ type Entity interface {
 // new NodeID, causing spurious cache invalidations, extra lookups and
 // aliasing anomalies. This may not matter for a simple, read-only filesystem.
 type Node struct {
-	ID     uint64      // Unique ID of the Node
-	Name   string      // Name of the Node
-	Attrs  fuse.Attr   // Node attributes and permissions
-	XAttrs XAttr       // Extended attributes on the node
-	Parent *Dir        // Parent directory of the Node
-	fs     *FileSystem // Stored reference to the file system
+	ID      uint64      // Unique ID of the Node (its inode number)
+	Gen     uint64      // Generation of the inode number of the Node
+	Name    string      // Name of the Node
+	Attrs   fuse.Attr   // Node attributes and permissions
+	XAttrs  XAttr       // Extended attributes on the node
+	Parent  *Dir        // Parent directory of the Node
+	fs      *FileSystem // Stored reference to the file system
+	archive bool        // If the node belongs to a read-only snapshot
+	xattrID sealID      // ID that extended attribute values are sealed for
 }
 
 // Init a Node with the required properties for storage in the file system.
 func (n *Node) Init(name string, mode os.FileMode, parent *Dir, fs *FileSystem) {
 	// Manage the Node properties
-	n.ID, _ = fs.Sequence.Next()
+	n.ID, n.Gen = fs.allocate(parent, name)
+	n.xattrID = nodeSealID(n)
 	n.Name = name
 	n.Parent = parent
 	n.XAttrs = make(XAttr)
@@ -83,9 +89,9 @@ func (n *Node) IsDir() bool {
 
 // IsArchive returns true if the node is an archive node, that is a node
 // constructed to display version history (and is therefore not writeable).
-// TODO: Implement archives
+// Nodes of snapshots are archives.
 func (n *Node) IsArchive() bool {
-	return false
+	return n.archive
 }
 
 // FuseType returns the fuse type of the node for listing
@@ -94,6 +100,10 @@ func (n *Node) FuseType() fuse.DirentType {
 		return fuse.DT_Dir
 	}
 
+	if n.Attrs.Mode&os.ModeSymlink != 0 {
+		return fuse.DT_Link
+	}
+
 	return fuse.DT_File
 }
 
@@ -145,6 +155,7 @@ func (n *Node) Attr(ctx context.Context, attr *fuse.Attr) error {
 	attr.Rdev = n.Attrs.Rdev           // device numbers
 	attr.Flags = n.Attrs.Flags         // chflags(2) flags (OS X only)
 	attr.BlockSize = n.Attrs.BlockSize // preferred blocksize for filesystem I/O
+	n.fs.attrValid(attr)               // how long the attributes may be cached
 	return nil
 }
 
@@ -185,23 +196,33 @@ func (n *Node) Forget() {
 func (n *Node) Getattr(ctx context.Context, req *fuse.GetattrRequest, resp *fuse.GetattrResponse) error {
 	logger.Debug("getting attrs on node %d", n.ID)
 	resp.Attr = n.Attrs
+	resp.Attr.Valid = DefaultAttrValid
+	n.fs.attrValid(&resp.Attr)
 	return nil
 }
 
 // Getxattr gets an extended attribute by the given name from the node.
 //
-// If there is no xattr by that name, returns fuse.ErrNoXattr.
+// If there is no xattr by that name, returns fuse.ErrNoXattr. If the value
+// is larger than the requested size, returns fuse.ERANGE; a size of zero
+// probes the size of the value.
 //
 // https://godoc.org/bazil.org/fuse/fs#NodeGetxattrer
 func (n *Node) Getxattr(ctx context.Context, req *fuse.GetxattrRequest, resp *fuse.GetxattrResponse) error {
-	if data, ok := n.XAttrs[req.Name]; ok {
+	n.fs.Lock()
+	defer n.fs.Unlock()
+
+	if err := n.checkXattrAccess(req.Header, req.Name, false); err != nil {
+		return err
+	}
+
+	if data, ok := n.getxattr(req.Name); ok {
 		logger.Debug("getting xattr named %s on node %d", req.Name, n.ID)
-		if req.Size != 0 {
-			resp.Xattr = data[:req.Size]
-		} else {
-			resp.Xattr = data
+		if req.Size != 0 && uint32(len(data)) > req.Size {
+			return fuse.ERANGE
 		}
 
+		resp.Xattr = data
 		return nil
 	}
 
@@ -209,16 +230,32 @@ func (n *Node) Getxattr(ctx context.Context, req *fuse.GetxattrRequest, resp *fu
 	return fuse.ErrNoXattr
 }
 
-// Listxattr lists the extended attributes recorded for the node.
+// Listxattr lists the extended attributes recorded for the node that are
+// visible to the user of the request.
+//
+// If the list is larger than the requested size, returns fuse.ERANGE; a
+// size of zero probes the size of the list.
 //
 // https://godoc.org/bazil.org/fuse/fs#NodeListxattrer
 func (n *Node) Listxattr(ctx context.Context, req *fuse.ListxattrRequest, resp *fuse.ListxattrResponse) error {
+	n.fs.Lock()
+	defer n.fs.Unlock()
+
 	logger.Debug("listing xattr names on node %d", n.ID)
 
+	names := make([]string, 0, len(n.XAttrs))
 	for name := range n.XAttrs {
-		resp.Append(name)
+		if n.checkXattrAccess(req.Header, name, false) == nil {
+			names = append(names, name)
+		}
 	}
 
+	sort.Strings(names)
+	resp.Append(names...)
+
+	if req.Size != 0 && uint32(len(resp.Xattr)) > req.Size {
+		return fuse.ERANGE
+	}
 	return nil
 }
 
@@ -253,16 +290,37 @@ func (n *Node) Listxattr(ctx context.Context, req *fuse.ListxattrRequest, resp *
 //
 // https://godoc.org/bazil.org/fuse/fs#NodeRemovexattrer
 func (n *Node) Removexattr(ctx context.Context, req *fuse.RemovexattrRequest) error {
+	n.fs.Lock()
+	defer n.fs.Unlock()
+
 	if n.IsArchive() || n.fs.readonly {
 		return fuse.EPERM
 	}
 
-	n.fs.Lock()
-	defer n.fs.Unlock()
+	if err := n.checkXattrAccess(req.Header, req.Name, true); err != nil {
+		return err
+	}
 
-	if _, ok := n.XAttrs[req.Name]; ok {
+	if err := n.checkProtectedXattr(req.Header, req.Name, nil, true); err != nil {
+		return err
+	}
+
+	if err := n.fs.checkRules(req.Header, n.Path(), nil); err != nil {
+		return err
+	}
+
+	if err := n.Parent.diverge(); err != nil {
+		return err
+	}
+
+	if prev, ok := n.XAttrs[req.Name]; ok {
 		logger.Debug("removing xattr named %s on node %d", req.Name, n.ID)
 		delete(n.XAttrs, req.Name)
+		n.fs.xbytes -= uint64(len(req.Name) + len(prev))
+
+		m := newMutation(OpRemovexattr, req.Header, n)
+		m.xattr = req.Name
+		n.fs.record(m)
 		return nil
 	}
 
@@ -281,13 +339,37 @@ func (n *Node) Removexattr(ctx context.Context, req *fuse.RemovexattrRequest) er
 //
 // https://godoc.org/bazil.org/fuse/fs#NodeSetattrer
 func (n *Node) Setattr(ctx context.Context, req *fuse.SetattrRequest, resp *fuse.SetattrResponse) error {
+	n.fs.Lock()
+	defer n.fs.Unlock()
+
 	if n.IsArchive() || n.fs.readonly {
 		return fuse.EPERM
 	}
 
-	n.fs.Lock()
-	defer n.fs.Unlock()
+	if err := n.fs.checkRuleSetattr(n, req); err != nil {
+		return err
+	}
 
+	if err := n.fs.checkSetattr(n, req); err != nil {
+		return err
+	}
+
+	if err := n.Parent.diverge(); err != nil {
+		return err
+	}
+
+	m := newMutation(OpSetattr, req.Header, n)
+	n.setattr(req, resp)
+
+	m.NewSize = n.Attrs.Size
+	m.NewMode = n.Attrs.Mode
+	n.fs.record(m)
+	return nil
+}
+
+// setattr applies the metadata in the request to the node and writes the
+// resulting attributes to the response. Must be called with the lock held.
+func (n *Node) setattr(req *fuse.SetattrRequest, resp *fuse.SetattrResponse) {
 	// If a handle is set - we don't do anything with that currently.
 	if req.Valid.Handle() {
 		logger.Debug("(error) setting handle attr on node %d but we don't store it!", n.ID)
@@ -334,6 +416,7 @@ func (n *Node) Setattr(ctx context.Context, req *fuse.SetattrRequest, resp *fuse
 	// Set the uid on the node
 	if req.Valid.Uid() {
 		logger.Debug("setting node %d UID to %v", n.ID, req.Uid)
+		n.fs.chown(n, req.Uid)
 		n.Attrs.Uid = req.Uid
 	}
 
@@ -371,22 +454,76 @@ func (n *Node) Setattr(ctx context.Context, req *fuse.SetattrRequest, resp *fuse
 	}
 
 	resp.Attr = n.Attrs
-	return nil
 }
 
 // Setxattr sets an extended attribute with the given name and value.
-// TODO: Use flags to fail the request if the xattr does/not already exist.
+//
+// If the flags require the xattr to be created and it exists, returns
+// fuse.EEXIST; if they require it to be replaced and it does not exist,
+// returns fuse.ErrNoXattr. Values larger than the configured limit return
+// E2BIG and xattrs that exceed the limit of the node or the capacity of the
+// file system return ENOSPC.
 //
 // https://godoc.org/bazil.org/fuse/fs#NodeSetxattrer
 func (n *Node) Setxattr(ctx context.Context, req *fuse.SetxattrRequest) error {
+	n.fs.Lock()
+	defer n.fs.Unlock()
+
 	if n.IsArchive() || n.fs.readonly {
 		return fuse.EPERM
 	}
 
-	n.fs.Lock()
-	defer n.fs.Unlock()
+	if err := n.checkSetxattr(req); err != nil {
+		return err
+	}
+
+	if err := n.checkProtectedXattr(req.Header, req.Name, req.Xattr, false); err != nil {
+		return err
+	}
+
+	if err := n.fs.checkRules(req.Header, n.Path(), nil); err != nil {
+		return err
+	}
+
+	if req.Name == TTLXattr {
+		if _, err := parseTTL(req.Xattr); err != nil {
+			logger.Debug("(error) invalid time to live %q for node %d: %s", req.Xattr, n.ID, err)
+			return fuse.Errno(syscall.EINVAL)
+		}
+	}
+
+	if err := n.Parent.diverge(); err != nil {
+		return err
+	}
+
+	// Setting the shred attribute destroys the data of the file instead.
+	if req.Name == ShredXattr {
+		return n.shred(req.Header)
+	}
 
 	logger.Debug("setting xattr named %s on node %d", req.Name, n.ID)
-	n.XAttrs[req.Name] = req.Xattr
+	n.setxattr(req.Name, req.Xattr)
+
+	m := newMutation(OpSetxattr, req.Header, n)
+	m.xattr = req.Name
+	n.fs.record(m)
 	return nil
 }
+
+// setxattr stores a copy of the value of the extended attribute, sealed if
+// encryption is enabled, and updates the file system state. Must be called
+// with the lock held.
+func (n *Node) setxattr(name string, value []byte) {
+	if prev, ok := n.XAttrs[name]; ok {
+		n.fs.xbytes -= uint64(len(name) + len(prev))
+	}
+
+	if n.fs.keys != nil {
+		value = n.fs.keys.Seal(value, n.xattrID.xattr(name))
+	} else {
+		value = append([]byte(nil), value...)
+	}
+
+	n.XAttrs[name] = value
+	n.fs.xbytes += uint64(len(name) + len(value))
+}
@@ -0,0 +1,170 @@
+// Overlay of an in-memory upper layer on a read-only lower directory.
+
+package memfs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"bazil.org/fuse"
+)
+
+//===========================================================================
+// Overlay Directories
+//===========================================================================
+
+// populate merges the entries of the lower directory into the directory the
+// first time it is accessed. Lower directories are populated lazily in turn,
+// and the data of lower files is read from disk until it is written, when it
+// is copied up into memory. Names that were removed from the directory are
+// whiteouts and are never merged, nor are the names reserved for the hidden
+// directories of the root. Lower hard links are merged as separate files,
+// since the names of a file may be in directories that are merged later. The
+// entries of a snapshot directory that has yet to copy them are copied
+// instead. Must be called with the lock held.
+func (d *Dir) populate() error {
+	if d.source != nil {
+		return d.materialize()
+	}
+
+	if d.origin == "" || d.merged {
+		return nil
+	}
+
+	// Mark the directory as merged first so that failures are not retried.
+	d.merged = true
+	infos, err := ioutil.ReadDir(d.origin)
+	if err != nil {
+		logger.Error("could not read lower directory %q: %s", d.origin, err)
+		return fuse.EIO
+	}
+
+	// Merging does not modify the directory.
+	mtime := d.Attrs.Mtime
+
+	// Merged entries are loaded, so they keep their inode numbers.
+	defer func(loading bool) { d.fs.loading = loading }(d.fs.loading)
+	d.fs.loading = true
+
+	for _, info := range infos {
+		name := info.Name()
+		if _, ok := d.Children[name]; ok || d.whiteouts[name] {
+			continue
+		}
+
+		path := filepath.Join(d.origin, name)
+		if d.reserved(name) {
+			logger.Warn("skipping %q in lower directory: the name is reserved", path)
+			continue
+		}
+
+		uid, gid := d.fs.owner(info)
+
+		var ent Entity
+		switch {
+		case info.IsDir():
+			c := d.mkdir(name, info.Mode().Perm(), uid, gid)
+			c.origin = path
+			ent = c
+
+		case info.Mode().IsRegular():
+			f := d.create(name, info.Mode().Perm(), uid, gid)
+			size := uint64(info.Size())
+
+			// The data of the file is not resident until it is copied up.
+			f.lower = path
+			f.spilled = true
+			f.Attrs.Size = size
+			f.Attrs.Blocks = Blocks(size)
+			d.fs.nbytes += size
+			d.fs.sbytes += size
+			d.fs.charge(&f.Node, int64(size), 0)
+			ent = f
+
+		case info.Mode()&os.ModeSymlink != 0:
+			target, err := os.Readlink(path)
+			if err != nil {
+				logger.Warn("skipping %q in lower directory: %s", path, err)
+				continue
+			}
+
+			l := d.symlink(name, target, uid, gid)
+			l.Attrs.Mtime = info.ModTime()
+			l.Attrs.Atime = info.ModTime()
+			continue
+
+		default:
+			logger.Debug("skipping %q in lower directory: %s is not supported", path, info.Mode().Type())
+			continue
+		}
+
+		node := ent.GetNode()
+		node.Attrs.Mtime = info.ModTime()
+		node.Attrs.Atime = info.ModTime()
+
+		xattrs, err := diskXattrs(path)
+		if err != nil {
+			logger.Warn("could not read extended attributes of %q: %s", path, err)
+		}
+
+		for xname, value := range xattrs {
+			node.setxattr(xname, value)
+		}
+	}
+
+	d.Attrs.Mtime = mtime
+	return nil
+}
+
+// whiteout records that the named entry was removed from the directory so
+// that it is never merged from the lower directory. Must be called with the
+// lock held.
+func (d *Dir) whiteout(name string) {
+	if d.origin == "" {
+		return
+	}
+
+	if d.whiteouts == nil {
+		d.whiteouts = make(map[string]bool)
+	}
+	d.whiteouts[name] = true
+}
+
+// readLower reads the data of a file that has not been copied up from the
+// lower directory into buf from the offset.
+func (f *File) readLower(buf []byte, off int64) (int, error) {
+	fobj, err := os.Open(f.lower)
+	if err != nil {
+		return 0, err
+	}
+	defer fobj.Close()
+	return fobj.ReadAt(buf, off)
+}
+
+// copyUp reads the data of a file in the lower directory into memory so that
+// it can be modified. Data that was changed on disk since the directory was
+// populated is truncated or zero-filled to the size of the file. Must be
+// called with the lock held.
+func (f *File) copyUp() error {
+	data, err := ioutil.ReadFile(f.lower)
+	if err != nil {
+		logger.Error("could not copy up %q: %s", f.lower, err)
+		return fuse.EIO
+	}
+
+	size := int(f.Attrs.Size)
+	if len(data) > size {
+		data = data[:size]
+	} else if len(data) < size {
+		data = append(data, make([]byte, size-len(data))...)
+	}
+
+	logger.Debug("copied up %d bytes of file %d from %s", size, f.ID, f.lower)
+	f.Data = data
+	f.lower = ""
+	f.spilled = false
+	f.fs.sbytes = addClamped(f.fs.sbytes, -int64(size))
+	f.fs.reclaim(f)
+	return nil
+}
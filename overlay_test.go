@@ -0,0 +1,142 @@
+package memfs_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"bazil.org/fuse"
+
+	"golang.org/x/net/context"
+
+	. "github.com/bbengfort/memfs"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Overlay", func() {
+
+	var err error
+	var tmpDir string
+	var lower string
+	var config *Config
+	var fs *FileSystem
+	var ctx context.Context
+
+	readLower := func(path string) string {
+		data, err := ioutil.ReadFile(filepath.Join(lower, path))
+		Ω(err).ShouldNot(HaveOccurred())
+		return string(data)
+	}
+
+	resolveFile := func(path string) *File {
+		ent, err := fs.Resolve(path)
+		Ω(err).ShouldNot(HaveOccurred())
+		return ent.(*File)
+	}
+
+	BeforeEach(func() {
+		tmpDir, err = ioutil.TempDir("", TempDirPrefix)
+		Ω(err).ShouldNot(HaveOccurred())
+
+		lower = filepath.Join(tmpDir, "lower")
+		Ω(os.MkdirAll(filepath.Join(lower, "fixtures"), 0755)).Should(Succeed())
+		Ω(ioutil.WriteFile(filepath.Join(lower, "fixtures", "a.txt"), []byte("fixture"), 0640)).Should(Succeed())
+		Ω(ioutil.WriteFile(filepath.Join(lower, "b.txt"), []byte("lower"), 0644)).Should(Succeed())
+
+		config = makeTestConfig()
+		config.Overlay = lower
+		ctx = context.TODO()
+	})
+
+	JustBeforeEach(func() {
+		fs = New(filepath.Join(tmpDir, "testmp"), config)
+	})
+
+	AfterEach(func() {
+		Ω(os.RemoveAll(tmpDir)).Should(Succeed())
+	})
+
+	It("should expose the lower directory", func() {
+		data, err := fs.ReadFile("/fixtures/a.txt")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(data).Should(Equal([]byte("fixture")))
+
+		f := resolveFile("/fixtures/a.txt")
+		Ω(f.Attrs.Mode).Should(Equal(os.FileMode(0640)))
+		Ω(f.Attrs.Size).Should(Equal(uint64(7)))
+	})
+
+	It("should read through to the lower directory without copying up", func() {
+		f := resolveFile("/b.txt")
+
+		req := &fuse.ReadRequest{Offset: 1, Size: 3}
+		resp := new(fuse.ReadResponse)
+		Ω(f.Read(ctx, req, resp)).Should(Succeed())
+		Ω(resp.Data).Should(Equal([]byte("owe")))
+		Ω(f.Data).Should(BeEmpty())
+	})
+
+	It("should copy up written files and leave the lower directory unchanged", func() {
+		f := resolveFile("/b.txt")
+
+		req := &fuse.WriteRequest{Offset: 5, Data: []byte(" upper")}
+		Ω(f.Write(ctx, req, new(fuse.WriteResponse))).Should(Succeed())
+		Ω(f.Data).Should(Equal([]byte("lower upper")))
+
+		Ω(fs.WriteFile("/fixtures/c.txt", []byte("new"), 0644)).Should(Succeed())
+		Ω(readLower("b.txt")).Should(Equal("lower"))
+		Ω(filepath.Join(lower, "fixtures", "c.txt")).ShouldNot(BeAnExistingFile())
+	})
+
+	It("should record removed entries as whiteouts", func() {
+		Ω(fs.Remove("/fixtures/a.txt")).Should(Succeed())
+		Ω(fs.Rename("/b.txt", "/fixtures/b.txt")).Should(Succeed())
+
+		_, err := fs.Resolve("/fixtures/a.txt")
+		Ω(err).Should(MatchError(fuse.ENOENT))
+		_, err = fs.Resolve("/b.txt")
+		Ω(err).Should(MatchError(fuse.ENOENT))
+
+		data, err := fs.ReadFile("/fixtures/b.txt")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(data).Should(Equal([]byte("lower")))
+
+		Ω(readLower("fixtures/a.txt")).Should(Equal("fixture"))
+		Ω(readLower("b.txt")).Should(Equal("lower"))
+	})
+
+	It("should not remove or replace a lower directory that has entries", func() {
+		Ω(os.MkdirAll(filepath.Join(lower, "nested", "sub"), 0755)).Should(Succeed())
+		Ω(ioutil.WriteFile(filepath.Join(lower, "nested", "sub", "c.txt"), []byte("c"), 0644)).Should(Succeed())
+		Ω(fs.Mkdir("/empty", 0755)).Should(Succeed())
+
+		Ω(fs.Remove("/nested/sub")).Should(MatchError(ENOTEMPTY))
+		Ω(fs.Rename("/empty", "/nested/sub")).Should(MatchError(ENOTEMPTY))
+
+		data, err := fs.ReadFile("/nested/sub/c.txt")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(data).Should(Equal([]byte("c")))
+
+		Ω(fs.Remove("/nested/sub/c.txt")).Should(Succeed())
+		Ω(fs.Remove("/nested/sub")).Should(Succeed())
+	})
+
+	It("should merge lower and upper entries when listing", func() {
+		Ω(fs.WriteFile("/c.txt", []byte("upper"), 0644)).Should(Succeed())
+
+		ent, err := fs.Resolve("/")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		dirents, err := ent.(*Dir).ReadDirAll(ctx)
+		Ω(err).ShouldNot(HaveOccurred())
+
+		names := make([]string, 0, len(dirents))
+		for _, dirent := range dirents {
+			names = append(names, dirent.Name)
+		}
+		Ω(names).Should(ConsistOf("fixtures", "b.txt", "c.txt"))
+	})
+
+})
@@ -0,0 +1,266 @@
+// Per-user and per-directory limits on the bytes and inodes in use.
+
+package memfs
+
+import (
+	"encoding/json"
+	"net/http"
+	"syscall"
+
+	"bazil.org/fuse"
+)
+
+// EDQUOT is returned when an operation would exceed a quota.
+var EDQUOT = fuse.Errno(syscall.EDQUOT)
+
+//===========================================================================
+// Quota Types
+//===========================================================================
+
+// Quota limits the number of bytes and inodes that may be used. A zero
+// limit means that the resource is unlimited.
+type Quota struct {
+	Bytes  uint64 `json:"bytes" yaml:"bytes"`   // Maximum number of bytes of file data
+	Inodes uint64 `json:"inodes" yaml:"inodes"` // Maximum number of files and directories
+}
+
+// QuotaConfig specifies the quotas of users by uid and of directory subtrees
+// by absolute path. A directory quota applies to everything beneath it, but
+// not to the directory itself.
+type QuotaConfig struct {
+	Users       map[uint32]Quota `json:"users" yaml:"users"`             // Quotas on the nodes owned by a user
+	Directories map[string]Quota `json:"directories" yaml:"directories"` // Quotas on the nodes beneath a directory
+}
+
+// Usage is the number of bytes and inodes charged against a quota.
+type Usage struct {
+	Bytes  uint64 `json:"bytes"`  // Number of bytes of file data
+	Inodes uint64 `json:"inodes"` // Number of files and directories
+}
+
+// add the signed deltas to the usage, clamping the usage at zero.
+func (u *Usage) add(bytes, inodes int64) {
+	u.Bytes = addClamped(u.Bytes, bytes)
+	u.Inodes = addClamped(u.Inodes, inodes)
+}
+
+// addClamped adds a signed delta to an unsigned value without underflowing.
+func addClamped(val uint64, delta int64) uint64 {
+	if delta < 0 && uint64(-delta) > val {
+		return 0
+	}
+	return uint64(int64(val) + delta)
+}
+
+// exceeds returns true if adding the bytes and inodes to the usage would
+// exceed the quota. Usage that does not grow never exceeds the quota, so
+// that users over quota (e.g. after a reload) can still free up space.
+func (q Quota) exceeds(u *Usage, bytes, inodes uint64) bool {
+	if q.Bytes > 0 && bytes > 0 && u.Bytes+bytes > q.Bytes {
+		return true
+	}
+	return q.Inodes > 0 && inodes > 0 && u.Inodes+inodes > q.Inodes
+}
+
+// QuotaStatus reports a quota along with the current usage against it.
+type QuotaStatus struct {
+	Quota Quota `json:"quota"` // The configured limits (zero if unlimited)
+	Usage Usage `json:"usage"` // The bytes and inodes in use
+}
+
+// QuotaReport is the status of all user and directory quotas.
+type QuotaReport struct {
+	Users       map[uint32]*QuotaStatus `json:"users"`       // Usage of every user and their quotas
+	Directories map[string]*QuotaStatus `json:"directories"` // Usage of every directory with a quota
+}
+
+//===========================================================================
+// Quota Accounting
+//===========================================================================
+
+// userUsage returns the usage of the user, creating it if necessary. Must be
+// called with the lock held.
+func (mfs *FileSystem) userUsage(uid uint32) *Usage {
+	u, ok := mfs.usage[uid]
+	if !ok {
+		u = new(Usage)
+		mfs.usage[uid] = u
+	}
+	return u
+}
+
+// charge applies the deltas to the usage of the owner of the node and of
+// every directory that contains it. Must be called with the lock held.
+func (mfs *FileSystem) charge(n *Node, bytes, inodes int64) {
+	mfs.userUsage(n.Attrs.Uid).add(bytes, inodes)
+	chargeTree(n.Parent, bytes, inodes)
+}
+
+// chargeTree applies the deltas to the directory and all of its ancestors.
+func chargeTree(d *Dir, bytes, inodes int64) {
+	for ; d != nil; d = d.Parent {
+		d.usage.add(bytes, inodes)
+	}
+}
+
+// chown moves the usage of the node from its current owner to the user.
+// Must be called with the lock held.
+func (mfs *FileSystem) chown(n *Node, uid uint32) {
+	if uid == n.Attrs.Uid {
+		return
+	}
+
+	bytes := int64(nodeUsage(n).Bytes)
+	mfs.userUsage(n.Attrs.Uid).add(-bytes, -1)
+	mfs.userUsage(uid).add(bytes, 1)
+}
+
+// nodeUsage returns the bytes and inodes used by the node itself.
+func nodeUsage(n *Node) Usage {
+	if n.IsDir() {
+		return Usage{Inodes: 1}
+	}
+	return Usage{Bytes: n.Attrs.Size, Inodes: 1}
+}
+
+// subtreeUsage returns the bytes and inodes used by the entity and, if it is
+// a directory, everything beneath it.
+func subtreeUsage(ent Entity) Usage {
+	u := nodeUsage(ent.GetNode())
+	if d, ok := ent.(*Dir); ok {
+		u.Bytes += d.usage.Bytes
+		u.Inodes += d.usage.Inodes
+	}
+	return u
+}
+
+//===========================================================================
+// Quota Enforcement
+//===========================================================================
+
+// checkQuota returns EDQUOT if adding the bytes and inodes owned by the user
+// beneath the directory would exceed the quota of the user or of the
+// directory or any of its ancestors. Must be called with the lock held.
+func (mfs *FileSystem) checkQuota(uid uint32, dir *Dir, bytes, inodes uint64) error {
+	quotas := mfs.Config.Quotas
+
+	if q, ok := quotas.Users[uid]; ok && q.exceeds(mfs.userUsage(uid), bytes, inodes) {
+		logger.Debug("(error) user %d would exceed quota by adding %d bytes and %d inodes", uid, bytes, inodes)
+		return EDQUOT
+	}
+
+	if len(quotas.Directories) == 0 {
+		return nil
+	}
+
+	for d := dir; d != nil; d = d.Parent {
+		if q, ok := quotas.Directories[d.Path()]; ok && q.exceeds(&d.usage, bytes, inodes) {
+			logger.Debug("(error) %q would exceed quota by adding %d bytes and %d inodes", d.Path(), bytes, inodes)
+			return EDQUOT
+		}
+	}
+
+	return nil
+}
+
+// checkWrite returns EDQUOT if growing the file to size would exceed a quota.
+// Must be called with the lock held.
+func (mfs *FileSystem) checkWrite(f *File, size uint64) error {
+	if size <= f.Attrs.Size {
+		return nil
+	}
+	return mfs.checkQuota(f.Attrs.Uid, f.Parent, size-f.Attrs.Size, 0)
+}
+
+// checkSetattr returns EDQUOT if the truncation or change of owner in the
+// request would exceed a quota. Must be called with the lock held.
+func (mfs *FileSystem) checkSetattr(n *Node, req *fuse.SetattrRequest) error {
+	size, uid := n.Attrs.Size, n.Attrs.Uid
+	if req.Valid.Size() && !n.IsDir() {
+		size = req.Size
+	}
+
+	// The new owner is charged for the entire node.
+	if req.Valid.Uid() && req.Uid != uid {
+		uid = req.Uid
+		if q, ok := mfs.Config.Quotas.Users[uid]; ok && q.exceeds(mfs.userUsage(uid), size, 1) {
+			logger.Debug("(error) user %d would exceed quota by taking ownership of node %d", uid, n.ID)
+			return EDQUOT
+		}
+	}
+
+	if size > n.Attrs.Size {
+		return mfs.checkQuota(uid, n.Parent, size-n.Attrs.Size, 0)
+	}
+	return nil
+}
+
+// checkMove returns EDQUOT if moving the entity from the src directory to
+// the dst directory would exceed the quota of a directory that contains dst
+// but not src. Must be called with the lock held.
+func (mfs *FileSystem) checkMove(ent Entity, src, dst *Dir) error {
+	dirs := mfs.Config.Quotas.Directories
+	if len(dirs) == 0 || src == dst {
+		return nil
+	}
+
+	common := make(map[*Dir]bool)
+	for d := src; d != nil; d = d.Parent {
+		common[d] = true
+	}
+
+	u := subtreeUsage(ent)
+	for d := dst; d != nil && !common[d]; d = d.Parent {
+		if q, ok := dirs[d.Path()]; ok && q.exceeds(&d.usage, u.Bytes, u.Inodes) {
+			logger.Debug("(error) %q would exceed quota by moving %q into it", d.Path(), ent.Path())
+			return EDQUOT
+		}
+	}
+
+	return nil
+}
+
+//===========================================================================
+// Quota Reporting
+//===========================================================================
+
+// Quotas returns the usage of every user and of every directory that has a
+// quota, along with the configured quotas.
+func (mfs *FileSystem) Quotas() *QuotaReport {
+	mfs.Lock()
+	defer mfs.Unlock()
+
+	quotas := mfs.Config.Quotas
+	report := &QuotaReport{
+		Users:       make(map[uint32]*QuotaStatus, len(mfs.usage)),
+		Directories: make(map[string]*QuotaStatus, len(quotas.Directories)),
+	}
+
+	for uid, u := range mfs.usage {
+		report.Users[uid] = &QuotaStatus{Quota: quotas.Users[uid], Usage: *u}
+	}
+
+	for uid, q := range quotas.Users {
+		if _, ok := report.Users[uid]; !ok {
+			report.Users[uid] = &QuotaStatus{Quota: q}
+		}
+	}
+
+	for path, q := range quotas.Directories {
+		status := &QuotaStatus{Quota: q}
+		if ent, err := mfs.resolve(path); err == nil {
+			if d, ok := ent.(*Dir); ok {
+				status.Usage = d.usage
+			}
+		}
+		report.Directories[path] = status
+	}
+
+	return report
+}
+
+// serveQuotas writes the quota report as JSON.
+func (mfs *FileSystem) serveQuotas(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(mfs.Quotas())
+}
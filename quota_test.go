@@ -0,0 +1,140 @@
+package memfs_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"bazil.org/fuse"
+
+	"golang.org/x/net/context"
+
+	. "github.com/bbengfort/memfs"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Quotas", func() {
+
+	var err error
+	var tmpDir string
+	var config *Config
+	var fs *FileSystem
+	var uid uint32
+	var ctx context.Context
+
+	BeforeEach(func() {
+		tmpDir, err = ioutil.TempDir("", TempDirPrefix)
+		Ω(err).ShouldNot(HaveOccurred())
+
+		uid = uint32(os.Geteuid())
+		config = makeTestConfig()
+		ctx = context.TODO()
+	})
+
+	JustBeforeEach(func() {
+		fs = New(filepath.Join(tmpDir, "testmp"), config)
+	})
+
+	AfterEach(func() {
+		Ω(os.RemoveAll(tmpDir)).Should(Succeed())
+	})
+
+	Context("per user", func() {
+
+		BeforeEach(func() {
+			config.Quotas.Users = map[uint32]Quota{uid: {Bytes: 16, Inodes: 3}}
+		})
+
+		It("should limit the number of inodes", func() {
+			Ω(fs.Mkdir("/a", 0755)).Should(Succeed())
+			Ω(fs.WriteFile("/a/b.txt", nil, 0644)).Should(Succeed())
+			Ω(fs.Mkdir("/c", 0755)).Should(MatchError(EDQUOT))
+
+			Ω(fs.Remove("/a/b.txt")).Should(Succeed())
+			Ω(fs.Mkdir("/c", 0755)).Should(Succeed())
+		})
+
+		It("should limit the number of bytes", func() {
+			Ω(fs.WriteFile("/a.txt", []byte("0123456789"), 0644)).Should(Succeed())
+			Ω(fs.WriteFile("/b.txt", []byte("0123456789"), 0644)).Should(MatchError(EDQUOT))
+			Ω(fs.WriteFile("/a.txt", []byte("0123"), 0644)).Should(Succeed())
+			Ω(fs.WriteFile("/b.txt", []byte("0123456789"), 0644)).Should(Succeed())
+
+			report := fs.Quotas()
+			Ω(report.Users[uid].Usage).Should(Equal(Usage{Bytes: 14, Inodes: 3}))
+			Ω(report.Users[uid].Quota.Bytes).Should(Equal(uint64(16)))
+		})
+
+		It("should enforce the quota on writes and truncation", func() {
+			Ω(fs.WriteFile("/a.txt", []byte("0123456789"), 0644)).Should(Succeed())
+			ent, err := fs.Resolve("/a.txt")
+			Ω(err).ShouldNot(HaveOccurred())
+			f := ent.(*File)
+
+			req := &fuse.WriteRequest{Offset: 10, Data: []byte("0123456789")}
+			Ω(f.Write(ctx, req, new(fuse.WriteResponse))).Should(MatchError(EDQUOT))
+
+			req = &fuse.WriteRequest{Offset: 10, Data: []byte("012345")}
+			Ω(f.Write(ctx, req, new(fuse.WriteResponse))).Should(Succeed())
+
+			setattr := &fuse.SetattrRequest{Valid: fuse.SetattrSize, Size: 17}
+			Ω(f.Setattr(ctx, setattr, new(fuse.SetattrResponse))).Should(MatchError(EDQUOT))
+
+			setattr = &fuse.SetattrRequest{Valid: fuse.SetattrSize, Size: 4}
+			Ω(f.Setattr(ctx, setattr, new(fuse.SetattrResponse))).Should(Succeed())
+		})
+
+		It("should report the quota of a constrained caller in statfs", func() {
+			Ω(fs.WriteFile("/a.txt", make([]byte, 10), 0644)).Should(Succeed())
+
+			req := &fuse.StatfsRequest{Header: fuse.Header{Uid: uid}}
+			resp := new(fuse.StatfsResponse)
+			Ω(fs.Statfs(ctx, req, resp)).Should(Succeed())
+			Ω(resp.Files).Should(Equal(uint64(3)))
+			Ω(resp.Ffree).Should(Equal(uint64(1)))
+
+			req = &fuse.StatfsRequest{Header: fuse.Header{Uid: uid + 1}}
+			resp = new(fuse.StatfsResponse)
+			Ω(fs.Statfs(ctx, req, resp)).Should(Succeed())
+			Ω(resp.Blocks).Should(Equal(config.CacheSize / 512))
+		})
+
+	})
+
+	Context("per directory", func() {
+
+		BeforeEach(func() {
+			config.Quotas.Directories = map[string]Quota{"/team": {Bytes: 10}}
+		})
+
+		JustBeforeEach(func() {
+			Ω(fs.Mkdir("/team", 0755)).Should(Succeed())
+			Ω(fs.Mkdir("/team/project", 0755)).Should(Succeed())
+		})
+
+		It("should limit the bytes in the subtree", func() {
+			Ω(fs.WriteFile("/team/project/a.txt", []byte("01234567"), 0644)).Should(Succeed())
+			Ω(fs.WriteFile("/team/b.txt", []byte("0123"), 0644)).Should(MatchError(EDQUOT))
+			Ω(fs.WriteFile("/b.txt", []byte("0123"), 0644)).Should(Succeed())
+
+			report := fs.Quotas()
+			Ω(report.Directories["/team"].Usage).Should(Equal(Usage{Bytes: 8, Inodes: 2}))
+		})
+
+		It("should limit moves into the subtree", func() {
+			Ω(fs.WriteFile("/a.txt", []byte("0123456789ab"), 0644)).Should(Succeed())
+			Ω(fs.Rename("/a.txt", "/team/a.txt")).Should(MatchError(EDQUOT))
+
+			Ω(fs.WriteFile("/team/project/b.txt", []byte("0123456789"), 0644)).Should(Succeed())
+			Ω(fs.Rename("/team/project/b.txt", "/team/b.txt")).Should(Succeed())
+			Ω(fs.Rename("/team/b.txt", "/b.txt")).Should(Succeed())
+
+			report := fs.Quotas()
+			Ω(report.Directories["/team"].Usage).Should(Equal(Usage{Inodes: 1}))
+		})
+
+	})
+
+})
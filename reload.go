@@ -0,0 +1,202 @@
+// Runtime reconfiguration of a mounted file system.
+
+package memfs
+
+import (
+	"reflect"
+	"strings"
+)
+
+//===========================================================================
+// Configuration Reload
+//===========================================================================
+
+// Reload re-reads the configuration file the file system was created from,
+// layering the environment and flags over it as LoadConfig does, and applies
+// the result to the running file system. It returns the configuration keys
+// that changed but cannot take effect until the file system is remounted.
+func (mfs *FileSystem) Reload(flags *Config) ([]string, error) {
+	conf, err := LoadConfig(mfs.Config.Path, flags)
+	if err != nil {
+		logger.Error("could not reload configuration: %s", err)
+		return nil, err
+	}
+
+	return mfs.Apply(conf)
+}
+
+// Apply the configuration to the running file system. The log level and
+// sink, the cache size, capacity and inode limit, the readonly and secure
+// flags, the replica membership, the quotas, the xattr limits, the time to
+// live of directories, the path rules and the kernel cache durations are
+// changed in place and the data is re-encrypted if the encryption key
+// changed; the log file is reopened so that it can be rotated externally.
+// Changes to any other setting are not applied, the current values are kept
+// and their keys are returned so that the caller can report that a remount
+// is required.
+func (mfs *FileSystem) Apply(conf *Config) ([]string, error) {
+	return mfs.apply(conf, true)
+}
+
+// apply the configuration as Apply does, replacing the logger only if logging
+// is true; the Manager replaces it once for all of its volumes instead.
+func (mfs *FileSystem) apply(conf *Config, logging bool) ([]string, error) {
+	if err := conf.Validate(); err != nil {
+		return nil, err
+	}
+
+	mfs.Lock()
+	defer mfs.Unlock()
+
+	prev := mfs.Config
+	next := *conf
+	remount := make([]string, 0)
+
+	// Keep the current value of settings that are fixed while mounted.
+	fixed := func(key string, changed bool, restore func()) {
+		if changed {
+			remount = append(remount, key)
+			restore()
+		}
+	}
+
+	fixed("name", next.Name != prev.Name, func() { next.Name = prev.Name })
+	fixed("audit", !reflect.DeepEqual(next.Audit, prev.Audit), func() { next.Audit = prev.Audit })
+	fixed("watch", next.Watch != prev.Watch, func() { next.Watch = prev.Watch })
+	fixed("control", next.Control != prev.Control, func() { next.Control = prev.Control })
+	fixed("spill.path", next.Spill.Path != prev.Spill.Path, func() { next.Spill.Path = prev.Spill.Path })
+	fixed("mirror", next.Mirror != prev.Mirror, func() { next.Mirror = prev.Mirror })
+	fixed("overlay", next.Overlay != prev.Overlay, func() { next.Overlay = prev.Overlay })
+	fixed("preload", next.Preload != prev.Preload, func() { next.Preload = prev.Preload })
+	fixed("dedup", next.Dedup != prev.Dedup, func() { next.Dedup = prev.Dedup })
+	fixed("compress", next.Compress != prev.Compress, func() { next.Compress = prev.Compress })
+	fixed("ttl.interval", next.TTL.Interval != prev.TTL.Interval, func() { next.TTL.Interval = prev.TTL.Interval })
+
+	// Encryption cannot be enabled or disabled while mounted, but the key can
+	// be rotated.
+	fixed("encryption", next.Encryption.Enabled() != prev.Encryption.Enabled(), func() { next.Encryption = prev.Encryption })
+	fixed("mlock", next.Mlock != prev.Mlock, func() { next.Mlock = prev.Mlock })
+
+	// A readonly mount cannot be made writable without remounting.
+	fixed("readonly", mfs.mountedRO && !next.ReadOnly, func() { next.ReadOnly = prev.ReadOnly })
+
+	// Load the new key and replace the logger first since they are the only
+	// steps that can fail.
+	var keys *Keyring
+	if mfs.keys != nil && !reflect.DeepEqual(next.Encryption, prev.Encryption) {
+		var err error
+		if keys, err = NewKeyring(&next.Encryption); err != nil {
+			return nil, err
+		}
+	}
+
+	if logging {
+		if err := reconfigureLogger(&next.Logging, next.Level); err != nil {
+			return nil, err
+		}
+	}
+
+	if next.ReadOnly != mfs.readonly {
+		logger.Info("readonly mode changed from %t to %t", mfs.readonly, next.ReadOnly)
+		mfs.readonly = next.ReadOnly
+	}
+
+	if next.Secure != prev.Secure {
+		logger.Info("secure mode changed from %t to %t", prev.Secure, next.Secure)
+	}
+
+	if next.XAttr != prev.XAttr {
+		logger.Info("xattr limits changed to %d bytes per value and %d bytes per node", next.XAttr.maxValue(), next.XAttr.MaxNode)
+	}
+
+	if next.CacheSize != prev.CacheSize {
+		logger.Info("cache size changed from %d to %d bytes", prev.CacheSize, next.CacheSize)
+		if next.CacheSize < mfs.nbytes {
+			logger.Warn("cache size of %d bytes is less than the %d bytes in use", next.CacheSize, mfs.nbytes)
+		}
+	}
+
+	if next.Spill.Capacity != prev.Spill.Capacity {
+		logger.Info("spill capacity changed from %d to %d bytes", prev.Spill.Capacity, next.Spill.Capacity)
+	}
+
+	if next.MaxInodes != prev.MaxInodes {
+		logger.Info("inode limit changed from %d to %d", prev.MaxInodes, next.MaxInodes)
+	}
+
+	mfs.applyReplicas(prev.Replicas, next.Replicas)
+
+	if !reflect.DeepEqual(next.Quotas, prev.Quotas) {
+		logger.Info("quotas changed to %d user and %d directory quotas", len(next.Quotas.Users), len(next.Quotas.Directories))
+	}
+
+	if !reflect.DeepEqual(next.TTL.Directories, prev.TTL.Directories) {
+		logger.Info("time to live changed for %d directories", len(next.TTL.Directories))
+	}
+
+	if !reflect.DeepEqual(next.Rules, prev.Rules) {
+		logger.Info("path rules changed to %d rules", len(next.Rules))
+	}
+
+	// Swap the configuration so that all readers see the new values.
+	next.Path = conf.Path
+	mfs.Config = &next
+
+	// Re-encrypt data that is not sealed with the new key.
+	if keys != nil {
+		if _, err := mfs.rotate(keys); err != nil {
+			logger.Error("could not rotate encryption key: %s", err)
+		}
+	}
+
+	// Evict data if the cache size was reduced.
+	mfs.reclaim(nil)
+
+	if len(remount) > 0 {
+		logger.Warn("configuration changes to %s require a remount", strings.Join(remount, ", "))
+	}
+
+	logger.Info("configuration reloaded from %q", next.Path)
+	return remount, nil
+}
+
+// applyReplicas logs the replicas that joined or left the system. Must be
+// called with the lock held.
+func (mfs *FileSystem) applyReplicas(prev, next []*Replica) {
+	current := make(map[uint]*Replica, len(prev))
+	for _, replica := range prev {
+		current[replica.PID] = replica
+	}
+
+	for _, replica := range next {
+		if old, ok := current[replica.PID]; !ok {
+			logger.Info("replica %d (%s) at %s added", replica.PID, replica.Name, replica.Addr())
+		} else if *old != *replica {
+			logger.Info("replica %d (%s) changed to %s at %s", replica.PID, old.Name, replica.Name, replica.Addr())
+		}
+		delete(current, replica.PID)
+	}
+
+	for _, replica := range current {
+		logger.Info("replica %d (%s) at %s removed", replica.PID, replica.Name, replica.Addr())
+	}
+}
+
+// reconfigureLogger replaces the sink and levels of the package logger with
+// those of a logger created from the log configuration, closing the sink of
+// the previous configuration.
+func reconfigureLogger(conf *LogConfig, level string) error {
+	if level == "" {
+		level = logger.level().String()
+	}
+
+	l, err := NewLogger(conf, level)
+	if err != nil {
+		return err
+	}
+
+	if err := logger.Replace(l); err != nil {
+		logger.Warn("could not close previous log sink: %s", err)
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+package memfs_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"bazil.org/fuse"
+
+	"golang.org/x/net/context"
+
+	. "github.com/bbengfort/memfs"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Reload", func() {
+
+	var err error
+	var tmpDir string
+	var config *Config
+	var fs *FileSystem
+
+	BeforeEach(func() {
+		tmpDir, err = ioutil.TempDir("", TempDirPrefix)
+		Ω(err).ShouldNot(HaveOccurred())
+
+		config = DefaultConfig()
+		fs = New(filepath.Join(tmpDir, "testmp"), config)
+	})
+
+	AfterEach(func() {
+		Ω(os.RemoveAll(tmpDir)).Should(Succeed())
+	})
+
+	It("should toggle readonly mode", func() {
+		conf := DefaultConfig()
+		conf.ReadOnly = true
+
+		remount, err := fs.Apply(conf)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(remount).Should(BeEmpty())
+		Ω(fs.WriteFile("/a.txt", []byte("a"), 0644)).Should(MatchError(fuse.EPERM))
+
+		conf.ReadOnly = false
+		_, err = fs.Apply(conf)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(fs.WriteFile("/a.txt", []byte("a"), 0644)).Should(Succeed())
+	})
+
+	It("should apply the cache size to statfs", func() {
+		conf := DefaultConfig()
+		conf.CacheSize = 2 * MinCacheSize
+
+		_, err := fs.Apply(conf)
+		Ω(err).ShouldNot(HaveOccurred())
+
+		resp := new(fuse.StatfsResponse)
+		Ω(fs.Statfs(context.TODO(), new(fuse.StatfsRequest), resp)).Should(Succeed())
+		Ω(resp.Blocks * uint64(resp.Bsize)).Should(Equal(2 * MinCacheSize))
+	})
+
+	It("should report settings that require a remount", func() {
+		conf := DefaultConfig()
+		conf.Level = "debug"
+		conf.Control = "localhost:3265"
+		conf.Watch.Buffer = 12
+
+		remount, err := fs.Apply(conf)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(remount).Should(ConsistOf("control", "watch"))
+		Ω(fs.Config.Level).Should(Equal("debug"))
+		Ω(fs.Config.Control).Should(BeZero())
+		Ω(fs.Config.Watch.Buffer).Should(BeZero())
+	})
+
+	It("should not apply an invalid configuration", func() {
+		conf := DefaultConfig()
+		conf.ReadOnly = true
+		conf.Level = "loud"
+
+		_, err := fs.Apply(conf)
+		Ω(err).Should(HaveOccurred())
+		Ω(fs.Config).Should(Equal(config))
+		Ω(fs.WriteFile("/a.txt", []byte("a"), 0644)).Should(Succeed())
+	})
+
+	It("should reload the configuration file", func() {
+		path := filepath.Join(tmpDir, "memfs.yml")
+		Ω(ioutil.WriteFile(path, []byte("readonly: true\nreplicas:\n  - {pid: 2, name: bravo, host: localhost, port: 3264}\n"), 0644)).Should(Succeed())
+		fs.Config.Path = path
+
+		remount, err := fs.Reload(nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(remount).Should(BeEmpty())
+		Ω(fs.Config.Path).Should(Equal(path))
+		Ω(fs.Config.Replicas).Should(HaveLen(1))
+		Ω(fs.WriteFile("/a.txt", []byte("a"), 0644)).Should(MatchError(fuse.EPERM))
+	})
+
+})
@@ -0,0 +1,235 @@
+// Size and time based rotation of log files with optional compression.
+
+package memfs
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// Format of the timestamp appended to rotated log files.
+const rotateTimeFormat = "20060102T150405.000000000"
+
+//===========================================================================
+// RotatingWriter Type and Constructor
+//===========================================================================
+
+// RotatingWriter is an io.WriteCloser that appends to a file on disk and
+// rotates that file when it grows past MaxSize bytes or has been written to
+// for longer than MaxAge. Rotated files are renamed with a timestamp suffix
+// and, if Compress is set, are gzipped in the background and the
+// uncompressed copy removed. If a rotation fails the active file is reopened
+// so that logging continues.
+type RotatingWriter struct {
+	sync.Mutex
+	Path     string         // Path of the active log file
+	MaxSize  uint64         // Rotate when the file exceeds this size (0 disables)
+	MaxAge   time.Duration  // Rotate when the file is older than this (0 disables)
+	Compress bool           // Gzip rotated files
+	file     *os.File       // Handle to the active log file
+	size     uint64         // Number of bytes in the active log file
+	opened   time.Time      // When the active log file was opened
+	closed   bool           // If the writer has been closed
+	gzipping sync.WaitGroup // Completes when rotated files are compressed
+	gzipErr  error          // First error compressing a rotated file
+}
+
+// OpenRotatingWriter opens (or creates) the log file at path for appending,
+// rotating it according to the size and age limits.
+func OpenRotatingWriter(path string, maxSize uint64, maxAge time.Duration, compress bool) (*RotatingWriter, error) {
+	w := &RotatingWriter{
+		Path:     path,
+		MaxSize:  maxSize,
+		MaxAge:   maxAge,
+		Compress: compress,
+	}
+
+	if err := w.open(); err != nil {
+		return nil, err
+	}
+
+	return w, nil
+}
+
+//===========================================================================
+// RotatingWriter Methods
+//===========================================================================
+
+// Write appends p to the active log file, rotating it first if required.
+func (w *RotatingWriter) Write(p []byte) (int, error) {
+	w.Lock()
+	defer w.Unlock()
+
+	if w.closed {
+		return 0, os.ErrClosed
+	}
+
+	// Reopen the active file if it could not be reopened after a rotation.
+	if w.file == nil {
+		if err := w.open(); err != nil {
+			return 0, err
+		}
+	}
+
+	if w.shouldRotate(uint64(len(p))) {
+		if err := w.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := w.file.Write(p)
+	w.size += uint64(n)
+	return n, err
+}
+
+// Rotate forces a rotation of the active log file.
+func (w *RotatingWriter) Rotate() error {
+	w.Lock()
+	defer w.Unlock()
+
+	if w.closed {
+		return os.ErrClosed
+	}
+	return w.rotate()
+}
+
+// Close the active log file, waiting for rotated files to be compressed and
+// returning the first error that compressing them encountered.
+func (w *RotatingWriter) Close() error {
+	w.Lock()
+	if w.closed {
+		w.Unlock()
+		return nil
+	}
+
+	var err error
+	w.closed = true
+	if w.file != nil {
+		err = w.file.Close()
+		w.file = nil
+	}
+	w.Unlock()
+
+	w.gzipping.Wait()
+	if err == nil {
+		err = w.gzipErr
+	}
+	return err
+}
+
+// Determines if the next write of n bytes requires a rotation. Must be
+// called with the lock held.
+func (w *RotatingWriter) shouldRotate(n uint64) bool {
+	if w.size == 0 {
+		return false
+	}
+
+	if w.MaxSize > 0 && w.size+n > w.MaxSize {
+		return true
+	}
+
+	if w.MaxAge > 0 && time.Since(w.opened) > w.MaxAge {
+		return true
+	}
+
+	return false
+}
+
+// Opens the log file for appending, recording its current size. The age of
+// the file is counted from when it is opened, since the modification time of
+// an existing file is that of its last write rather than of its creation.
+// Must be called with the lock held.
+func (w *RotatingWriter) open() error {
+	file, err := os.OpenFile(w.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	w.file = file
+	w.size = uint64(info.Size())
+	w.opened = time.Now()
+	return nil
+}
+
+// Closes the active file, moves it aside and opens a fresh log file,
+// compressing the rotated file in the background. If the file cannot be
+// moved aside it is reopened and appended to. Must be called with the lock
+// held.
+func (w *RotatingWriter) rotate() error {
+	if w.file != nil {
+		err := w.file.Close()
+		w.file = nil
+		if err != nil {
+			w.open()
+			return err
+		}
+	}
+
+	dst := fmt.Sprintf("%s.%s", w.Path, time.Now().Format(rotateTimeFormat))
+	if err := os.Rename(w.Path, dst); err != nil && !os.IsNotExist(err) {
+		w.open()
+		return err
+	}
+
+	if w.Compress {
+		w.gzipping.Add(1)
+		go w.gzip(dst)
+	}
+
+	return w.open()
+}
+
+// Compresses the rotated file at path, recording the first error. A rotated
+// file that cannot be compressed is kept as it is.
+func (w *RotatingWriter) gzip(path string) {
+	defer w.gzipping.Done()
+	if err := gzipFile(path); err != nil {
+		w.Lock()
+		if w.gzipErr == nil {
+			w.gzipErr = fmt.Errorf("could not compress %s: %s", path, err)
+		}
+		w.Unlock()
+	}
+}
+
+// Compresses the file at path to path.gz and removes the original, removing
+// the partially written copy on failure.
+func gzipFile(path string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.OpenFile(path+".gz", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	gz := gzip.NewWriter(dst)
+	_, err = io.Copy(gz, src)
+	if cerr := gz.Close(); err == nil {
+		err = cerr
+	}
+
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+
+	if err != nil {
+		os.Remove(path + ".gz")
+		return err
+	}
+
+	return os.Remove(path)
+}
@@ -0,0 +1,130 @@
+package memfs_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	. "github.com/bbengfort/memfs"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("RotatingWriter", func() {
+
+	var err error
+	var tmpDir string
+	var path string
+
+	BeforeEach(func() {
+		tmpDir, err = ioutil.TempDir("", TempDirPrefix)
+		Ω(err).ShouldNot(HaveOccurred())
+		path = filepath.Join(tmpDir, "rotating.log")
+	})
+
+	AfterEach(func() {
+		Ω(os.RemoveAll(tmpDir)).Should(Succeed())
+	})
+
+	// Returns the names of the rotated log files in the temporary directory.
+	rotated := func() []string {
+		names := make([]string, 0)
+		infos, err := ioutil.ReadDir(tmpDir)
+		Ω(err).ShouldNot(HaveOccurred())
+
+		for _, info := range infos {
+			if info.Name() != "rotating.log" {
+				names = append(names, info.Name())
+			}
+		}
+		return names
+	}
+
+	It("should rotate when the file exceeds the maximum size", func() {
+		w, err := OpenRotatingWriter(path, 32, 0, false)
+		Ω(err).ShouldNot(HaveOccurred())
+		defer w.Close()
+
+		line := []byte(strings.Repeat("a", 20) + "\n")
+		for i := 0; i < 3; i++ {
+			_, err = w.Write(line)
+			Ω(err).ShouldNot(HaveOccurred())
+		}
+
+		Ω(rotated()).Should(HaveLen(2))
+
+		data, err := ioutil.ReadFile(path)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(data).Should(Equal(line))
+	})
+
+	It("should rotate when the file exceeds the maximum age", func() {
+		w, err := OpenRotatingWriter(path, 0, 10*time.Millisecond, false)
+		Ω(err).ShouldNot(HaveOccurred())
+		defer w.Close()
+
+		_, err = w.Write([]byte("first\n"))
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(rotated()).Should(BeEmpty())
+
+		time.Sleep(20 * time.Millisecond)
+		_, err = w.Write([]byte("second\n"))
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(rotated()).Should(HaveLen(1))
+	})
+
+	It("should keep writing when a rotation fails", func() {
+		logs := filepath.Join(tmpDir, "logs")
+		Ω(os.Mkdir(logs, 0755)).Should(Succeed())
+
+		w, err := OpenRotatingWriter(filepath.Join(logs, "rotating.log"), 0, 0, false)
+		Ω(err).ShouldNot(HaveOccurred())
+		defer w.Close()
+
+		// The active file cannot be reopened without its directory.
+		Ω(os.RemoveAll(logs)).Should(Succeed())
+		Ω(w.Rotate()).ShouldNot(Succeed())
+
+		Ω(os.Mkdir(logs, 0755)).Should(Succeed())
+		_, err = w.Write([]byte("recovered\n"))
+		Ω(err).ShouldNot(HaveOccurred())
+
+		data, err := ioutil.ReadFile(filepath.Join(logs, "rotating.log"))
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(data).Should(Equal([]byte("recovered\n")))
+	})
+
+	It("should count the age of an existing file from when it is opened", func() {
+		Ω(ioutil.WriteFile(path, []byte("old\n"), 0644)).Should(Succeed())
+		old := time.Now().Add(-time.Hour)
+		Ω(os.Chtimes(path, old, old)).Should(Succeed())
+
+		w, err := OpenRotatingWriter(path, 0, time.Minute, false)
+		Ω(err).ShouldNot(HaveOccurred())
+		defer w.Close()
+
+		_, err = w.Write([]byte("new\n"))
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(rotated()).Should(BeEmpty())
+	})
+
+	It("should compress rotated files", func() {
+		w, err := OpenRotatingWriter(path, 0, 0, true)
+		Ω(err).ShouldNot(HaveOccurred())
+		defer w.Close()
+
+		_, err = w.Write([]byte("compress me\n"))
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(w.Rotate()).Should(Succeed())
+
+		// Rotated files are compressed in the background until closed.
+		Ω(w.Close()).Should(Succeed())
+		names := rotated()
+		Ω(names).Should(HaveLen(1))
+		Ω(names[0]).Should(HaveSuffix(".gz"))
+	})
+
+})
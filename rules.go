@@ -0,0 +1,254 @@
+// Policies applied to the subtrees of the file system that match path rules.
+
+package memfs
+
+import (
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"bazil.org/fuse"
+)
+
+// EFBIG is returned when a write or truncation would exceed the maximum file
+// size of a rule.
+var EFBIG = fuse.Errno(syscall.EFBIG)
+
+//===========================================================================
+// Rule Configuration
+//===========================================================================
+
+// Rule applies a policy to the paths that match a glob and to everything
+// beneath them, so that one file system can be carved into zones, e.g. a
+// read-only /releases or a /scratch whose files expire. The glob uses the
+// syntax of filepath.Match, so "/builds/*" matches every entry of /builds.
+// Every rule that matches a path applies in order, a later rule overriding
+// the fields that it sets; unset fields do not change the policy.
+type Rule struct {
+	Path      string   `json:"path" yaml:"path"`           // Glob of the absolute paths the rule applies to
+	ReadOnly  *bool    `json:"readonly" yaml:"readonly"`   // Refuse changes to matching entries
+	MaxSize   uint64   `json:"maxsize" yaml:"maxsize"`     // Maximum size of matching files (0 for unlimited)
+	Owners    []uint32 `json:"owners" yaml:"owners"`       // Users that may create and change matching entries (empty for all)
+	TTL       Duration `json:"ttl" yaml:"ttl"`             // Time to live of matching entries (0 for the directory policy)
+	Compress  *bool    `json:"compress" yaml:"compress"`   // Whether matching files are compressed when cold
+	Mirror    *bool    `json:"mirror" yaml:"mirror"`       // Whether changes to matching entries are mirrored
+	Immutable *bool    `json:"immutable" yaml:"immutable"` // Whether matching files are immutable once flushed with data
+	Retention Duration `json:"retention" yaml:"retention"` // How long immutable files are retained (0 for forever)
+}
+
+// matches returns true if the glob of the rule matches the path or any of
+// the directories that contain it.
+func (r *Rule) matches(path string) bool {
+	for {
+		if ok, _ := filepath.Match(r.Path, path); ok {
+			return true
+		}
+
+		if path == "/" || path == "." {
+			return false
+		}
+		path = filepath.Dir(path)
+	}
+}
+
+// within returns true if the glob of the rule may match the directory at the
+// path, any of the directories that contain it or any entry beneath it.
+func (r *Rule) within(dir string) bool {
+	if r.matches(dir) {
+		return true
+	}
+
+	globs := strings.Split(strings.Trim(r.Path, "/"), "/")
+	names := strings.Split(strings.Trim(dir, "/"), "/")
+	if dir == "/" {
+		names = nil
+	}
+
+	if len(globs) <= len(names) {
+		return false
+	}
+
+	for i, name := range names {
+		if ok, _ := filepath.Match(globs[i], name); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// zone is the policy of a path, combined from the rules that match it.
+type zone struct {
+	readonly  bool          // Changes are refused
+	maxSize   uint64        // Maximum size of files (0 for unlimited)
+	owners    []uint32      // Users that may make changes (empty for all)
+	ttl       time.Duration // Time to live of entries (0 if not set)
+	compress  bool          // Cold files are compressed
+	mirror    bool          // Changes are mirrored
+	immutable bool          // Files are immutable once flushed with data
+	retention time.Duration // How long immutable files are retained (0 for forever)
+}
+
+// zone returns the policy of the path. Must be called with the lock held.
+func (mfs *FileSystem) zone(path string) *zone {
+	z := &zone{compress: true, mirror: true}
+	for _, r := range mfs.Config.Rules {
+		if !r.matches(path) {
+			continue
+		}
+
+		if r.ReadOnly != nil {
+			z.readonly = *r.ReadOnly
+		}
+
+		if r.MaxSize > 0 {
+			z.maxSize = r.MaxSize
+		}
+
+		if len(r.Owners) > 0 {
+			z.owners = r.Owners
+		}
+
+		if r.TTL > 0 {
+			z.ttl = time.Duration(r.TTL)
+		}
+
+		if r.Compress != nil {
+			z.compress = *r.Compress
+		}
+
+		if r.Mirror != nil {
+			z.mirror = *r.Mirror
+		}
+
+		if r.Immutable != nil {
+			z.immutable = *r.Immutable
+		}
+
+		if r.Retention > 0 {
+			z.retention = time.Duration(r.Retention)
+		}
+	}
+	return z
+}
+
+// allows returns true if the user may make changes in the zone. Root is
+// always allowed.
+func (z *zone) allows(uid uint32) bool {
+	if uid == 0 || len(z.owners) == 0 {
+		return true
+	}
+
+	for _, owner := range z.owners {
+		if owner == uid {
+			return true
+		}
+	}
+	return false
+}
+
+//===========================================================================
+// Rule Enforcement
+//===========================================================================
+
+// checkRules returns EPERM if the rules of the path forbid the user of the
+// request from creating an entry at the path or, if the entity is not nil,
+// from changing the entity at the path, which must also not be protected by
+// its flags or retention. Must be called with the lock held.
+func (mfs *FileSystem) checkRules(hdr fuse.Header, path string, ent Entity) error {
+	if ent != nil {
+		if err := ent.GetNode().checkProtected(false); err != nil {
+			return err
+		}
+	}
+
+	if len(mfs.Config.Rules) == 0 {
+		return nil
+	}
+
+	z := mfs.zone(path)
+	if z.readonly {
+		logger.Debug("(error) %q is in a read-only zone", path)
+		return fuse.EPERM
+	}
+
+	if !z.allows(hdr.Uid) {
+		logger.Debug("(error) user %d may not change %q", hdr.Uid, path)
+		return fuse.EPERM
+	}
+	return nil
+}
+
+// checkRuleSize returns EFBIG if the rules of the path limit files to less
+// than the size. Must be called with the lock held.
+func (mfs *FileSystem) checkRuleSize(path string, size uint64) error {
+	if len(mfs.Config.Rules) == 0 {
+		return nil
+	}
+
+	if max := mfs.zone(path).maxSize; max > 0 && size > max {
+		logger.Debug("(error) size of %d bytes exceeds the limit of %d bytes of %q", size, max, path)
+		return EFBIG
+	}
+	return nil
+}
+
+// checkRuleSetattr returns an error if the node or the rules of its path
+// forbid the changes in the request: any change to an immutable node or to a
+// read-only zone, truncating an append-only or retained file, exceeding the
+// maximum size or giving the node to a user that is not one of the owners of
+// the zone. Must be called with the lock held.
+func (mfs *FileSystem) checkRuleSetattr(ent Entity, req *fuse.SetattrRequest) error {
+	if err := ent.GetNode().checkProtectedSetattr(req); err != nil {
+		return err
+	}
+
+	if len(mfs.Config.Rules) == 0 {
+		return nil
+	}
+
+	path := ent.Path()
+	if err := mfs.checkRules(req.Header, path, nil); err != nil {
+		return err
+	}
+
+	if req.Valid.Size() && !ent.IsDir() {
+		if err := mfs.checkRuleSize(path, req.Size); err != nil {
+			return err
+		}
+	}
+
+	if req.Valid.Uid() && !mfs.zone(path).allows(req.Uid) {
+		logger.Debug("(error) user %d may not own %q", req.Uid, path)
+		return fuse.EPERM
+	}
+	return nil
+}
+
+// checkRuleMove returns EPERM if the rules or protection of the entity
+// forbid moving it from its path to the new name in the dst directory, or
+// replacing the entry that is already there. Must be called with the lock held.
+func (mfs *FileSystem) checkRuleMove(hdr fuse.Header, ent Entity, dst *Dir, newName string) error {
+	if err := mfs.checkRules(hdr, ent.Path(), ent); err != nil {
+		return err
+	}
+
+	var prev Entity
+	if c, ok := dst.Children[newName]; ok && c != ent {
+		prev = c
+	}
+	return mfs.checkRules(hdr, filepath.Join(dst.Path(), newName), prev)
+}
+
+// mirrored returns true if the rules allow the mutation to be mirrored. Must
+// be called with the lock held.
+func (mfs *FileSystem) mirrored(m *Mutation) bool {
+	if len(mfs.Config.Rules) == 0 {
+		return true
+	}
+
+	if !mfs.zone(m.Path).mirror {
+		return false
+	}
+	return m.NewPath == "" || mfs.zone(m.NewPath).mirror
+}
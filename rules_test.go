@@ -0,0 +1,255 @@
+package memfs_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"bazil.org/fuse"
+
+	"golang.org/x/net/context"
+
+	. "github.com/bbengfort/memfs"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Rules", func() {
+
+	var err error
+	var tmpDir string
+	var config *Config
+	var fs *FileSystem
+	var ctx context.Context
+	var user fuse.Header
+
+	yes, no := true, false
+
+	// dir returns the directory at the path.
+	dir := func(path string) *Dir {
+		ent, err := fs.Resolve(path)
+		Ω(err).ShouldNot(HaveOccurred())
+		return ent.(*Dir)
+	}
+
+	// create creates a file through the fuse interface as the user.
+	create := func(path string, hdr fuse.Header) (*File, error) {
+		req := &fuse.CreateRequest{Header: hdr, Name: filepath.Base(path), Mode: 0644}
+		node, _, err := dir(filepath.Dir(path)).Create(ctx, req, &fuse.CreateResponse{})
+		if err != nil {
+			return nil, err
+		}
+		return node.(*File), nil
+	}
+
+	// write writes the data to the file through the fuse interface.
+	write := func(f *File, data string) error {
+		req := &fuse.WriteRequest{Header: user, Offset: int64(f.Attrs.Size), Data: []byte(data)}
+		return f.Write(ctx, req, new(fuse.WriteResponse))
+	}
+
+	// truncate sets the size of the file through the fuse interface.
+	truncate := func(f *File, size uint64) error {
+		req := &fuse.SetattrRequest{Header: user, Size: size, Valid: fuse.SetattrSize}
+		return f.Setattr(ctx, req, new(fuse.SetattrResponse))
+	}
+
+	BeforeEach(func() {
+		tmpDir, err = ioutil.TempDir("", TempDirPrefix)
+		Ω(err).ShouldNot(HaveOccurred())
+
+		config = makeTestConfig()
+		ctx = context.TODO()
+		user = fuse.Header{Uid: 1000, Gid: 1000}
+	})
+
+	JustBeforeEach(func() {
+		fs = New(filepath.Join(tmpDir, "testmp"), config)
+		for _, path := range []string{"/releases", "/scratch", "/shared", "/builds"} {
+			Ω(fs.Mkdir(path, 0777)).Should(Succeed())
+		}
+	})
+
+	AfterEach(func() {
+		Ω(fs.Shutdown()).Should(Succeed())
+		Ω(os.RemoveAll(tmpDir)).Should(Succeed())
+	})
+
+	Context("with read-only zones", func() {
+
+		BeforeEach(func() {
+			config.Rules = []*Rule{
+				{Path: "/releases/*", ReadOnly: &yes},
+				{Path: "/releases/staging", ReadOnly: &no},
+			}
+		})
+
+		It("should refuse changes to a read-only zone", func() {
+			_, err := create("/releases/v1.tgz", user)
+			Ω(err).Should(MatchError(fuse.EPERM))
+			Ω(fs.WriteFile("/releases/v1.tgz", []byte("v1"), 0644)).Should(MatchError(fuse.EPERM))
+
+			req := &fuse.MkdirRequest{Header: user, Name: "v2", Mode: 0755}
+			_, err = dir("/releases").Mkdir(ctx, req)
+			Ω(err).Should(MatchError(fuse.EPERM))
+
+			_, err = create("/scratch/v1.tgz", user)
+			Ω(err).ShouldNot(HaveOccurred())
+		})
+
+		It("should let later rules override earlier rules", func() {
+			Ω(fs.Mkdir("/releases/staging", 0755)).Should(Succeed())
+			_, err := create("/releases/staging/v1.tgz", user)
+			Ω(err).ShouldNot(HaveOccurred())
+		})
+
+		It("should refuse to move entries into or out of a read-only zone", func() {
+			Ω(fs.WriteFile("/scratch/v1.tgz", []byte("v1"), 0644)).Should(Succeed())
+			Ω(fs.Rename("/scratch/v1.tgz", "/releases/v1.tgz")).Should(MatchError(fuse.EPERM))
+
+			req := &fuse.RenameRequest{Header: user, OldName: "v1.tgz", NewName: "v1.tgz"}
+			Ω(dir("/scratch").Rename(ctx, req, dir("/releases"))).Should(MatchError(fuse.EPERM))
+		})
+
+	})
+
+	Context("with size limits and owners", func() {
+
+		BeforeEach(func() {
+			config.Rules = []*Rule{
+				{Path: "/scratch/*", MaxSize: 8},
+				{Path: "/shared/*", Owners: []uint32{1001}},
+			}
+		})
+
+		It("should limit the size of files", func() {
+			f, err := create("/scratch/small.txt", user)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(write(f, "12345678")).Should(Succeed())
+			Ω(write(f, "9")).Should(MatchError(EFBIG))
+			Ω(truncate(f, 16)).Should(MatchError(EFBIG))
+			Ω(truncate(f, 4)).Should(Succeed())
+		})
+
+		It("should only allow the owners to make changes", func() {
+			_, err := create("/shared/a.txt", user)
+			Ω(err).Should(MatchError(fuse.EPERM))
+
+			f, err := create("/shared/a.txt", fuse.Header{Uid: 1001, Gid: 1001})
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(write(f, "denied")).Should(MatchError(fuse.EPERM))
+
+			// Root may always make changes, but not give files to others.
+			_, err = create("/shared/b.txt", fuse.Header{})
+			Ω(err).ShouldNot(HaveOccurred())
+
+			req := &fuse.SetattrRequest{Header: fuse.Header{}, Uid: 1000, Valid: fuse.SetattrUid}
+			Ω(f.Setattr(ctx, req, new(fuse.SetattrResponse))).Should(MatchError(fuse.EPERM))
+		})
+
+	})
+
+	Context("with immutable zones", func() {
+
+		BeforeEach(func() {
+			config.Rules = []*Rule{{Path: "/builds/*", Immutable: &yes}}
+		})
+
+		It("should refuse changes to files once they are flushed", func() {
+			f, err := create("/builds/app", user)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(write(f, "binary")).Should(Succeed())
+			Ω(write(f, "more")).Should(Succeed())
+			Ω(f.Flush(ctx, &fuse.FlushRequest{Header: user})).Should(Succeed())
+
+			Ω(write(f, "patch")).Should(MatchError(fuse.EPERM))
+			Ω(truncate(f, 0)).Should(MatchError(fuse.EPERM))
+			Ω(fs.Rename("/builds/app", "/builds/app.old")).Should(MatchError(fuse.EPERM))
+			Ω(fs.Remove("/builds/app")).Should(MatchError(fuse.EPERM))
+
+			// Replacing an immutable file is also refused.
+			Ω(fs.WriteFile("/scratch/app", []byte("fake"), 0644)).Should(Succeed())
+			Ω(fs.Rename("/scratch/app", "/builds/app")).Should(MatchError(fuse.EPERM))
+
+			// Other attributes can still be changed.
+			req := &fuse.SetattrRequest{Header: user, Mode: 0755, Valid: fuse.SetattrMode}
+			Ω(f.Setattr(ctx, req, new(fuse.SetattrResponse))).Should(Succeed())
+
+			contents, err := fs.ReadFile("/builds/app")
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(contents).Should(Equal([]byte("binarymore")))
+		})
+
+	})
+
+	Context("with time to live and compression rules", func() {
+
+		BeforeEach(func() {
+			config.Compress.After = Duration(time.Hour)
+			config.Rules = []*Rule{
+				{Path: "/scratch/*.log", TTL: Duration(time.Hour)},
+				{Path: "/builds", Compress: &no},
+			}
+		})
+
+		It("should reap files that match a rule", func() {
+			Ω(fs.WriteFile("/scratch/build.log", []byte("log"), 0644)).Should(Succeed())
+			Ω(fs.WriteFile("/scratch/notes.txt", []byte("notes"), 0644)).Should(Succeed())
+			for _, path := range []string{"/scratch/build.log", "/scratch/notes.txt"} {
+				ent, err := fs.Resolve(path)
+				Ω(err).ShouldNot(HaveOccurred())
+				ent.GetNode().Attrs.Mtime = time.Now().Add(-2 * time.Hour)
+			}
+
+			report, err := fs.Reap(false)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(report.Paths).Should(Equal([]string{"/scratch/build.log"}))
+		})
+
+		It("should not compress files where compression is off", func() {
+			data := make([]byte, 4096)
+			for _, path := range []string{"/builds/app", "/scratch/app"} {
+				Ω(fs.WriteFile(path, data, 0644)).Should(Succeed())
+				ent, err := fs.Resolve(path)
+				Ω(err).ShouldNot(HaveOccurred())
+				ent.GetNode().Attrs.Atime = time.Now().Add(-2 * time.Hour)
+			}
+
+			Ω(fs.CompressCold()).Should(Equal(1))
+		})
+
+	})
+
+	Context("with mirroring rules", func() {
+
+		var mirrorDir string
+
+		BeforeEach(func() {
+			mirrorDir = filepath.Join(tmpDir, "mirror")
+			Ω(os.Mkdir(mirrorDir, 0755)).Should(Succeed())
+
+			config.Mirror = MirrorConfig{Path: mirrorDir}
+			config.Rules = []*Rule{{Path: "/scratch", Mirror: &no}}
+		})
+
+		It("should not mirror changes where mirroring is off", func() {
+			Ω(fs.WriteFile("/shared/a.txt", []byte("a"), 0644)).Should(Succeed())
+			Ω(fs.WriteFile("/scratch/a.txt", []byte("a"), 0644)).Should(Succeed())
+
+			Ω(filepath.Join(mirrorDir, "shared", "a.txt")).Should(BeAnExistingFile())
+			Ω(filepath.Join(mirrorDir, "scratch")).ShouldNot(BeAnExistingFile())
+		})
+
+	})
+
+	It("should validate the rules", func() {
+		config.Rules = []*Rule{{Path: "scratch"}, {Path: "/[", TTL: Duration(-time.Hour)}}
+		err := config.Validate()
+		Ω(err).Should(MatchError(ContainSubstring("is not an absolute path")))
+		Ω(err).Should(MatchError(ContainSubstring("is not a valid glob")))
+		Ω(err).Should(MatchError(ContainSubstring("is negative")))
+	})
+
+})
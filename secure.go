@@ -0,0 +1,242 @@
+// Overwriting of freed file data in memory and on disk.
+
+package memfs
+
+import (
+	"os"
+	"syscall"
+	"time"
+
+	"bazil.org/fuse"
+)
+
+// ShredXattr is the extended attribute that destroys the data of a file when
+// it is set to any value; the attribute itself is not stored. It stands in
+// for an ioctl, which the FUSE library does not support.
+const ShredXattr = "user.memfs.shred"
+
+//===========================================================================
+// Secure Mode
+//===========================================================================
+
+// secure returns true if freed file data must be overwritten before it is
+// released, which is always the case if encryption is enabled.
+func (mfs *FileSystem) secure() bool {
+	return mfs.Config.Secure || mfs.keys != nil
+}
+
+// scrub zeros file data that is about to be released or reallocated in
+// secure mode. The data must not be shared with snapshots. Must be called
+// with the lock held.
+func (f *File) scrub(data []byte) {
+	if f.fs.secure() {
+		wipe(data)
+	}
+}
+
+// scrubData zeros the resident data of the file in secure mode before it is
+// released, unless snapshots still share it. Must be called with the lock
+// held.
+func (f *File) scrubData() {
+	if f.cow == nil || f.cow.refs == 0 {
+		f.scrub(f.Data)
+	}
+}
+
+// scrubBlocks zeros the deduplicated blocks that only the file references in
+// secure mode before they are released. Must be called with the lock held.
+func (f *File) scrubBlocks() {
+	for _, b := range f.blocks {
+		if b.refs == 1 {
+			f.scrub(b.data)
+		}
+	}
+}
+
+// wipe overwrites the buffer with zeros.
+func wipe(buf []byte) {
+	for i := range buf {
+		buf[i] = 0
+	}
+}
+
+// unspill removes the spilled data of the node, overwriting it first in
+// secure mode. Must be called with the lock held.
+func (mfs *FileSystem) unspill(n *Node) error {
+	if mfs.secure() {
+		return mfs.spill.Shred(n)
+	}
+	return mfs.spill.Delete(n)
+}
+
+// Shred overwrites the data of the node on disk with zeros, syncs it and
+// then removes it. Data that is linked to a snapshot is only removed.
+func (s *SpillStore) Shred(n *Node) error {
+	fobj, err := os.OpenFile(s.path(n), os.O_WRONLY, 0)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	info, err := fobj.Stat()
+	if err == nil {
+		if st, ok := info.Sys().(*syscall.Stat_t); ok && st.Nlink > 1 {
+			fobj.Close()
+			return s.Delete(n)
+		}
+
+		zeros := make([]byte, 64*1024)
+		for off := int64(0); off < info.Size() && err == nil; off += int64(len(zeros)) {
+			if rem := info.Size() - off; rem < int64(len(zeros)) {
+				zeros = zeros[:rem]
+			}
+			_, err = fobj.WriteAt(zeros, off)
+		}
+	}
+
+	if err == nil {
+		err = fobj.Sync()
+	}
+
+	if cerr := fobj.Close(); err == nil {
+		err = cerr
+	}
+
+	if err != nil {
+		return err
+	}
+	return s.Delete(n)
+}
+
+//===========================================================================
+// File Shredding
+//===========================================================================
+
+// Shred destroys the data of the file at the path, overwriting it in memory
+// and in the spill directory whether or not secure mode is enabled, and
+// truncates the file to zero bytes. Data held by snapshots is kept.
+func (mfs *FileSystem) Shred(path string) error {
+	mfs.Lock()
+	defer mfs.Unlock()
+
+	if mfs.readonly {
+		return fuse.EPERM
+	}
+
+	ent, err := mfs.resolve(path)
+	if err != nil {
+		return err
+	}
+
+	f, ok := ent.(*File)
+	if !ok {
+		return fuse.Errno(syscall.EISDIR)
+	}
+
+	if f.IsArchive() {
+		return fuse.EPERM
+	}
+
+	if err := mfs.checkRules(mfs.apiHeader(), f.Path(), f); err != nil {
+		return err
+	}
+
+	if err := f.Parent.diverge(); err != nil {
+		return err
+	}
+
+	m := mfs.apiMutation(OpSetattr, f)
+	if err := f.shred(); err != nil {
+		return err
+	}
+
+	m.NewSize = f.Attrs.Size
+	m.NewMode = f.Attrs.Mode
+	mfs.record(m)
+	return nil
+}
+
+// shred destroys the data of the file with the node, recording the
+// truncation. Must be called with the lock held.
+func (n *Node) shred(hdr fuse.Header) error {
+	ent, ok := n.fs.Inodes.Get(n.ID)
+	if !ok {
+		return fuse.ENOENT
+	}
+
+	f, ok := ent.(*File)
+	if !ok {
+		return fuse.Errno(syscall.EISDIR)
+	}
+
+	if err := n.fs.checkRules(hdr, f.Path(), f); err != nil {
+		return err
+	}
+
+	if err := f.shred(); err != nil {
+		return err
+	}
+
+	m := newMutation(OpSetattr, hdr, n)
+	m.NewSize = f.Attrs.Size
+	m.NewMode = f.Attrs.Mode
+	n.fs.record(m)
+	return nil
+}
+
+// shred overwrites the data of the file in every tier it is held in and
+// truncates the file to zero bytes. Must be called with the lock held.
+func (f *File) shred() error {
+	size := f.Attrs.Size
+
+	if f.spilled && f.lower == "" {
+		if err := f.fs.spill.Shred(&f.Node); err != nil {
+			logger.Error("could not shred spilled data of file %d: %s", f.ID, err)
+			return fuse.EIO
+		}
+		f.disown(size)
+		f.fs.sbytes = addClamped(f.fs.sbytes, -int64(size))
+		f.spilled = false
+	}
+
+	// Data shared with snapshots is detached rather than overwritten.
+	if f.cow == nil || f.cow.refs == 0 {
+		wipe(f.Data)
+	}
+	f.unshare(false)
+
+	for _, b := range f.blocks {
+		if b.refs == 1 {
+			wipe(b.data)
+		}
+	}
+	f.release()
+
+	if f.held == nil || f.held.refs == 0 {
+		wipe(f.packed)
+	}
+	f.dropPacked()
+
+	if f.sealed != nil && f.sealed.refs == 0 {
+		for _, chunk := range f.sealed.chunks {
+			wipe(chunk)
+		}
+	}
+	f.dropSealed()
+	f.discard()
+
+	f.Data = make([]byte, 0)
+	f.dirty = false
+	f.fs.nbytes = addClamped(f.fs.nbytes, -int64(size))
+	f.fs.charge(&f.Node, -int64(size), 0)
+
+	f.Attrs.Size = 0
+	f.Attrs.Blocks = 0
+	f.Attrs.Mtime = time.Now()
+	f.Attrs.Ctime = f.Attrs.Mtime
+
+	logger.Info("shredded %d bytes of file %d", size, f.ID)
+	return nil
+}
@@ -0,0 +1,164 @@
+package memfs_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"bazil.org/fuse"
+
+	"golang.org/x/net/context"
+
+	. "github.com/bbengfort/memfs"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Secure", func() {
+
+	var err error
+	var tmpDir string
+	var config *Config
+	var fs *FileSystem
+	var ctx context.Context
+	var secret []byte
+
+	// write creates a file holding the secret through the fuse interface so
+	// that its data is resident.
+	write := func(path string) *File {
+		Ω(fs.WriteFile(path, nil, 0600)).Should(Succeed())
+		ent, err := fs.Resolve(path)
+		Ω(err).ShouldNot(HaveOccurred())
+
+		f := ent.(*File)
+		req := &fuse.WriteRequest{Offset: 0, Data: secret}
+		Ω(f.Write(ctx, req, new(fuse.WriteResponse))).Should(Succeed())
+		return f
+	}
+
+	BeforeEach(func() {
+		tmpDir, err = ioutil.TempDir("", TempDirPrefix)
+		Ω(err).ShouldNot(HaveOccurred())
+
+		config = makeTestConfig()
+		config.Secure = true
+		ctx = context.TODO()
+		secret = []byte("correct horse battery staple")
+	})
+
+	JustBeforeEach(func() {
+		fs = New(filepath.Join(tmpDir, "testmp"), config)
+	})
+
+	AfterEach(func() {
+		Ω(fs.Shutdown()).Should(Succeed())
+		Ω(os.RemoveAll(tmpDir)).Should(Succeed())
+	})
+
+	It("should not wipe the data of a read response when the file is truncated", func() {
+		f := write("/secret.txt")
+
+		resp := new(fuse.ReadResponse)
+		Ω(f.Read(ctx, &fuse.ReadRequest{Offset: 0, Size: 64}, resp)).Should(Succeed())
+
+		req := &fuse.SetattrRequest{Valid: fuse.SetattrSize, Size: 0}
+		Ω(f.Setattr(ctx, req, new(fuse.SetattrResponse))).Should(Succeed())
+		Ω(resp.Data).Should(Equal(secret))
+
+		f = write("/other.txt")
+		Ω(f.Read(ctx, &fuse.ReadRequest{Offset: 0, Size: 64}, resp)).Should(Succeed())
+		Ω(f.Write(ctx, &fuse.WriteRequest{Offset: 4096, Data: secret}, new(fuse.WriteResponse))).Should(Succeed())
+		Ω(resp.Data).Should(Equal(secret))
+	})
+
+	It("should zero data on truncate and remove", func() {
+		f := write("/key.txt")
+		data := f.Data
+
+		req := &fuse.SetattrRequest{Size: 7, Valid: fuse.SetattrSize}
+		Ω(f.Setattr(ctx, req, &fuse.SetattrResponse{})).Should(Succeed())
+		Ω(data[7:]).Should(Equal(make([]byte, len(secret)-7)))
+		Ω(data[:7]).Should(Equal([]byte("correct")))
+
+		Ω(fs.Remove("/key.txt")).Should(Succeed())
+		Ω(data).Should(Equal(make([]byte, len(secret))))
+	})
+
+	It("should not zero data shared with snapshots", func() {
+		f := write("/key.txt")
+		data := f.Data
+		Ω(fs.CreateSnapshot("nightly")).Should(Succeed())
+
+		Ω(fs.Remove("/key.txt")).Should(Succeed())
+		Ω(data).Should(Equal(secret))
+
+		Ω(fs.DeleteSnapshot("nightly")).Should(Succeed())
+		Ω(data).Should(Equal(make([]byte, len(secret))))
+	})
+
+	Context("without secure mode", func() {
+
+		BeforeEach(func() {
+			config.Secure = false
+		})
+
+		It("should shred a file when the shred attribute is set", func() {
+			f := write("/key.txt")
+			data := f.Data
+
+			req := &fuse.SetxattrRequest{Name: ShredXattr, Xattr: []byte("1")}
+			Ω(f.Setxattr(ctx, req)).Should(Succeed())
+			Ω(data).Should(Equal(make([]byte, len(secret))))
+			Ω(f.Attrs.Size).Should(BeZero())
+			Ω(f.XAttrs).ShouldNot(HaveKey(ShredXattr))
+
+			contents, err := fs.ReadFile("/key.txt")
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(contents).Should(BeEmpty())
+		})
+
+		It("should not shred directories", func() {
+			Ω(fs.Mkdir("/keys", 0700)).Should(Succeed())
+			Ω(fs.Shred("/keys")).Should(MatchError(fuse.Errno(syscall.EISDIR)))
+		})
+
+	})
+
+	Context("with a spill directory", func() {
+
+		var spillDir string
+
+		BeforeEach(func() {
+			spillDir = filepath.Join(tmpDir, "spill")
+			config.CacheSize = 100
+			config.MaxInodes = 100
+			config.Spill = SpillConfig{Path: spillDir}
+		})
+
+		It("should overwrite spilled data before deleting it", func() {
+			Ω(fs.WriteFile("/key.txt", bytes.Repeat(secret, 2), 0600)).Should(Succeed())
+			Ω(fs.WriteFile("/other.txt", bytes.Repeat([]byte("x"), 80), 0600)).Should(Succeed())
+
+			names, err := filepath.Glob(filepath.Join(spillDir, "*.spill"))
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(names).Should(HaveLen(1))
+
+			// Keep the spilled file open to read it after it is unlinked.
+			fobj, err := os.Open(names[0])
+			Ω(err).ShouldNot(HaveOccurred())
+			defer fobj.Close()
+
+			Ω(fs.Shred("/key.txt")).Should(Succeed())
+			Ω(names[0]).ShouldNot(BeAnExistingFile())
+
+			raw, err := ioutil.ReadAll(fobj)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(raw).Should(Equal(make([]byte, 2*len(secret))))
+		})
+
+	})
+
+})
@@ -0,0 +1,79 @@
+// HTTP control API for introspecting and managing a running file system.
+
+package memfs
+
+import (
+	"net"
+	"net/http"
+)
+
+//===========================================================================
+// Control Server
+//===========================================================================
+
+// Handler returns the HTTP handler of the control API, which exposes the
+// following endpoints to clients on the loopback interface only, since they
+// change the state of the file system or expose its contents:
+//
+//	/watch      stream or long-poll change notifications
+//	/quotas     usage of every user and directory against their quotas
+//	/export     tar stream of the file system (?compression=gzip to compress)
+//	/snapshots  list, create (POST ?name=) or delete (DELETE ?name=) snapshots
+//	/dedup      savings of the deduplicated block store
+//	/reap       expired entries that would be removed (POST to remove them)
+func (mfs *FileSystem) Handler() http.Handler {
+	return WebLogger(logger.Subsystem("http"), local(mfs.mux()))
+}
+
+// mux routes the endpoints of the control API without logging the requests,
+// so that a Manager can serve it beneath the path of the volume.
+func (mfs *FileSystem) mux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.Handle("/watch", mfs.watch)
+	mux.HandleFunc("/quotas", mfs.serveQuotas)
+	mux.HandleFunc("/export", mfs.serveExport)
+	mux.HandleFunc("/snapshots", mfs.serveSnapshots)
+	mux.HandleFunc("/dedup", mfs.serveDedup)
+	mux.HandleFunc("/reap", mfs.serveReap)
+	return mux
+}
+
+// local wraps the handler so that it refuses requests from clients that are
+// not on the loopback interface.
+func local(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !loopback(r) {
+			logger.Subsystem("http").Warn("refused %s %s from %s", r.Method, r.URL.Path, r.RemoteAddr)
+			http.Error(w, "the control api is only available from the loopback interface", http.StatusForbidden)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// loopback returns true if the request was made from the loopback interface.
+func loopback(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// serveControl listens on the configured control address in a background
+// go routine and serves the control API until it is closed by Shutdown.
+func (mfs *FileSystem) serveControl() {
+	mfs.control = &http.Server{
+		Addr:    mfs.Config.Control,
+		Handler: mfs.Handler(),
+	}
+
+	go func(srv *http.Server) {
+		logger.Info("serving control api on %s", srv.Addr)
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			logger.Error("control api stopped: %s", err)
+		}
+	}(mfs.control)
+}
@@ -0,0 +1,523 @@
+// Point-in-time copy-on-write snapshots of the file system tree.
+
+package memfs
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+)
+
+// SnapshotDir is the hidden directory of the root that snapshots appear in.
+// Like ControlDir, the name is reserved in the root.
+const SnapshotDir = ".snapshots"
+
+//===========================================================================
+// Snapshot Types
+//===========================================================================
+
+// Snapshot describes a read-only point-in-time copy of the file system.
+type Snapshot struct {
+	Name    string    `json:"name"`    // Name of the snapshot directory
+	Created time.Time `json:"created"` // When the snapshot was taken
+}
+
+// shared tracks the snapshot files and mirror write backs that share the data
+// buffer (or the spilled or compressed data) of a file in the live tree. The
+// buffer is copied before the live file is modified, at which point they hold
+// the only references to it.
+type shared struct {
+	refs int  // Number of snapshot files and write backs referencing the buffer
+	live bool // If the live file still references the buffer
+}
+
+//===========================================================================
+// Snapshot API
+//===========================================================================
+
+// CreateSnapshot freezes the current state of the tree under the hidden
+// .snapshots directory of the root. The entries of each directory are copied
+// when the snapshot directory is first read or the live directory is about
+// to be modified, and the data of files (resident, spilled, compressed or in
+// an overlay lower directory) is shared with the snapshot until the live file
+// is modified, so only diverged data counts toward the capacity. Every node
+// of a snapshot is an archive that rejects modifications.
+func (mfs *FileSystem) CreateSnapshot(name string) error {
+	if name == "" || name == "." || name == ".." || strings.Contains(name, "/") {
+		return fuse.Errno(syscall.EINVAL)
+	}
+
+	mfs.Lock()
+	defer mfs.Unlock()
+
+	if mfs.snapshots == nil {
+		mfs.snapshots = new(Dir)
+		mfs.snapshots.Init(SnapshotDir, 0555, mfs.root, mfs)
+		mfs.snapshots.archive = true
+		mfs.frozen++
+	}
+
+	if _, ok := mfs.snapshots.Children[name]; ok {
+		return fuse.EEXIST
+	}
+
+	ent, err := mfs.freeze(mfs.root, mfs.snapshots)
+	if ent != nil {
+		ent.GetNode().Name = name
+	}
+
+	if err != nil {
+		if ent != nil {
+			mfs.thaw(ent)
+		}
+		return err
+	}
+
+	root := ent.(*Dir)
+	root.Attrs.Crtime = time.Now()
+	mfs.snapshots.Children[name] = root
+	logger.Info("created snapshot %q", name)
+
+	// Save the inode numbers of the live tree with the snapshot.
+	if err := mfs.saveInodes(); err != nil {
+		logger.Error("could not save inode state: %s", err)
+	}
+	return nil
+}
+
+// Snapshots returns the snapshots of the file system ordered by name.
+func (mfs *FileSystem) Snapshots() []*Snapshot {
+	mfs.Lock()
+	defer mfs.Unlock()
+
+	snapshots := make([]*Snapshot, 0)
+	if mfs.snapshots == nil {
+		return snapshots
+	}
+
+	for name, ent := range mfs.snapshots.Children {
+		snapshots = append(snapshots, &Snapshot{Name: name, Created: ent.GetNode().Attrs.Crtime})
+	}
+
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i].Name < snapshots[j].Name
+	})
+	return snapshots
+}
+
+// DeleteSnapshot removes the named snapshot, releasing its nodes and any data
+// that is no longer shared with the live tree or other snapshots.
+func (mfs *FileSystem) DeleteSnapshot(name string) error {
+	mfs.Lock()
+	defer mfs.Unlock()
+
+	if mfs.snapshots == nil {
+		return fuse.ENOENT
+	}
+
+	ent, ok := mfs.snapshots.Children[name]
+	if !ok {
+		return fuse.ENOENT
+	}
+
+	delete(mfs.snapshots.Children, name)
+	mfs.thaw(ent)
+
+	// The snapshot may still be cached by the kernel.
+	if mfs.server != nil {
+		go func(srv *fs.Server, dir *Dir) {
+			if err := srv.InvalidateEntry(dir, name); err != nil && err != fuse.ErrNotCached {
+				logger.Subsystem("cache").Warn("could not invalidate kernel cache after deleting snapshot %q: %s", name, err)
+			}
+		}(mfs.server, mfs.snapshots)
+	}
+
+	logger.Info("deleted snapshot %q", name)
+	return nil
+}
+
+//===========================================================================
+// Snapshot Helpers
+//===========================================================================
+
+// freeze copies the entity into the parent directory as an archive. The
+// entries of a directory are copied when the snapshot directory is first
+// read or the live directory is about to be modified, and the data of files
+// is shared until the live file is modified. Copies do not count against the
+// inode limit of the live tree. On error the partial copy is returned so
+// that it can be released. Must be called with the lock held.
+func (mfs *FileSystem) freeze(ent Entity, parent *Dir) (Entity, error) {
+	switch src := ent.(type) {
+	case *Dir:
+		d := new(Dir)
+		d.Init(src.Name, src.Attrs.Mode, parent, mfs)
+		d.freezeNode(&src.Node)
+
+		d.source = src
+		src.views = append(src.views, d)
+		mfs.views++
+		return d, nil
+
+	case *Symlink:
+		l := new(Symlink)
+		l.Init(src.Name, src.Target, parent, mfs)
+		l.freezeNode(&src.Node)
+		return l, nil
+
+	case *File:
+		f := new(File)
+		f.Init(src.Name, src.Attrs.Mode, parent, mfs)
+		f.freezeNode(&src.Node)
+		f.Data = nil
+
+		// Each name of a hard linked file is copied separately, so the copies
+		// remember the live file to identify them as links of each other.
+		if len(src.links) > 0 {
+			f.origin = src
+		}
+
+		// The lower directory is never modified, so its files can be read
+		// by the snapshot as they are.
+		if src.lower != "" {
+			f.lower = src.lower
+			f.spilled = true
+			return f, nil
+		}
+
+		if src.spilled {
+			if err := mfs.spill.Link(&src.Node, &f.Node); err != nil {
+				logger.Error("could not link spilled data of file %d: %s", src.ID, err)
+				return f, fuse.EIO
+			}
+			f.spilled = true
+			f.spillID = src.spillID
+			f.held = src.lend()
+			return f, nil
+		}
+
+		if src.packed != nil {
+			f.packed = src.packed
+			f.held = src.lend()
+			return f, nil
+		}
+
+		if src.sealed != nil {
+			src.sealed.refs++
+			f.sealed = src.sealed
+			return f, nil
+		}
+
+		// Snapshots of encrypted files hold their own sealed copy of data
+		// that is resident in plaintext while it is being modified.
+		if mfs.keys != nil {
+			f.hold(append([]byte(nil), src.Data...))
+			return f, nil
+		}
+
+		if src.blocks != nil {
+			f.blocks = mfs.blocks.Retain(src.blocks)
+			mfs.snapbytes += f.Attrs.Size
+			return f, nil
+		}
+
+		if src.cow == nil {
+			src.cow = &shared{live: true}
+		}
+		src.cow.refs++
+		f.cow = src.cow
+		f.Data = src.Data
+		return f, nil
+	}
+
+	return nil, fuse.EIO
+}
+
+// materialize copies the entries of the live directory into the snapshot
+// directory that has yet to copy them. If an entry cannot be copied, the
+// directory is left as it was. Must be called with the lock held.
+func (d *Dir) materialize() error {
+	src := d.source
+	if err := src.populate(); err != nil {
+		return err
+	}
+
+	children := make(map[string]Entity, len(src.Children))
+	for name, child := range src.Children {
+		// A hard link of a file is copied under the name of the link.
+		c, err := d.fs.freeze(child, d)
+		if c != nil {
+			c.GetNode().Name = name
+			children[name] = c
+		}
+
+		if err != nil {
+			for _, c := range children {
+				d.fs.thaw(c)
+			}
+			return err
+		}
+	}
+
+	d.detach()
+	d.Children = children
+	return nil
+}
+
+// detach removes the snapshot directory from the views of the live directory
+// it has yet to copy the entries of. Must be called with the lock held.
+func (d *Dir) detach() {
+	views := d.source.views
+	for i, view := range views {
+		if view == d {
+			d.source.views = append(views[:i], views[i+1:]...)
+			break
+		}
+	}
+
+	d.source = nil
+	d.fs.views--
+}
+
+// diverge copies the entries of the live directory into the snapshots that
+// have yet to copy them before the directory or one of its entries is
+// modified. The directories above it are copied first, since copying a
+// directory is what creates the snapshot directories of its subdirectories.
+// Access times are not preserved. Must be called with the lock held.
+func (d *Dir) diverge() error {
+	if d == nil || d.fs.views == 0 {
+		return nil
+	}
+
+	if err := d.Parent.diverge(); err != nil {
+		return err
+	}
+
+	for len(d.views) > 0 {
+		if err := d.views[0].materialize(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// hold sets the data of a snapshot file that is not shared with the live
+// tree, sealing it if encryption is enabled. Must be called with the lock
+// held.
+func (f *File) hold(data []byte) {
+	f.fs.snapbytes += uint64(len(data))
+	if f.fs.keys == nil {
+		f.Data = data
+		return
+	}
+
+	f.sealed = newSealed(f.fs.keys, &f.Node, data)
+	f.sealed.refs = 1
+	wipe(data)
+	f.Data = nil
+}
+
+// freezeNode copies the attributes and extended attributes of the source
+// node and marks the node as an archive, which is counted as frozen.
+func (n *Node) freezeNode(src *Node) {
+	ino := n.Attrs.Inode
+	n.Attrs = src.Attrs
+	n.Attrs.Inode = ino
+	n.archive = true
+	n.fs.frozen++
+
+	// Extended attribute values are replaced rather than modified, so they
+	// can be shared, and remain sealed for the source node.
+	n.xattrID = src.xattrID
+	for name, value := range src.XAttrs {
+		n.XAttrs[name] = value
+	}
+}
+
+// thaw releases the inodes of a snapshot entity and the data that only it
+// references. Must be called with the lock held.
+func (mfs *FileSystem) thaw(ent Entity) {
+	switch e := ent.(type) {
+	case *Dir:
+		if e.source != nil {
+			e.detach()
+		}
+
+		for _, child := range e.Children {
+			mfs.thaw(child)
+		}
+
+	case *File:
+		if e.lower != "" {
+			e.lower = ""
+		} else if e.spilled {
+			if err := mfs.unspill(&e.Node); err != nil {
+				logger.Warn("could not delete spilled data of file %d: %s", e.ID, err)
+			}
+
+			e.held.refs--
+			if e.held.refs == 0 && !e.held.live {
+				mfs.snapbytes = addClamped(mfs.snapbytes, -int64(e.Attrs.Size))
+				mfs.sbytes = addClamped(mfs.sbytes, -int64(e.Attrs.Size))
+			}
+			e.held = nil
+		} else if e.packed != nil {
+			mfs.unref(e.held, e.packed)
+			e.held = nil
+			e.packed = nil
+		} else if e.sealed != nil {
+			e.sealed.refs--
+			if e.sealed.refs == 0 && !e.sealed.live {
+				mfs.snapbytes = addClamped(mfs.snapbytes, -int64(e.Attrs.Size))
+			}
+			e.sealed = nil
+		} else if e.blocks != nil {
+			mfs.snapbytes = addClamped(mfs.snapbytes, -int64(e.Attrs.Size))
+			e.scrubBlocks()
+			e.release()
+		} else if e.cow == nil {
+			mfs.snapbytes = addClamped(mfs.snapbytes, -int64(len(e.Data)))
+			e.scrub(e.Data)
+		} else {
+			mfs.unref(e.cow, e.Data)
+			e.cow = nil
+		}
+		e.spilled = false
+		e.Data = nil
+	}
+
+	mfs.frozen--
+	mfs.Inodes.Release(ent.GetNode().ID)
+}
+
+// unref releases a reference to data shared with a live file, freeing the
+// data once neither the live file nor any other reference holds it. Must be
+// called with the lock held.
+func (mfs *FileSystem) unref(cow *shared, data []byte) {
+	cow.refs--
+	if cow.refs == 0 && !cow.live {
+		mfs.snapbytes = addClamped(mfs.snapbytes, -int64(len(data)))
+		if mfs.secure() {
+			wipe(data)
+		}
+	}
+}
+
+// pin shares the resident data of the file, as a snapshot does, so that it
+// is copied before the live file is modified until it is released by unpin.
+// Must be called with the lock held.
+func (f *File) pin() (*shared, []byte) {
+	if f.cow == nil {
+		f.cow = &shared{live: true}
+	}
+	f.cow.refs++
+	return f.cow, f.Data
+}
+
+// unpin releases data pinned by pin, detaching it from the file if nothing
+// else shares it so that the file can again be compressed or sealed. Must be
+// called with the lock held.
+func (f *File) unpin(cow *shared, data []byte) {
+	f.fs.unref(cow, data)
+	if f.cow == cow && cow.refs == 0 {
+		f.cow = nil
+	}
+}
+
+// unshare detaches the data of a live file from the snapshots that share it,
+// copying it first if it is about to be modified in place. The detached data
+// is then held only by snapshots. Must be called with the lock held.
+func (f *File) unshare(modify bool) {
+	if f.cow == nil {
+		return
+	}
+
+	if f.cow.refs > 0 {
+		f.fs.snapbytes += uint64(len(f.Data))
+		if modify {
+			f.Data = append([]byte(nil), f.Data...)
+		}
+	}
+
+	f.cow.live = false
+	f.cow = nil
+}
+
+// lend shares the spilled or compressed data of the file with a snapshot.
+// Must be called with the lock held.
+func (f *File) lend() *shared {
+	if f.held == nil {
+		f.held = &shared{live: true}
+	}
+	f.held.refs++
+	return f.held
+}
+
+// disown detaches the spilled or compressed data of a live file that is
+// about to be released from the snapshots that share it, which then hold the
+// only references to it. Spilled data held by snapshots stays on disk. Must
+// be called with the lock held.
+func (f *File) disown(size uint64) {
+	if f.held == nil {
+		return
+	}
+
+	if f.held.refs > 0 {
+		f.fs.snapbytes += size
+		if f.spilled {
+			f.fs.sbytes += size
+		}
+	}
+
+	f.held.live = false
+	f.held = nil
+}
+
+// child returns the named entry of the directory, including the hidden
+// snapshots directory of the root. Must be called with the lock held.
+func (d *Dir) child(name string) (Entity, bool) {
+	if d == d.fs.root && name == SnapshotDir && d.fs.snapshots != nil {
+		return d.fs.snapshots, true
+	}
+
+	ent, ok := d.Children[name]
+	return ent, ok
+}
+
+// serveSnapshots lists the snapshots as JSON on GET, creates the snapshot
+// named by the name query parameter on POST and deletes it on DELETE.
+func (mfs *FileSystem) serveSnapshots(w http.ResponseWriter, r *http.Request) {
+	var err error
+	name := r.URL.Query().Get("name")
+
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(mfs.Snapshots())
+		return
+	case http.MethodPost:
+		err = mfs.CreateSnapshot(name)
+	case http.MethodDelete:
+		err = mfs.DeleteSnapshot(name)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	switch err {
+	case nil:
+		w.WriteHeader(http.StatusNoContent)
+	case fuse.EEXIST:
+		http.Error(w, fmt.Sprintf("snapshot %q already exists", name), http.StatusConflict)
+	case fuse.ENOENT:
+		http.Error(w, fmt.Sprintf("snapshot %q does not exist", name), http.StatusNotFound)
+	default:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	}
+}
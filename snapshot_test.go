@@ -0,0 +1,298 @@
+package memfs_test
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"time"
+
+	"bazil.org/fuse"
+
+	"golang.org/x/net/context"
+
+	. "github.com/bbengfort/memfs"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Snapshots", func() {
+
+	var err error
+	var tmpDir string
+	var config *Config
+	var fs *FileSystem
+	var ctx context.Context
+
+	bfree := func() uint64 {
+		resp := new(fuse.StatfsResponse)
+		Ω(fs.Statfs(ctx, new(fuse.StatfsRequest), resp)).Should(Succeed())
+		return resp.Bfree
+	}
+
+	BeforeEach(func() {
+		tmpDir, err = ioutil.TempDir("", TempDirPrefix)
+		Ω(err).ShouldNot(HaveOccurred())
+
+		config = makeTestConfig()
+		ctx = context.TODO()
+	})
+
+	JustBeforeEach(func() {
+		fs = New(filepath.Join(tmpDir, "testmp"), config)
+		Ω(fs.Mkdir("/docs", 0755)).Should(Succeed())
+		Ω(fs.WriteFile("/docs/a.txt", []byte("original"), 0644)).Should(Succeed())
+	})
+
+	AfterEach(func() {
+		Ω(os.RemoveAll(tmpDir)).Should(Succeed())
+	})
+
+	It("should preserve the tree at the point the snapshot was taken", func() {
+		Ω(fs.CreateSnapshot("nightly")).Should(Succeed())
+
+		ent, err := fs.Resolve("/docs/a.txt")
+		Ω(err).ShouldNot(HaveOccurred())
+		req := &fuse.WriteRequest{Offset: 0, Data: []byte("modified")}
+		Ω(ent.(*File).Write(ctx, req, new(fuse.WriteResponse))).Should(Succeed())
+		Ω(fs.WriteFile("/docs/b.txt", []byte("new"), 0644)).Should(Succeed())
+
+		data, err := fs.ReadFile("/.snapshots/nightly/docs/a.txt")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(data).Should(Equal([]byte("original")))
+
+		data, err = fs.ReadFile("/docs/a.txt")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(data).Should(Equal([]byte("modified")))
+
+		_, err = fs.Resolve("/.snapshots/nightly/docs/b.txt")
+		Ω(err).Should(MatchError(fuse.ENOENT))
+	})
+
+	It("should reject modifications of snapshots", func() {
+		Ω(fs.CreateSnapshot("nightly")).Should(Succeed())
+		Ω(fs.CreateSnapshot("nightly")).Should(MatchError(fuse.EEXIST))
+
+		ent, err := fs.Resolve("/.snapshots/nightly/docs/a.txt")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(ent.IsArchive()).Should(BeTrue())
+
+		req := &fuse.WriteRequest{Offset: 0, Data: []byte("modified")}
+		Ω(ent.(*File).Write(ctx, req, new(fuse.WriteResponse))).Should(MatchError(fuse.EPERM))
+		Ω(fs.WriteFile("/.snapshots/nightly/docs/c.txt", nil, 0644)).Should(MatchError(fuse.EPERM))
+		Ω(fs.Remove("/.snapshots/nightly/docs/a.txt")).Should(MatchError(fuse.EPERM))
+	})
+
+	It("should read and close the files of snapshots", func() {
+		Ω(fs.CreateSnapshot("nightly")).Should(Succeed())
+
+		ent, err := fs.Resolve("/.snapshots/nightly/docs/a.txt")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		resp := new(fuse.ReadResponse)
+		Ω(ent.(*File).Read(ctx, &fuse.ReadRequest{Size: 64}, resp)).Should(Succeed())
+		Ω(resp.Data).Should(Equal([]byte("original")))
+		Ω(ent.(*File).Flush(ctx, new(fuse.FlushRequest))).Should(Succeed())
+	})
+
+	It("should list and delete snapshots without showing them in the root", func() {
+		Ω(fs.CreateSnapshot("nightly")).Should(Succeed())
+		Ω(fs.CreateSnapshot("hourly")).Should(Succeed())
+
+		snapshots := fs.Snapshots()
+		Ω(snapshots).Should(HaveLen(2))
+		Ω(snapshots[0].Name).Should(Equal("hourly"))
+		Ω(snapshots[1].Name).Should(Equal("nightly"))
+
+		root, err := fs.Resolve("/")
+		Ω(err).ShouldNot(HaveOccurred())
+		dirents, err := root.(*Dir).ReadDirAll(ctx)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(dirents).Should(HaveLen(1))
+
+		Ω(fs.DeleteSnapshot("hourly")).Should(Succeed())
+		Ω(fs.DeleteSnapshot("hourly")).Should(MatchError(fuse.ENOENT))
+		Ω(fs.Snapshots()).Should(HaveLen(1))
+
+		_, err = fs.Resolve("/.snapshots/hourly")
+		Ω(err).Should(MatchError(fuse.ENOENT))
+	})
+
+	It("should only account for diverged data", func() {
+		Ω(fs.WriteFile("/docs/big.txt", make([]byte, 4096), 0644)).Should(Succeed())
+		free := bfree()
+
+		Ω(fs.CreateSnapshot("nightly")).Should(Succeed())
+		_, err := fs.Resolve("/.snapshots/nightly/docs/big.txt")
+		Ω(err).ShouldNot(HaveOccurred())
+		snapped := bfree()
+		Ω(snapped).Should(BeNumerically("<", free))
+		Ω(snapped).Should(BeNumerically(">", free-8))
+
+		Ω(fs.WriteFile("/docs/big.txt", make([]byte, 4096), 0644)).Should(Succeed())
+		Ω(bfree()).Should(Equal(snapped - 8))
+
+		Ω(fs.DeleteSnapshot("nightly")).Should(Succeed())
+		Ω(bfree()).Should(Equal(free))
+	})
+
+	It("should copy the entries of directories when they are first read", func() {
+		// The hidden snapshots directory takes an inode as well.
+		inodes := fs.Inodes.Len() + 1
+		Ω(fs.CreateSnapshot("nightly")).Should(Succeed())
+		Ω(fs.Inodes.Len()).Should(Equal(inodes + 1))
+
+		_, err := fs.Resolve("/.snapshots/nightly/docs/a.txt")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(fs.Inodes.Len()).Should(Equal(inodes + 3))
+
+		Ω(fs.DeleteSnapshot("nightly")).Should(Succeed())
+		Ω(fs.Inodes.Len()).Should(Equal(inodes))
+	})
+
+	It("should copy the entries of directories before they are modified", func() {
+		Ω(fs.CreateSnapshot("nightly")).Should(Succeed())
+		Ω(fs.Mkdir("/docs/drafts", 0755)).Should(Succeed())
+		Ω(fs.Rename("/docs/a.txt", "/docs/drafts/a.txt")).Should(Succeed())
+		Ω(fs.Remove("/docs/drafts/a.txt")).Should(Succeed())
+		Ω(fs.Remove("/docs/drafts")).Should(Succeed())
+		Ω(fs.Remove("/docs")).Should(Succeed())
+
+		data, err := fs.ReadFile("/.snapshots/nightly/docs/a.txt")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(data).Should(Equal([]byte("original")))
+
+		_, err = fs.Resolve("/.snapshots/nightly/docs/drafts")
+		Ω(err).Should(MatchError(fuse.ENOENT))
+	})
+
+	It("should only manage snapshots from the loopback interface", func() {
+		w := httptest.NewRecorder()
+		fs.Handler().ServeHTTP(w, httptest.NewRequest("POST", "/snapshots?name=nightly", nil))
+		Ω(w.Code).Should(Equal(403))
+		Ω(fs.Snapshots()).Should(BeEmpty())
+
+		w = httptest.NewRecorder()
+		fs.Handler().ServeHTTP(w, localRequest("POST", "/snapshots?name=nightly"))
+		Ω(w.Code).Should(Equal(204))
+		Ω(fs.Snapshots()).Should(HaveLen(1))
+	})
+
+	Context("with an inode limit", func() {
+
+		BeforeEach(func() {
+			config.MaxInodes = 5
+		})
+
+		It("should not count the nodes of snapshots against the limit", func() {
+			Ω(fs.CreateSnapshot("nightly")).Should(Succeed())
+			Ω(fs.CreateSnapshot("hourly")).Should(Succeed())
+
+			_, err := fs.Resolve("/.snapshots/nightly/docs/a.txt")
+			Ω(err).ShouldNot(HaveOccurred())
+			_, err = fs.Resolve("/.snapshots/hourly/docs/a.txt")
+			Ω(err).ShouldNot(HaveOccurred())
+
+			// The live tree of 3 nodes can still grow to the limit.
+			Ω(fs.Remove("/docs/a.txt")).Should(Succeed())
+			Ω(fs.WriteFile("/a.txt", nil, 0644)).Should(Succeed())
+			Ω(fs.WriteFile("/b.txt", nil, 0644)).Should(Succeed())
+			Ω(fs.WriteFile("/c.txt", nil, 0644)).Should(Succeed())
+			Ω(fs.WriteFile("/d.txt", nil, 0644)).Should(MatchError(ENOSPC))
+
+			resp := new(fuse.StatfsResponse)
+			Ω(fs.Statfs(ctx, new(fuse.StatfsRequest), resp)).Should(Succeed())
+			Ω(resp.Ffree).Should(BeZero())
+
+			Ω(fs.DeleteSnapshot("nightly")).Should(Succeed())
+			Ω(fs.DeleteSnapshot("hourly")).Should(Succeed())
+			Ω(fs.WriteFile("/d.txt", nil, 0644)).Should(MatchError(ENOSPC))
+		})
+
+	})
+
+	Context("with a spill directory", func() {
+
+		var data []byte
+
+		BeforeEach(func() {
+			config.CacheSize = 100
+			config.MaxInodes = 100
+			config.Secure = true
+			config.Spill = SpillConfig{Path: filepath.Join(tmpDir, "spill")}
+			data = bytes.Repeat([]byte("spilled"), 50)
+		})
+
+		It("should share the spilled data with the snapshot", func() {
+			Ω(fs.WriteFile("/docs/big.dat", data, 0644)).Should(Succeed())
+			Ω(fs.WriteFile("/docs/small.dat", []byte("small"), 0644)).Should(Succeed())
+			Ω(fs.CreateSnapshot("nightly")).Should(Succeed())
+
+			ent, err := fs.Resolve("/.snapshots/nightly/docs/big.dat")
+			Ω(err).ShouldNot(HaveOccurred())
+			f := ent.(*File)
+			Ω(f.Data).Should(BeEmpty())
+
+			// Replacing the live file keeps the data of the snapshot.
+			Ω(fs.WriteFile("/docs/big.dat", []byte("replaced"), 0644)).Should(Succeed())
+			Ω(fs.Shred("/docs/big.dat")).Should(Succeed())
+
+			resp := new(fuse.ReadResponse)
+			Ω(f.Read(ctx, &fuse.ReadRequest{Offset: 7, Size: 14}, resp)).Should(Succeed())
+			Ω(resp.Data).Should(Equal(data[7:21]))
+			Ω(f.Data).Should(BeEmpty())
+
+			contents, err := fs.ReadFile("/.snapshots/nightly/docs/big.dat")
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(contents).Should(Equal(data))
+
+			path := filepath.Join(config.Spill.Path, fmt.Sprintf("%d-%d.spill", f.ID, f.Gen))
+			Ω(path).Should(BeAnExistingFile())
+			Ω(fs.DeleteSnapshot("nightly")).Should(Succeed())
+			Ω(path).ShouldNot(BeAnExistingFile())
+		})
+
+	})
+
+	Context("with compression", func() {
+
+		var data []byte
+
+		BeforeEach(func() {
+			config.Compress.After = Duration(time.Hour)
+			data = bytes.Repeat([]byte("INFO request handled in 3ms\n"), 1024)
+		})
+
+		It("should share the compressed data with the snapshot", func() {
+			Ω(fs.WriteFile("/docs/cold.log", data, 0644)).Should(Succeed())
+			ent, err := fs.Resolve("/docs/cold.log")
+			Ω(err).ShouldNot(HaveOccurred())
+			ent.GetNode().Attrs.Atime = time.Now().Add(-2 * time.Hour)
+			Ω(fs.CompressCold()).Should(Equal(1))
+
+			Ω(fs.CreateSnapshot("nightly")).Should(Succeed())
+			ent, err = fs.Resolve("/.snapshots/nightly/docs/cold.log")
+			Ω(err).ShouldNot(HaveOccurred())
+			f := ent.(*File)
+			Ω(f.Data).Should(BeEmpty())
+
+			// Decompressing the live file keeps the data of the snapshot.
+			Ω(fs.WriteFile("/docs/cold.log", []byte("replaced"), 0644)).Should(Succeed())
+
+			resp := new(fuse.ReadResponse)
+			Ω(f.Read(ctx, &fuse.ReadRequest{Offset: 28, Size: 56}, resp)).Should(Succeed())
+			Ω(resp.Data).Should(Equal(data[28:84]))
+			Ω(f.Data).Should(BeEmpty())
+
+			contents, err := fs.ReadFile("/.snapshots/nightly/docs/cold.log")
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(contents).Should(Equal(data))
+			Ω(fs.DeleteSnapshot("nightly")).Should(Succeed())
+		})
+
+	})
+
+})
@@ -0,0 +1,418 @@
+// Eviction of cold file data to a backing directory under memory pressure.
+
+package memfs
+
+import (
+	"bytes"
+	"container/list"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"bazil.org/fuse"
+)
+
+// Extension of the files that evicted data is written to.
+const spillExt = ".spill"
+
+// How long the free space of the spill directory is cached before the disk
+// is checked again.
+const spillStatInterval = 5 * time.Second
+
+//===========================================================================
+// Spill Store Type and Constructor
+//===========================================================================
+
+// SpillConfig specifies the backing directory that cold file data is
+// evicted to when the resident data exceeds the cache size. Spilling is
+// disabled if no path is specified.
+type SpillConfig struct {
+	Path     string `json:"path" yaml:"path"`         // Directory to write evicted file data to
+	Capacity uint64 `json:"capacity" yaml:"capacity"` // Maximum bytes of data in memory and on disk (0 for unlimited)
+}
+
+// SpillStore writes the data of evicted files to a backing directory, one
+// file per node, keyed by the inode number and generation of the node. If
+// encryption is enabled the data is written in chunks sealed for an ID,
+// which is the ID of the node unless the data is shared with a snapshot.
+//
+// The store also keeps the resident files in the order they were accessed,
+// so that the least recently used files are evicted without scanning all of
+// the inodes of the file system.
+type SpillStore struct {
+	Path    string     // The backing directory
+	keys    *Keyring   // Encrypts the spilled data (nil if disabled)
+	lru     *list.List // Resident files from least to most recently used
+	room    uint64     // Spilled bytes and free bytes on disk at the last check
+	checked time.Time  // When the free space of the disk was last checked
+}
+
+// OpenSpillStore creates the backing directory if it does not exist and
+// removes any data that was spilled by a previous run of the file system.
+func OpenSpillStore(conf *SpillConfig) (*SpillStore, error) {
+	if err := os.MkdirAll(conf.Path, 0700); err != nil {
+		return nil, err
+	}
+
+	infos, err := ioutil.ReadDir(conf.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, info := range infos {
+		if strings.HasSuffix(info.Name(), spillExt) {
+			if err := os.Remove(filepath.Join(conf.Path, info.Name())); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return &SpillStore{Path: conf.Path, lru: list.New()}, nil
+}
+
+//===========================================================================
+// Spill Store Methods
+//===========================================================================
+
+// path returns the location of the spilled data of the node.
+func (s *SpillStore) path(n *Node) string {
+	return filepath.Join(s.Path, fmt.Sprintf("%d-%d%s", n.ID, n.Gen, spillExt))
+}
+
+// Put writes the data of the node to disk, sealed for the ID if encryption
+// is enabled.
+func (s *SpillStore) Put(n *Node, id sealID, data []byte) error {
+	if s.keys != nil {
+		return s.putSealed(n, s.keys.sealChunks(id, data))
+	}
+	return ioutil.WriteFile(s.path(n), data, 0600)
+}
+
+// putSealed writes the sealed chunks of the data of the node to disk.
+func (s *SpillStore) putSealed(n *Node, chunks [][]byte) error {
+	return ioutil.WriteFile(s.path(n), bytes.Join(chunks, nil), 0600)
+}
+
+// Get reads the data of the node from disk, opening it with the ID it was
+// sealed for if encryption is enabled.
+func (s *SpillStore) Get(n *Node, id sealID) ([]byte, error) {
+	data, err := ioutil.ReadFile(s.path(n))
+	if err != nil || s.keys == nil {
+		return data, err
+	}
+	return s.keys.openChunks(id, data)
+}
+
+// ReadAt reads len(buf) bytes of the data of the node from the offset. If
+// the data is sealed, only the chunks that are read are decrypted.
+func (s *SpillStore) ReadAt(n *Node, id sealID, buf []byte, off int64) (int, error) {
+	fobj, err := os.Open(s.path(n))
+	if err != nil {
+		return 0, err
+	}
+	defer fobj.Close()
+
+	if s.keys == nil {
+		return fobj.ReadAt(buf, off)
+	}
+
+	info, err := fobj.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	sealed := make([]byte, sealChunk+sealOverhead)
+	nread := 0
+	for i := off / sealChunk; nread < len(buf); i++ {
+		pos := i * (sealChunk + sealOverhead)
+		size, err := fobj.ReadAt(sealed, pos)
+		if size == 0 {
+			if err == nil {
+				err = io.EOF
+			}
+			return nread, err
+		}
+
+		chunk, err := s.keys.Open(sealed[:size], id.chunk(int(i), pos+int64(size) == info.Size()))
+		if err != nil {
+			return nread, err
+		}
+
+		start := int64(0)
+		if nread == 0 {
+			start = off % sealChunk
+		}
+
+		if start < int64(len(chunk)) {
+			nread += copy(buf[nread:], chunk[start:])
+		}
+		wipe(chunk)
+
+		if size < len(sealed) && nread < len(buf) {
+			return nread, io.EOF
+		}
+	}
+	return nread, nil
+}
+
+// Link shares the data of the node on disk with the dst node, so that the
+// data is kept until both of them are deleted.
+func (s *SpillStore) Link(n, dst *Node) error {
+	return os.Link(s.path(n), s.path(dst))
+}
+
+// Room returns the bytes that have been spilled plus the free space of the
+// disk, which is checked at most once per spillStatInterval since the check
+// is a system call made with the lock of the file system held. The spilled
+// bytes are passed in so that data spilled since the check is accounted for.
+func (s *SpillStore) Room(spilled uint64) (uint64, error) {
+	if time.Since(s.checked) >= spillStatInterval {
+		var stat syscall.Statfs_t
+		if err := syscall.Statfs(s.Path, &stat); err != nil {
+			return 0, err
+		}
+
+		s.room = spilled + uint64(stat.Bavail)*uint64(stat.Bsize)
+		s.checked = time.Now()
+	}
+	return s.room, nil
+}
+
+// Delete removes the data of the node from disk.
+func (s *SpillStore) Delete(n *Node) error {
+	if err := os.Remove(s.path(n)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+//===========================================================================
+// File Eviction
+//===========================================================================
+
+// evict writes the data of the file to the spill store and releases it from
+// memory. Must be called with the lock held.
+func (f *File) evict() error {
+	if f.sealed != nil {
+		return f.evictSealed()
+	}
+
+	if f.spilled || len(f.Data) == 0 {
+		return nil
+	}
+
+	id := nodeSealID(&f.Node)
+	if err := f.fs.spill.Put(&f.Node, id, f.Data); err != nil {
+		return err
+	}
+
+	f.fs.sbytes += uint64(len(f.Data))
+	f.scrubData()
+	f.unshare(false)
+	f.Data = nil
+	f.spilled = true
+	f.spillID = id
+	return nil
+}
+
+// evictSealed writes the sealed chunks of the file to the spill store as
+// they are, so that the data is never decrypted to be evicted. Must be
+// called with the lock held.
+func (f *File) evictSealed() error {
+	if err := f.fs.spill.putSealed(&f.Node, f.sealed.chunks); err != nil {
+		return err
+	}
+
+	f.fs.sbytes += f.Attrs.Size
+	f.spillID = f.sealed.id
+	f.dropSealed()
+	f.spilled = true
+	return nil
+}
+
+// fault reads the data of an evicted file (or copies up the data of a file
+// in the lower directory, or inflates a deduplicated, compressed or encrypted
+// file) back into memory and evicts other files if the resident data then
+// exceeds the cache size. Must be called with the lock held.
+func (f *File) fault() error {
+	if f.packed != nil {
+		if err := f.unpack(); err != nil {
+			return err
+		}
+		f.fs.reclaim(f)
+		return nil
+	}
+
+	if f.blocks != nil {
+		f.inflate()
+		f.fs.reclaim(f)
+		return nil
+	}
+
+	if f.sealed != nil {
+		if err := f.unseal(); err != nil {
+			return err
+		}
+		f.fs.reclaim(f)
+		return nil
+	}
+
+	if !f.spilled {
+		return nil
+	}
+
+	if f.lower != "" {
+		return f.copyUp()
+	}
+
+	data, err := f.fs.spill.Get(&f.Node, f.spillID)
+	if err != nil {
+		logger.Error("could not fault in data of file %d: %s", f.ID, err)
+		return fuse.EIO
+	}
+
+	if err := f.fs.unspill(&f.Node); err != nil {
+		logger.Warn("could not delete spilled data of file %d: %s", f.ID, err)
+	}
+
+	f.disown(uint64(len(data)))
+	f.Data = data
+	f.spilled = false
+	f.fs.sbytes = addClamped(f.fs.sbytes, -int64(len(data)))
+	f.fs.reclaim(f)
+	return nil
+}
+
+// discard removes the spilled data of a file that is being unlinked. Must
+// be called with the lock held.
+func (f *File) discard() {
+	if !f.spilled {
+		return
+	}
+
+	// The data of files in the lower directory is never removed.
+	if f.lower != "" {
+		f.fs.sbytes = addClamped(f.fs.sbytes, -int64(f.Attrs.Size))
+		f.lower = ""
+		f.spilled = false
+		return
+	}
+
+	if err := f.fs.unspill(&f.Node); err != nil {
+		logger.Warn("could not delete spilled data of file %d: %s", f.ID, err)
+	}
+
+	f.disown(f.Attrs.Size)
+	f.fs.sbytes = addClamped(f.fs.sbytes, -int64(f.Attrs.Size))
+	f.spilled = false
+}
+
+// resident returns the number of bytes of file data held in memory,
+// including data held only by snapshots and excluding deduplicated data.
+// Must be called with the lock held.
+func (mfs *FileSystem) resident() uint64 {
+	return addClamped(mfs.nbytes, -int64(mfs.sbytes)) + mfs.snapbytes - mfs.savings()
+}
+
+// touch marks the file as the most recently used resident file, so that it
+// is the last to be evicted. Must be called with the lock held.
+func (mfs *FileSystem) touch(f *File) {
+	if mfs.spill == nil {
+		return
+	}
+
+	if f.lru != nil {
+		mfs.spill.lru.MoveToBack(f.lru)
+		return
+	}
+	f.lru = mfs.spill.lru.PushBack(f)
+}
+
+// forget removes the file from the resident files, e.g. when it is evicted
+// or unlinked. Must be called with the lock held.
+func (mfs *FileSystem) forget(f *File) {
+	if f.lru == nil {
+		return
+	}
+
+	mfs.spill.lru.Remove(f.lru)
+	f.lru = nil
+}
+
+// reclaim marks keep as the most recently used file then evicts the least
+// recently used files (other than keep) until the resident data is 10% below
+// the cache size, if it exceeds the cache size and a spill directory is
+// configured. Files that are no longer resident are dropped from the list as
+// it is walked. Must be called with the lock held.
+func (mfs *FileSystem) reclaim(keep *File) {
+	if keep != nil {
+		mfs.touch(keep)
+	}
+
+	if mfs.spill == nil || mfs.resident() <= mfs.Config.CacheSize {
+		return
+	}
+
+	target := mfs.Config.CacheSize - mfs.Config.CacheSize/10
+	for e := mfs.spill.lru.Front(); e != nil && mfs.resident() > target; {
+		f := e.Value.(*File)
+		e = e.Next()
+
+		if f == keep {
+			continue
+		}
+
+		if f.spilled || f.IsArchive() || (len(f.Data) == 0 && f.sealed == nil) {
+			mfs.forget(f)
+			continue
+		}
+
+		if err := f.evict(); err != nil {
+			logger.Error("could not evict data of file %d: %s", f.ID, err)
+			return
+		}
+		mfs.forget(f)
+		logger.Debug("evicted %d bytes of file %d to %s", f.Attrs.Size, f.ID, mfs.spill.Path)
+	}
+}
+
+// checkSpace returns ENOSPC if adding the bytes would exceed the capacity of
+// a file system with a spill directory or the share of the memory budget of a
+// volume. Must be called with the lock held.
+func (mfs *FileSystem) checkSpace(bytes uint64) error {
+	capacity := mfs.Config.Spill.Capacity
+	if mfs.spill != nil && capacity > 0 && bytes > 0 && mfs.used()+bytes > capacity {
+		logger.Debug("(error) adding %d bytes would exceed the capacity of %d bytes", bytes, capacity)
+		return ENOSPC
+	}
+
+	// The budget is checked last since it reserves the bytes.
+	return mfs.checkBudget(bytes)
+}
+
+// capacity returns the number of bytes of data the file system can hold,
+// which is the cache size unless a spill directory is configured. If the
+// spill directory has no capacity limit, the data that can be spilled is
+// bounded by the free space of the disk. Must be called with the lock held.
+func (mfs *FileSystem) capacity() uint64 {
+	if mfs.spill == nil {
+		return mfs.Config.CacheSize
+	}
+
+	if mfs.Config.Spill.Capacity > 0 {
+		return mfs.Config.Spill.Capacity
+	}
+
+	room, err := mfs.spill.Room(mfs.sbytes)
+	if err != nil {
+		logger.Warn("could not stat spill directory: %s", err)
+		return mfs.Config.CacheSize
+	}
+
+	return mfs.Config.CacheSize + room
+}
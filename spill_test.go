@@ -0,0 +1,132 @@
+package memfs_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"bazil.org/fuse"
+
+	"golang.org/x/net/context"
+
+	. "github.com/bbengfort/memfs"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Spill", func() {
+
+	var err error
+	var tmpDir string
+	var spillDir string
+	var config *Config
+	var fs *FileSystem
+
+	spilled := func() []string {
+		names, err := filepath.Glob(filepath.Join(spillDir, "*.spill"))
+		Ω(err).ShouldNot(HaveOccurred())
+		return names
+	}
+
+	BeforeEach(func() {
+		tmpDir, err = ioutil.TempDir("", TempDirPrefix)
+		Ω(err).ShouldNot(HaveOccurred())
+		spillDir = filepath.Join(tmpDir, "spill")
+
+		config = makeTestConfig()
+		config.CacheSize = 100
+		config.MaxInodes = 100
+		config.Spill = SpillConfig{Path: spillDir, Capacity: 1000}
+	})
+
+	JustBeforeEach(func() {
+		fs = New(filepath.Join(tmpDir, "testmp"), config)
+	})
+
+	AfterEach(func() {
+		Ω(os.RemoveAll(tmpDir)).Should(Succeed())
+	})
+
+	It("should evict the least recently used files", func() {
+		Ω(fs.WriteFile("/a.txt", bytes.Repeat([]byte("a"), 60), 0644)).Should(Succeed())
+		Ω(spilled()).Should(BeEmpty())
+
+		Ω(fs.WriteFile("/b.txt", bytes.Repeat([]byte("b"), 60), 0644)).Should(Succeed())
+		Ω(fs.WriteFile("/c.txt", bytes.Repeat([]byte("c"), 60), 0644)).Should(Succeed())
+		Ω(spilled()).Should(HaveLen(2))
+
+		ent, err := fs.Resolve("/a.txt")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(ent.(*File).Data).Should(BeEmpty())
+
+		// Faulting a file in evicts the least recently used resident file.
+		data, err := fs.ReadFile("/a.txt")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(data).Should(Equal(bytes.Repeat([]byte("a"), 60)))
+		Ω(ent.(*File).Data).Should(HaveLen(60))
+		Ω(spilled()).Should(HaveLen(2))
+
+		data, err = fs.ReadFile("/c.txt")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(data).Should(Equal(bytes.Repeat([]byte("c"), 60)))
+	})
+
+	It("should keep recently read files resident", func() {
+		Ω(fs.WriteFile("/a.txt", bytes.Repeat([]byte("a"), 40), 0644)).Should(Succeed())
+		Ω(fs.WriteFile("/b.txt", bytes.Repeat([]byte("b"), 40), 0644)).Should(Succeed())
+
+		_, err := fs.ReadFile("/a.txt")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		Ω(fs.WriteFile("/c.txt", bytes.Repeat([]byte("c"), 40), 0644)).Should(Succeed())
+		Ω(spilled()).Should(HaveLen(1))
+
+		for path, resident := range map[string]bool{"/a.txt": true, "/b.txt": false, "/c.txt": true} {
+			ent, err := fs.Resolve(path)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(len(ent.(*File).Data) > 0).Should(Equal(resident), path)
+		}
+	})
+
+	It("should read files larger than the cache from disk", func() {
+		data := make([]byte, 300)
+		for i := range data {
+			data[i] = byte(i)
+		}
+
+		Ω(fs.WriteFile("/large.dat", data, 0644)).Should(Succeed())
+		Ω(fs.WriteFile("/small.dat", []byte("small"), 0644)).Should(Succeed())
+
+		ent, err := fs.Resolve("/large.dat")
+		Ω(err).ShouldNot(HaveOccurred())
+		f := ent.(*File)
+		Ω(f.Data).Should(BeEmpty())
+
+		req := &fuse.ReadRequest{Offset: 100, Size: 50}
+		resp := new(fuse.ReadResponse)
+		Ω(f.Read(context.TODO(), req, resp)).Should(Succeed())
+		Ω(resp.Data).Should(Equal(data[100:150]))
+		Ω(f.Data).Should(BeEmpty())
+	})
+
+	It("should delete the spilled data of removed files", func() {
+		Ω(fs.WriteFile("/a.txt", bytes.Repeat([]byte("a"), 60), 0644)).Should(Succeed())
+		Ω(fs.WriteFile("/b.txt", bytes.Repeat([]byte("b"), 60), 0644)).Should(Succeed())
+		Ω(spilled()).Should(HaveLen(1))
+
+		Ω(fs.Remove("/a.txt")).Should(Succeed())
+		Ω(spilled()).Should(BeEmpty())
+	})
+
+	It("should limit the total capacity", func() {
+		Ω(fs.WriteFile("/a.txt", make([]byte, 600), 0644)).Should(Succeed())
+		Ω(fs.WriteFile("/b.txt", make([]byte, 600), 0644)).Should(MatchError(ENOSPC))
+
+		resp := new(fuse.StatfsResponse)
+		Ω(fs.Statfs(context.TODO(), new(fuse.StatfsRequest), resp)).Should(Succeed())
+		Ω(resp.Blocks).Should(Equal(uint64(1000 / 512)))
+	})
+
+})
@@ -0,0 +1,350 @@
+// Expiration of files and directories that have not been modified for their
+// time to live.
+
+package memfs
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"bazil.org/fuse"
+)
+
+// TTLXattr is the extended attribute that sets the time to live of a file or,
+// when set on a directory, of the entries beneath it. The value is a duration
+// such as "36h" or a number of seconds; a time to live of zero never expires,
+// which exempts a file or subtree from the policy of a parent directory.
+const TTLXattr = "user.memfs.ttl"
+
+// Minimum interval between runs of the reaper.
+const minReapInterval = time.Second
+
+//===========================================================================
+// TTL Configuration
+//===========================================================================
+
+// TTLConfig specifies how often expired entries are reaped in the background
+// and the time to live of the entries beneath directories by absolute path.
+// A time to live set on a node with TTLXattr takes precedence over the rules
+// that match its path, which take precedence over the policy of its
+// directory.
+type TTLConfig struct {
+	Interval    Duration            `json:"interval" yaml:"interval"`       // How often expired entries are removed (0 disables the reaper)
+	Directories map[string]Duration `json:"directories" yaml:"directories"` // Time to live of the entries beneath a directory
+}
+
+// ReapReport lists the entries that were removed by the reaper or, on a dry
+// run, that would be removed.
+type ReapReport struct {
+	DryRun bool     `json:"dryrun"` // True if nothing was removed
+	Files  uint64   `json:"files"`  // Number of expired files
+	Dirs   uint64   `json:"dirs"`   // Number of expired directories
+	Bytes  uint64   `json:"bytes"`  // Bytes of data in the expired files
+	Paths  []string `json:"paths"`  // Paths of the expired entries, deepest first
+}
+
+// parseTTL parses a time to live from a duration or a number of seconds.
+func parseTTL(value []byte) (time.Duration, error) {
+	s := strings.TrimSpace(string(value))
+	if secs, err := strconv.ParseUint(s, 10, 32); err == nil {
+		return time.Duration(secs) * time.Second, nil
+	}
+
+	ttl, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, err
+	}
+
+	if ttl < 0 {
+		return 0, errors.New("time to live is negative")
+	}
+	return ttl, nil
+}
+
+// ttl returns the time to live set on the node with TTLXattr, if any. Must be
+// called with the lock held.
+func (n *Node) ttl() (time.Duration, bool) {
+	value, ok := n.getxattr(TTLXattr)
+	if !ok {
+		return 0, false
+	}
+
+	ttl, err := parseTTL(value)
+	return ttl, err == nil
+}
+
+// policy returns the time to live of the entries beneath the directory set
+// on it with TTLXattr or in the configuration, if any. Must be called with
+// the lock held.
+func (d *Dir) policy() (time.Duration, bool) {
+	if ttl, ok := d.ttl(); ok {
+		return ttl, true
+	}
+
+	ttl, ok := d.fs.Config.TTL.Directories[d.Path()]
+	return time.Duration(ttl), ok
+}
+
+// expired returns true if the node has not been modified for the time to
+// live. Nodes with a time to live of zero never expire.
+func expired(n *Node, ttl time.Duration, now time.Time) bool {
+	return ttl > 0 && now.Sub(n.Attrs.Mtime) > ttl
+}
+
+//===========================================================================
+// Reaping Expired Entries
+//===========================================================================
+
+// Reap removes the files that have not been modified for their time to live
+// and the directories that are empty once their expired entries are removed
+// and have themselves expired. If dryRun is true nothing is removed and the
+// report lists what would be. Removals are recorded like any other, so the
+// file and byte counts, quotas, watchers and mirror are kept up to date.
+//
+// The tree is reaped one directory at a time, releasing the lock between
+// directories so that a large tree does not block other operations, and runs
+// of the reaper are serialized.
+func (mfs *FileSystem) Reap(dryRun bool) (*ReapReport, error) {
+	mfs.reaping.Lock()
+	defer mfs.reaping.Unlock()
+
+	mfs.Lock()
+	root, readonly := mfs.root, mfs.readonly
+	mfs.Unlock()
+
+	if readonly && !dryRun {
+		return nil, fuse.EPERM
+	}
+
+	report := &ReapReport{DryRun: dryRun, Paths: make([]string, 0)}
+	mfs.reapDir(root, 0, time.Now(), report)
+
+	if !dryRun && len(report.Paths) > 0 {
+		logger.Info("reaped %d expired files and %d expired directories, freeing %d bytes", report.Files, report.Dirs, report.Bytes)
+	}
+	return report, nil
+}
+
+// reapDir reaps the expired entries beneath the directory, whose entries
+// expire after ttl unless the directory, a rule or the entry sets its own.
+// Lower directories are only merged into the tree if a time to live may
+// apply to them. The subdirectories are reaped first, each with the lock
+// acquired separately, then the files of the directory in one batch. Returns
+// true if every entry of the directory was reaped. Must be called without
+// the lock held.
+func (mfs *FileSystem) reapDir(d *Dir, ttl time.Duration, now time.Time, report *ReapReport) bool {
+	mfs.Lock()
+	if !mfs.live(d) {
+		mfs.Unlock()
+		return false
+	}
+
+	if policy, ok := d.policy(); ok {
+		ttl = policy
+	}
+
+	if ttl > 0 || mfs.mayExpire(d.Path()) {
+		if err := d.populate(); err != nil {
+			mfs.Unlock()
+			return false
+		}
+	}
+
+	// Reaping the entries modifies the directory, so check if the
+	// subdirectories are stale first.
+	subdirs := make([]*Dir, 0)
+	stale := make(map[*Dir]bool)
+	for _, name := range d.names() {
+		if sub, ok := d.Children[name].(*Dir); ok {
+			subdirs = append(subdirs, sub)
+			stale[sub] = expired(&sub.Node, mfs.ruleTTL(sub, ttl), now)
+		}
+	}
+	mfs.Unlock()
+
+	// The subdirectories that were reaped, or would be on a dry run.
+	reaped := make(map[*Dir]bool)
+	for _, sub := range subdirs {
+		if !mfs.reapDir(sub, ttl, now, report) || !stale[sub] {
+			continue
+		}
+
+		// The subdirectory may have been moved or removed while unlocked.
+		mfs.Lock()
+		if mfs.live(d) && d.Children[sub.Name] == Entity(sub) && mfs.reap(d, sub.Name, report) {
+			reaped[sub] = true
+		}
+		mfs.Unlock()
+	}
+
+	mfs.Lock()
+	defer mfs.Unlock()
+
+	if !mfs.live(d) {
+		return false
+	}
+
+	empty := true
+	for _, name := range d.names() {
+		var reap bool
+		switch ent := d.Children[name].(type) {
+		case *Dir:
+			if !reaped[ent] {
+				empty = false
+			}
+			continue
+		case *File:
+			expires := mfs.ruleTTL(ent, ttl)
+			if own, ok := ent.ttl(); ok {
+				expires = own
+			}
+			reap = expired(&ent.Node, expires, now) && ent.checkProtected(false) == nil
+		case *Symlink:
+			expires := mfs.ruleTTL(ent, ttl)
+			if own, ok := ent.ttl(); ok {
+				expires = own
+			}
+			reap = expired(&ent.Node, expires, now)
+		}
+
+		if !reap || !mfs.reap(d, name, report) {
+			empty = false
+		}
+	}
+
+	return empty
+}
+
+// live returns true if the directory has not been removed from the file
+// system. Must be called with the lock held.
+func (mfs *FileSystem) live(d *Dir) bool {
+	ent, ok := mfs.Inodes.Get(d.ID)
+	return ok && ent == Entity(d)
+}
+
+// names returns the names of the entries of the directory in sorted order.
+// Must be called with the lock held.
+func (d *Dir) names() []string {
+	names := make([]string, 0, len(d.Children))
+	for name := range d.Children {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// mayExpire returns true if a rule or a directory policy in the configuration
+// sets a time to live that may apply to the entries beneath the directory at
+// the path. Must be called with the lock held.
+func (mfs *FileSystem) mayExpire(path string) bool {
+	for _, r := range mfs.Config.Rules {
+		if r.TTL > 0 && r.within(path) {
+			return true
+		}
+	}
+
+	for dir, ttl := range mfs.Config.TTL.Directories {
+		if ttl > 0 && (dir == path || strings.HasPrefix(dir, strings.TrimSuffix(path, "/")+"/")) {
+			return true
+		}
+	}
+	return false
+}
+
+// ruleTTL returns the time to live that the rules of the path of the entity
+// set or, if they do not, the time to live of its directory. Must be called
+// with the lock held.
+func (mfs *FileSystem) ruleTTL(ent Entity, ttl time.Duration) time.Duration {
+	if len(mfs.Config.Rules) == 0 {
+		return ttl
+	}
+
+	if z := mfs.zone(ent.Path()); z.ttl > 0 {
+		return z.ttl
+	}
+	return ttl
+}
+
+// reap removes the named entry of the directory, unless it is a dry run, and
+// adds it to the report. Returns false if the entry could not be removed, in
+// which case it is not reported. Must be called with the lock held.
+func (mfs *FileSystem) reap(d *Dir, name string, report *ReapReport) bool {
+	ent := d.Children[name]
+	path := filepath.Join(d.Path(), name)
+	size := ent.GetNode().Attrs.Size
+
+	if !report.DryRun {
+		if _, err := d.remove(name); err != nil {
+			logger.Error("could not reap %q: %s", path, err)
+			return false
+		}
+
+		m := mfs.apiMutation(OpRemove, ent)
+		m.Path = path
+		m.Source = SourceReaper
+		m.NewSize = 0
+		m.parent, m.name = d, name
+		mfs.record(m)
+	}
+
+	report.Paths = append(report.Paths, path)
+	if ent.IsDir() {
+		report.Dirs++
+	} else {
+		report.Files++
+		report.Bytes += size
+	}
+	return true
+}
+
+// reaper reaps expired entries at the interval until the file system is
+// shut down.
+func (mfs *FileSystem) reaper(interval time.Duration, stop <-chan struct{}) {
+	if interval < minReapInterval {
+		interval = minReapInterval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if _, err := mfs.Reap(false); err != nil && err != fuse.EPERM {
+				logger.Error("could not reap expired entries: %s", err)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+// serveReap writes the report of the expired entries as JSON. A GET is a dry
+// run that removes nothing, a POST reaps the expired entries.
+func (mfs *FileSystem) serveReap(w http.ResponseWriter, r *http.Request) {
+	var dryRun bool
+	switch r.Method {
+	case http.MethodGet:
+		dryRun = true
+	case http.MethodPost:
+		dryRun = false
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	report, err := mfs.Reap(dryRun)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
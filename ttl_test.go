@@ -0,0 +1,239 @@
+package memfs_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"bazil.org/fuse"
+
+	"golang.org/x/net/context"
+
+	. "github.com/bbengfort/memfs"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("TTL", func() {
+
+	var err error
+	var tmpDir string
+	var config *Config
+	var fs *FileSystem
+	var ctx context.Context
+
+	// stale ages the modification time of the entity at the path by two hours.
+	stale := func(path string) Entity {
+		ent, err := fs.Resolve(path)
+		Ω(err).ShouldNot(HaveOccurred())
+		ent.GetNode().Attrs.Mtime = time.Now().Add(-2 * time.Hour)
+		return ent
+	}
+
+	// setTTL sets the time to live attribute of the entity at the path.
+	setTTL := func(path, ttl string) error {
+		ent, err := fs.Resolve(path)
+		Ω(err).ShouldNot(HaveOccurred())
+		req := &fuse.SetxattrRequest{Name: TTLXattr, Xattr: []byte(ttl)}
+		return ent.GetNode().Setxattr(ctx, req)
+	}
+
+	BeforeEach(func() {
+		tmpDir, err = ioutil.TempDir("", TempDirPrefix)
+		Ω(err).ShouldNot(HaveOccurred())
+
+		config = makeTestConfig()
+		ctx = context.TODO()
+	})
+
+	JustBeforeEach(func() {
+		fs = New(filepath.Join(tmpDir, "testmp"), config)
+	})
+
+	AfterEach(func() {
+		Ω(fs.Shutdown()).Should(Succeed())
+		Ω(os.RemoveAll(tmpDir)).Should(Succeed())
+	})
+
+	It("should reap files whose time to live has passed", func() {
+		Ω(fs.WriteFile("/build.log", []byte("expired"), 0644)).Should(Succeed())
+		Ω(fs.WriteFile("/notes.txt", []byte("kept"), 0644)).Should(Succeed())
+		Ω(setTTL("/build.log", "1h")).Should(Succeed())
+		stale("/build.log")
+		stale("/notes.txt")
+
+		report, err := fs.Reap(true)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(report.Paths).Should(Equal([]string{"/build.log"}))
+		Ω(report.Files).Should(Equal(uint64(1)))
+		Ω(report.Bytes).Should(Equal(uint64(7)))
+
+		// A dry run removes nothing.
+		_, err = fs.Resolve("/build.log")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		usage := fs.Quotas().Users[uint32(os.Geteuid())].Usage
+		report, err = fs.Reap(false)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(report.Paths).Should(Equal([]string{"/build.log"}))
+
+		_, err = fs.Resolve("/build.log")
+		Ω(err).Should(HaveOccurred())
+
+		after := fs.Quotas().Users[uint32(os.Geteuid())].Usage
+		Ω(after.Bytes).Should(Equal(usage.Bytes - 7))
+		Ω(after.Inodes).Should(Equal(usage.Inodes - 1))
+	})
+
+	It("should not reap files modified within their time to live", func() {
+		Ω(fs.WriteFile("/build.log", []byte("fresh"), 0644)).Should(Succeed())
+		Ω(setTTL("/build.log", "3600")).Should(Succeed())
+
+		report, err := fs.Reap(false)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(report.Paths).Should(BeEmpty())
+	})
+
+	It("should reject an invalid time to live", func() {
+		Ω(fs.WriteFile("/build.log", nil, 0644)).Should(Succeed())
+		Ω(setTTL("/build.log", "soon")).Should(MatchError(fuse.Errno(syscall.EINVAL)))
+		Ω(setTTL("/build.log", "-1h")).Should(MatchError(fuse.Errno(syscall.EINVAL)))
+	})
+
+	Context("with a directory policy", func() {
+
+		BeforeEach(func() {
+			config.TTL.Directories = map[string]Duration{"/scratch": Duration(time.Hour)}
+		})
+
+		JustBeforeEach(func() {
+			Ω(fs.Mkdir("/scratch", 0755)).Should(Succeed())
+			Ω(fs.Mkdir("/scratch/build", 0755)).Should(Succeed())
+			Ω(fs.WriteFile("/scratch/build/out.o", []byte("object"), 0644)).Should(Succeed())
+			Ω(fs.WriteFile("/scratch/keep.txt", []byte("keep"), 0644)).Should(Succeed())
+			Ω(setTTL("/scratch/keep.txt", "0")).Should(Succeed())
+			stale("/scratch/build/out.o")
+			stale("/scratch/keep.txt")
+		})
+
+		It("should reap expired entries beneath the directory", func() {
+			stale("/scratch/build")
+			stale("/scratch")
+
+			report, err := fs.Reap(false)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(report.Paths).Should(Equal([]string{"/scratch/build/out.o", "/scratch/build"}))
+			Ω(report.Files).Should(Equal(uint64(1)))
+			Ω(report.Dirs).Should(Equal(uint64(1)))
+
+			// The directory with the policy and exempt files are kept.
+			_, err = fs.Resolve("/scratch/keep.txt")
+			Ω(err).ShouldNot(HaveOccurred())
+		})
+
+		It("should report the same entries on a dry run", func() {
+			stale("/scratch/build")
+
+			report, err := fs.Reap(true)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(report.Paths).Should(Equal([]string{"/scratch/build/out.o", "/scratch/build"}))
+
+			_, err = fs.Resolve("/scratch/build/out.o")
+			Ω(err).ShouldNot(HaveOccurred())
+		})
+
+		It("should report each entry once when reaped concurrently", func() {
+			stale("/scratch/build")
+
+			reports := make(chan *ReapReport, 2)
+			for i := 0; i < 2; i++ {
+				go func() {
+					defer GinkgoRecover()
+					report, err := fs.Reap(false)
+					Ω(err).ShouldNot(HaveOccurred())
+					reports <- report
+				}()
+			}
+
+			paths := append((<-reports).Paths, (<-reports).Paths...)
+			Ω(paths).Should(Equal([]string{"/scratch/build/out.o", "/scratch/build"}))
+		})
+
+		It("should keep directories modified within the time to live", func() {
+			report, err := fs.Reap(false)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(report.Paths).Should(Equal([]string{"/scratch/build/out.o"}))
+
+			_, err = fs.Resolve("/scratch/build")
+			Ω(err).ShouldNot(HaveOccurred())
+		})
+
+		It("should prefer the time to live set on the directory", func() {
+			Ω(setTTL("/scratch", "4h")).Should(Succeed())
+
+			report, err := fs.Reap(true)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(report.Paths).Should(BeEmpty())
+		})
+
+		It("should validate the policy", func() {
+			config.TTL.Directories["scratch/"] = Duration(-time.Hour)
+			err := config.Validate()
+			Ω(err).Should(MatchError(ContainSubstring("is not a clean absolute path")))
+			Ω(err).Should(MatchError(ContainSubstring("is negative")))
+		})
+
+	})
+
+	Context("with a rule over a lower directory", func() {
+
+		BeforeEach(func() {
+			lower := filepath.Join(tmpDir, "lower")
+			Ω(os.MkdirAll(filepath.Join(lower, "scratch"), 0755)).Should(Succeed())
+			Ω(os.MkdirAll(filepath.Join(lower, "data"), 0755)).Should(Succeed())
+			Ω(ioutil.WriteFile(filepath.Join(lower, "scratch", "old.log"), []byte("old"), 0644)).Should(Succeed())
+			Ω(ioutil.WriteFile(filepath.Join(lower, "data", "a.txt"), []byte("a"), 0644)).Should(Succeed())
+
+			old := time.Now().Add(-2 * time.Hour)
+			Ω(os.Chtimes(filepath.Join(lower, "scratch", "old.log"), old, old)).Should(Succeed())
+
+			config.Overlay = lower
+			config.Rules = []*Rule{{Path: "/scratch/*", TTL: Duration(time.Hour)}}
+		})
+
+		It("should only merge the directories a time to live may apply to", func() {
+			report, err := fs.Reap(true)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(report.Paths).Should(Equal([]string{"/scratch/old.log"}))
+
+			// The root, both directories and the expired file, but not the
+			// file in the directory that no rule with a time to live matches.
+			usage := fs.Quotas().Users[uint32(os.Geteuid())].Usage
+			Ω(usage.Inodes).Should(Equal(uint64(4)))
+		})
+
+	})
+
+	Context("with a reaper", func() {
+
+		BeforeEach(func() {
+			config.TTL.Interval = Duration(time.Second)
+		})
+
+		It("should reap expired entries in the background", func() {
+			Ω(fs.WriteFile("/build.log", []byte("expired"), 0644)).Should(Succeed())
+			Ω(setTTL("/build.log", "1h")).Should(Succeed())
+			stale("/build.log")
+
+			Eventually(func() error {
+				_, err := fs.Resolve("/build.log")
+				return err
+			}, 3*time.Second, 100*time.Millisecond).Should(HaveOccurred())
+		})
+
+	})
+
+})
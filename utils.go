@@ -2,13 +2,77 @@
 
 package memfs
 
-import "strings"
+import (
+	"encoding/json"
+	"strings"
+	"time"
+)
 
 // Formatters for representing the date and time as a string.
 const (
 	JSONDateTime = "2006-01-02T15:04:05-07:00"
 )
 
+//===========================================================================
+// Duration Helpers
+//===========================================================================
+
+// Duration wraps time.Duration so that it can be specified in configuration
+// files as a human readable string such as "90s" or "1h30m".
+type Duration time.Duration
+
+// MarshalJSON writes the duration as a parseable string.
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// UnmarshalJSON parses a duration from a string or from an integer number of
+// nanoseconds (the encoding of time.Duration).
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		var ns int64
+		if err := json.Unmarshal(data, &ns); err != nil {
+			return err
+		}
+		*d = Duration(ns)
+		return nil
+	}
+
+	return d.Set(s)
+}
+
+// MarshalYAML writes the duration as a parseable string.
+func (d Duration) MarshalYAML() (interface{}, error) {
+	return time.Duration(d).String(), nil
+}
+
+// UnmarshalYAML parses a duration from a string such as "90s".
+func (d *Duration) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+
+	return d.Set(s)
+}
+
+// Set parses the duration from a string, e.g. from an environment variable.
+func (d *Duration) Set(s string) error {
+	val, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+
+	*d = Duration(val)
+	return nil
+}
+
+// String returns the human readable representation of the duration.
+func (d Duration) String() string {
+	return time.Duration(d).String()
+}
+
 //===========================================================================
 // String Helpers
 //===========================================================================
@@ -60,6 +124,20 @@ func StrideFixed(s string, n int) []string {
 	return o
 }
 
+// HasPathPrefix returns true if path is equal to prefix or is a descendant
+// of the prefix directory, e.g. "/a/b" has the prefix "/a" but "/ab" does not.
+func HasPathPrefix(path, prefix string) bool {
+	if prefix == "" || prefix == "/" {
+		return true
+	}
+
+	if !strings.HasPrefix(path, prefix) {
+		return false
+	}
+
+	return len(path) == len(prefix) || path[len(prefix)] == '/'
+}
+
 //===========================================================================
 // String Collection Helpers
 //===========================================================================
@@ -79,6 +79,27 @@ var _ = Describe("Utils", func() {
 			}
 
 		})
+
+		It("should determine if a path has a directory prefix", func() {
+
+			var prefixTests = []struct {
+				path     string // path to test
+				prefix   string // directory prefix
+				expected bool   // expected result
+			}{
+				{"/a/b", "/a", true},
+				{"/a", "/a", true},
+				{"/ab", "/a", false},
+				{"/b/a", "/a", false},
+				{"/a/b", "/", true},
+				{"/a/b", "", true},
+			}
+
+			for _, tt := range prefixTests {
+				Ω(HasPathPrefix(tt.path, tt.prefix)).Should(Equal(tt.expected))
+			}
+
+		})
 	})
 
 	Describe("collection helpers", func() {
@@ -0,0 +1,487 @@
+// Multiple named volumes served by one process with a shared memory budget.
+
+package memfs
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+//===========================================================================
+// Volume Configuration
+//===========================================================================
+
+// Volume defines an independent file system tree that is mounted by a
+// Manager alongside the other volumes of the configuration. A volume inherits
+// the settings of the configuration, overridden by the fields that it sets.
+// Settings that name a file or a directory cannot be shared by the volumes,
+// so they are only specified by each volume.
+type Volume struct {
+	Name       string       `json:"name" yaml:"name"`             // Unique name of the volume
+	Mount      string       `json:"mount" yaml:"mount"`           // Path the volume is mounted on
+	CacheSize  uint64       `json:"cachesize" yaml:"cachesize"`   // Maximum amount of memory used (0 inherits)
+	MaxInodes  uint64       `json:"maxinodes" yaml:"maxinodes"`   // Maximum number of files and directories (0 inherits)
+	ReadOnly   bool         `json:"readonly" yaml:"readonly"`     // Whether or not the volume is read only
+	Replicas   []*Replica   `json:"replicas" yaml:"replicas"`     // Remote replicas of the volume (empty inherits)
+	Audit      AuditConfig  `json:"audit" yaml:"audit"`           // Audit trail of the mutations of the volume
+	Spill      SpillConfig  `json:"spill" yaml:"spill"`           // Backing directory for cold file data of the volume
+	Mirror     MirrorConfig `json:"mirror" yaml:"mirror"`         // Backing directory to load and propagate mutations to
+	Overlay    string       `json:"overlay" yaml:"overlay"`       // Read-only lower directory beneath the volume
+	Preload    string       `json:"preload" yaml:"preload"`       // Directory or tar archive to load into the volume at mount
+	InodeState string       `json:"inodestate" yaml:"inodestate"` // File the inode numbers of the volume are saved to and restored from
+}
+
+// volume returns the configuration of the volume, named after it. The audit
+// trail, spill and mirror directories, overlay, preload and inode state are
+// those of the volume, since Validate does not allow them to be set for all
+// volumes. The control api, volumes and budget belong to the manager and are
+// cleared.
+func (conf *Config) volume(vol *Volume) *Config {
+	c := *conf
+	c.Name = vol.Name
+	c.ReadOnly = conf.ReadOnly || vol.ReadOnly
+
+	if vol.CacheSize > 0 {
+		c.CacheSize = vol.CacheSize
+	}
+
+	if vol.MaxInodes > 0 {
+		c.MaxInodes = vol.MaxInodes
+	}
+
+	if len(vol.Replicas) > 0 {
+		c.Replicas = vol.Replicas
+	}
+
+	c.Audit = vol.Audit
+	c.Spill = vol.Spill
+	c.Mirror = vol.Mirror
+	c.Overlay = vol.Overlay
+	c.Preload = vol.Preload
+	c.InodeState = vol.InodeState
+	c.Control = ""
+	c.Volumes = nil
+	c.Budget = 0
+	return &c
+}
+
+//===========================================================================
+// Memory Budget
+//===========================================================================
+
+// Budget is the memory shared by the volumes of a manager. Each volume
+// reports the data it holds in memory as it changes, so that a volume can
+// check the budget without locking the other volumes. The budget lock is
+// only ever acquired while holding the lock of a single volume, never the
+// other way around.
+type Budget struct {
+	sync.Mutex
+	limit uint64                 // Bytes shared by the volumes (0 for unlimited)
+	usage map[*FileSystem]uint64 // Bytes held in memory by each volume
+}
+
+// NewBudget creates a budget of limit bytes, or an unlimited budget if the
+// limit is zero.
+func NewBudget(limit uint64) *Budget {
+	return &Budget{limit: limit, usage: make(map[*FileSystem]uint64)}
+}
+
+// Limit returns the number of bytes shared by the volumes.
+func (b *Budget) Limit() uint64 {
+	b.Lock()
+	defer b.Unlock()
+	return b.limit
+}
+
+// SetLimit changes the number of bytes shared by the volumes. Volumes that
+// already hold more than their share are not reduced, but cannot grow.
+func (b *Budget) SetLimit(limit uint64) {
+	b.Lock()
+	defer b.Unlock()
+
+	if limit != b.limit {
+		logger.Info("memory budget changed from %d to %d bytes", b.limit, limit)
+		b.limit = limit
+	}
+}
+
+// Used returns the number of bytes held in memory by all volumes.
+func (b *Budget) Used() uint64 {
+	b.Lock()
+	defer b.Unlock()
+
+	var used uint64
+	for _, bytes := range b.usage {
+		used += bytes
+	}
+	return used
+}
+
+// update records the bytes held in memory by the volume.
+func (b *Budget) update(mfs *FileSystem, bytes uint64) {
+	b.Lock()
+	b.usage[mfs] = bytes
+	b.Unlock()
+}
+
+// share returns the number of bytes the volume may hold in memory, which is
+// the limit less the bytes held by the other volumes. A nil or unlimited
+// budget places no limit on the volume.
+func (b *Budget) share(mfs *FileSystem) uint64 {
+	if b == nil {
+		return math.MaxUint64
+	}
+
+	b.Lock()
+	defer b.Unlock()
+	return b.available(mfs)
+}
+
+// available returns the share of the volume. Must be called with the lock
+// held.
+func (b *Budget) available(mfs *FileSystem) uint64 {
+	if b.limit == 0 {
+		return math.MaxUint64
+	}
+
+	share := b.limit
+	for other, bytes := range b.usage {
+		if other != mfs {
+			share = addClamped(share, -int64(bytes))
+		}
+	}
+	return share
+}
+
+// reserve records the resident bytes of the volume and, if adding bytes does
+// not exceed its share, reserves them until the volume next reports its
+// usage. The share is checked and the bytes reserved under the same lock so
+// that two volumes cannot both claim what remains of the budget. It returns
+// the share and whether the bytes were reserved.
+func (b *Budget) reserve(mfs *FileSystem, resident, bytes uint64) (uint64, bool) {
+	b.Lock()
+	defer b.Unlock()
+
+	share := b.available(mfs)
+	if resident+bytes > share {
+		b.usage[mfs] = resident
+		return share, false
+	}
+
+	b.usage[mfs] = resident + bytes
+	return share, true
+}
+
+// updateBudget reports the data held in memory to the budget of the volume,
+// if it has one. Must be called with the lock held.
+func (mfs *FileSystem) updateBudget() {
+	if mfs.budget != nil {
+		mfs.budget.update(mfs, mfs.resident())
+	}
+}
+
+// checkBudget reserves the bytes in the memory budget of the volume, returning
+// ENOSPC if adding them would exceed its share. Must be called with the lock
+// held.
+func (mfs *FileSystem) checkBudget(bytes uint64) error {
+	if mfs.budget == nil || bytes == 0 {
+		return nil
+	}
+
+	if share, ok := mfs.budget.reserve(mfs, mfs.resident(), bytes); !ok {
+		logger.Debug("(error) adding %d bytes would exceed the memory budget share of %d bytes", bytes, share)
+		return ENOSPC
+	}
+	return nil
+}
+
+//===========================================================================
+// Volume Manager
+//===========================================================================
+
+// Manager hosts the volumes of a configuration in one process, mounting each
+// volume at its own mount point. The volumes are independent file systems
+// but share the memory budget and the control api of the manager.
+type Manager struct {
+	sync.Mutex                        // Manager can be locked and unlocked
+	Config     *Config                // Configuration the volumes are derived from
+	Budget     *Budget                // Memory shared by the volumes
+	volumes    map[string]*FileSystem // Volumes by name
+	control    *http.Server           // HTTP control API server (optional)
+}
+
+// NewManager creates the file systems of the volumes of the configuration.
+// The process-wide logger is configured once from the configuration, since
+// the volumes cannot set their own logging.
+func NewManager(config *Config) (*Manager, error) {
+	if len(config.Volumes) == 0 {
+		return nil, errors.New("no volumes are configured")
+	}
+
+	if err := reconfigureLogger(&config.Logging, strings.ToUpper(config.Level)); err != nil {
+		logger.Error("could not configure logging: %s", err)
+	}
+
+	m := &Manager{
+		Config:  config,
+		Budget:  NewBudget(config.Budget),
+		volumes: make(map[string]*FileSystem, len(config.Volumes)),
+	}
+
+	for _, vol := range config.Volumes {
+		fs := newFileSystem(vol.Mount, config.volume(vol))
+		fs.budget = m.Budget
+		m.volumes[vol.Name] = fs
+	}
+
+	return m, nil
+}
+
+// Volume returns the file system of the named volume, or nil if there is no
+// volume with that name.
+func (m *Manager) Volume(name string) *FileSystem {
+	return m.volumes[name]
+}
+
+// Run mounts and serves every volume, serving the control api if an address
+// is configured. It blocks until all of the volumes are unmounted, returning
+// the first error that any of them stopped with.
+func (m *Manager) Run() error {
+	if m.Config.Control != "" {
+		m.serveControl()
+	}
+
+	errs := make(chan error, len(m.volumes))
+	for name, fs := range m.volumes {
+		go func(name string, fs *FileSystem) {
+			err := fs.Run()
+			if err != nil {
+				logger.Error("volume %s stopped: %s", name, err)
+			}
+			errs <- err
+		}(name, fs)
+	}
+
+	var err error
+	for range m.volumes {
+		if verr := <-errs; verr != nil && err == nil {
+			err = fmt.Errorf("volume stopped: %s", verr)
+		}
+	}
+	return err
+}
+
+// Shutdown every volume and the control api, returning the first error that
+// a volume could not be shut down with.
+func (m *Manager) Shutdown() error {
+	var err error
+	for name, fs := range m.volumes {
+		if verr := fs.Shutdown(); verr != nil {
+			logger.Error("could not shut down volume %s: %s", name, verr)
+			if err == nil {
+				err = verr
+			}
+		}
+	}
+
+	if m.control != nil {
+		if cerr := m.control.Close(); cerr != nil {
+			logger.Error("could not close control api: %s", cerr)
+		}
+	}
+
+	return err
+}
+
+// Reload re-reads the configuration file the manager was created from,
+// layering the environment and flags over it as LoadConfig does, and applies
+// the result to the running volumes. It returns the configuration keys that
+// changed but cannot take effect until the volumes are remounted.
+func (m *Manager) Reload(flags *Config) ([]string, error) {
+	conf, err := LoadConfig(m.Config.Path, flags)
+	if err != nil {
+		logger.Error("could not reload configuration: %s", err)
+		return nil, err
+	}
+
+	return m.Apply(conf)
+}
+
+// Apply the configuration to the running volumes. The logger is replaced
+// once, each volume is otherwise reconfigured as FileSystem.Apply does and
+// the memory budget is changed in place. Volumes cannot be added, removed or moved to another mount point and
+// the control api cannot be moved without remounting, so these changes are
+// not applied and their keys are returned with the keys of the volumes.
+func (m *Manager) Apply(conf *Config) ([]string, error) {
+	if err := conf.Validate(); err != nil {
+		return nil, err
+	}
+
+	m.Lock()
+	defer m.Unlock()
+
+	prev := m.Config
+	next := *conf
+	remount := make([]string, 0)
+
+	if next.Control != prev.Control {
+		remount = append(remount, "control")
+		next.Control = prev.Control
+	}
+
+	// Keep the current volumes, updated with their new settings.
+	volumes := make(map[string]*Volume, len(next.Volumes))
+	for _, vol := range next.Volumes {
+		volumes[vol.Name] = vol
+	}
+
+	next.Volumes = make([]*Volume, 0, len(prev.Volumes))
+	for _, vol := range prev.Volumes {
+		update, ok := volumes[vol.Name]
+		if !ok || filepath.Clean(update.Mount) != filepath.Clean(vol.Mount) {
+			next.Volumes = append(next.Volumes, vol)
+			continue
+		}
+		next.Volumes = append(next.Volumes, update)
+	}
+
+	// The volumes are compared by name, so reordering them is not a change.
+	changed := len(volumes) != len(prev.Volumes)
+	for _, vol := range next.Volumes {
+		if !reflect.DeepEqual(vol, volumes[vol.Name]) {
+			changed = true
+		}
+	}
+
+	if changed {
+		remount = append(remount, "volumes")
+	}
+
+	if err := reconfigureLogger(&next.Logging, next.Level); err != nil {
+		return nil, err
+	}
+
+	for _, vol := range next.Volumes {
+		keys, err := m.volumes[vol.Name].apply(next.volume(vol), false)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, key := range keys {
+			remount = append(remount, fmt.Sprintf("volumes.%s.%s", vol.Name, key))
+		}
+	}
+
+	m.Budget.SetLimit(next.Budget)
+	next.Path = conf.Path
+	m.Config = &next
+
+	if len(remount) > 0 {
+		logger.Warn("configuration changes to %s require a remount", strings.Join(remount, ", "))
+	}
+	return remount, nil
+}
+
+//===========================================================================
+// Volume Status
+//===========================================================================
+
+// VolumeStatus describes the usage of a volume.
+type VolumeStatus struct {
+	Name     string `json:"name"`     // Name of the volume
+	Mount    string `json:"mount"`    // Path the volume is mounted on
+	ReadOnly bool   `json:"readonly"` // Whether or not the volume is read only
+	Files    uint64 `json:"files"`    // Number of files in the volume
+	Dirs     uint64 `json:"dirs"`     // Number of directories in the volume
+	Bytes    uint64 `json:"bytes"`    // Amount of data in the volume
+	Resident uint64 `json:"resident"` // Amount of data held in memory
+	Capacity uint64 `json:"capacity"` // Amount of data the volume can hold
+}
+
+// ManagerStatus describes the usage of the volumes and the memory budget.
+type ManagerStatus struct {
+	Budget  uint64          `json:"budget"`  // Memory shared by the volumes (0 for unlimited)
+	Used    uint64          `json:"used"`    // Memory held by the volumes
+	Volumes []*VolumeStatus `json:"volumes"` // Usage of each volume
+}
+
+// Status returns the usage of the volumes, in the order they are configured,
+// and of the memory budget.
+func (m *Manager) Status() *ManagerStatus {
+	m.Lock()
+	defer m.Unlock()
+
+	status := &ManagerStatus{Volumes: make([]*VolumeStatus, 0, len(m.Config.Volumes))}
+	for _, vol := range m.Config.Volumes {
+		status.Volumes = append(status.Volumes, m.volumes[vol.Name].volumeStatus(vol.Name))
+	}
+
+	status.Budget = m.Budget.Limit()
+	status.Used = m.Budget.Used()
+	return status
+}
+
+// volumeStatus returns the usage of the volume, reporting it to the budget.
+func (mfs *FileSystem) volumeStatus(name string) *VolumeStatus {
+	mfs.Lock()
+	defer mfs.Unlock()
+
+	mfs.updateBudget()
+	return &VolumeStatus{
+		Name:     name,
+		Mount:    mfs.MountPoint,
+		ReadOnly: mfs.readonly,
+		Files:    mfs.nfiles,
+		Dirs:     mfs.ndirs,
+		Bytes:    mfs.nbytes,
+		Resident: mfs.resident(),
+		Capacity: mfs.capacity(),
+	}
+}
+
+//===========================================================================
+// Manager Control Server
+//===========================================================================
+
+// Handler returns the HTTP handler of the control api of the manager, which
+// lists the usage of the volumes and the budget at /volumes and serves the
+// control api of each volume beneath /volumes/<name>, e.g. /volumes/home/quotas,
+// to clients on the loopback interface only.
+func (m *Manager) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/volumes", m.serveVolumes)
+	for name, fs := range m.volumes {
+		prefix := "/volumes/" + name
+		mux.Handle(prefix+"/", http.StripPrefix(prefix, fs.mux()))
+	}
+	return WebLogger(logger.Subsystem("http"), local(mux))
+}
+
+// serveVolumes writes the usage of the volumes and the budget as JSON.
+func (m *Manager) serveVolumes(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(m.Status())
+}
+
+// serveControl listens on the configured control address in a background
+// go routine and serves the control api until it is closed by Shutdown.
+func (m *Manager) serveControl() {
+	m.control = &http.Server{
+		Addr:    m.Config.Control,
+		Handler: m.Handler(),
+	}
+
+	go func(srv *http.Server) {
+		logger.Info("serving control api on %s", srv.Addr)
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			logger.Error("control api stopped: %s", err)
+		}
+	}(m.control)
+}
@@ -0,0 +1,270 @@
+package memfs_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+
+	"bazil.org/fuse"
+
+	"golang.org/x/net/context"
+
+	. "github.com/bbengfort/memfs"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Volumes", func() {
+
+	var err error
+	var tmpDir string
+	var config *Config
+	var manager *Manager
+
+	BeforeEach(func() {
+		tmpDir, err = ioutil.TempDir("", TempDirPrefix)
+		Ω(err).ShouldNot(HaveOccurred())
+
+		config = makeTestConfig()
+		config.Level = ""
+		config.Control = "localhost:0"
+		config.Volumes = []*Volume{
+			{Name: "home", Mount: filepath.Join(tmpDir, "home"), CacheSize: 2 * MinCacheSize},
+			{Name: "builds", Mount: filepath.Join(tmpDir, "builds"), ReadOnly: true, Replicas: []*Replica{
+				{PID: 1, Name: "alpha", Host: "localhost", Port: 3264},
+			}},
+		}
+	})
+
+	JustBeforeEach(func() {
+		manager, err = NewManager(config)
+		Ω(err).ShouldNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		Ω(manager.Shutdown()).Should(Succeed())
+		Ω(os.RemoveAll(tmpDir)).Should(Succeed())
+	})
+
+	It("should create an independent file system for each volume", func() {
+		home, builds := manager.Volume("home"), manager.Volume("builds")
+		Ω(home).ShouldNot(BeNil())
+		Ω(builds).ShouldNot(BeNil())
+		Ω(manager.Volume("scratch")).Should(BeNil())
+
+		Ω(home.MountPoint).Should(Equal(filepath.Join(tmpDir, "home")))
+		Ω(home.Config.Name).Should(Equal("home"))
+		Ω(home.Config.CacheSize).Should(Equal(2 * MinCacheSize))
+		Ω(home.Config.Control).Should(BeEmpty())
+		Ω(home.Config.Replicas).Should(BeEmpty())
+
+		Ω(builds.Config.CacheSize).Should(Equal(config.CacheSize))
+		Ω(builds.Config.ReadOnly).Should(BeTrue())
+		Ω(builds.Config.Replicas).Should(HaveLen(1))
+
+		Ω(home.WriteFile("/notes.txt", []byte("notes"), 0644)).Should(Succeed())
+		_, err := builds.Resolve("/notes.txt")
+		Ω(err).Should(HaveOccurred())
+		Ω(builds.WriteFile("/notes.txt", []byte("notes"), 0644)).Should(HaveOccurred())
+	})
+
+	It("should require volumes", func() {
+		_, err := NewManager(makeTestConfig())
+		Ω(err).Should(HaveOccurred())
+	})
+
+	It("should validate the volumes", func() {
+		config.Volumes = append(config.Volumes,
+			&Volume{Name: "home", Mount: filepath.Join(tmpDir, "home")},
+			&Volume{Name: "a/b"},
+			&Volume{Name: "small", Mount: "/mnt/small", CacheSize: 1024},
+		)
+		config.Budget = 1024
+
+		err := config.Validate()
+		Ω(err).Should(MatchError(ContainSubstring(`name "home" is not unique`)))
+		Ω(err).Should(MatchError(ContainSubstring("is not unique")))
+		Ω(err).Should(MatchError(ContainSubstring(`"a/b" is not a valid name`)))
+		Ω(err).Should(MatchError(ContainSubstring("mount point is empty")))
+		Ω(err).Should(MatchError(ContainSubstring("volumes[4]: cachesize")))
+		Ω(err).Should(MatchError(ContainSubstring("budget:")))
+	})
+
+	It("should only allow each volume to specify its files and directories", func() {
+		config.Spill.Path = filepath.Join(tmpDir, "spill")
+		config.Preload = filepath.Join(tmpDir, "seed")
+		config.Volumes[0].Spill.Path = filepath.Join(tmpDir, "spill")
+		config.Volumes[0].Overlay = filepath.Join(tmpDir, "lower")
+		config.Volumes[0].Mirror.Path = filepath.Join(tmpDir, "mirror")
+		config.Volumes[1].Audit.Path = filepath.Join(tmpDir, "spill")
+
+		err := config.Validate()
+		Ω(err).Should(MatchError(ContainSubstring("spill: must be specified by each volume")))
+		Ω(err).Should(MatchError(ContainSubstring("preload: must be specified by each volume")))
+		Ω(err).Should(MatchError(ContainSubstring("volumes[0].overlay: cannot be combined with a mirror directory")))
+		Ω(err).Should(MatchError(ContainSubstring("volumes[1]: path")))
+		Ω(err).ShouldNot(MatchError(ContainSubstring("mirror: must")))
+	})
+
+	Context("with the files and directories of each volume", func() {
+
+		BeforeEach(func() {
+			config.Volumes[0].Spill.Path = filepath.Join(tmpDir, "spill")
+			config.Volumes[1].Audit.Path = filepath.Join(tmpDir, "audit.log")
+		})
+
+		It("should configure each volume with its own settings", func() {
+			Ω(config.Validate()).Should(Succeed())
+
+			home, builds := manager.Volume("home"), manager.Volume("builds")
+			Ω(home.Config.Spill.Path).Should(Equal(filepath.Join(tmpDir, "spill")))
+			Ω(home.Config.Audit.Path).Should(BeEmpty())
+			Ω(builds.Config.Spill.Path).Should(BeEmpty())
+			Ω(builds.Config.Audit.Path).Should(Equal(filepath.Join(tmpDir, "audit.log")))
+		})
+
+	})
+
+	Context("with a memory budget", func() {
+
+		BeforeEach(func() {
+			config.Budget = MinCacheSize
+			config.Volumes[1].ReadOnly = false
+		})
+
+		It("should share the budget between the volumes", func() {
+			home, builds := manager.Volume("home"), manager.Volume("builds")
+			data := make([]byte, MinCacheSize/2+1024)
+
+			Ω(home.WriteFile("/a.bin", data, 0644)).Should(Succeed())
+			Ω(builds.WriteFile("/b.bin", data, 0644)).Should(MatchError(ENOSPC))
+			Ω(manager.Budget.Used()).Should(BeNumerically(">=", len(data)))
+
+			// The budget is also reported to statfs of the other volumes.
+			resp := new(fuse.StatfsResponse)
+			Ω(builds.Statfs(context.TODO(), new(fuse.StatfsRequest), resp)).Should(Succeed())
+			Ω(resp.Blocks * uint64(resp.Bsize)).Should(BeNumerically("<", MinCacheSize/2))
+
+			// Freeing data in one volume makes room in the other.
+			Ω(home.Remove("/a.bin")).Should(Succeed())
+			Ω(builds.WriteFile("/b.bin", data, 0644)).Should(Succeed())
+		})
+
+		It("should not let concurrent writes to the volumes exceed the budget", func() {
+			data := make([]byte, MinCacheSize/2+1024)
+			errs := make(chan error, 2)
+			for _, name := range []string{"home", "builds"} {
+				go func(fs *FileSystem) {
+					defer GinkgoRecover()
+					errs <- fs.WriteFile("/a.bin", data, 0644)
+				}(manager.Volume(name))
+			}
+
+			failed := 0
+			for i := 0; i < 2; i++ {
+				if err := <-errs; err != nil {
+					Ω(err).Should(MatchError(ENOSPC))
+					failed++
+				}
+			}
+
+			Ω(failed).Should(Equal(1))
+			Ω(manager.Budget.Used()).Should(BeNumerically("<=", MinCacheSize))
+		})
+
+	})
+
+	Context("with a control api", func() {
+
+		It("should list the volumes and the budget", func() {
+			Ω(manager.Volume("home").WriteFile("/notes.txt", []byte("notes"), 0644)).Should(Succeed())
+
+			w := httptest.NewRecorder()
+			manager.Handler().ServeHTTP(w, localRequest("GET", "/volumes"))
+			Ω(w.Code).Should(Equal(200))
+
+			status := new(ManagerStatus)
+			Ω(json.Unmarshal(w.Body.Bytes(), status)).Should(Succeed())
+			Ω(status.Used).Should(Equal(uint64(5)))
+			Ω(status.Volumes).Should(HaveLen(2))
+			Ω(status.Volumes[0].Name).Should(Equal("home"))
+			Ω(status.Volumes[0].Files).Should(Equal(uint64(1)))
+			Ω(status.Volumes[1].Name).Should(Equal("builds"))
+			Ω(status.Volumes[1].ReadOnly).Should(BeTrue())
+		})
+
+		It("should serve the control api of each volume", func() {
+			Ω(manager.Volume("home").WriteFile("/notes.txt", []byte("notes"), 0644)).Should(Succeed())
+
+			w := httptest.NewRecorder()
+			manager.Handler().ServeHTTP(w, localRequest("GET", "/volumes/home/quotas"))
+			Ω(w.Code).Should(Equal(200))
+
+			quotas := new(QuotaReport)
+			Ω(json.Unmarshal(w.Body.Bytes(), quotas)).Should(Succeed())
+			Ω(quotas.Users[uint32(os.Geteuid())].Usage.Bytes).Should(Equal(uint64(5)))
+
+			w = httptest.NewRecorder()
+			manager.Handler().ServeHTTP(w, localRequest("GET", "/volumes/scratch/quotas"))
+			Ω(w.Code).Should(Equal(404))
+		})
+
+		It("should only serve clients on the loopback interface", func() {
+			for _, path := range []string{"/volumes", "/volumes/home/quotas", "/volumes/home/reap"} {
+				w := httptest.NewRecorder()
+				manager.Handler().ServeHTTP(w, httptest.NewRequest("POST", path, nil))
+				Ω(w.Code).Should(Equal(403))
+			}
+		})
+
+	})
+
+	Context("when the configuration is applied", func() {
+
+		It("should reconfigure the volumes and the budget", func() {
+			next := *config
+			next.Budget = 4 * MinCacheSize
+			next.Volumes = []*Volume{
+				{Name: "home", Mount: filepath.Join(tmpDir, "home"), CacheSize: 3 * MinCacheSize},
+				config.Volumes[1],
+			}
+
+			remount, err := manager.Apply(&next)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(remount).Should(BeEmpty())
+			Ω(manager.Volume("home").Config.CacheSize).Should(Equal(3 * MinCacheSize))
+			Ω(manager.Budget.Limit()).Should(Equal(4 * MinCacheSize))
+		})
+
+		It("should not require a remount to reorder the volumes", func() {
+			next := *config
+			next.Volumes = []*Volume{config.Volumes[1], config.Volumes[0]}
+
+			remount, err := manager.Apply(&next)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(remount).Should(BeEmpty())
+		})
+
+		It("should require a remount to add, remove or move volumes", func() {
+			next := *config
+			next.Control = "localhost:1"
+			next.Volumes = []*Volume{
+				{Name: "home", Mount: filepath.Join(tmpDir, "moved"), CacheSize: 3 * MinCacheSize},
+				{Name: "scratch", Mount: filepath.Join(tmpDir, "scratch")},
+			}
+
+			remount, err := manager.Apply(&next)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(remount).Should(ConsistOf("control", "volumes"))
+			Ω(manager.Volume("home").Config.CacheSize).Should(Equal(2 * MinCacheSize))
+			Ω(manager.Volume("builds")).ShouldNot(BeNil())
+			Ω(manager.Volume("scratch")).Should(BeNil())
+			Ω(manager.Config.Volumes).Should(Equal(config.Volumes))
+		})
+
+	})
+
+})
@@ -0,0 +1,366 @@
+// Change notification feed for in-process and remote subscribers.
+
+package memfs
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Default sizes of the subscriber buffers and of the long-poll history.
+const (
+	DefaultWatchBuffer  = 256
+	DefaultWatchHistory = 1024
+	DefaultPollTimeout  = 30 * time.Second
+)
+
+//===========================================================================
+// Event Type
+//===========================================================================
+
+// WatchConfig specifies the bounds of the change notification buffers.
+type WatchConfig struct {
+	Buffer  int `json:"buffer" yaml:"buffer"`   // Number of events buffered per subscriber
+	History int `json:"history" yaml:"history"` // Number of recent events kept for long-polling
+}
+
+// Event is a change notification delivered to watch subscribers.
+type Event struct {
+	Seq     uint64    `json:"seq"`               // Monotonically increasing event number
+	Op      string    `json:"op"`                // Name of the mutating operation
+	Node    uint64    `json:"node"`              // ID of the node that changed
+	Path    string    `json:"path"`              // Path of the node that changed
+	NewPath string    `json:"newpath,omitempty"` // Destination path of a rename
+	Size    uint64    `json:"size"`              // Size of the node after the change
+	Time    time.Time `json:"time"`              // When the change occurred
+}
+
+// Matches returns true if the event is in the subtree rooted at prefix (or
+// was renamed into or out of it) and its operation is in ops (or ops is empty).
+func (e *Event) Matches(prefix string, ops map[string]bool) bool {
+	if len(ops) > 0 && !ops[e.Op] {
+		return false
+	}
+	return HasPathPrefix(e.Path, prefix) || (e.NewPath != "" && HasPathPrefix(e.NewPath, prefix))
+}
+
+//===========================================================================
+// Subscription Type
+//===========================================================================
+
+// Subscription is an in-process stream of events filtered by path prefix and
+// operation. Events are delivered on a bounded channel; if the subscriber
+// falls behind, events are dropped rather than blocking the file system.
+type Subscription struct {
+	Events  <-chan *Event   // Channel on which matching events are delivered
+	Prefix  string          // Only events beneath this path are delivered
+	id      uint64          // Key of the subscription in the watcher
+	ops     map[string]bool // Only events of these operations are delivered
+	events  chan *Event     // Writable end of the Events channel
+	dropped uint64          // Number of events dropped due to a full buffer
+	watcher *Watcher        // The watcher the subscription is registered with
+}
+
+// Dropped returns the number of events discarded because the buffer was full.
+func (s *Subscription) Dropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
+
+// Close unregisters the subscription and closes its event channel.
+func (s *Subscription) Close() {
+	s.watcher.unsubscribe(s)
+}
+
+//===========================================================================
+// Watcher Type and Constructor
+//===========================================================================
+
+// Watcher fans mutation events out to subscribers and keeps a bounded
+// history of recent events so that remote clients can long-poll by sequence.
+type Watcher struct {
+	sync.Mutex
+	buffer  int                      // Default buffer size of subscriptions
+	seq     uint64                   // Sequence number of the last event
+	nextID  uint64                   // ID of the next subscription
+	subs    map[uint64]*Subscription // Registered subscriptions
+	history []*Event                 // Ring buffer of recent events
+	notify  chan struct{}            // Closed and replaced on every publish
+}
+
+// NewWatcher creates a watcher with the specified buffer and history bounds,
+// using the defaults if they are not positive.
+func NewWatcher(conf *WatchConfig) *Watcher {
+	buffer, history := conf.Buffer, conf.History
+	if buffer <= 0 {
+		buffer = DefaultWatchBuffer
+	}
+	if history <= 0 {
+		history = DefaultWatchHistory
+	}
+
+	return &Watcher{
+		buffer:  buffer,
+		subs:    make(map[uint64]*Subscription),
+		history: make([]*Event, 0, history),
+		notify:  make(chan struct{}),
+	}
+}
+
+//===========================================================================
+// Watcher Methods
+//===========================================================================
+
+// Subscribe registers a subscription to events beneath prefix for the given
+// operations (all operations if none are specified). If buffer is not
+// positive the default buffer size of the watcher is used.
+func (w *Watcher) Subscribe(prefix string, buffer int, ops ...string) *Subscription {
+	if buffer <= 0 {
+		buffer = w.buffer
+	}
+
+	events := make(chan *Event, buffer)
+	sub := &Subscription{
+		Events:  events,
+		Prefix:  prefix,
+		ops:     make(map[string]bool, len(ops)),
+		events:  events,
+		watcher: w,
+	}
+
+	for _, op := range ops {
+		sub.ops[Regularize(op)] = true
+	}
+
+	w.Lock()
+	defer w.Unlock()
+
+	w.nextID++
+	sub.id = w.nextID
+	w.subs[sub.id] = sub
+	return sub
+}
+
+// Publish converts the mutation into an event and delivers it to every
+// matching subscriber without blocking.
+func (w *Watcher) Publish(m *Mutation) {
+	w.Lock()
+	defer w.Unlock()
+
+	w.seq++
+	event := &Event{
+		Seq:     w.seq,
+		Op:      m.Op,
+		Node:    m.Node,
+		Path:    m.Path,
+		NewPath: m.NewPath,
+		Size:    m.NewSize,
+		Time:    m.Time,
+	}
+
+	// Append to the history, discarding the oldest event when full.
+	if len(w.history) == cap(w.history) {
+		copy(w.history, w.history[1:])
+		w.history = w.history[:len(w.history)-1]
+	}
+	w.history = append(w.history, event)
+
+	for _, sub := range w.subs {
+		if !event.Matches(sub.Prefix, sub.ops) {
+			continue
+		}
+
+		select {
+		case sub.events <- event:
+		default:
+			atomic.AddUint64(&sub.dropped, 1)
+		}
+	}
+
+	// Wake up any long-polling clients.
+	close(w.notify)
+	w.notify = make(chan struct{})
+}
+
+// Since returns the events in the history after the given sequence number
+// that match the filters, along with the channel that will be closed when
+// the next event is published.
+func (w *Watcher) Since(seq uint64, prefix string, ops map[string]bool) ([]*Event, <-chan struct{}) {
+	w.Lock()
+	defer w.Unlock()
+
+	events := make([]*Event, 0)
+	for _, event := range w.history {
+		if event.Seq > seq && event.Matches(prefix, ops) {
+			events = append(events, event)
+		}
+	}
+
+	return events, w.notify
+}
+
+// Seq returns the sequence number of the most recently published event.
+func (w *Watcher) Seq() uint64 {
+	w.Lock()
+	defer w.Unlock()
+	return w.seq
+}
+
+// Removes the subscription from the watcher and closes its channel.
+func (w *Watcher) unsubscribe(sub *Subscription) {
+	w.Lock()
+	defer w.Unlock()
+
+	if _, ok := w.subs[sub.id]; ok {
+		delete(w.subs, sub.id)
+		close(sub.events)
+	}
+}
+
+//===========================================================================
+// Watch HTTP Handlers
+//===========================================================================
+
+// parseWatchQuery extracts the prefix and operation filters from the query.
+func parseWatchQuery(r *http.Request) (string, []string) {
+	query := r.URL.Query()
+	prefix := query.Get("prefix")
+	ops := make([]string, 0)
+
+	if val := query.Get("ops"); val != "" {
+		for _, op := range strings.Split(val, ",") {
+			ops = append(ops, Regularize(op))
+		}
+	}
+
+	return prefix, ops
+}
+
+// ServeHTTP streams events as server-sent events if the client accepts
+// text/event-stream (or passes stream=sse), otherwise it long-polls: the
+// events after the "since" sequence number are returned as a JSON array as
+// soon as at least one is available or the timeout expires.
+//
+// Query parameters: prefix, ops (comma separated), since, timeout, buffer
+// (bounded by the buffer size of the watcher).
+func (w *Watcher) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Get("stream") == "sse" || strings.Contains(r.Header.Get("Accept"), "text/event-stream") {
+		w.serveEvents(rw, r)
+		return
+	}
+	w.servePoll(rw, r)
+}
+
+// Streams events to the client as server-sent events until it disconnects.
+func (w *Watcher) serveEvents(rw http.ResponseWriter, r *http.Request) {
+	flusher, ok := rw.(http.Flusher)
+	if !ok {
+		http.Error(rw, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	// Clients may ask for a smaller buffer than the watcher's, never a larger
+	// one, so that they cannot make the server allocate unbounded buffers.
+	var err error
+	var buffer int
+	if val := r.URL.Query().Get("buffer"); val != "" {
+		if buffer, err = strconv.Atoi(val); err != nil {
+			http.Error(rw, "could not parse buffer: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if buffer > w.buffer {
+		buffer = w.buffer
+	}
+
+	prefix, ops := parseWatchQuery(r)
+
+	sub := w.Subscribe(prefix, buffer, ops...)
+	defer sub.Close()
+
+	rw.Header().Set("Content-Type", "text/event-stream")
+	rw.Header().Set("Cache-Control", "no-cache")
+	rw.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case event, ok := <-sub.Events:
+			if !ok {
+				return
+			}
+
+			data, err := json.Marshal(event)
+			if err != nil {
+				return
+			}
+
+			if _, err := fmt.Fprintf(rw, "id: %d\nevent: %s\ndata: %s\n\n", event.Seq, event.Op, data); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+// Returns the events since the requested sequence number as a JSON array,
+// waiting until at least one is available or the timeout expires.
+func (w *Watcher) servePoll(rw http.ResponseWriter, r *http.Request) {
+	var err error
+	var since uint64
+
+	query := r.URL.Query()
+	if val := query.Get("since"); val != "" {
+		if since, err = strconv.ParseUint(val, 10, 64); err != nil {
+			http.Error(rw, "could not parse since: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	} else {
+		since = w.Seq()
+	}
+
+	timeout := DefaultPollTimeout
+	if val := query.Get("timeout"); val != "" {
+		if timeout, err = time.ParseDuration(val); err != nil {
+			http.Error(rw, "could not parse timeout: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	prefix, opnames := parseWatchQuery(r)
+	ops := make(map[string]bool, len(opnames))
+	for _, op := range opnames {
+		ops[op] = true
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	var events []*Event
+	for {
+		var notify <-chan struct{}
+		if events, notify = w.Since(since, prefix, ops); len(events) > 0 {
+			break
+		}
+
+		select {
+		case <-notify:
+			continue
+		case <-timer.C:
+		case <-r.Context().Done():
+			return
+		}
+		break
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(rw).Encode(events)
+}
@@ -0,0 +1,193 @@
+package memfs_test
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"bazil.org/fuse"
+
+	"golang.org/x/net/context"
+
+	. "github.com/bbengfort/memfs"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Watch", func() {
+
+	var err error
+	var tmpDir string
+	var fs *FileSystem
+	var root *Dir
+	var ctx context.Context
+
+	BeforeEach(func() {
+		tmpDir, err = ioutil.TempDir("", TempDirPrefix)
+		Ω(err).ShouldNot(HaveOccurred())
+
+		fs = New(filepath.Join(tmpDir, "testmp"), makeTestConfig())
+		node, err := fs.Root()
+		Ω(err).ShouldNot(HaveOccurred())
+		root = node.(*Dir)
+		ctx = context.TODO()
+	})
+
+	AfterEach(func() {
+		Ω(os.RemoveAll(tmpDir)).Should(Succeed())
+	})
+
+	// Creates a file with the given name in the directory.
+	create := func(dir *Dir, name string) *File {
+		node, _, err := dir.Create(ctx, &fuse.CreateRequest{Name: name, Mode: 0644}, &fuse.CreateResponse{})
+		Ω(err).ShouldNot(HaveOccurred())
+		return node.(*File)
+	}
+
+	It("should deliver events to in-process subscribers", func() {
+		sub := fs.Subscribe("/", 16)
+		defer sub.Close()
+
+		file := create(root, "a.txt")
+		Ω(file.Write(ctx, &fuse.WriteRequest{Data: []byte("hello")}, &fuse.WriteResponse{})).Should(Succeed())
+		Ω(file.Flush(ctx, &fuse.FlushRequest{})).Should(Succeed())
+
+		var event *Event
+		Eventually(sub.Events).Should(Receive(&event))
+		Ω(event.Op).Should(Equal(OpCreate))
+		Ω(event.Path).Should(Equal("/a.txt"))
+
+		Eventually(sub.Events).Should(Receive(&event))
+		Ω(event.Op).Should(Equal(OpWrite))
+		Ω(event.Size).Should(Equal(uint64(5)))
+
+		Eventually(sub.Events).Should(Receive(&event))
+		Ω(event.Op).Should(Equal(OpFlush))
+	})
+
+	It("should filter events by prefix and operation", func() {
+		node, err := root.Mkdir(ctx, &fuse.MkdirRequest{Name: "build", Mode: 0755})
+		Ω(err).ShouldNot(HaveOccurred())
+
+		sub := fs.Subscribe("/build", 16, "create")
+		defer sub.Close()
+
+		create(root, "outside.txt")
+		file := create(node.(*Dir), "inside.o")
+		Ω(file.Write(ctx, &fuse.WriteRequest{Data: []byte("obj")}, &fuse.WriteResponse{})).Should(Succeed())
+
+		var event *Event
+		Eventually(sub.Events).Should(Receive(&event))
+		Ω(event.Path).Should(Equal("/build/inside.o"))
+		Consistently(sub.Events).ShouldNot(Receive())
+	})
+
+	It("should drop events when the buffer is full", func() {
+		sub := fs.Subscribe("/", 2)
+		defer sub.Close()
+
+		for _, name := range []string{"a", "b", "c", "d"} {
+			create(root, name)
+		}
+
+		Ω(sub.Events).Should(HaveLen(2))
+		Ω(sub.Dropped()).Should(Equal(uint64(2)))
+	})
+
+	It("should close the channel when the subscription is closed", func() {
+		sub := fs.Subscribe("/", 2)
+		sub.Close()
+		Eventually(sub.Events).Should(BeClosed())
+	})
+
+	Describe("remote subscribers", func() {
+
+		var server *httptest.Server
+
+		BeforeEach(func() {
+			server = httptest.NewServer(fs.Handler())
+		})
+
+		AfterEach(func() {
+			server.Close()
+		})
+
+		It("should long-poll for events since a sequence number", func() {
+			create(root, "a.txt")
+			create(root, "b.txt")
+
+			resp, err := http.Get(server.URL + "/watch?since=1&timeout=1s")
+			Ω(err).ShouldNot(HaveOccurred())
+			defer resp.Body.Close()
+
+			events := make([]*Event, 0)
+			Ω(json.NewDecoder(resp.Body).Decode(&events)).Should(Succeed())
+			Ω(events).Should(HaveLen(1))
+			Ω(events[0].Seq).Should(Equal(uint64(2)))
+			Ω(events[0].Path).Should(Equal("/b.txt"))
+		})
+
+		It("should wait for the next event when long-polling", func() {
+			go func() {
+				time.Sleep(50 * time.Millisecond)
+				create(root, "late.txt")
+			}()
+
+			resp, err := http.Get(server.URL + "/watch?timeout=5s")
+			Ω(err).ShouldNot(HaveOccurred())
+			defer resp.Body.Close()
+
+			events := make([]*Event, 0)
+			Ω(json.NewDecoder(resp.Body).Decode(&events)).Should(Succeed())
+			Ω(events).Should(HaveLen(1))
+			Ω(events[0].Path).Should(Equal("/late.txt"))
+		})
+
+		It("should stream server-sent events", func() {
+			req, err := http.NewRequest("GET", server.URL+"/watch?prefix=/a.txt", nil)
+			Ω(err).ShouldNot(HaveOccurred())
+			req.Header.Set("Accept", "text/event-stream")
+
+			resp, err := http.DefaultClient.Do(req)
+			Ω(err).ShouldNot(HaveOccurred())
+			defer resp.Body.Close()
+			Ω(resp.Header.Get("Content-Type")).Should(Equal("text/event-stream"))
+
+			create(root, "b.txt")
+			create(root, "a.txt")
+
+			lines := make([]string, 0, 3)
+			reader := bufio.NewReader(resp.Body)
+			for len(lines) < 3 {
+				line, err := reader.ReadString('\n')
+				Ω(err).ShouldNot(HaveOccurred())
+				lines = append(lines, strings.TrimSpace(line))
+			}
+
+			Ω(lines[0]).Should(Equal("id: 2"))
+			Ω(lines[1]).Should(Equal("event: create"))
+			Ω(lines[2]).Should(ContainSubstring(`"path":"/a.txt"`))
+		})
+
+		It("should bound the buffer requested by a client", func() {
+			resp, err := http.Get(server.URL + "/watch?stream=sse&buffer=lots")
+			Ω(err).ShouldNot(HaveOccurred())
+			resp.Body.Close()
+			Ω(resp.StatusCode).Should(Equal(http.StatusBadRequest))
+
+			resp, err = http.Get(server.URL + "/watch?stream=sse&buffer=2000000000")
+			Ω(err).ShouldNot(HaveOccurred())
+			resp.Body.Close()
+			Ω(resp.StatusCode).Should(Equal(http.StatusOK))
+		})
+
+	})
+
+})
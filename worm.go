@@ -0,0 +1,187 @@
+// Write-once-read-many files and the immutable and append-only flags.
+
+package memfs
+
+import (
+	"strings"
+	"syscall"
+	"time"
+
+	"bazil.org/fuse"
+)
+
+// FlagsXattr holds the attribute flags of a file in the letters of chattr(1):
+// "i" if the file is immutable and "a" if it can only be appended to. Only
+// root may change the flags. The vendored fuse package does not pass ioctl
+// requests to the file system, so FS_IOC_SETFLAGS (chattr) is not supported
+// and the flags are set with this extended attribute instead.
+const FlagsXattr = "user.memfs.flags"
+
+// RetainXattr holds the time until which a write-once file is retained, in
+// RFC 3339 format, or "forever". It is set when a file in an immutable zone
+// is first flushed with data; until it passes the data of the file cannot be
+// changed and the file cannot be renamed or removed. The retention can be
+// extended by root or, in an immutable zone, by the owner of the file, but
+// never shortened. Since nobody can remove a retained file, only root may set
+// the retention of files outside of immutable zones.
+const RetainXattr = "user.memfs.retain"
+
+// The attribute flags and the retention that never expires.
+const (
+	flagImmutable = "i"
+	flagAppend    = "a"
+	retainForever = "forever"
+)
+
+//===========================================================================
+// Flags and Retention
+//===========================================================================
+
+// parseFlags returns an error if the value is not a set of attribute flags.
+func parseFlags(value []byte) error {
+	for _, c := range string(value) {
+		if !strings.ContainsRune(flagImmutable+flagAppend, c) {
+			return fuse.Errno(syscall.EINVAL)
+		}
+	}
+	return nil
+}
+
+// hasFlag returns true if the attribute flag is set on the node. Must be
+// called with the lock held.
+func (n *Node) hasFlag(flag string) bool {
+	value, ok := n.getxattr(FlagsXattr)
+	return ok && strings.Contains(string(value), flag)
+}
+
+// parseRetain returns the time until which the value retains a file, or the
+// zero time if it retains the file forever.
+func parseRetain(value []byte) (time.Time, error) {
+	if string(value) == retainForever {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339, string(value))
+}
+
+// retained returns true if the retention of the node has not passed. Must be
+// called with the lock held.
+func (n *Node) retained() bool {
+	value, ok := n.getxattr(RetainXattr)
+	if !ok {
+		return false
+	}
+
+	until, err := parseRetain(value)
+	return err != nil || until.IsZero() || time.Now().Before(until)
+}
+
+// checkProtected returns EPERM if the node is immutable, retained or is
+// append-only and the change does not append to it. Must be called with the
+// lock held.
+func (n *Node) checkProtected(appending bool) error {
+	if n.hasFlag(flagImmutable) || n.retained() || (!appending && n.hasFlag(flagAppend)) {
+		logger.Debug("(error) node %d is protected from changes", n.ID)
+		return fuse.EPERM
+	}
+	return nil
+}
+
+// checkProtectedSetattr returns EPERM if the request would change an
+// immutable node or the size of an append-only or retained node. Must be
+// called with the lock held.
+func (n *Node) checkProtectedSetattr(req *fuse.SetattrRequest) error {
+	if n.hasFlag(flagImmutable) {
+		logger.Debug("(error) node %d is immutable", n.ID)
+		return fuse.EPERM
+	}
+
+	if req.Valid.Size() && !n.IsDir() && (n.retained() || n.hasFlag(flagAppend)) {
+		logger.Debug("(error) size of node %d cannot be changed", n.ID)
+		return fuse.EPERM
+	}
+	return nil
+}
+
+// checkProtectedXattr returns an error if the user of the request may not
+// set the extended attribute to the value or, if remove is true, remove it:
+// only root may change the flags, which must be set on files, only root or
+// the owner of a file in an immutable zone may change the retention, which
+// can only be extended, and no other attribute of an immutable node can be
+// changed. Must be called with the lock held.
+func (n *Node) checkProtectedXattr(hdr fuse.Header, name string, value []byte, remove bool) error {
+	switch name {
+	case FlagsXattr:
+		if hdr.Uid != 0 {
+			return fuse.EPERM
+		}
+
+		if n.IsDir() {
+			return fuse.Errno(syscall.EINVAL)
+		}
+
+		if remove {
+			return nil
+		}
+		return parseFlags(value)
+
+	case RetainXattr:
+		if hdr.Uid != 0 && (hdr.Uid != n.Attrs.Uid || !n.fs.zone(n.Path()).immutable) {
+			logger.Debug("(error) only root may retain node %d outside of an immutable zone", n.ID)
+			return fuse.EPERM
+		}
+
+		if remove {
+			if n.retained() {
+				logger.Debug("(error) retention of node %d has not passed", n.ID)
+				return fuse.EPERM
+			}
+			return nil
+		}
+
+		until, err := parseRetain(value)
+		if err != nil || n.IsDir() {
+			return fuse.Errno(syscall.EINVAL)
+		}
+
+		if prev, ok := n.getxattr(RetainXattr); ok && n.retained() {
+			current, _ := parseRetain(prev)
+			if !until.IsZero() && (current.IsZero() || until.Before(current)) {
+				logger.Debug("(error) retention of node %d cannot be shortened", n.ID)
+				return fuse.EPERM
+			}
+		}
+		return nil
+	}
+
+	if n.hasFlag(flagImmutable) {
+		return fuse.EPERM
+	}
+	return nil
+}
+
+//===========================================================================
+// Write-Once Files
+//===========================================================================
+
+// retain makes the file immutable for the retention period of its zone if
+// the zone is immutable, the file holds data and it is not already retained,
+// returning true if the retention was set. Must be called with the lock held.
+func (f *File) retain() bool {
+	if len(f.fs.Config.Rules) == 0 || f.Attrs.Size == 0 || f.retained() {
+		return false
+	}
+
+	z := f.fs.zone(f.Path())
+	if !z.immutable {
+		return false
+	}
+
+	value := retainForever
+	if z.retention > 0 {
+		value = time.Now().Add(z.retention).UTC().Format(time.RFC3339)
+	}
+
+	logger.Debug("retaining file %d until %s", f.ID, value)
+	f.setxattr(RetainXattr, []byte(value))
+	return true
+}
@@ -0,0 +1,241 @@
+package memfs_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"bazil.org/fuse"
+
+	"golang.org/x/net/context"
+
+	. "github.com/bbengfort/memfs"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("WORM", func() {
+
+	var err error
+	var tmpDir string
+	var config *Config
+	var fs *FileSystem
+	var ctx context.Context
+	var user, root fuse.Header
+
+	yes := true
+
+	// create creates a file through the fuse interface, writes the data to it
+	// and flushes it.
+	create := func(path, data string) *File {
+		ent, err := fs.Resolve(filepath.Dir(path))
+		Ω(err).ShouldNot(HaveOccurred())
+
+		req := &fuse.CreateRequest{Header: user, Name: filepath.Base(path), Mode: 0644}
+		node, _, err := ent.(*Dir).Create(ctx, req, &fuse.CreateResponse{})
+		Ω(err).ShouldNot(HaveOccurred())
+
+		f := node.(*File)
+		wreq := &fuse.WriteRequest{Header: user, Data: []byte(data)}
+		Ω(f.Write(ctx, wreq, new(fuse.WriteResponse))).Should(Succeed())
+		Ω(f.Flush(ctx, &fuse.FlushRequest{Header: user})).Should(Succeed())
+		return f
+	}
+
+	// write writes the data at the offset through the fuse interface.
+	write := func(f *File, off int64, data string) error {
+		req := &fuse.WriteRequest{Header: user, Offset: off, Data: []byte(data)}
+		return f.Write(ctx, req, new(fuse.WriteResponse))
+	}
+
+	// setattr changes the size or, if size is negative, the mode of the file.
+	setattr := func(f *File, size int64) error {
+		req := &fuse.SetattrRequest{Header: user, Size: uint64(size), Valid: fuse.SetattrSize}
+		if size < 0 {
+			req = &fuse.SetattrRequest{Header: user, Mode: 0600, Valid: fuse.SetattrMode}
+		}
+		return f.Setattr(ctx, req, new(fuse.SetattrResponse))
+	}
+
+	// setxattr sets the extended attribute as the user of the header.
+	setxattr := func(f *File, hdr fuse.Header, name, value string) error {
+		return f.Setxattr(ctx, &fuse.SetxattrRequest{Header: hdr, Name: name, Xattr: []byte(value)})
+	}
+
+	// retention returns the value of the retention attribute of the file.
+	retention := func(f *File) string {
+		resp := new(fuse.GetxattrResponse)
+		Ω(f.Getxattr(ctx, &fuse.GetxattrRequest{Header: user, Name: RetainXattr}, resp)).Should(Succeed())
+		return string(resp.Xattr)
+	}
+
+	BeforeEach(func() {
+		tmpDir, err = ioutil.TempDir("", TempDirPrefix)
+		Ω(err).ShouldNot(HaveOccurred())
+
+		config = makeTestConfig()
+		config.Rules = []*Rule{{Path: "/artifacts/*", Immutable: &yes, Retention: Duration(time.Hour)}}
+		ctx = context.TODO()
+		user = fuse.Header{Uid: 1000, Gid: 1000}
+		root = fuse.Header{}
+	})
+
+	JustBeforeEach(func() {
+		fs = New(filepath.Join(tmpDir, "testmp"), config)
+		Ω(fs.Mkdir("/artifacts", 0777)).Should(Succeed())
+		Ω(fs.Mkdir("/work", 0777)).Should(Succeed())
+	})
+
+	AfterEach(func() {
+		Ω(fs.Shutdown()).Should(Succeed())
+		Ω(os.RemoveAll(tmpDir)).Should(Succeed())
+	})
+
+	Context("with a retention policy", func() {
+
+		It("should retain files once they are flushed", func() {
+			f := create("/artifacts/app.tgz", "release")
+
+			until, err := time.Parse(time.RFC3339, retention(f))
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(until).Should(BeTemporally("~", time.Now().Add(time.Hour), 2*time.Second))
+
+			Ω(write(f, 7, "!")).Should(MatchError(fuse.EPERM))
+			Ω(setattr(f, 0)).Should(MatchError(fuse.EPERM))
+			Ω(fs.Rename("/artifacts/app.tgz", "/work/app.tgz")).Should(MatchError(fuse.EPERM))
+			Ω(fs.Remove("/artifacts/app.tgz")).Should(MatchError(fuse.EPERM))
+			Ω(fs.Shred("/artifacts/app.tgz")).Should(MatchError(fuse.EPERM))
+
+			// The mode of a retained file can still be changed.
+			Ω(setattr(f, -1)).Should(Succeed())
+		})
+
+		It("should only extend the retention", func() {
+			f := create("/artifacts/app.tgz", "release")
+
+			req := &fuse.RemovexattrRequest{Header: root, Name: RetainXattr}
+			Ω(f.Removexattr(ctx, req)).Should(MatchError(fuse.EPERM))
+
+			sooner := time.Now().Add(time.Minute).UTC().Format(time.RFC3339)
+			Ω(setxattr(f, user, RetainXattr, sooner)).Should(MatchError(fuse.EPERM))
+			Ω(setxattr(f, user, RetainXattr, "tomorrow")).Should(MatchError(fuse.Errno(syscall.EINVAL)))
+			Ω(setxattr(f, fuse.Header{Uid: 1001}, RetainXattr, "forever")).Should(MatchError(fuse.EPERM))
+
+			Ω(setxattr(f, user, RetainXattr, "forever")).Should(Succeed())
+			Ω(retention(f)).Should(Equal("forever"))
+		})
+
+		It("should not retain files outside of the zone or without data", func() {
+			f := create("/work/app.tgz", "draft")
+			Ω(write(f, 5, "!")).Should(Succeed())
+
+			empty := create("/artifacts/empty", "")
+			Ω(write(empty, 0, "late")).Should(Succeed())
+		})
+
+		It("should only allow root to retain files outside of the zone", func() {
+			f := create("/work/app.tgz", "draft")
+			Ω(setxattr(f, user, RetainXattr, "forever")).Should(MatchError(fuse.EPERM))
+			Ω(fs.Remove("/work/app.tgz")).Should(Succeed())
+
+			f = create("/work/app.tgz", "draft")
+			Ω(setxattr(f, root, RetainXattr, "forever")).Should(Succeed())
+			Ω(fs.Remove("/work/app.tgz")).Should(MatchError(fuse.EPERM))
+		})
+
+		It("should not reap retained files", func() {
+			config := *fs.Config
+			config.Level = ""
+			config.TTL.Directories = map[string]Duration{"/artifacts": Duration(time.Minute)}
+			_, err := fs.Apply(&config)
+			Ω(err).ShouldNot(HaveOccurred())
+
+			f := create("/artifacts/app.tgz", "release")
+			f.Attrs.Mtime = time.Now().Add(-time.Hour)
+
+			report, err := fs.Reap(false)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(report.Paths).Should(BeEmpty())
+		})
+
+		It("should persist the retention with the node", func() {
+			create("/artifacts/app.tgz", "release")
+
+			path := filepath.Join(tmpDir, "export.tar")
+			out, err := os.Create(path)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(fs.Export(out, "")).Should(Succeed())
+			Ω(out.Close()).Should(Succeed())
+
+			restored := New(filepath.Join(tmpDir, "restored"), makeTestConfig())
+			defer restored.Shutdown()
+			Ω(restored.LoadTar(path)).Should(Succeed())
+			Ω(restored.Remove("/artifacts/app.tgz")).Should(MatchError(fuse.EPERM))
+		})
+
+	})
+
+	Context("with a short retention", func() {
+
+		BeforeEach(func() {
+			config.Rules[0].Retention = Duration(time.Second)
+		})
+
+		It("should allow changes once the retention passes", func() {
+			create("/artifacts/app.tgz", "release")
+			Ω(fs.Remove("/artifacts/app.tgz")).Should(MatchError(fuse.EPERM))
+
+			Eventually(func() error {
+				return fs.Remove("/artifacts/app.tgz")
+			}, 3*time.Second, 100*time.Millisecond).Should(Succeed())
+		})
+
+	})
+
+	Context("with attribute flags", func() {
+
+		It("should refuse all changes to immutable files", func() {
+			f := create("/work/app", "binary")
+			Ω(setxattr(f, user, FlagsXattr, "i")).Should(MatchError(fuse.EPERM))
+			Ω(setxattr(f, root, FlagsXattr, "i")).Should(Succeed())
+
+			Ω(write(f, 6, "!")).Should(MatchError(fuse.EPERM))
+			Ω(setattr(f, -1)).Should(MatchError(fuse.EPERM))
+			Ω(setxattr(f, user, "user.tag", "v")).Should(MatchError(fuse.EPERM))
+			Ω(fs.Remove("/work/app")).Should(MatchError(fuse.EPERM))
+
+			// Clearing the flag makes the file mutable again.
+			Ω(f.Removexattr(ctx, &fuse.RemovexattrRequest{Header: root, Name: FlagsXattr})).Should(Succeed())
+			Ω(write(f, 6, "!")).Should(Succeed())
+		})
+
+		It("should only allow appending to append-only files", func() {
+			f := create("/work/audit.log", "one\n")
+			Ω(setxattr(f, root, FlagsXattr, "a")).Should(Succeed())
+
+			Ω(write(f, 4, "two\n")).Should(Succeed())
+			Ω(write(f, 0, "zap\n")).Should(MatchError(fuse.EPERM))
+			Ω(setattr(f, 0)).Should(MatchError(fuse.EPERM))
+			Ω(fs.Rename("/work/audit.log", "/work/old.log")).Should(MatchError(fuse.EPERM))
+
+			contents, err := fs.ReadFile("/work/audit.log")
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(contents).Should(Equal([]byte("one\ntwo\n")))
+		})
+
+		It("should validate the flags", func() {
+			f := create("/work/app", "binary")
+			Ω(setxattr(f, root, FlagsXattr, "x")).Should(MatchError(fuse.Errno(syscall.EINVAL)))
+
+			ent, err := fs.Resolve("/work")
+			Ω(err).ShouldNot(HaveOccurred())
+			req := &fuse.SetxattrRequest{Header: root, Name: FlagsXattr, Xattr: []byte("i")}
+			Ω(ent.GetNode().Setxattr(ctx, req)).Should(MatchError(fuse.Errno(syscall.EINVAL)))
+		})
+
+	})
+
+})
@@ -0,0 +1,176 @@
+// Namespaces, flags and limits of the extended attributes of nodes.
+
+package memfs
+
+import (
+	"strings"
+	"syscall"
+
+	"bazil.org/fuse"
+)
+
+// Limits on the names and values of extended attributes imposed by the
+// kernel interface.
+const (
+	XattrNameMax = 255
+	XattrSizeMax = 64 * 1024
+)
+
+// Namespaces of extended attribute names. Attributes in the user namespace
+// are unrestricted, attributes in the trusted namespace are only visible to
+// root and attributes in the security namespace can only be changed by the
+// owner of the node or root. The system namespace holds access control lists,
+// which are not supported.
+const (
+	XattrUser     = "user."
+	XattrTrusted  = "trusted."
+	XattrSecurity = "security."
+	XattrSystem   = "system."
+)
+
+// Flags of setxattr(2) that require the attribute to be created or replaced.
+const (
+	xattrCreate  = 0x1
+	xattrReplace = 0x2
+)
+
+// E2BIG is returned when the value of an extended attribute is too large.
+var E2BIG = fuse.Errno(syscall.E2BIG)
+
+//===========================================================================
+// Extended Attribute Limits
+//===========================================================================
+
+// XattrConfig limits the size of extended attribute values and the total
+// size of the names and values of the extended attributes of a node.
+type XattrConfig struct {
+	MaxValue uint64 `json:"maxvalue" yaml:"maxvalue"` // Maximum bytes of a value (0 for 64 KiB)
+	MaxNode  uint64 `json:"maxnode" yaml:"maxnode"`   // Maximum bytes of names and values per node (0 for unlimited)
+}
+
+// maxValue returns the configured maximum size of a value or the kernel
+// limit if it is not set.
+func (conf *XattrConfig) maxValue() uint64 {
+	if conf.MaxValue == 0 {
+		return XattrSizeMax
+	}
+	return conf.MaxValue
+}
+
+// xattrNamespace returns the namespace prefix of the name, or an empty string
+// if the name is not in a known namespace or the platform has no namespaces.
+func xattrNamespace(name string) string {
+	if !xattrNamespaced {
+		return ""
+	}
+
+	for _, ns := range []string{XattrUser, XattrTrusted, XattrSecurity, XattrSystem} {
+		if strings.HasPrefix(name, ns) {
+			return ns
+		}
+	}
+	return ""
+}
+
+//===========================================================================
+// Extended Attribute Checks
+//===========================================================================
+
+// checkXattrAccess returns an error if the user of the request may not read
+// (or, if write is true, change) the named extended attribute. Attributes
+// that cannot be read are reported as missing. Names are only restricted to
+// the namespaces on Linux; other platforms (e.g. the com.apple. attributes of
+// OS X) accept any name.
+func (n *Node) checkXattrAccess(hdr fuse.Header, name string, write bool) error {
+	if !xattrNamespaced {
+		return nil
+	}
+
+	switch xattrNamespace(name) {
+	case XattrUser:
+		return nil
+	case XattrTrusted:
+		if hdr.Uid != 0 {
+			if write {
+				return fuse.EPERM
+			}
+			return fuse.ErrNoXattr
+		}
+		return nil
+	case XattrSecurity:
+		if write && hdr.Uid != 0 && hdr.Uid != n.Attrs.Uid {
+			return fuse.EPERM
+		}
+		return nil
+	default:
+		return fuse.ENOTSUP
+	}
+}
+
+// checkSetxattr returns an error if the extended attribute cannot be set
+// with the flags of the request or if the name or value exceed the limits of
+// the node or the capacity of the file system. Must be called with the lock
+// held.
+func (n *Node) checkSetxattr(req *fuse.SetxattrRequest) error {
+	if err := n.checkXattrAccess(req.Header, req.Name, true); err != nil {
+		return err
+	}
+
+	if len(req.Name) == len(xattrNamespace(req.Name)) {
+		return fuse.Errno(syscall.EINVAL)
+	}
+
+	if len(req.Name) > XattrNameMax {
+		return fuse.ERANGE
+	}
+
+	if uint64(len(req.Xattr)) > n.fs.Config.XAttr.maxValue() {
+		logger.Debug("(error) xattr %s of %d bytes exceeds the limit of %d bytes", req.Name, len(req.Xattr), n.fs.Config.XAttr.maxValue())
+		return E2BIG
+	}
+
+	prev, exists := n.XAttrs[req.Name]
+	if exists && req.Flags&xattrCreate != 0 {
+		return fuse.EEXIST
+	}
+
+	if !exists && req.Flags&xattrReplace != 0 {
+		return fuse.ErrNoXattr
+	}
+
+	size := n.fs.xattrSize(req.Name, req.Xattr)
+	if exists {
+		size = addClamped(size, -int64(len(req.Name)+len(prev)))
+	}
+
+	if max := n.fs.Config.XAttr.MaxNode; max > 0 && n.xattrSize()+size > max {
+		logger.Debug("(error) xattrs of node %d would exceed the limit of %d bytes", n.ID, max)
+		return ENOSPC
+	}
+
+	if n.fs.used()+n.fs.metadataSize()+size > n.fs.capacity() {
+		logger.Debug("(error) xattr %s would exceed the capacity of %d bytes", req.Name, n.fs.capacity())
+		return ENOSPC
+	}
+	return nil
+}
+
+// xattrSize returns the number of bytes the names and values of the extended
+// attributes of the node are stored in. Must be called with the lock held.
+func (n *Node) xattrSize() uint64 {
+	var size uint64
+	for name, value := range n.XAttrs {
+		size += uint64(len(name) + len(value))
+	}
+	return size
+}
+
+// xattrSize returns the number of bytes an extended attribute is stored in,
+// including the overhead of sealing the value if encryption is enabled.
+func (mfs *FileSystem) xattrSize(name string, value []byte) uint64 {
+	size := uint64(len(name) + len(value))
+	if mfs.keys != nil {
+		size += sealOverhead
+	}
+	return size
+}
@@ -0,0 +1,66 @@
+//go:build linux
+// +build linux
+
+// Extended attributes of files on disk, used to load and mirror directories,
+// and the namespaces of extended attribute names.
+
+package memfs
+
+import (
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// Extended attribute names must be in one of the namespaces on Linux.
+const xattrNamespaced = true
+
+// diskXattrs returns the extended attributes of the file on disk.
+func diskXattrs(path string) (map[string][]byte, error) {
+	size, err := unix.Listxattr(path, nil)
+	if err != nil {
+		if err == unix.ENOTSUP {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	if size == 0 {
+		return nil, nil
+	}
+
+	buf := make([]byte, size)
+	if size, err = unix.Listxattr(path, buf); err != nil {
+		return nil, err
+	}
+
+	xattrs := make(map[string][]byte)
+	for _, name := range strings.Split(strings.TrimRight(string(buf[:size]), "\x00"), "\x00") {
+		vsize, err := unix.Getxattr(path, name, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		value := make([]byte, vsize)
+		if vsize, err = unix.Getxattr(path, name, value); err != nil {
+			return nil, err
+		}
+		xattrs[name] = value[:vsize]
+	}
+
+	return xattrs, nil
+}
+
+// setDiskXattr sets the extended attribute of the file on disk.
+func setDiskXattr(path, name string, value []byte) error {
+	return unix.Setxattr(path, name, value, 0)
+}
+
+// removeDiskXattr removes the extended attribute of the file on disk, if it
+// exists.
+func removeDiskXattr(path, name string) error {
+	if err := unix.Removexattr(path, name); err != nil && err != unix.ENODATA {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,25 @@
+//go:build !linux
+// +build !linux
+
+// Extended attributes of files on disk are not supported on this platform,
+// so they are neither loaded nor mirrored.
+
+package memfs
+
+// Extended attribute names have no namespaces on this platform.
+const xattrNamespaced = false
+
+// diskXattrs returns no extended attributes.
+func diskXattrs(path string) (map[string][]byte, error) {
+	return nil, nil
+}
+
+// setDiskXattr ignores the extended attribute.
+func setDiskXattr(path, name string, value []byte) error {
+	return nil
+}
+
+// removeDiskXattr ignores the extended attribute.
+func removeDiskXattr(path, name string) error {
+	return nil
+}
@@ -0,0 +1,156 @@
+package memfs_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"syscall"
+
+	"bazil.org/fuse"
+
+	"golang.org/x/net/context"
+
+	. "github.com/bbengfort/memfs"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Xattrs", func() {
+
+	var err error
+	var tmpDir string
+	var config *Config
+	var fs *FileSystem
+	var ctx context.Context
+	var f *File
+	var user fuse.Header
+
+	set := func(hdr fuse.Header, name, value string, flags uint32) error {
+		req := &fuse.SetxattrRequest{Header: hdr, Name: name, Xattr: []byte(value), Flags: flags}
+		return f.Setxattr(ctx, req)
+	}
+
+	BeforeEach(func() {
+		tmpDir, err = ioutil.TempDir("", TempDirPrefix)
+		Ω(err).ShouldNot(HaveOccurred())
+
+		config = makeTestConfig()
+		ctx = context.TODO()
+		user = fuse.Header{Uid: 1000, Gid: 1000}
+	})
+
+	JustBeforeEach(func() {
+		fs = New(filepath.Join(tmpDir, "testmp"), config)
+		Ω(fs.WriteFile("/a.txt", []byte("a"), 0644)).Should(Succeed())
+
+		ent, err := fs.Resolve("/a.txt")
+		Ω(err).ShouldNot(HaveOccurred())
+		f = ent.(*File)
+		f.Attrs.Uid = user.Uid
+	})
+
+	AfterEach(func() {
+		Ω(fs.Shutdown()).Should(Succeed())
+		Ω(os.RemoveAll(tmpDir)).Should(Succeed())
+	})
+
+	It("should honor the create and replace flags", func() {
+		Ω(set(user, "user.tag", "one", 0x2)).Should(MatchError(fuse.ErrNoXattr))
+		Ω(set(user, "user.tag", "one", 0x1)).Should(Succeed())
+		Ω(set(user, "user.tag", "two", 0x1)).Should(MatchError(fuse.EEXIST))
+		Ω(set(user, "user.tag", "two", 0x2)).Should(Succeed())
+
+		resp := new(fuse.GetxattrResponse)
+		Ω(f.Getxattr(ctx, &fuse.GetxattrRequest{Header: user, Name: "user.tag"}, resp)).Should(Succeed())
+		Ω(resp.Xattr).Should(Equal([]byte("two")))
+	})
+
+	It("should return ERANGE if the buffer is too small", func() {
+		Ω(set(user, "user.tag", "value", 0)).Should(Succeed())
+
+		resp := new(fuse.GetxattrResponse)
+		req := &fuse.GetxattrRequest{Header: user, Name: "user.tag", Size: 3}
+		Ω(f.Getxattr(ctx, req, resp)).Should(MatchError(fuse.ERANGE))
+
+		// A size of zero probes the size of the value.
+		req.Size = 0
+		Ω(f.Getxattr(ctx, req, resp)).Should(Succeed())
+		Ω(resp.Xattr).Should(HaveLen(5))
+
+		list := new(fuse.ListxattrResponse)
+		Ω(f.Listxattr(ctx, &fuse.ListxattrRequest{Header: user, Size: 4}, list)).Should(MatchError(fuse.ERANGE))
+	})
+
+	It("should enforce the namespace rules", func() {
+		if runtime.GOOS != "linux" {
+			Skip("extended attributes only have namespaces on linux")
+		}
+
+		Ω(set(user, "trusted.key", "v", 0)).Should(MatchError(fuse.EPERM))
+		Ω(set(fuse.Header{}, "trusted.key", "v", 0)).Should(Succeed())
+
+		resp := new(fuse.GetxattrResponse)
+		Ω(f.Getxattr(ctx, &fuse.GetxattrRequest{Header: user, Name: "trusted.key"}, resp)).Should(MatchError(fuse.ErrNoXattr))
+
+		Ω(set(user, "security.label", "v", 0)).Should(Succeed())
+		Ω(set(fuse.Header{Uid: 1001}, "security.label", "w", 0)).Should(MatchError(fuse.EPERM))
+
+		Ω(set(fuse.Header{}, "system.posix_acl_access", "v", 0)).Should(MatchError(fuse.ENOTSUP))
+		Ω(set(user, "other.key", "v", 0)).Should(MatchError(fuse.ENOTSUP))
+		Ω(set(user, "user.", "v", 0)).Should(MatchError(fuse.Errno(syscall.EINVAL)))
+
+		list := new(fuse.ListxattrResponse)
+		Ω(f.Listxattr(ctx, &fuse.ListxattrRequest{Header: user}, list)).Should(Succeed())
+		Ω(list.Xattr).Should(Equal([]byte("security.label\x00")))
+	})
+
+	It("should only restrict names to the namespaces on linux", func() {
+		err := set(user, "com.apple.FinderInfo", "v", 0)
+		if runtime.GOOS == "linux" {
+			Ω(err).Should(MatchError(fuse.ENOTSUP))
+		} else {
+			Ω(err).Should(Succeed())
+		}
+	})
+
+	Context("with limits", func() {
+
+		BeforeEach(func() {
+			config.XAttr = XattrConfig{MaxValue: 16, MaxNode: 40}
+		})
+
+		It("should limit the size of values and nodes", func() {
+			Ω(set(user, "user.big", string(bytes.Repeat([]byte("x"), 17)), 0)).Should(MatchError(E2BIG))
+			Ω(set(user, "user.one", string(bytes.Repeat([]byte("x"), 16)), 0)).Should(Succeed())
+			Ω(set(user, "user.two", string(bytes.Repeat([]byte("x"), 16)), 0)).Should(MatchError(ENOSPC))
+
+			// Replacing a value only counts the difference.
+			Ω(set(user, "user.one", string(bytes.Repeat([]byte("y"), 16)), 0)).Should(Succeed())
+		})
+
+		It("should validate the value limit", func() {
+			config.XAttr.MaxValue = XattrSizeMax + 1
+			Ω(config.Validate()).Should(MatchError(ContainSubstring("xattr.maxvalue")))
+		})
+
+	})
+
+	Context("with a small cache", func() {
+
+		BeforeEach(func() {
+			config.CacheSize = 4096
+			config.MaxInodes = 10
+		})
+
+		It("should count xattrs against the capacity", func() {
+			value := string(bytes.Repeat([]byte("x"), 2048))
+			Ω(set(user, "user.one", value, 0)).Should(Succeed())
+			Ω(set(user, "user.two", value, 0)).Should(MatchError(ENOSPC))
+		})
+
+	})
+
+})